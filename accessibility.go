@@ -0,0 +1,144 @@
+// Package main contains the accessibility mode, plain and verbal output for users on screen readers
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// emojiNames replaces emoji with their :shortcode:, which a screen reader reads out
+// predictably. Where several shortcodes share an emoji, the first in order is used.
+var emojiNames = func() *strings.Replacer {
+	codes := make([]string, 0, len(emojiShortcodes))
+	for code := range emojiShortcodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	seen := make(map[string]bool)
+	var pairs []string
+	for _, code := range codes {
+		if emoji := emojiShortcodes[code]; !seen[emoji] {
+			seen[emoji] = true
+			pairs = append(pairs, emoji, ":"+code+":")
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}()
+
+// setAccessibleOutput switches conn's output to or from the accessible rendering
+func setAccessibleOutput(conn net.Conn, on bool) {
+	if pc, ok := conn.(*protoConn); ok {
+		pc.accessible.Store(on)
+	}
+}
+
+// isAccessible reports whether conn gets the accessible rendering
+func isAccessible(conn net.Conn) bool {
+	pc, ok := conn.(*protoConn)
+	return ok && pc.accessible.Load()
+}
+
+// isDecoration reports whether r only decorates output: box drawing, block elements,
+// and the bell
+func isDecoration(r rune) bool {
+	return r == '\a' || (r >= '\u2500' && r <= '\u259f')
+}
+
+// accessibleText renders server output for a screen reader: no colors, bell or box
+// drawing, emoji read as their shortcodes, and server notices announced as such.
+// Blank lines are dropped.
+func accessibleText(text string) string {
+	text = emojiNames.Replace(stripANSI(text))
+	text = strings.Map(func(r rune) rune {
+		if isDecoration(r) {
+			return -1
+		}
+		return r
+	}, text)
+
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if strings.TrimFunc(line, unicode.IsSpace) == "" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, systemPrefix); ok {
+			line = "Server notice: " + rest
+		}
+		out.WriteString(line)
+	}
+	return out.String()
+}
+
+// verbalEvent describes an event in words, saying what kind of message it is and
+// who it is from before its text. ok is false for events accessible users don't
+// get, such as typing indicators.
+func verbalEvent(ev WireEvent, text string) (line string, ok bool) {
+	body := emojiNames.Replace(ev.Body)
+	switch ev.Type {
+	case "typing":
+		return "", false
+	case "message":
+		kind := "Message"
+		if ev.Bot {
+			kind = "Bot message"
+		}
+		line = fmt.Sprintf("%s from %s in %s: %s\n", kind, ev.From, ev.Room, body)
+		if ev.Tag != "" {
+			line = fmt.Sprintf("%s from %s in %s, tagged %s: %s\n", kind, ev.From, ev.Room, ev.Tag, body)
+		}
+		if len(ev.Buttons) > 0 {
+			labels := make([]string, len(ev.Buttons))
+			for i, b := range ev.Buttons {
+				labels[i] = fmt.Sprintf("%s, %s", b.ID, b.Label)
+			}
+			line += fmt.Sprintf("Buttons: %s. Answer with /click %s and a button.\n", strings.Join(labels, "; "), ev.ID)
+		}
+		return line, true
+	case "private":
+		return fmt.Sprintf("Private message from %s: %s\n", ev.From, body), true
+	case "reaction":
+		return fmt.Sprintf("%s reacted with %s to message %s in %s\n", ev.From, body, ev.ID, ev.Room), true
+	case "unreaction":
+		return fmt.Sprintf("%s removed the reaction %s from message %s in %s\n", ev.From, body, ev.ID, ev.Room), true
+	case "notice", "priority", "announcement":
+		// The body has no timestamp in front of the notice's prefix
+		line = accessibleText(ev.Body + "\n")
+		if ev.Type == "notice" && ev.Room != "" {
+			line = strings.Replace(line, "Server notice: ", "Server notice in "+ev.Room+": ", 1)
+		}
+		return line, line != ""
+	}
+	return accessibleText(text), true
+}
+
+// handleAccessibleCommand handles the /accessible command, which turns the
+// accessibility mode on or off for the account
+// Format: /accessible on|off
+func handleAccessibleCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+		conn.Write([]byte("\033[1;31mUsage: /accessible on|off\033[0m\n"))
+		return
+	}
+	on := parts[1] == "on"
+	mutex.Lock()
+	username := hub.Account(conn)
+	if s, ok := sessions[conn]; ok {
+		s.accessible = on
+	}
+	mutex.Unlock()
+
+	if _, err := db.Exec("UPDATE users SET accessible = ? WHERE username = ?", on, username); err != nil {
+		conn.Write([]byte("\033[1;31mError saving accessibility setting. Please try again.\033[0m\n"))
+		return
+	}
+	setAccessibleOutput(conn, on)
+	if on {
+		conn.Write([]byte("Accessibility mode is on. Output is plain text, each message says what it is and who it is from, and logins, status changes, and joins and leaves of channels you aren't talking in are left out. /accessible off turns it off.\n"))
+	} else {
+		conn.Write([]byte("\033[1;32mAccessibility mode is off.\033[0m\n"))
+	}
+}
@@ -0,0 +1,105 @@
+// Package main contains the commands users manage their own account with
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// deleteConfirmWindow is how long a user has to confirm /deleteaccount
+const deleteConfirmWindow = time.Minute
+
+// pendingDeletions records when each connection asked to delete its account
+var pendingDeletions = make(map[net.Conn]time.Time)
+
+// handlePasswdCommand handles the /passwd command
+// Format: /passwd <old> <new>
+func handlePasswdCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) != 2 {
+		conn.Write([]byte("\033[1;31mUsage: /passwd <old> <new>\033[0m\n"))
+		return
+	}
+	oldPassword, newPassword := args[0], args[1]
+
+	mutex.Lock()
+	account := hub.Account(conn)
+	mutex.Unlock()
+	if account == "" {
+		conn.Write([]byte("\033[1;31mOnly registered accounts have a password.\033[0m\n"))
+		return
+	}
+
+	if len(newPassword) > maxPasswordLength {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mPassword must be %d characters or less.\033[0m\n", maxPasswordLength)))
+		return
+	}
+	if !verifyUser(account, oldPassword) {
+		conn.Write([]byte("\033[1;31mCurrent password is incorrect.\033[0m\n"))
+		return
+	}
+	if err := updateUserPassword(account, newPassword); err != nil {
+		conn.Write([]byte("\033[1;31mError changing password. Please try again.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte("\033[1;32mYour password has been changed.\033[0m\n"))
+}
+
+// handleDeleteAccountCommand handles the /deleteaccount command. The password is
+// checked first; the account is only deleted once the user confirms.
+// Format: /deleteaccount <password> | /deleteaccount confirm
+func handleDeleteAccountCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) != 1 {
+		conn.Write([]byte("\033[1;31mUsage: /deleteaccount <password>\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	account := hub.Account(conn)
+	requested, pending := pendingDeletions[conn]
+	delete(pendingDeletions, conn)
+	mutex.Unlock()
+	if account == "" {
+		conn.Write([]byte("\033[1;31mOnly registered accounts can be deleted.\033[0m\n"))
+		return
+	}
+
+	if args[0] == "confirm" && pending {
+		if clock.Now().Sub(requested) > deleteConfirmWindow {
+			conn.Write([]byte("\033[1;31mConfirmation expired. Run /deleteaccount <password> again.\033[0m\n"))
+			return
+		}
+		deleteAccount(conn, account)
+		return
+	}
+
+	if !verifyUser(account, args[0]) {
+		conn.Write([]byte("\033[1;31mPassword is incorrect.\033[0m\n"))
+		return
+	}
+	mutex.Lock()
+	pendingDeletions[conn] = clock.Now()
+	mutex.Unlock()
+	conn.Write([]byte(fmt.Sprintf("\033[1;33mThis permanently deletes %s and all of its messages. Type /deleteaccount confirm within %s to continue.\033[0m\n",
+		account, deleteConfirmWindow)))
+}
+
+// deleteAccount removes an account and disconnects every session logged in to it
+func deleteAccount(conn net.Conn, account string) {
+	if err := deleteUser(account); err != nil {
+		conn.Write([]byte("\033[1;31mError deleting account. Please try again.\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	sessionConns := hub.ConnsForAccount(account)
+	mutex.Unlock()
+
+	for _, c := range sessionConns {
+		c.Write([]byte("\033[1;32mYour account has been deleted. Goodbye!\033[0m\n"))
+		c.Close()
+	}
+}
@@ -0,0 +1,74 @@
+// Package main contains the server administrator role
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	// adminUsers holds the account names that have admin rights
+	adminUsers = make(map[string]bool)
+	adminMutex = &sync.RWMutex{}
+)
+
+// adminFlag lets -admin be repeated on the command line to grant admin rights
+type adminFlag struct{}
+
+func (adminFlag) String() string {
+	adminMutex.RLock()
+	defer adminMutex.RUnlock()
+
+	names := make([]string, 0, len(adminUsers))
+	for name := range adminUsers {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (adminFlag) Set(value string) error {
+	adminMutex.Lock()
+	defer adminMutex.Unlock()
+
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			adminUsers[name] = true
+		}
+	}
+	return nil
+}
+
+// Account roles stored in the users table
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+	roleBot   = "bot"
+)
+
+// isValidRole reports whether role is one of the known account roles
+func isValidRole(role string) bool {
+	return role == roleUser || role == roleAdmin || role == roleBot
+}
+
+// isAdminAccount reports whether the account has admin rights,
+// either from the -admin flag or from its role in the database
+func isAdminAccount(username string) bool {
+	adminMutex.RLock()
+	flagged := adminUsers[username]
+	adminMutex.RUnlock()
+	if flagged {
+		return true
+	}
+
+	role, err := getUserRole(username)
+	return err == nil && role == roleAdmin
+}
+
+// isAdmin reports whether the account logged in on conn has admin rights
+func isAdmin(conn net.Conn) bool {
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+	return username != "" && isAdminAccount(username)
+}
@@ -0,0 +1,281 @@
+// Package main contains the HTTP admin API and the embedded dashboard
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminAPIToken must be presented as a bearer token on every admin API call.
+// The admin API is disabled while it is empty.
+var adminAPIToken = ""
+
+// adminAPIActor is the name recorded in the moderation log for API actions
+const adminAPIActor = "admin-api"
+
+//go:embed admin_dashboard.html
+var adminDashboardHTML []byte
+
+// ChannelInfo describes a channel in API responses
+type ChannelInfo struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	// Category and Position place the channel in the channel directory
+	Category string `json:"category,omitempty"`
+	Position int    `json:"position,omitempty"`
+}
+
+// ServerStatus is the payload of GET /api/status
+type ServerStatus struct {
+	Connections int           `json:"connections"`
+	Users       []string      `json:"users"`
+	Channels    []ChannelInfo `json:"channels"`
+}
+
+// ConnectionInfo describes a logged in connection in GET /api/connections
+type ConnectionInfo struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Account string `json:"account,omitempty"`
+	Room    string `json:"room"`
+	Addr    string `json:"addr"`
+	// Connected is when the connection was accepted, and LastActive when it last
+	// sent anything
+	Connected  time.Time `json:"connected"`
+	LastActive time.Time `json:"last_active"`
+}
+
+// ReloadResult is the payload of POST /api/reload
+type ReloadResult struct {
+	Status  string   `json:"status"`
+	Changed []string `json:"changed"`
+}
+
+// moderationRequest is the body accepted by the moderation endpoints
+type moderationRequest struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+	Text   string `json:"text"`
+	// Priority marks an announcement as urgent so it bypasses message filters
+	Priority bool `json:"priority"`
+	// Pin keeps an announcement to show users who log in later
+	Pin bool `json:"pin"`
+}
+
+// registerAdminRoutes adds the admin API and dashboard routes to mux
+func registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{$}", serveAdminDashboard)
+	mux.HandleFunc("GET /api/status", requireAdminToken(serveAdminStatus))
+	mux.HandleFunc("GET /api/moderation", requireAdminToken(serveAdminModeration))
+	mux.HandleFunc("GET /api/metrics", requireAdminToken(serveAdminMetrics))
+	mux.HandleFunc("GET /api/connections", requireAdminToken(serveAdminConnections))
+	mux.HandleFunc("GET /api/logs", requireAdminToken(serveAdminLogs))
+	mux.HandleFunc("POST /api/reload", requireAdminToken(serveAdminReload))
+	mux.HandleFunc("POST /api/kick", requireAdminToken(serveAdminKick))
+	mux.HandleFunc("POST /api/ban", requireAdminToken(serveAdminBan))
+	mux.HandleFunc("POST /api/unban", requireAdminToken(serveAdminUnban))
+	mux.HandleFunc("POST /api/announce", requireAdminToken(serveAdminAnnounce))
+}
+
+// hasAdminToken reports whether a request carries the configured admin bearer token
+func hasAdminToken(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return adminAPIToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminAPIToken)) == 1
+}
+
+// requireAdminToken rejects requests without the configured bearer token
+func requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasAdminToken(r) {
+			writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes an error message as a JSON response
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// decodeModerationRequest parses the body of a moderation endpoint
+func decodeModerationRequest(w http.ResponseWriter, r *http.Request) (moderationRequest, bool) {
+	var req moderationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return req, false
+	}
+	return req, true
+}
+
+// serveAdminDashboard serves the embedded dashboard page
+func serveAdminDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(adminDashboardHTML)
+}
+
+// serveAdminStatus reports live connection counts and channels
+func serveAdminStatus(w http.ResponseWriter, r *http.Request) {
+	users := connectedUsers()
+	writeJSON(w, http.StatusOK, ServerStatus{
+		Connections: len(users),
+		Users:       users,
+		Channels:    listRooms(),
+	})
+}
+
+// serveAdminConnections lists every logged in connection with its account and channel
+func serveAdminConnections(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	list := make([]ConnectionInfo, 0, hub.Len())
+	for _, c := range hub.Clients() {
+		list = append(list, ConnectionInfo{
+			ID:         connIDs[c.Conn],
+			Name:       c.Name,
+			Account:    c.Account,
+			Room:       sessionForLocked(c.Conn).room,
+			Addr:       c.Conn.RemoteAddr().String(),
+			Connected:  connectedAt[c.Conn],
+			LastActive: lastSeen[c.Conn],
+		})
+	}
+	mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// serveAdminLogs returns the most recent server log records, oldest first
+// Query: ?limit=<n> (default 100, at most logRingSize)
+func serveAdminLogs(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = min(n, logRingSize)
+	}
+	writeJSON(w, http.StatusOK, recentLogs.last(limit))
+}
+
+// serveAdminReload rereads the config file and applies the settings that can change
+// while the server runs
+func serveAdminReload(w http.ResponseWriter, r *http.Request) {
+	changed, err := reloadConfig()
+	if err == errNoConfigFile {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		logger.Error("reloading config", "err", err)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger.Info("config reloaded", "path", configPath, "changed", strings.Join(changed, ","))
+	writeJSON(w, http.StatusOK, ReloadResult{Status: "reloaded", Changed: changed})
+}
+
+// serveAdminModeration lists recent moderation actions
+func serveAdminModeration(w http.ResponseWriter, r *http.Request) {
+	actions, err := getRecentModeration(50)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error reading moderation log")
+		return
+	}
+	writeJSON(w, http.StatusOK, actions)
+}
+
+// serveAdminKick disconnects a user by display name
+func serveAdminKick(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeModerationRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.User == "" {
+		writeJSONError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	if err := kickUser(adminAPIActor, req.User, req.Reason); err == errUserNotConnected {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "kicked"})
+}
+
+// serveAdminBan bans an account
+func serveAdminBan(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeModerationRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.User == "" {
+		writeJSONError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	if err := banUser(adminAPIActor, req.User, req.Reason); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "banned"})
+}
+
+// serveAdminUnban lifts a ban
+func serveAdminUnban(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeModerationRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.User == "" {
+		writeJSONError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	if err := unbanUser(adminAPIActor, req.User); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "unbanned"})
+}
+
+// serveAdminAnnounce broadcasts a system announcement
+func serveAdminAnnounce(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeModerationRequest(w, r)
+	if !ok {
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		writeJSONError(w, http.StatusBadRequest, "text is required")
+		return
+	}
+	if req.Priority {
+		announcePriority(adminAPIActor, req.Text)
+	} else {
+		announce(adminAPIActor, req.Text)
+	}
+	if req.Pin {
+		id, err := pinAnnouncement(adminAPIActor, req.Text)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "announced, but pinning failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "pinned", "id": strconv.FormatInt(id, 10)})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "announced"})
+}
@@ -0,0 +1,147 @@
+// Package main contains the admin activity analytics command
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// analyticsStopWords are common words left out of the top terms list
+var analyticsStopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "but": true, "not": true,
+	"you": true, "all": true, "can": true, "was": true, "this": true, "that": true,
+	"with": true, "have": true, "from": true, "just": true, "what": true, "its": true,
+}
+
+// parsePeriod parses durations like 30m, 24h or 7d
+func parsePeriod(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid period %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid period %q", s)
+	}
+	return d, nil
+}
+
+// countTerms adds the interesting words of body to counts
+func countTerms(counts map[string]int, body string) {
+	words := strings.FieldsFunc(strings.ToLower(body), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if len(w) < 3 || analyticsStopWords[w] {
+			continue
+		}
+		counts[w]++
+	}
+}
+
+// topTerms returns the n most frequent terms, most frequent first
+func topTerms(counts map[string]int, n int) []string {
+	terms := make([]string, 0, len(counts))
+	for term := range counts {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if counts[terms[i]] != counts[terms[j]] {
+			return counts[terms[i]] > counts[terms[j]]
+		}
+		return terms[i] < terms[j]
+	})
+	if len(terms) > n {
+		terms = terms[:n]
+	}
+	return terms
+}
+
+// handleAnalyticsCommand handles the /analytics command
+// Format: /analytics [channel] [period]
+func handleAnalyticsCommand(conn net.Conn, message string) {
+	if !isAdmin(conn) {
+		conn.Write([]byte("\033[1;31mOnly admins can view analytics.\033[0m\n"))
+		return
+	}
+
+	channel := currentRoom(conn)
+	period := 24 * time.Hour
+	for _, arg := range strings.Fields(message)[1:] {
+		if strings.HasPrefix(arg, "#") {
+			channel = arg
+			continue
+		}
+		d, err := parsePeriod(arg)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mUsage: /analytics [channel] [period, e.g. 24h or 7d]\033[0m\n"))
+			return
+		}
+		period = d
+	}
+	since := time.Now().UTC().Add(-period)
+
+	conn.Write([]byte(fmt.Sprintf("\033[1;36mAnalytics for %s over the last %s:\033[0m\n", channel, period)))
+
+	// Busiest hours, aggregated by the database
+	rows, err := db.Query(`SELECT strftime('%H', created_at) AS hour, COUNT(*) AS n FROM messages
+		WHERE channel = ? AND created_at >= ? GROUP BY hour ORDER BY n DESC LIMIT 3`, channel, since)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError computing analytics.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte("\033[1;33mBusiest hours (UTC):\033[0m\n"))
+	for rows.Next() {
+		var hour string
+		var n int
+		if err := rows.Scan(&hour, &n); err == nil {
+			conn.Write([]byte(fmt.Sprintf("\033[90m  %s:00  %d messages\033[0m\n", hour, n)))
+		}
+	}
+	rows.Close()
+
+	// Most active users, aggregated by the database
+	rows, err = db.Query(`SELECT sender, COUNT(*) AS n FROM messages
+		WHERE channel = ? AND created_at >= ? GROUP BY sender ORDER BY n DESC LIMIT 5`, channel, since)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError computing analytics.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte("\033[1;33mMost active users:\033[0m\n"))
+	for rows.Next() {
+		var sender string
+		var n int
+		if err := rows.Scan(&sender, &n); err == nil {
+			conn.Write([]byte(fmt.Sprintf("\033[90m  %-10s %d messages\033[0m\n", sender, n)))
+		}
+	}
+	rows.Close()
+
+	// Top terms, streamed row by row so only the term counts are held in memory
+	rows, err = db.Query("SELECT body FROM messages WHERE channel = ? AND created_at >= ?", channel, since)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError computing analytics.\033[0m\n"))
+		return
+	}
+	counts := make(map[string]int)
+	for rows.Next() {
+		var body string
+		if err := rows.Scan(&body); err == nil {
+			countTerms(counts, openBody(body))
+		}
+	}
+	rows.Close()
+
+	conn.Write([]byte("\033[1;33mTop terms:\033[0m\n"))
+	for _, term := range topTerms(counts, 10) {
+		conn.Write([]byte(fmt.Sprintf("\033[90m  %-15s %d\033[0m\n", term, counts[term])))
+	}
+}
@@ -0,0 +1,67 @@
+// Package main contains limits that protect the server from slow or idle unauthenticated connections
+package main
+
+import (
+	"bufio"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// authTimeout is how long a connection may take to finish login and pick a display name
+	authTimeout = 60 * time.Second
+	// maxPreAuthLine is the largest line accepted before the client is authenticated
+	maxPreAuthLine = 256
+	// maxPendingAuth caps the number of connections that have not finished logging in
+	maxPendingAuth = 100
+
+	pendingAuth      = 0
+	pendingAuthMutex = &sync.Mutex{}
+)
+
+// errLineTooLong is returned when a client sends a line longer than allowed
+var errLineTooLong = errors.New("line too long")
+
+// acquireAuthSlot reserves a slot for an unauthenticated connection.
+// It returns false if too many connections are already waiting to log in.
+func acquireAuthSlot() bool {
+	pendingAuthMutex.Lock()
+	defer pendingAuthMutex.Unlock()
+
+	if maxPendingAuth > 0 && pendingAuth >= maxPendingAuth {
+		return false
+	}
+	pendingAuth++
+	return true
+}
+
+// releaseAuthSlot frees a slot taken by acquireAuthSlot
+func releaseAuthSlot() {
+	pendingAuthMutex.Lock()
+	defer pendingAuthMutex.Unlock()
+
+	if pendingAuth > 0 {
+		pendingAuth--
+	}
+}
+
+// readLimitedLine reads a single line without buffering more than limit bytes.
+// Unlike ReadString it never lets a client grow our buffers by withholding the newline.
+func readLimitedLine(reader *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(line), nil
+	}
+}
@@ -0,0 +1,253 @@
+// Package main contains personal bookmarks of channel messages, which only the
+// user who made them sees
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxBookmarks caps the bookmarks one account may keep
+	maxBookmarks = 100
+	// bookmarkContext is how many messages before and after a bookmark are shown with it
+	bookmarkContext = 3
+	// bookmarkExcerpt is how much of a message /bookmarks shows in its list
+	bookmarkExcerpt = 60
+)
+
+// Bookmark is a channel message an account bookmarked, with its note
+type Bookmark struct {
+	Message HistoryMessage
+	Note    string
+	Created time.Time
+}
+
+// addBookmark bookmarks a message for account, replacing the note of an existing
+// bookmark. It reports false if the account already has maxBookmarks others.
+func addBookmark(account, messageID, note string) (bool, error) {
+	var count, existing int
+	if err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(message_id = ?), 0) FROM bookmarks WHERE username = ?", messageID, account).Scan(&count, &existing); err != nil {
+		return false, err
+	}
+	if existing == 0 && count >= maxBookmarks {
+		return false, nil
+	}
+	_, err := db.Exec(`INSERT INTO bookmarks (username, message_id, note, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (username, message_id) DO UPDATE SET note = excluded.note`, account, messageID, note, clock.Now())
+	return err == nil, err
+}
+
+// removeBookmark deletes a bookmark, reporting false if there was none
+func removeBookmark(account, messageID string) (bool, error) {
+	result, err := db.Exec("DELETE FROM bookmarks WHERE username = ? AND message_id = ?", account, messageID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// listBookmarks returns account's bookmarks, oldest first. Bookmarks of messages
+// that are no longer stored are left out.
+func listBookmarks(account string) ([]Bookmark, error) {
+	rows, err := db.Query(`SELECT m.message_id, m.seq, m.channel, m.sender, m.body, COALESCE(m.tag, ''), m.created_at, b.note, b.created_at
+		FROM bookmarks b JOIN messages m ON m.message_id = b.message_id
+		WHERE b.username = ? AND m.seq IS NOT NULL ORDER BY b.created_at, b.message_id`, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bookmarks []Bookmark
+	for rows.Next() {
+		var b Bookmark
+		m := &b.Message
+		if err := rows.Scan(&m.ID, &m.Seq, &m.Channel, &m.Sender, &m.Body, &m.Tag, &m.Time, &b.Note, &b.Created); err != nil {
+			return nil, err
+		}
+		m.Body = openBody(m.Body)
+		bookmarks = append(bookmarks, b)
+	}
+	return bookmarks, rows.Err()
+}
+
+// bookmarkAround returns a bookmarked message with the messages just before and
+// after it in its channel, oldest first
+func bookmarkAround(m HistoryMessage) ([]HistoryMessage, error) {
+	before, err := getHistoryPage(m.Channel, HistoryQuery{Before: m.ID, Limit: bookmarkContext})
+	if err != nil {
+		return nil, err
+	}
+	after, err := getHistoryPage(m.Channel, HistoryQuery{After: m.ID, Limit: bookmarkContext})
+	if err != nil {
+		return nil, err
+	}
+	messages := append(before.Messages, m)
+	return append(messages, after.Messages...), nil
+}
+
+// excerpt shortens text to at most n characters
+func excerpt(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// handleBookmarkCommand handles the /bookmark command, which bookmarks a message in
+// one of the user's channels
+// Format: /bookmark <message-id> [note]
+func handleBookmarkCommand(conn net.Conn, message string) {
+	parts := strings.SplitN(message, " ", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		conn.Write([]byte("\033[1;31mUsage: /bookmark <message-id> [note]\033[0m\n"))
+		return
+	}
+	id, note := parts[1], ""
+	if len(parts) == 3 {
+		note = strings.TrimSpace(parts[2])
+	}
+
+	m, found, err := getChannelMessage(id)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError looking up the message. Please try again.\033[0m\n"))
+		return
+	}
+	mutex.Lock()
+	username := hub.Account(conn)
+	inChannel := found && sessionForLocked(conn).joined[m.channel]
+	mutex.Unlock()
+	if !inChannel {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mNo message %s in your channels.\033[0m\n", id)))
+		return
+	}
+
+	added, err := addBookmark(username, id, note)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError saving the bookmark. Please try again.\033[0m\n"))
+		return
+	}
+	if !added {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou already have %d bookmarks; remove one with /unbookmark first.\033[0m\n", maxBookmarks)))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mBookmarked @%s's message in %s. See /bookmarks.\033[0m\n", m.sender, m.channel)))
+}
+
+// handleUnbookmarkCommand handles the /unbookmark command
+// Format: /unbookmark <message-id>
+func handleUnbookmarkCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 2 {
+		conn.Write([]byte("\033[1;31mUsage: /unbookmark <message-id>\033[0m\n"))
+		return
+	}
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	removed, err := removeBookmark(username, parts[1])
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError removing the bookmark. Please try again.\033[0m\n"))
+		return
+	}
+	if !removed {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou have no bookmark %s.\033[0m\n", parts[1])))
+		return
+	}
+	conn.Write([]byte("\033[1;32mBookmark removed.\033[0m\n"))
+}
+
+// handleBookmarksCommand handles the /bookmarks command, which lists the user's
+// bookmarks, or shows one in context
+// Format: /bookmarks [number|message-id]
+func handleBookmarksCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) > 1 {
+		conn.Write([]byte("\033[1;31mUsage: /bookmarks [number|message-id]\033[0m\n"))
+		return
+	}
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	bookmarks, err := listBookmarks(username)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError loading your bookmarks. Please try again.\033[0m\n"))
+		return
+	}
+	if len(bookmarks) == 0 {
+		conn.Write([]byte("\033[1;33mYou have no bookmarks. Add one with /bookmark <message-id>.\033[0m\n"))
+		return
+	}
+	loc := userLocation(conn)
+
+	if len(args) == 0 {
+		var out strings.Builder
+		out.WriteString("\033[1;36mYour bookmarks:\033[0m\n")
+		for i, b := range bookmarks {
+			m := b.Message
+			out.WriteString(fmt.Sprintf("  %d. [%s] %s %s: %s", i+1, m.Time.In(loc).Format("2006-01-02 15:04"), m.Channel, m.Sender, excerpt(m.Body, bookmarkExcerpt)))
+			if b.Note != "" {
+				out.WriteString(fmt.Sprintf(" \033[1;33m(%s)\033[0m", b.Note))
+			}
+			out.WriteString("\n")
+		}
+		out.WriteString("\033[90mShow one in context with /bookmarks <number>.\033[0m\n")
+		conn.Write([]byte(out.String()))
+		return
+	}
+
+	var b *Bookmark
+	for i := range bookmarks {
+		if strconv.Itoa(i+1) == args[0] || bookmarks[i].Message.ID == args[0] {
+			b = &bookmarks[i]
+			break
+		}
+	}
+	if b == nil {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou have no bookmark %s.\033[0m\n", args[0])))
+		return
+	}
+	// Only members see the conversation around a bookmark, which may be newer than it
+	mutex.Lock()
+	inChannel := sessionForLocked(conn).joined[b.Message.Channel]
+	mutex.Unlock()
+	messages := []HistoryMessage{b.Message}
+	if inChannel {
+		if messages, err = bookmarkAround(b.Message); err != nil {
+			conn.Write([]byte("\033[1;31mError retrieving history.\033[0m\n"))
+			return
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("\033[1;36mBookmark in %s", b.Message.Channel))
+	if b.Note != "" {
+		out.WriteString(": " + b.Note)
+	}
+	out.WriteString("\033[0m\n")
+	for _, m := range messages {
+		body := m.Body
+		if m.Tag != "" {
+			body = fmt.Sprintf("[%s] %s", m.Tag, m.Body)
+		}
+		line := fmt.Sprintf("[%s] %s: %s", m.Time.In(loc).Format("2006-01-02 15:04:05"), m.Sender, body)
+		if m.ID == b.Message.ID {
+			out.WriteString("\033[1;33m> " + line + "\033[0m\n")
+		} else {
+			out.WriteString("\033[90m  " + line + "\033[0m\n")
+		}
+	}
+	if inChannel {
+		out.WriteString(fmt.Sprintf("\033[90mRead on with /join %s, then /history after=%s or /history before=%s.\033[0m\n", b.Message.Channel, b.Message.ID, b.Message.ID))
+	} else {
+		out.WriteString(fmt.Sprintf("\033[90m/join %s to see the messages around it.\033[0m\n", b.Message.Channel))
+	}
+	conn.Write([]byte(out.String()))
+}
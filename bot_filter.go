@@ -0,0 +1,128 @@
+// Package main contains suppression of bot traffic at server, channel and user level
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	// showBotTraffic is the server-wide default for delivering bot messages
+	showBotTraffic = true
+	// channelBotTraffic overrides the server default per channel
+	channelBotTraffic = make(map[string]bool)
+	channelBotMutex   = &sync.RWMutex{}
+)
+
+// loadChannelBotSettings reads the per-channel bot traffic settings into memory
+func loadChannelBotSettings() error {
+	rows, err := db.Query("SELECT channel, show_bots FROM channel_bot_settings")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	channelBotMutex.Lock()
+	defer channelBotMutex.Unlock()
+	for rows.Next() {
+		var channel string
+		var show bool
+		if err := rows.Scan(&channel, &show); err != nil {
+			return err
+		}
+		channelBotTraffic[channel] = show
+	}
+	return rows.Err()
+}
+
+// setChannelBotTraffic stores a channel's bot traffic setting; "default" removes it
+func setChannelBotTraffic(channel, value string) error {
+	channelBotMutex.Lock()
+	defer channelBotMutex.Unlock()
+
+	if value == "default" {
+		delete(channelBotTraffic, channel)
+		_, err := db.Exec("DELETE FROM channel_bot_settings WHERE channel = ?", channel)
+		return err
+	}
+	show := value == "on"
+	channelBotTraffic[channel] = show
+	_, err := db.Exec("INSERT OR REPLACE INTO channel_bot_settings (channel, show_bots) VALUES (?, ?)", channel, show)
+	return err
+}
+
+// receivesBotTraffic decides whether a recipient sees bot messages in a channel:
+// the user's own choice wins, then the channel setting, then the server default
+func receivesBotTraffic(s *Session, channel string) bool {
+	switch s.filterBots {
+	case "on":
+		return true
+	case "off":
+		return false
+	}
+
+	channelBotMutex.RLock()
+	show, ok := channelBotTraffic[channel]
+	channelBotMutex.RUnlock()
+	if ok {
+		return show
+	}
+	return showBotTraffic
+}
+
+// handleFilterCommand handles the /filter command
+// Format: /filter bots on|off|default
+func handleFilterCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 3 || parts[1] != "bots" || (parts[2] != "on" && parts[2] != "off" && parts[2] != "default") {
+		conn.Write([]byte("\033[1;31mUsage: /filter bots on|off|default\033[0m\n"))
+		return
+	}
+	value := parts[2]
+	if value == "default" {
+		value = ""
+	}
+
+	mutex.Lock()
+	username := hub.Account(conn)
+	if s, ok := sessions[conn]; ok {
+		s.filterBots = value
+	}
+	mutex.Unlock()
+
+	if _, err := db.Exec("UPDATE users SET filter_bots = ? WHERE username = ?", value, username); err != nil {
+		conn.Write([]byte("\033[1;31mError saving filter. Please try again.\033[0m\n"))
+		return
+	}
+	switch value {
+	case "on":
+		conn.Write([]byte("\033[1;32mBot messages will be shown.\033[0m\n"))
+	case "off":
+		conn.Write([]byte("\033[1;32mBot messages will be hidden.\033[0m\n"))
+	default:
+		conn.Write([]byte("\033[1;32mBot messages follow the channel default.\033[0m\n"))
+	}
+}
+
+// handleChannelFilterCommand handles the admin /channelfilter command
+// Format: /channelfilter <#channel> bots on|off|default
+func handleChannelFilterCommand(conn net.Conn, message string) {
+	if !isAdmin(conn) {
+		conn.Write([]byte("\033[1;31mOnly admins can change channel filters.\033[0m\n"))
+		return
+	}
+	parts := strings.Fields(message)
+	if len(parts) != 4 || !strings.HasPrefix(parts[1], "#") || parts[2] != "bots" ||
+		(parts[3] != "on" && parts[3] != "off" && parts[3] != "default") {
+		conn.Write([]byte("\033[1;31mUsage: /channelfilter <#channel> bots on|off|default\033[0m\n"))
+		return
+	}
+
+	if err := setChannelBotTraffic(parts[1], parts[3]); err != nil {
+		conn.Write([]byte("\033[1;31mError saving channel filter.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mBot traffic in %s set to %s.\033[0m\n", parts[1], parts[3])))
+}
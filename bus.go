@@ -0,0 +1,45 @@
+// Package main contains the message bus between command handlers and delivery
+package main
+
+// MessageBus carries events and messages from the code that produces them (commands,
+// moderation, presence, system notices) to the code that delivers them to
+// connections. Handlers only publish; they don't know whether delivery happens in
+// this process or on another instance.
+//
+// An implementation backed by a broker (Redis, NATS) publishes to the broker and,
+// for what it receives from it, hands the message to localBus so this instance's
+// members get it.
+type MessageBus interface {
+	// Broadcast sends a line of text to every client and public channel spectator
+	Broadcast(text string)
+	// Publish sends a message to a channel's members, or to everyone if it is a priority
+	// message or a presence summary without a channel
+	Publish(msg OutgoingMessage)
+	// SendPrivate sends a private message to the user it is addressed to
+	SendPrivate(msg PrivateMessage)
+	// Emit hands a typed event to the event consumers
+	Emit(ev Event)
+}
+
+// bus is the MessageBus every producer publishes to
+var bus MessageBus = localBus{}
+
+// setBus replaces the message bus, e.g. with one backed by a broker. Pending presence
+// timers read bus under presenceMutex, so it is replaced under it too.
+func setBus(b MessageBus) {
+	presenceMutex.Lock()
+	bus = b
+	presenceMutex.Unlock()
+}
+
+// localBus delivers within this process, through the queues read by
+// handleBroadcasting and processPrivateMessages
+type localBus struct{}
+
+func (localBus) Broadcast(text string) { broadcast <- text }
+
+func (localBus) Publish(msg OutgoingMessage) { channelMessages <- msg }
+
+func (localBus) SendPrivate(msg PrivateMessage) { privateMsg <- msg }
+
+func (localBus) Emit(ev Event) { dispatchEvent(ev) }
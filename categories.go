@@ -0,0 +1,363 @@
+// Package main contains channel categories and ordering for the channel directory
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// validCategoryName matches category names such as Support or Dev-Tools
+var validCategoryName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// errUnknownCategory is returned when placing a channel in a category that doesn't exist
+var errUnknownCategory = errors.New("unknown category")
+
+// ChannelCategory is one group of the channel directory. Channels without a category
+// are listed last, in a group with an empty name.
+type ChannelCategory struct {
+	Name     string        `json:"name"`
+	Position int           `json:"position"`
+	Channels []ChannelInfo `json:"channels"`
+}
+
+// channelPlacement is where a channel is listed in the directory
+type channelPlacement struct {
+	category string
+	position int
+}
+
+var (
+	// categories maps each category to its position in the directory
+	categories = make(map[string]int)
+	// channelPlacements maps channels to their category and position within it
+	channelPlacements = make(map[string]channelPlacement)
+	categoriesMutex   = &sync.RWMutex{}
+)
+
+// loadChannelLayout reads the categories and channel placements into memory
+func loadChannelLayout() error {
+	rows, err := db.Query("SELECT name, position FROM categories")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	categoriesMutex.Lock()
+	defer categoriesMutex.Unlock()
+	for rows.Next() {
+		var name string
+		var position int
+		if err := rows.Scan(&name, &position); err != nil {
+			return err
+		}
+		categories[name] = position
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	placed, err := db.Query("SELECT channel, category, position FROM channel_layout")
+	if err != nil {
+		return err
+	}
+	defer placed.Close()
+	for placed.Next() {
+		var channel string
+		var p channelPlacement
+		if err := placed.Scan(&channel, &p.category, &p.position); err != nil {
+			return err
+		}
+		channelPlacements[channel] = p
+	}
+	return placed.Err()
+}
+
+// findCategoryLocked returns the stored spelling of a category, matched
+// case-insensitively. Callers must hold categoriesMutex.
+func findCategoryLocked(name string) (string, bool) {
+	for category := range categories {
+		if strings.EqualFold(category, name) {
+			return category, true
+		}
+	}
+	return "", false
+}
+
+// setCategory creates a category or moves it to a new position
+func setCategory(name string, position int) error {
+	categoriesMutex.Lock()
+	defer categoriesMutex.Unlock()
+	if existing, ok := findCategoryLocked(name); ok {
+		name = existing
+	}
+	if _, err := db.Exec("INSERT OR REPLACE INTO categories (name, position) VALUES (?, ?)", name, position); err != nil {
+		return err
+	}
+	categories[name] = position
+	return nil
+}
+
+// removeCategory deletes a category; its channels become uncategorized
+func removeCategory(name string) (bool, error) {
+	categoriesMutex.Lock()
+	defer categoriesMutex.Unlock()
+	name, ok := findCategoryLocked(name)
+	if !ok {
+		return false, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM channel_layout WHERE category = ?", name); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM categories WHERE name = ?", name); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	delete(categories, name)
+	for channel, p := range channelPlacements {
+		if p.category == name {
+			delete(channelPlacements, channel)
+		}
+	}
+	return true, nil
+}
+
+// placeChannel lists a channel under a category at a position. A negative position
+// puts it after the category's other channels.
+func placeChannel(channel, category string, position int) (string, error) {
+	categoriesMutex.Lock()
+	defer categoriesMutex.Unlock()
+	category, ok := findCategoryLocked(category)
+	if !ok {
+		return "", errUnknownCategory
+	}
+	if position < 0 {
+		position = 0
+		for other, p := range channelPlacements {
+			if p.category == category && other != channel && p.position >= position {
+				position = p.position + 1
+			}
+		}
+	}
+	if _, err := db.Exec("INSERT OR REPLACE INTO channel_layout (channel, category, position) VALUES (?, ?, ?)",
+		channel, category, position); err != nil {
+		return "", err
+	}
+	channelPlacements[channel] = channelPlacement{category: category, position: position}
+	return category, nil
+}
+
+// unplaceChannel takes a channel out of its category
+func unplaceChannel(channel string) error {
+	categoriesMutex.Lock()
+	defer categoriesMutex.Unlock()
+	if _, err := db.Exec("DELETE FROM channel_layout WHERE channel = ?", channel); err != nil {
+		return err
+	}
+	delete(channelPlacements, channel)
+	return nil
+}
+
+// channelDirectory groups the active channels, and every channel placed in a
+// category, by category. Categories and the channels in them are in position order,
+// then by name; uncategorized channels come last.
+func channelDirectory() []ChannelCategory {
+	active := listRooms()
+
+	categoriesMutex.RLock()
+	defer categoriesMutex.RUnlock()
+	groups := make(map[string]*ChannelCategory, len(categories))
+	for name, position := range categories {
+		groups[name] = &ChannelCategory{Name: name, Position: position, Channels: []ChannelInfo{}}
+	}
+	other := &ChannelCategory{Channels: []ChannelInfo{}}
+
+	listed := make(map[string]bool)
+	add := func(info ChannelInfo) {
+		listed[info.Name] = true
+		if p, ok := channelPlacements[info.Name]; ok && groups[p.category] != nil {
+			info.Category, info.Position = p.category, p.position
+			groups[p.category].Channels = append(groups[p.category].Channels, info)
+			return
+		}
+		other.Channels = append(other.Channels, info)
+	}
+	for _, info := range active {
+		add(info)
+	}
+	// Placed channels are listed even while nobody is in them
+	for channel := range channelPlacements {
+		if !listed[channel] {
+			add(ChannelInfo{Name: channel})
+		}
+	}
+
+	directory := make([]ChannelCategory, 0, len(groups)+1)
+	for _, g := range groups {
+		directory = append(directory, *g)
+	}
+	sort.Slice(directory, func(i, j int) bool {
+		if directory[i].Position != directory[j].Position {
+			return directory[i].Position < directory[j].Position
+		}
+		return directory[i].Name < directory[j].Name
+	})
+	if len(other.Channels) > 0 {
+		directory = append(directory, *other)
+	}
+	for _, g := range directory {
+		sort.Slice(g.Channels, func(i, j int) bool {
+			if g.Channels[i].Position != g.Channels[j].Position {
+				return g.Channels[i].Position < g.Channels[j].Position
+			}
+			return g.Channels[i].Name < g.Channels[j].Name
+		})
+	}
+	return directory
+}
+
+// handleListCommand handles the /list command, showing the channel directory
+func handleListCommand(conn net.Conn) {
+	current := currentRoom(conn)
+	var out strings.Builder
+	out.WriteString("\033[1;36mChannel directory:\033[0m\n")
+	for _, g := range channelDirectory() {
+		name := g.Name
+		if name == "" {
+			name = "Other"
+		}
+		out.WriteString(fmt.Sprintf("\033[1;33m%s\033[0m\n", name))
+		if len(g.Channels) == 0 {
+			out.WriteString("\033[90m  (no channels)\033[0m\n")
+		}
+		for _, c := range g.Channels {
+			marker := " "
+			if c.Name == current {
+				marker = "*"
+			}
+			out.WriteString(fmt.Sprintf("\033[90m%s %s (%d)\033[0m\n", marker, c.Name, c.Members))
+		}
+	}
+	conn.Write([]byte(out.String()))
+}
+
+// handleCategoryCommand handles the /category command. Admins manage categories;
+// a channel's owner can place it in one.
+// Format: /category set <name> [position] | /category remove <name> |
+// /category place <#channel> <name> [position] | /category unplace <#channel>
+func handleCategoryCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	usage := "\033[1;31mUsage: /category set <name> [position] | remove <name> | place <#channel> <name> [position] | unplace <#channel>\033[0m\n"
+	if len(parts) < 3 {
+		conn.Write([]byte(usage))
+		return
+	}
+	// An optional trailing position
+	position := -1
+	last := parts[len(parts)-1]
+	if n, err := strconv.Atoi(last); err == nil && ((parts[1] == "set" && len(parts) == 4) || (parts[1] == "place" && len(parts) == 5)) {
+		if n < 0 {
+			conn.Write([]byte("\033[1;31mPositions can't be negative.\033[0m\n"))
+			return
+		}
+		position = n
+		parts = parts[:len(parts)-1]
+	}
+
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	switch {
+	case (parts[1] == "set" || parts[1] == "remove") && len(parts) == 3:
+		if !isAdmin(conn) {
+			conn.Write([]byte("\033[1;31mOnly admins can change categories.\033[0m\n"))
+			return
+		}
+		name := parts[2]
+		if !validCategoryName.MatchString(name) {
+			conn.Write([]byte("\033[1;31mCategory names use letters, digits, '-' and '_' (max 32).\033[0m\n"))
+			return
+		}
+		if parts[1] == "remove" {
+			removed, err := removeCategory(name)
+			switch {
+			case err != nil:
+				conn.Write([]byte("\033[1;31mError removing category.\033[0m\n"))
+			case !removed:
+				conn.Write([]byte(fmt.Sprintf("\033[1;31mNo category %s.\033[0m\n", name)))
+			default:
+				conn.Write([]byte(fmt.Sprintf("\033[1;32mRemoved category %s; its channels are now uncategorized.\033[0m\n", name)))
+			}
+			return
+		}
+		if position < 0 {
+			position = 0
+		}
+		if err := setCategory(name, position); err != nil {
+			conn.Write([]byte("\033[1;31mError saving category.\033[0m\n"))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mCategory %s is at position %d.\033[0m\n", name, position)))
+
+	case (parts[1] == "place" && len(parts) == 4) || (parts[1] == "unplace" && len(parts) == 3):
+		channel := strings.ToLower(parts[2])
+		if !validRoomName.MatchString(channel) {
+			conn.Write([]byte(usage))
+			return
+		}
+		if !canManageChannel(username, channel) {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mOnly the owner of %s can place it in a category.\033[0m\n", channel)))
+			return
+		}
+		if parts[1] == "unplace" {
+			if err := unplaceChannel(channel); err != nil {
+				conn.Write([]byte("\033[1;31mError saving channel placement.\033[0m\n"))
+				return
+			}
+			conn.Write([]byte(fmt.Sprintf("\033[1;32m%s is now uncategorized.\033[0m\n", channel)))
+			return
+		}
+		category, err := placeChannel(channel, parts[3], position)
+		if err == errUnknownCategory {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mNo category %s. Type /list to see them.\033[0m\n", parts[3])))
+			return
+		} else if err != nil {
+			conn.Write([]byte("\033[1;31mError saving channel placement.\033[0m\n"))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[1;32m%s is listed under %s.\033[0m\n", channel, category)))
+
+	default:
+		conn.Write([]byte(usage))
+	}
+}
+
+// registerChannelRoutes adds the channel directory endpoint to mux
+func registerChannelRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/channels", serveChannelDirectory)
+}
+
+// serveChannelDirectory returns the channel directory as JSON.
+// Either the admin token or the stream token grants read access.
+func serveChannelDirectory(w http.ResponseWriter, r *http.Request) {
+	if !hasStreamToken(r) && !hasAdminToken(r) {
+		writeJSONError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]ChannelCategory{"categories": channelDirectory()})
+}
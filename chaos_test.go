@@ -0,0 +1,55 @@
+//go:build chaos
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInjectedDBFaultsOpenBreaker(t *testing.T) {
+	defer setFaults(faultConfig{dbFailRate: 1})()
+	savedBreaker, savedBackoff := dbBreaker, dbRetryBackoff
+	dbBreaker = &circuitBreaker{threshold: 2, cooldown: time.Minute}
+	dbRetryBackoff = time.Millisecond
+	defer func() {
+		dbBreaker, dbRetryBackoff = savedBreaker, savedBackoff
+		pendingWrites = nil
+	}()
+	pendingWrites = []func() error{func() error { return nil }} // keep the outage notice quiet
+
+	for i := 0; i < 2; i++ {
+		if _, err := dbExec("INSERT"); !isDBUnavailable(err) {
+			t.Fatalf("Expected an injected outage, got %v", err)
+		}
+	}
+	if _, err := dbExec("INSERT"); err != errCircuitOpen {
+		t.Errorf("Expected the breaker to open, got %v", err)
+	}
+
+	// Writes made during the outage are kept for replay instead of failing
+	if err := persist(queuedWrite{query: "INSERT"}, "id"); err != nil {
+		t.Errorf("Expected the write to be kept, got %v", err)
+	}
+	if len(pendingWrites) != 2 {
+		t.Errorf("Expected the write to be queued, got %d pending", len(pendingWrites))
+	}
+}
+
+func TestInjectedWriteFaultDropsClient(t *testing.T) {
+	defer setFaults(faultConfig{writeFailRate: 1})()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := newTimeoutConn(server)
+	if _, err := conn.Write([]byte("hello\n")); err != errInjectedWrite {
+		t.Fatalf("Expected an injected write failure, got %v", err)
+	}
+
+	// The connection is closed, so the client's reader sees it go away
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the connection to be closed after a failed write")
+	}
+}
@@ -0,0 +1,222 @@
+// Package main contains the command-line subcommands of the chat-server binary
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// cliCommand is one subcommand of the chat-server binary
+type cliCommand struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+// cliCommands lists every subcommand, in the order shown by help
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{"serve", "serve [flags]", "Run the chat server (default)", runServe},
+		{"useradd", "useradd [-role admin|bot] <username>", "Create an account, reading the password from stdin", runUseraddCommand},
+		{"passwd", "passwd <username>", "Set an account's password, reading it from stdin", runPasswdCommand},
+		{"users", "users import <file.csv> | export [file.csv]", "Bulk import or export accounts", runUsersCommand},
+		{"migrate", "migrate users-json <file> | copy <from> <to>", "Import legacy data or copy between databases", runMigrateCommand},
+		{"ctl", "ctl [-json] <command> [args]", "Run an admin command against a running server", runCtlCommand},
+		{"events", "events [-after <id>] [-type <type>]", "Write the event log as JSON lines, e.g. to backfill a new consumer", runEventsCommand},
+		{"backup", "backup <file>", "Write a consistent copy of the database, safe while the server runs", runBackupCommand},
+		{"help", "help", "Show this help message", runHelpCommand},
+	}
+}
+
+// runCLI dispatches to a subcommand. Without one, or when only flags are given,
+// the server starts so existing invocations keep working.
+func runCLI(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(args)
+	}
+
+	for _, cmd := range cliCommands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	runHelpCommand(nil)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// newCommandFlags returns a flag set with the options shared by every subcommand
+func newCommandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&dbPath, "db", dbPath, "path to the SQLite database")
+	fs.StringVar(&configPath, "config", configPath, "JSON file with default values for these flags")
+	fs.StringVar(&storageKeyFile, "storage-key-file", storageKeyFile, "file holding the 32-byte key, hex or base64, that message bodies are encrypted with (default $CHAT_STORAGE_KEY)")
+	fs.IntVar(&maxUsernameLength, "max-username-length", maxUsernameLength, "longest allowed username")
+	fs.IntVar(&maxPasswordLength, "max-password-length", maxPasswordLength, "longest allowed password")
+	return fs
+}
+
+// runHelpCommand prints the available subcommands
+func runHelpCommand(args []string) error {
+	fmt.Println("Usage: chat-server <command> [arguments]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, cmd := range cliCommands {
+		fmt.Printf("  %-46s %s\n", cmd.usage, cmd.summary)
+	}
+	fmt.Println()
+	fmt.Println("Every command accepts -db <path> to choose the database file and")
+	fmt.Println("-config <file> to read default flag values from a JSON file.")
+	return nil
+}
+
+// requireDatabase fails unless -db names an existing file, so a mistyped path isn't
+// created as an empty database
+func requireDatabase() error {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return fmt.Errorf("no database at %s", dbPath)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// readPasswordLine reads a password from the first line of stdin
+func readPasswordLine() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	password := strings.TrimSpace(line)
+	if password == "" {
+		return "", errors.New("password must not be empty")
+	}
+	if len(password) > maxPasswordLength {
+		return "", fmt.Errorf("password must be %d characters or less", maxPasswordLength)
+	}
+	return password, nil
+}
+
+// runUseraddCommand creates an account from the command line
+func runUseraddCommand(args []string) error {
+	fs := newCommandFlags("useradd")
+	role := fs.String("role", roleUser, "role of the new account (user, admin or bot)")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: chat-server useradd [-role admin|bot] <username>")
+	}
+	username := fs.Arg(0)
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+	if !isValidRole(*role) {
+		return fmt.Errorf("unknown role %q", *role)
+	}
+
+	// useradd may set up a new server's database, but says so in case -db is mistyped
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Creating a new database at %s\n", dbPath)
+	}
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer closeDB()
+
+	exists, err := userExists(username)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("user %s already exists", username)
+	}
+
+	password, err := readPasswordLine()
+	if err != nil {
+		return err
+	}
+	if err := saveUser(username, password); err != nil {
+		return err
+	}
+	if err := setUserRole(username, *role); err != nil {
+		return err
+	}
+	fmt.Printf("Created %s user %s\n", *role, username)
+	return nil
+}
+
+// runPasswdCommand resets an account's password from the command line
+func runPasswdCommand(args []string) error {
+	fs := newCommandFlags("passwd")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: chat-server passwd <username>")
+	}
+	username := fs.Arg(0)
+
+	if err := requireDatabase(); err != nil {
+		return err
+	}
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer closeDB()
+
+	exists, err := userExists(username)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+
+	password, err := readPasswordLine()
+	if err != nil {
+		return err
+	}
+	if err := updateUserPassword(username, password); err != nil {
+		return err
+	}
+	fmt.Printf("Password updated for %s\n", username)
+	return nil
+}
+
+// runBackupCommand writes a consistent snapshot of the database to a new file
+func runBackupCommand(args []string) error {
+	fs := newCommandFlags("backup")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: chat-server backup <file>")
+	}
+	dest := fs.Arg(0)
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+
+	if err := requireDatabase(); err != nil {
+		return err
+	}
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer closeDB()
+
+	// VACUUM INTO takes a transactionally consistent copy without stopping writers
+	if _, err := db.Exec("VACUUM INTO ?", dest); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %s to %s\n", dbPath, dest)
+	return nil
+}
@@ -0,0 +1,66 @@
+// Package main contains the server's sources of time and randomness, which simulation
+// tests replace with deterministic ones
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"time"
+)
+
+// Clock tells the time and runs scheduled work. Code whose behavior depends on time
+// passing (rate limits, expiry, idle eviction, periodic jobs) goes through clock so
+// tests can move time forward without sleeping.
+type Clock interface {
+	Now() time.Time
+	// Elapsed is how long the clock has been running. Unlike Now it is monotonic: it
+	// doesn't move when the system clock is set, so it is what durations are measured with.
+	Elapsed() time.Duration
+	// AfterFunc calls fn once after d
+	AfterFunc(d time.Duration, fn func())
+	// Every calls fn with the current time every d, until stop is called
+	Every(d time.Duration, fn func(now time.Time)) (stop func())
+}
+
+var (
+	clock Clock = realClock{}
+	// randomSource supplies IDs, tokens and challenges
+	randomSource io.Reader = rand.Reader
+)
+
+// realClock is the wall clock
+type realClock struct{}
+
+// clockStarted carries the monotonic reading realClock.Elapsed counts from
+var clockStarted = time.Now()
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Elapsed() time.Duration { return time.Since(clockStarted) }
+
+func (realClock) AfterFunc(d time.Duration, fn func()) { time.AfterFunc(d, fn) }
+
+func (realClock) Every(d time.Duration, fn func(now time.Time)) (stop func()) {
+	ticker := time.NewTicker(d)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case now := <-ticker.C:
+				fn(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// readRandom fills b from randomSource
+func readRandom(b []byte) error {
+	_, err := io.ReadFull(randomSource, b)
+	return err
+}
@@ -0,0 +1,80 @@
+// Package main contains colored output: each connection has a color setting, and
+// clients that can't show colors get plain text
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// ansiSequence matches the ANSI color codes used in server output
+var ansiSequence = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// stripANSI removes ANSI color codes from text
+func stripANSI(s string) string {
+	return ansiSequence.ReplaceAllString(s, "")
+}
+
+// wrapClientConn applies the server's output settings to a new client connection.
+// Colors are written as ANSI codes everywhere and removed per connection by
+// protoConn, so a client gets plain text as soon as it turns colors off.
+func wrapClientConn(conn net.Conn) net.Conn {
+	pc := &protoConn{Conn: newOutboxConn(newShapedConn(conn))}
+	pc.plain.Store(!colorEnabled)
+	return pc
+}
+
+// setColorOutput turns colors on or off for conn's output
+func setColorOutput(conn net.Conn, on bool) {
+	if pc, ok := conn.(*protoConn); ok {
+		pc.plain.Store(!on)
+	}
+}
+
+// hasColor reports whether conn's output is colored
+func hasColor(conn net.Conn) bool {
+	pc, ok := conn.(*protoConn)
+	return ok && !pc.plain.Load() && !pc.accessible.Load() && !pc.json.Load()
+}
+
+// handleColorCommand handles the /color command. Before login it only changes the
+// connection, so a client can ask for plain text right after connecting; once
+// logged in the choice is also saved for the account's next logins.
+// Format: /color [on|off]
+func handleColorCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) == 1 {
+		state := "off"
+		if hasColor(conn) {
+			state = "on"
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[1;33mColors are %s.\033[0m\n", state)))
+		return
+	}
+	if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+		conn.Write([]byte("\033[1;31mUsage: /color [on|off]\033[0m\n"))
+		return
+	}
+	on := parts[1] == "on"
+	mutex.Lock()
+	username := hub.Account(conn)
+	if s, ok := sessions[conn]; ok {
+		s.color = parts[1]
+	}
+	mutex.Unlock()
+
+	if username != "" {
+		if _, err := db.Exec("UPDATE users SET color = ? WHERE username = ?", parts[1], username); err != nil {
+			conn.Write([]byte("\033[1;31mError saving color setting. Please try again.\033[0m\n"))
+			return
+		}
+	}
+	setColorOutput(conn, on)
+	if on {
+		conn.Write([]byte("\033[1;32mColors are on.\033[0m\n"))
+	} else {
+		conn.Write([]byte("Colors are off.\n"))
+	}
+}
@@ -0,0 +1,198 @@
+// Package main contains the command registry: every slash command is registered here
+// once, with what it needs to run, and /help is generated from it
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Command is a slash command a logged in user can run
+type Command struct {
+	// Name is the command without its slash
+	Name string
+	// Usage is shown by /help and when the command is given too few arguments
+	Usage string
+	// Help describes the command in /help; commands without it aren't listed
+	Help string
+	// MinArgs is how many words must follow the command
+	MinArgs int
+	// Role is the account role needed to run the command, "" for everyone
+	Role string
+	// Run carries out the command; message is the whole line as typed
+	Run func(conn net.Conn, message string)
+}
+
+var (
+	// commands are the registered commands by name, and commandOrder the order
+	// /help lists them in
+	commands     = make(map[string]*Command)
+	commandOrder []*Command
+)
+
+// registerCommand adds a command to the registry. Registering a name twice is a
+// programming error.
+func registerCommand(c *Command) {
+	if _, ok := commands[c.Name]; ok {
+		panic("command /" + c.Name + " registered twice")
+	}
+	commands[c.Name] = c
+	commandOrder = append(commandOrder, c)
+}
+
+// withoutArgs adapts a command handler that ignores its arguments
+func withoutArgs(fn func(conn net.Conn)) func(conn net.Conn, message string) {
+	return func(conn net.Conn, _ string) { fn(conn) }
+}
+
+func init() {
+	for _, c := range []*Command{
+		{Name: "register", Usage: "/register <username> <password>", Help: "Register a new user account", MinArgs: 2,
+			Run: func(conn net.Conn, message string) { handleRegisterCommand(conn, message) }},
+		{Name: "users", Usage: "/users", Help: "List all currently connected users", Run: withoutArgs(handleUsersCommand)},
+		{Name: "stats", Usage: "/stats [server]", Help: "Show your message counts, channels and sessions; with server, uptime, message totals, peak users, connections and channel sizes", Run: handleStatsCommand},
+		{Name: "status", Usage: "/status <status> [duration]", Help: "Set your status; with a duration like 30m it clears itself", MinArgs: 1, Run: handleStatusCommand},
+		{Name: "away", Usage: "/away [message]", Help: "Mark yourself away; private messages get an auto-reply until you next send a message", Run: handleAwayCommand},
+		{Name: "vacation", Usage: "/vacation <date|period> <message> | /vacation off", Help: "Go on vacation: private messages get an auto-reply and mentions are muted until the date", Run: handleVacationCommand},
+		{Name: "whois", Usage: "/whois <name|@account>", Help: "Show a user's account, sessions with their connect time, idle time and channels, and their status or vacation", MinArgs: 1, Run: handleWhoisCommand},
+		{Name: "private", Usage: "/private <name|@account> <message>", Help: "Send a private message by display name or @account", MinArgs: 2, Run: handlePrivateMessage},
+		{Name: "reply", Usage: "/reply <message>", Help: "Reply to the last private message you received", MinArgs: 1, Run: handleReplyCommand},
+		{Name: "join", Usage: "/join <#channel> [password]", Help: "Join a channel (creating it if needed) and talk there", MinArgs: 1, Run: handleJoinCommand},
+		{Name: "leave", Usage: "/leave [#channel]", Help: "Leave a channel (default: the current one)", Run: handleLeaveCommand},
+		{Name: "rooms", Usage: "/rooms", Help: "List active channels with member counts", Run: withoutArgs(handleRoomsCommand)},
+		{Name: "topic", Usage: "/topic [text|off]", Help: "Show the current channel's topic; operators can change it", Run: handleTopicCommand},
+		{Name: "op", Usage: "/op <username>", Help: "Make an account an operator of the current channel", MinArgs: 1, Run: handleOpCommand},
+		{Name: "deop", Usage: "/deop <username>", Help: "Stop an account being an operator of the current channel", MinArgs: 1, Run: handleOpCommand},
+		{Name: "roomkick", Usage: "/roomkick <name> [reason]", Help: "Remove a user from the current channel (operators)", MinArgs: 1, Run: handleRoomKickCommand},
+		{Name: "roommode", Usage: "/roommode [open|invite|password <password>]", Help: "Show the current channel's mode, or make it open, invite-only or password-protected (operators)", Run: handleRoomModeCommand},
+		{Name: "invite", Usage: "/invite <username>", Help: "Invite an account to the current invite-only channel (operators)", MinArgs: 1, Run: handleInviteCommand},
+		{Name: "list", Usage: "/list", Help: "Browse channels grouped by category", Run: withoutArgs(handleListCommand)},
+		{Name: "category", Usage: "/category set|remove <name> [position] | /category place|unplace <#channel> [name] [position]", Help: "Organize the channel directory (admins manage categories, owners place their channels)", MinArgs: 2, Run: handleCategoryCommand},
+		{Name: "send", Usage: "/send <idempotency-key> <message>", Help: "Send a message that is delivered at most once, even if retried", MinArgs: 2, Run: handleSendCommand},
+		{Name: "history", Usage: "/history [limit] [before=<id>|after=<id>] [tag=<tag>] | /history private <user> [limit]", Help: "Show recent messages, paging back with before=<message-id>, or your private conversation with a user", Run: handleHistoryCommand},
+		{Name: "search", Usage: "/search <keyword> [#channel|user] [before=<id>]", Help: "Find messages containing a keyword in your channels, optionally in one channel or from one user", MinArgs: 1, Run: handleSearchCommand},
+		{Name: "proto", Usage: "/proto json|text", Help: "Switch your output to newline-delimited JSON for bots and scripts, or back to text", MinArgs: 1, Run: handleProtoCommand},
+		{Name: "timezone", Usage: "/timezone [zone]", Help: "Show or set the time zone of message timestamps, e.g. Europe/Berlin", Run: handleTimezoneCommand},
+		{Name: "announce-to", Usage: "/announce-to <#a,#b,...> <text>", Help: "Send one announcement to several channels you own (admins: any channel)", MinArgs: 2, Run: handleAnnounceToCommand},
+		{Name: "forward", Usage: "/forward <message-id> <#channel>", Help: "Repost a message from one of your channels to another, crediting its sender", MinArgs: 2, Run: handleForwardCommand},
+		{Name: "interactive", Usage: "/interactive {\"body\": \"...\", \"buttons\": [{\"id\": \"...\", \"label\": \"...\"}]}", Help: "Post a message with buttons; clicks are reported back to you", MinArgs: 1, Run: handleInteractiveCommand},
+		{Name: "click", Usage: "/click <message-id> <button-id>", Help: "Click a button on a message", MinArgs: 2, Run: handleClickCommand},
+		{Name: "react", Usage: "/react <message-id> <emoji>", Help: "Add an emoji reaction to a message; some reactions grant a role", MinArgs: 2, Run: handleReactCommand},
+		{Name: "unreact", Usage: "/unreact <message-id> <emoji>", Help: "Remove your emoji reaction from a message", MinArgs: 2, Run: handleReactCommand},
+		{Name: "reactions", Usage: "/reactions <message-id>", Help: "Show the reactions to a message", MinArgs: 1, Run: handleReactionsCommand},
+		{Name: "reactionrole", Usage: "/reactionrole add <message-id> <emoji> <role> | remove <message-id> <emoji> | list [#channel]", Help: "Make reacting to a message in a channel you own grant a role", MinArgs: 1, Run: handleReactionRoleCommand},
+		{Name: "emojionly", Usage: "/emojionly on|off [#channel]", Help: "Allow only emoji in a channel you own", MinArgs: 1, Run: handleEmojiOnlyCommand},
+		{Name: "inbox", Usage: "/inbox [limit]", Help: "Re-read private messages sent to you while you were offline", Run: handleInboxCommand},
+		{Name: "typing", Usage: "/typing [name|@account]", Help: "Tell your channel, or one user, that you are typing", Run: handleTypingCommand},
+		{Name: "sendfile", Usage: "/sendfile <user> <filename> [size]", Help: "Offer a file to a user; once they accept, upload it with /transfer chunk", MinArgs: 2, Run: handleSendFileCommand},
+		{Name: "transfer", Usage: "/transfer accept|reject|cancel|end <id>", Help: "Answer a file offer, cancel a transfer, or finish sending a file", MinArgs: 2, Run: handleTransferCommand},
+		{Name: "color", Usage: "/color [on|off]", Help: "Turn colored output on or off; the choice is kept for your next logins", Run: handleColorCommand},
+		{Name: "accessible", Usage: "/accessible on|off", Help: "Plain, screen-reader-friendly output that names each message's kind and sender", MinArgs: 1, Run: handleAccessibleCommand},
+		{Name: "quiet", Usage: "/quiet [HH:MM-HH:MM|off]", Help: "Set quiet hours: only priority messages and friends' private messages arrive, the rest is counted for later", Run: handleQuietCommand},
+		{Name: "display", Usage: "/display [compact|normal|verbose]", Help: "Show channel messages without timestamps and channels, or with their channel and ID too", Run: handleDisplayCommand},
+		{Name: "emoji", Usage: "/emoji list|raw|expand", Help: "List emoji shortcodes like :smile:, or choose whether you see them as typed or as emoji", MinArgs: 1, Run: handleEmojiCommand},
+		{Name: "sessions", Usage: "/sessions | /sessions kill <id>|others", Help: "List the devices logged in with your account, or log some of them out", Run: handleSessionsCommand},
+		{Name: "resume", Usage: "/resume [token]", Help: "Get a reconnect token, or catch up on what you missed since you were disconnected", Run: handleResumeCommand},
+		{Name: "friend", Usage: "/friend add|remove <account> | /friend list", Help: "Manage your friends and get told when they come online, go offline, or change status", MinArgs: 1, Run: handleFriendCommand},
+		{Name: "passwd", Usage: "/passwd <old> <new>", Help: "Change your password", MinArgs: 2, Run: handlePasswdCommand},
+		{Name: "recoverycodes", Usage: "/recoverycodes | /recoverycodes new", Help: "Count your unused recovery codes, or replace them with new ones", Run: handleRecoveryCodesCommand},
+		{Name: "deleteaccount", Usage: "/deleteaccount <password>", Help: "Delete your account and its messages (asks for confirmation)", MinArgs: 1, Run: handleDeleteAccountCommand},
+		{Name: "members", Usage: "/members [limit] [after=<name>]", Help: "List channel members one page at a time", Run: handleMembersCommand},
+		{Name: "announce", Usage: "/announce [-pin] <text> | /announce unpin <id>", Help: "Broadcast a highlighted announcement, optionally pinned for later logins", MinArgs: 1, Role: roleAdmin, Run: handleAnnounceCommand},
+		{Name: "motd", Usage: "/motd | /motd set <text> | /motd clear", Help: "Show the message of the day; admins can change it", Run: handleMOTDCommand},
+		{Name: "priority", Usage: "/priority <message>", Help: "Send an urgent notice that bypasses everyone's filters", MinArgs: 1, Role: roleAdmin, Run: handlePriorityCommand},
+		{Name: "tag", Usage: "/tag <tag>: <message>", Help: "Send a message tagged so others can follow or mute it", MinArgs: 1, Run: handleTagCommand},
+		{Name: "tags", Usage: "/tags [follow|mute|clear <tag>]", Help: "Show or change which tagged messages you see", Run: handleTagsCommand},
+		{Name: "filter", Usage: "/filter bots on|off|default", Help: "Show or hide messages from bot accounts", Run: handleFilterCommand},
+		{Name: "integrations", Usage: "/integrations list|add webhook <url>|remove <id> [#channel]", Help: "List a channel's integrations; its owner can post its messages to a webhook", Run: handleIntegrationsCommand},
+		{Name: "channelfilter", Usage: "/channelfilter <#channel> bots on|off|default", Help: "Set whether a channel shows bot messages by default", MinArgs: 3, Role: roleAdmin, Run: handleChannelFilterCommand},
+		{Name: "complete", Usage: "/complete <prefix>", Help: "List online names (or #channels) starting with prefix, for tab-completion", MinArgs: 1, Run: handleCompleteCommand},
+		{Name: "rules", Usage: "/rules", Help: "Show the server rules", Run: withoutArgs(sendRules)},
+		{Name: "accept", Usage: "/accept", Help: "Accept the server rules", Run: func(conn net.Conn, _ string) { handleAcceptCommand(conn) }},
+		{Name: "quota", Usage: "/quota [top]", Help: "Show your storage usage (admins: top consumers)", Run: handleQuotaCommand},
+		{Name: "digest", Usage: "/digest [#channel] [period]", Help: "Summarize a channel's recent activity, e.g. /digest #general 6h", Run: handleDigestCommand},
+		{Name: "analytics", Usage: "/analytics [channel] [period]", Help: "Show activity analytics, e.g. /analytics #general 7d", Role: roleAdmin, Run: handleAnalyticsCommand},
+		{Name: "restrict", Usage: "/restrict <#channel> [verified] [role:<role>] [age:<period>] | off", Help: "Restrict who may join a channel", MinArgs: 1, Role: roleAdmin, Run: handleRestrictCommand},
+		{Name: "verify", Usage: "/verify <username> [off]", Help: "Mark an account as verified", MinArgs: 1, Role: roleAdmin, Run: handleVerifyCommand},
+		{Name: "nick", Usage: "/nick <newname>", Help: "Change your display name; your channels are told, and /whois shows your earlier names", MinArgs: 1, Run: handleNickCommand},
+		{Name: "bookmark", Usage: "/bookmark <message-id> [note]", Help: "Bookmark a message for yourself", MinArgs: 1, Run: handleBookmarkCommand},
+		{Name: "unbookmark", Usage: "/unbookmark <message-id>", Help: "Remove one of your bookmarks", MinArgs: 1, Run: handleUnbookmarkCommand},
+		{Name: "bookmarks", Usage: "/bookmarks [number|message-id]", Help: "List your bookmarks, or show one with the messages around it", Run: handleBookmarksCommand},
+		{Name: "tictactoe", Usage: "/tictactoe <name|@account> [#channel]", Help: "Start a game of tic-tac-toe, privately or in a channel you are in", MinArgs: 1, Run: handleNewGameCommand},
+		{Name: "move", Usage: "/move [game-id] <move>", Help: "Make your move; the game ID is only needed if you are in several games", MinArgs: 1, Run: handleMoveCommand},
+		{Name: "games", Usage: "/games [game-id]", Help: "List your games in progress, or show one", Run: handleGamesCommand},
+		{Name: "resign", Usage: "/resign [game-id]", Help: "Give up a game", Run: handleResignCommand},
+		{Name: "exit", Usage: "/exit", Help: "Exit the chat server", Run: withoutArgs(handleExitCommand)},
+		{Name: "help", Usage: "/help", Help: "Display this help message", Run: withoutArgs(handleHelpCommand)},
+		// Keepalive from clients that stay connected while idle; reading it already
+		// counted as activity
+		{Name: "pong", Run: func(net.Conn, string) {}},
+	} {
+		registerCommand(c)
+	}
+}
+
+// hasRole reports whether the account logged in on conn has role. Admins named with
+// -admin count as admins whatever their stored role.
+func hasRole(conn net.Conn, role string) bool {
+	if role == roleAdmin {
+		return isAdmin(conn)
+	}
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+	stored, err := getUserRole(username)
+	return username != "" && err == nil && stored == role
+}
+
+// handleHelpCommand lists the registered commands and the enabled plugins
+func handleHelpCommand(conn net.Conn) {
+	var help strings.Builder
+	help.WriteString("\033[1;36mAvailable Commands:\033[0m\n\n")
+	for _, c := range commandOrder {
+		if c.Help == "" {
+			continue
+		}
+		text := c.Help
+		if c.Role != "" {
+			text += " (" + c.Role + " only)"
+		}
+		help.WriteString(fmt.Sprintf("\033[1;33m%s\033[0m\n    %s\n\n", c.Usage, text))
+	}
+	help.WriteString(pluginHelp())
+	help.WriteString("\033[1;36mRegular Messages:\033[0m\n" +
+		"    Type any message without a command to send it to your current channel\n")
+	conn.Write([]byte(help.String()))
+}
+
+// handleCommand runs message if it is a command, reporting false if it is a chat
+// message. Unknown commands, missing arguments and missing roles are answered with
+// an error.
+func handleCommand(conn net.Conn, message string) bool {
+	if !strings.HasPrefix(message, "/") {
+		return false
+	}
+	fields := strings.Fields(message)
+	// Only the command name is logged, never its arguments, which may be passwords
+	connLogger(conn).Debug("command", "command", fields[0])
+
+	c, ok := commands[strings.TrimPrefix(fields[0], "/")]
+	if !ok {
+		if handlePluginCommand(conn, message) {
+			return true
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mUnknown command %s. Type /help for a list of commands.\033[0m\n", fields[0])))
+		return true
+	}
+	if c.Role != "" && !hasRole(conn, c.Role) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mOnly %ss can use /%s.\033[0m\n", c.Role, c.Name)))
+		return true
+	}
+	if len(fields)-1 < c.MinArgs {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mUsage: %s\033[0m\n", c.Usage)))
+		return true
+	}
+	c.Run(conn, message)
+	return true
+}
@@ -0,0 +1,58 @@
+// Package main contains server-side completion of nicknames and channel names
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// maxCompletions caps how many candidates /complete returns
+const maxCompletions = 20
+
+// knownChannels returns the names of every active channel
+func knownChannels() []string {
+	var names []string
+	for _, r := range listRooms() {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+// completeNames returns the candidates starting with prefix, ignoring case, sorted
+func completeNames(prefix string, candidates []string) []string {
+	lower := strings.ToLower(prefix)
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(strings.ToLower(c), lower) {
+			matches = append(matches, c)
+		}
+	}
+	sort.Strings(matches)
+	if len(matches) > maxCompletions {
+		matches = matches[:maxCompletions]
+	}
+	return matches
+}
+
+// handleCompleteCommand handles the /complete command
+// Format: /complete <prefix>; a prefix starting with # completes channel names.
+// The reply is a single line so clients can parse it for tab-completion:
+// "COMPLETE <prefix> <candidate> <candidate> ..."
+func handleCompleteCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 2 {
+		conn.Write([]byte("\033[1;31mUsage: /complete <prefix>\033[0m\n"))
+		return
+	}
+	prefix := parts[1]
+
+	var matches []string
+	if strings.HasPrefix(prefix, "#") {
+		matches = completeNames(prefix, knownChannels())
+	} else {
+		matches = completeNames(prefix, connectedUsers())
+	}
+	conn.Write([]byte(fmt.Sprintf("COMPLETE %s %s\n", prefix, strings.Join(matches, " "))))
+}
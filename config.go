@@ -0,0 +1,138 @@
+// Package main contains server settings and the optional JSON configuration file
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	// configPath is a JSON file whose keys give default values for command-line flags
+	configPath = ""
+	// listenAddr is the address of the TCP chat listener
+	listenAddr = ":8080"
+	// maxUsernameLength and maxPasswordLength limit account credentials
+	maxUsernameLength = 10
+	maxPasswordLength = 10
+	// minDisplayNameLength and maxDisplayNameLength bound display names in characters,
+	// separately from usernames
+	minDisplayNameLength = 2
+	maxDisplayNameLength = 20
+	// maxMessageLength limits chat and private messages in bytes (0 for unlimited)
+	maxMessageLength = 0
+	// registerLimit is how many registrations one IP may attempt per registerWindow
+	registerLimit  = 3
+	registerWindow = time.Minute
+	// colorEnabled sends ANSI colors to clients that haven't chosen with /color; when
+	// off they receive plain text. Setting NO_COLOR (https://no-color.org) turns it
+	// off by default.
+	colorEnabled = os.Getenv("NO_COLOR") == ""
+
+	// serveFlags are the flags of the running server, kept so -config can be reloaded
+	serveFlags *flag.FlagSet
+	// commandLineFlags are the flags given on the command line, which the config
+	// file never overrides
+	commandLineFlags = make(map[string]bool)
+)
+
+// reloadableFlags are the settings a running server picks up when -config is reloaded.
+// Anything that sizes a resource or starts a background job at startup needs a restart.
+var reloadableFlags = []string{
+	"max-message-length", "min-display-name-length", "max-display-name-length", "register-limit", "register-window",
+	"flood-messages", "flood-window", "flood-mute", "slow-mode-interval",
+	"max-sessions", "idle-evict", "presence-window", "bot-traffic", "log-level",
+}
+
+// errNoConfigFile is returned when a reload is asked for without -config
+var errNoConfigFile = errors.New("the server was started without -config")
+
+// loadConfigFile reads a JSON object of flag names to values
+func loadConfigFile(path string) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return values, nil
+}
+
+// applyConfig sets every flag of fs named in values, except flags already given on
+// the command line, which win over the file. Keys for flags this command doesn't
+// have are ignored, so one file can serve every subcommand.
+func applyConfig(fs *flag.FlagSet, values map[string]interface{}) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for name, value := range values {
+		if explicit[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		// Lists set repeatable flags such as -admin once per element
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+		for _, item := range items {
+			if err := fs.Set(name, fmt.Sprint(item)); err != nil {
+				return fmt.Errorf("config %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseCommandFlags parses the command line, then fills in the remaining flags from -config
+func parseCommandFlags(fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	fs.Visit(func(f *flag.Flag) { commandLineFlags[f.Name] = true })
+	if configPath == "" {
+		return nil
+	}
+	values, err := loadConfigFile(configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %v", err)
+	}
+	return applyConfig(fs, values)
+}
+
+// reloadConfig rereads -config and applies the reloadable settings it names, returning
+// the ones that changed. Settings removed from the file keep their current value.
+func reloadConfig() ([]string, error) {
+	if configPath == "" || serveFlags == nil {
+		return nil, errNoConfigFile
+	}
+	values, err := loadConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	changed := []string{}
+	for _, name := range reloadableFlags {
+		value, ok := values[name]
+		f := serveFlags.Lookup(name)
+		if !ok || f == nil || commandLineFlags[name] {
+			continue
+		}
+		old := f.Value.String()
+		if err := f.Value.Set(fmt.Sprint(value)); err != nil {
+			return changed, fmt.Errorf("config %q: %v", name, err)
+		}
+		if f.Value.String() != old {
+			changed = append(changed, name)
+		}
+	}
+	return changed, setLogLevel(logLevel)
+}
@@ -0,0 +1,141 @@
+// Package main contains announcements cross-posted to several channels at once
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// maxCrosspostChannels caps the channels one announcement can go to
+const maxCrosspostChannels = 10
+
+// parseChannelList splits "#a,#b,#c" into distinct, valid channel names
+func parseChannelList(list string) ([]string, error) {
+	var channels []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !validRoomName.MatchString(name) {
+			return nil, fmt.Errorf("%s is not a channel name", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			channels = append(channels, name)
+		}
+	}
+	if len(channels) == 0 || len(channels) > maxCrosspostChannels {
+		return nil, fmt.Errorf("give 1 to %d channels", maxCrosspostChannels)
+	}
+	return channels, nil
+}
+
+// saveAnnouncement stores an announcement once, with a reference to each channel it
+// went to
+func saveAnnouncement(id, sender, body string, channels []string, sent time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stored, err := sealBody(body)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO announcements (announcement_id, sender, body, created_at) VALUES (?, ?, ?, ?)",
+		id, sender, stored, sent); err != nil {
+		return err
+	}
+	for _, channel := range channels {
+		if _, err := tx.Exec("INSERT INTO announcement_channels (announcement_id, channel) VALUES (?, ?)", id, channel); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handleAnnounceToCommand handles the /announce-to command, sending one announcement
+// to several channels. Admins may announce anywhere; other users only to channels
+// they own.
+// Format: /announce-to <#a,#b,...> <text>
+func handleAnnounceToCommand(conn net.Conn, message string) {
+	parts := strings.SplitN(message, " ", 3)
+	if len(parts) != 3 || strings.TrimSpace(parts[2]) == "" {
+		conn.Write([]byte("\033[1;31mUsage: /announce-to <#a,#b,...> <text>\033[0m\n"))
+		return
+	}
+	channels, err := parseChannelList(parts[1])
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mInvalid channels: %v.\033[0m\n", err)))
+		return
+	}
+	text := strings.TrimSpace(parts[2])
+	if !checkMessageLength(conn, text) {
+		return
+	}
+
+	mutex.Lock()
+	username, name := hub.Account(conn), hub.Name(conn)
+	mutex.Unlock()
+	for _, channel := range channels {
+		if !canManageChannel(username, channel) {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mYou can only announce to channels you own; %s isn't yours.\033[0m\n", channel)))
+			return
+		}
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError sending announcement. Please try again.\033[0m\n"))
+		return
+	}
+	sent := clock.Now().UTC()
+	if err := saveAnnouncement(id, username, text, channels, sent); err != nil {
+		// Keep the announcement going out even if storing it fails
+		connLogger(conn).Error("saving announcement", "err", err)
+	}
+
+	bus.Publish(OutgoingMessage{
+		channel: channels[0],
+		alsoTo:  channels[1:],
+		text:    systemNotice("1;35", fmt.Sprintf("[Announcement to %s] %s: %s", strings.Join(channels, ", "), name, text)),
+		sent:    sent,
+		id:      id,
+		from:    name,
+		body:    text,
+	})
+	logModeration(username, "announce", strings.Join(channels, ","), text)
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mAnnounced to %s.\033[0m\n", strings.Join(channels, ", "))))
+}
+
+// deliverCrosspostLocked delivers a cross-posted announcement to the members and
+// spectators of all its channels, once each. Announcements aren't subject to bot or
+// tag filters. Callers must hold mutex.
+func deliverCrosspostLocked(msg OutgoingMessage, ev WireEvent) {
+	targets := make(map[string]bool)
+	for _, channel := range append([]string{msg.channel}, msg.alsoTo...) {
+		targets[channel] = true
+	}
+	delivered := make(map[net.Conn]bool)
+	for channel := range targets {
+		for conn := range rooms[channel] {
+			if !delivered[conn] {
+				delivered[conn] = true
+				if holdChannelMessageLocked(sessionForLocked(conn), msg) {
+					continue
+				}
+				writeEvent(conn, ev, messagePrefix(sessionForLocked(conn), msg, false)+msg.text)
+			}
+		}
+	}
+	for conn, channel := range spectators {
+		if targets[channel] {
+			writeEvent(conn, ev, timestamp(nil, msg.sent)+msg.text)
+		}
+	}
+}
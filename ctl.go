@@ -0,0 +1,229 @@
+// Package main contains the `ctl` subcommand that drives a running server through the admin API
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ctlUsage documents the commands understood by `chat-server ctl`
+const ctlUsage = `usage: chat-server ctl [-addr host:port] [-token secret] [-json] <command>
+
+Commands:
+  users                    List connected users and channels
+  connections              List connections with their account, channel and address
+  logs [limit]             Show the most recent server log records
+  reload                   Reread the server's -config file
+  moderation               Show recent moderation actions
+  metrics                  Show server counters such as write failures
+  kick <user> [reason]     Disconnect a user by display name
+  ban <user> [reason]      Ban an account
+  unban <user>             Lift a ban
+  announce [-pin] <text>   Broadcast a system announcement, optionally pinned for later logins
+  priority <text>          Broadcast an urgent notice that bypasses message filters`
+
+// runCtlCommand runs one admin command against a live server
+func runCtlCommand(args []string) error {
+	fs := newCommandFlags("ctl")
+	addr := fs.String("addr", envOr("CHAT_ADMIN_ADDR", "127.0.0.1:8081"), "admin API address (or CHAT_ADMIN_ADDR)")
+	token := fs.String("token", os.Getenv("CHAT_ADMIN_TOKEN"), "admin API token (or CHAT_ADMIN_TOKEN)")
+	jsonOutput := fs.Bool("json", false, "print the raw JSON response")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		return errors.New(ctlUsage)
+	}
+
+	var method, path string
+	var body interface{}
+	switch args[0] {
+	case "users":
+		method, path = "GET", "/api/status"
+	case "connections":
+		method, path = "GET", "/api/connections"
+	case "logs":
+		if len(args) > 2 {
+			return errors.New("usage: chat-server ctl logs [limit]")
+		}
+		method, path = "GET", "/api/logs"
+		if len(args) == 2 {
+			path += "?limit=" + url.QueryEscape(args[1])
+		}
+	case "reload":
+		method, path = "POST", "/api/reload"
+	case "moderation":
+		method, path = "GET", "/api/moderation"
+	case "metrics":
+		method, path = "GET", "/api/metrics"
+	case "kick", "ban":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: chat-server ctl %s <user> [reason]", args[0])
+		}
+		method, path = "POST", "/api/"+args[0]
+		body = moderationRequest{User: args[1], Reason: strings.Join(args[2:], " ")}
+	case "unban":
+		if len(args) != 2 {
+			return errors.New("usage: chat-server ctl unban <user>")
+		}
+		method, path = "POST", "/api/unban"
+		body = moderationRequest{User: args[1]}
+	case "announce":
+		pin := len(args) > 1 && args[1] == "-pin"
+		if pin {
+			args = args[1:]
+		}
+		if len(args) < 2 {
+			return errors.New("usage: chat-server ctl announce [-pin] <text>")
+		}
+		method, path = "POST", "/api/announce"
+		body = moderationRequest{Text: strings.Join(args[1:], " "), Pin: pin}
+	case "priority":
+		if len(args) < 2 {
+			return errors.New("usage: chat-server ctl priority <text>")
+		}
+		method, path = "POST", "/api/announce"
+		body = moderationRequest{Text: strings.Join(args[1:], " "), Priority: true}
+	default:
+		return fmt.Errorf("unknown ctl command %q\n%s", args[0], ctlUsage)
+	}
+
+	data, err := callAdminAPI(*addr, *token, method, path, body)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		fmt.Println(strings.TrimSpace(string(data)))
+		return nil
+	}
+	return printCtlResult(args[0], data)
+}
+
+// envOr returns an environment variable, or def when it is unset
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// callAdminAPI sends one request to the admin API and returns the response body
+func callAdminAPI(addr, token, method, path string, body interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, "http://"+addr+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr map[string]string
+		if json.Unmarshal(data, &apiErr) == nil && apiErr["error"] != "" {
+			return nil, errors.New(apiErr["error"])
+		}
+		return nil, fmt.Errorf("admin API returned %s", resp.Status)
+	}
+	return data, nil
+}
+
+// printCtlResult renders an admin API response for humans
+func printCtlResult(command string, data []byte) error {
+	switch command {
+	case "users":
+		var status ServerStatus
+		if err := json.Unmarshal(data, &status); err != nil {
+			return err
+		}
+		fmt.Printf("%d connected\n", status.Connections)
+		for _, name := range status.Users {
+			fmt.Println("  " + name)
+		}
+		for _, ch := range status.Channels {
+			fmt.Printf("%s (%d members)\n", ch.Name, ch.Members)
+		}
+	case "connections":
+		var list []ConnectionInfo
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		for _, c := range list {
+			fmt.Printf("%-5d %-12s %-12s %-12s %s\n", c.ID, c.Name, c.Account, c.Room, c.Addr)
+		}
+	case "logs":
+		var records []string
+		if err := json.Unmarshal(data, &records); err != nil {
+			return err
+		}
+		for _, record := range records {
+			fmt.Println(record)
+		}
+	case "reload":
+		var result ReloadResult
+		if err := json.Unmarshal(data, &result); err != nil {
+			return err
+		}
+		if len(result.Changed) == 0 {
+			fmt.Println("reloaded, nothing changed")
+		} else {
+			fmt.Println("reloaded, changed: " + strings.Join(result.Changed, ", "))
+		}
+	case "moderation":
+		var actions []ModerationAction
+		if err := json.Unmarshal(data, &actions); err != nil {
+			return err
+		}
+		for _, a := range actions {
+			fmt.Printf("%s  %-10s %-9s %-10s %s\n", a.CreatedAt.Local().Format("2006-01-02 15:04"), a.Actor, a.Action, a.Target, a.Reason)
+		}
+	case "metrics":
+		var snapshot map[string]int64
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return err
+		}
+		names := make([]string, 0, len(snapshot))
+		for name := range snapshot {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-20s %d\n", name, snapshot[name])
+		}
+	default:
+		var result map[string]string
+		if err := json.Unmarshal(data, &result); err != nil {
+			return err
+		}
+		fmt.Println(result["status"])
+	}
+	return nil
+}
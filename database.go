@@ -8,14 +8,32 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var db *sql.DB
+var (
+	db *sql.DB
+	// dbPath is the SQLite database file
+	dbPath = "./chat.db"
+)
 
 // initDB initializes the database and creates necessary tables
 func initDB() error {
 	var err error
-	db, err = sql.Open("sqlite3", "./chat.db")
+	resetUserCache()
+	if err := loadStorageKey(); err != nil {
+		return fmt.Errorf("loading storage key: %v", err)
+	}
+	db, err = openDatabase(dbPath)
 	if err != nil {
-		return fmt.Errorf("error opening database: %v", err)
+		return err
+	}
+	messageSearchIndexed = createSearchIndex(db)
+	return nil
+}
+
+// openDatabase opens a SQLite database file and creates necessary tables
+func openDatabase(path string) (*sql.DB, error) {
+	sqlDB, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
 	}
 
 	// Create users table if it doesn't exist
@@ -25,15 +43,377 @@ func initDB() error {
 		password TEXT NOT NULL,
 		status TEXT DEFAULT ''
 	);
+	CREATE TABLE IF NOT EXISTS storage_usage (
+		username TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (username, kind)
+	);
+	CREATE TABLE IF NOT EXISTS channel_bot_settings (
+		channel TEXT PRIMARY KEY,
+		show_bots INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS tag_filters (
+		username TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		mode TEXT NOT NULL,
+		PRIMARY KEY (username, channel, tag)
+	);
+	CREATE TABLE IF NOT EXISTS channel_restrictions (
+		channel TEXT PRIMARY KEY,
+		require_verified INTEGER NOT NULL DEFAULT 0,
+		required_role TEXT NOT NULL DEFAULT '',
+		min_account_age INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS friends (
+		username TEXT NOT NULL,
+		friend TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (username, friend)
+	);
+	CREATE TABLE IF NOT EXISTS user_routes (
+		username TEXT NOT NULL,
+		instance TEXT NOT NULL,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (username, instance)
+	);
+	CREATE TABLE IF NOT EXISTS routed_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		instance TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		sender_account TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		body TEXT NOT NULL,
+		store BOOLEAN NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS channel_owners (
+		channel TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS channel_integrations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		channel TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		target TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS categories (
+		name TEXT PRIMARY KEY,
+		position INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS channel_layout (
+		channel TEXT PRIMARY KEY,
+		category TEXT NOT NULL,
+		position INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS motd (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		text TEXT NOT NULL,
+		set_by TEXT NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS pinned_announcements (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		text TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS announcements (
+		announcement_id TEXT PRIMARY KEY,
+		sender TEXT NOT NULL,
+		body TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS announcement_channels (
+		announcement_id TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		PRIMARY KEY (announcement_id, channel)
+	);
+	CREATE TABLE IF NOT EXISTS event_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		data TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS reconnect_tokens (
+		token TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		instance TEXT NOT NULL,
+		positions TEXT NOT NULL,
+		room TEXT NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		used_at DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS idx_recovery_codes_username ON recovery_codes (username);
+	CREATE TABLE IF NOT EXISTS reactions (
+		message_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		emoji TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (message_id, username, emoji)
+	);
+	CREATE TABLE IF NOT EXISTS emoji_only_channels (
+		channel TEXT PRIMARY KEY,
+		set_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS reaction_roles (
+		message_id TEXT NOT NULL,
+		emoji TEXT NOT NULL,
+		role TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (message_id, emoji)
+	);
+	CREATE TABLE IF NOT EXISTS user_roles (
+		username TEXT NOT NULL,
+		role TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		granted_at DATETIME NOT NULL,
+		PRIMARY KEY (username, role)
+	);
+	CREATE TABLE IF NOT EXISTS room_settings (
+		channel TEXT PRIMARY KEY,
+		topic TEXT NOT NULL DEFAULT '',
+		topic_set_by TEXT NOT NULL DEFAULT '',
+		topic_set_at DATETIME,
+		invite_only INTEGER NOT NULL DEFAULT 0,
+		password_hash TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS room_operators (
+		channel TEXT NOT NULL,
+		username TEXT NOT NULL,
+		granted_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (channel, username)
+	);
+	CREATE TABLE IF NOT EXISTS room_invites (
+		channel TEXT NOT NULL,
+		username TEXT NOT NULL,
+		invited_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (channel, username)
+	);
+	CREATE TABLE IF NOT EXISTS leader_lease (
+		name TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS session_snapshots (
+		username TEXT PRIMARY KEY,
+		rooms TEXT NOT NULL,
+		room TEXT NOT NULL,
+		saved_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS telemetry (
+		recorded_at DATETIME NOT NULL,
+		peak_users INTEGER NOT NULL,
+		current_users INTEGER NOT NULL,
+		messages INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sender TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		body TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_messages_channel_time ON messages (channel, created_at);
+	CREATE TABLE IF NOT EXISTS bans (
+		username TEXT PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		banned_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS nickname_history (
+		username TEXT NOT NULL,
+		name TEXT NOT NULL,
+		changed_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS bookmarks (
+		username TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (username, message_id)
+	);
+	CREATE TABLE IF NOT EXISTS games (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		channel TEXT NOT NULL DEFAULT '',
+		player1 TEXT NOT NULL,
+		player2 TEXT NOT NULL,
+		state TEXT NOT NULL,
+		turn INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		winner TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS moderation_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		reason TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
 	`
-	_, err = db.Exec(createTableSQL)
+	_, err = sqlDB.Exec(createTableSQL)
 	if err != nil {
-		return fmt.Errorf("error creating table: %v", err)
+		sqlDB.Close()
+		return nil, fmt.Errorf("error creating table: %v", err)
 	}
 
+	// Add columns introduced after the original users table
+	userColumns := []struct{ name, decl string }{
+		{"disabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"sso_subject", "TEXT"},
+		{"role", "TEXT NOT NULL DEFAULT 'user'"},
+		{"rules_version", "TEXT"},
+		{"rules_accepted_at", "DATETIME"},
+		{"verified", "INTEGER NOT NULL DEFAULT 0"},
+		{"created_at", "DATETIME"},
+		{"onboarded_at", "DATETIME"},
+		{"user_id", "TEXT"},
+		{"filter_bots", "TEXT"},
+		{"timezone", "TEXT"},
+		{"raw_emoji", "INTEGER NOT NULL DEFAULT 0"},
+		{"accessible", "INTEGER NOT NULL DEFAULT 0"},
+		{"display", "TEXT"},
+		{"quiet_hours", "TEXT"},
+		{"last_seen_at", "DATETIME"},
+		{"away_message", "TEXT"},
+		{"status_expires_at", "DATETIME"},
+		{"vacation_until", "DATETIME"},
+		{"color", "TEXT"},
+	}
+	for _, col := range userColumns {
+		if err := addColumnIfMissing(sqlDB, "users", col.name, col.decl); err != nil {
+			sqlDB.Close()
+			return nil, fmt.Errorf("error migrating users table: %v", err)
+		}
+	}
+	// Add columns introduced after the original messages table
+	messageColumns := []struct{ name, decl string }{
+		{"message_id", "TEXT"},
+		{"idempotency_key", "TEXT"},
+		{"seq", "INTEGER"},
+		{"tag", "TEXT"},
+		{"recipient", "TEXT"},
+		{"offline", "INTEGER NOT NULL DEFAULT 0"},
+		{"delivered_at", "DATETIME"},
+	}
+	for _, col := range messageColumns {
+		if err := addColumnIfMissing(sqlDB, "messages", col.name, col.decl); err != nil {
+			sqlDB.Close()
+			return nil, fmt.Errorf("error migrating messages table: %v", err)
+		}
+	}
+	// Idempotency keys are unique per sender; older databases may hold duplicates,
+	// of which the latest keeps its key
+	if _, err := sqlDB.Exec(`UPDATE messages SET idempotency_key = NULL WHERE idempotency_key IS NOT NULL
+			AND id NOT IN (SELECT MAX(id) FROM messages WHERE idempotency_key IS NOT NULL GROUP BY sender, idempotency_key);
+		DROP INDEX IF EXISTS idx_messages_idempotency;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_idempotency_key ON messages (sender, idempotency_key) WHERE idempotency_key IS NOT NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_channel_seq ON messages (channel, seq);
+		CREATE INDEX IF NOT EXISTS idx_messages_channel_tag ON messages (channel, tag, seq);
+		CREATE INDEX IF NOT EXISTS idx_messages_private ON messages (sender, recipient, id);
+		CREATE INDEX IF NOT EXISTS idx_messages_offline ON messages (recipient, offline, id)`); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("error migrating messages table: %v", err)
+	}
+
+	// Events name the account behind them so they can be removed with the account
+	if err := addColumnIfMissing(sqlDB, "event_log", "account", "TEXT"); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("error migrating event_log table: %v", err)
+	}
+	if _, err := sqlDB.Exec("CREATE INDEX IF NOT EXISTS idx_event_log_account ON event_log (account)"); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("error migrating event_log table: %v", err)
+	}
+
+	if err := backfillUserIDs(sqlDB); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("error assigning user IDs: %v", err)
+	}
+
+	return sqlDB, nil
+}
+
+// backfillUserIDs gives a stable ID to accounts created before IDs existed
+func backfillUserIDs(sqlDB *sql.DB) error {
+	if _, err := sqlDB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_user_id ON users (user_id)"); err != nil {
+		return err
+	}
+
+	rows, err := sqlDB.Query("SELECT username FROM users WHERE user_id IS NULL")
+	if err != nil {
+		return err
+	}
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			rows.Close()
+			return err
+		}
+		usernames = append(usernames, username)
+	}
+	rows.Close()
+
+	for _, username := range usernames {
+		id, err := newUUID()
+		if err != nil {
+			return err
+		}
+		if _, err := sqlDB.Exec("UPDATE users SET user_id = ? WHERE username = ?", id, username); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// addColumnIfMissing adds a column to an existing table unless it is already there
+func addColumnIfMissing(sqlDB *sql.DB, table, column, decl string) error {
+	rows, err := sqlDB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = sqlDB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err
+}
+
 // saveUser saves a new user to the database
 func saveUser(username, password string) error {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -41,10 +421,109 @@ func saveUser(username, password string) error {
 		return err
 	}
 
-	_, err = db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", username, string(hashedPassword))
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO users (username, password, created_at, user_id) VALUES (?, ?, ?, ?)", username, string(hashedPassword), clock.Now().UTC(), id)
+	invalidateUser(username)
 	return err
 }
 
+// saveUserWithHash saves a new user whose password is already bcrypt-hashed
+func saveUserWithHash(username, hashedPassword, role string) error {
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO users (username, password, role, created_at, user_id) VALUES (?, ?, ?, ?, ?)", username, hashedPassword, role, clock.Now().UTC(), id)
+	invalidateUser(username)
+	return err
+}
+
+// setUserRole changes a user's role
+func setUserRole(username, role string) error {
+	_, err := db.Exec("UPDATE users SET role = ? WHERE username = ?", role, username)
+	invalidateUser(username)
+	return err
+}
+
+// updateUserPassword replaces a user's password with a new bcrypt hash
+func updateUserPassword(username, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE users SET password = ? WHERE username = ?", string(hashedPassword), username)
+	return err
+}
+
+// deleteUser removes an account along with its messages and announcements, private
+// messages sent to it (giving their bytes back to the senders' quota), friendships, filters, storage usage, session snapshot,
+// recovery codes, reactions, bookmarks, earlier display names, granted roles, the
+// games it played, and its cluster routes and routed messages. Bans and the
+// moderation log are kept.
+func deleteUser(username string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Private messages sent to the account stop counting toward their senders' quota
+	if err := releaseMessagesTx(tx, "recipient = ? AND sender != ?", username, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM messages WHERE sender = ? OR recipient = ?", username, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM friends WHERE username = ? OR friend = ?", username, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM announcement_channels WHERE announcement_id IN (SELECT announcement_id FROM announcements WHERE sender = ?)", username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM announcements WHERE sender = ?", username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM routed_messages WHERE recipient = ? OR sender_account = ?", username, username); err != nil {
+		return err
+	}
+	// Its games would otherwise count toward opponents' limit and pass to whoever
+	// registers the name next
+	if _, err := tx.Exec("DELETE FROM games WHERE player1 = ? OR player2 = ?", username, username); err != nil {
+		return err
+	}
+	if err := deleteLoggedEventsTx(tx, username); err != nil {
+		return err
+	}
+	// Webhooks the account set up would keep sending channel traffic to its endpoints
+	if _, err := tx.Exec("DELETE FROM channel_integrations WHERE created_by = ?", username); err != nil {
+		return err
+	}
+	for _, table := range []string{"tag_filters", "storage_usage", "session_snapshots", "reconnect_tokens", "channel_owners", "recovery_codes", "reactions", "bookmarks", "nickname_history", "user_roles", "room_operators", "room_invites", "user_routes", "users"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE username = ?", username); err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	invalidateUser(username)
+	if err != nil {
+		return err
+	}
+	return loadIntegrations()
+}
+
+// getUserRole retrieves a user's role
+func getUserRole(username string) (string, error) {
+	user, err := lookupUser(username)
+	if err == nil && !user.exists {
+		err = sql.ErrNoRows
+	}
+	return user.role, err
+}
+
 // verifyUser checks if the username and password match
 func verifyUser(username, password string) bool {
 	var hashedPassword string
@@ -57,24 +536,86 @@ func verifyUser(username, password string) bool {
 	return err == nil
 }
 
+// isUserDisabled reports whether an account has been disabled
+func isUserDisabled(username string) bool {
+	user, err := lookupUser(username)
+	return err == nil && user.disabled
+}
+
+// setUserDisabled enables or disables an account
+func setUserDisabled(username string, disabled bool) error {
+	res, err := db.Exec("UPDATE users SET disabled = ? WHERE username = ?", disabled, username)
+	invalidateUser(username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// setUserSSOSubject maps an account to an identity from an external SSO provider
+func setUserSSOSubject(username, subject string) error {
+	_, err := db.Exec("UPDATE users SET sso_subject = ? WHERE username = ?", subject, username)
+	return err
+}
+
+// userForSSOSubject returns the account mapped to an SSO identity, or sql.ErrNoRows
+func userForSSOSubject(subject string) (string, error) {
+	var username string
+	err := db.QueryRow("SELECT username FROM users WHERE sso_subject = ?", subject).Scan(&username)
+	return username, err
+}
+
+// userExists reports whether an account with the given username exists
+func userExists(username string) (bool, error) {
+	user, err := lookupUser(username)
+	return user.exists, err
+}
+
 // updateUserStatus updates a user's status
 func updateUserStatus(username, newStatus string) error {
 	_, err := db.Exec("UPDATE users SET status = ? WHERE username = ?", newStatus, username)
+	invalidateUser(username)
 	return err
 }
 
 // getUserStatus retrieves a user's status
 func getUserStatus(username string) (string, error) {
-	var status string
-	err := db.QueryRow("SELECT status FROM users WHERE username = ?", username).Scan(&status)
+	user, err := lookupUser(username)
 	if err != nil {
 		return "", err
 	}
-	return status, nil
+	if !user.exists {
+		return "", sql.ErrNoRows
+	}
+	return user.status, nil
 }
 
-// getAllUsers retrieves all users and their statuses
+// getAllUsers retrieves all users and their statuses. The result is cached until an
+// account is added or changed; callers must not modify it.
 func getAllUsers() (map[string]string, error) {
+	allUsersMutex.Lock()
+	defer allUsersMutex.Unlock()
+	if userCacheSize > 0 && allUsers != nil && clock.Now().Sub(allUsersLoaded) <= userCacheTTL {
+		userCacheHits.Add(1)
+		return allUsers, nil
+	}
+	userCacheMisses.Add(1)
+
+	users, err := loadAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	if userCacheSize > 0 {
+		allUsers, allUsersLoaded = users, clock.Now()
+	}
+	return users, nil
+}
+
+// loadAllUsers reads every user and their status from the database
+func loadAllUsers() (map[string]string, error) {
 	rows, err := db.Query("SELECT username, status FROM users")
 	if err != nil {
 		return nil, err
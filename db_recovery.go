@@ -0,0 +1,208 @@
+// Package main contains retries, a circuit breaker, and a degraded mode that keeps chat
+// running in memory while the database is unavailable
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	// dbRetries is how many times a failed write is retried before giving up
+	dbRetries = 3
+	// dbRetryBackoff is the wait before the first retry; it doubles each time
+	dbRetryBackoff = 50 * time.Millisecond
+	// maxPendingWrites bounds the writes kept in memory while the database is down
+	maxPendingWrites = 10000
+
+	dbBreaker = &circuitBreaker{threshold: 5, cooldown: 10 * time.Second}
+
+	// pendingWrites holds writes waiting for the database to come back, oldest first
+	pendingWrites      []func() error
+	pendingWritesMutex = &sync.Mutex{}
+
+	dbFailures       = newCounter("db_failures")
+	dbRetriesTotal   = newCounter("db_retries")
+	dbPendingWrites  = newCounter("db_pending_writes")
+	dbDroppedWrites  = newCounter("db_dropped_writes")
+	dbReplayedWrites = newCounter("db_replayed_writes")
+)
+
+// errCircuitOpen is returned without touching the database while the breaker is open
+var errCircuitOpen = errors.New("database unavailable")
+
+// circuitBreaker stops calling the database after repeated failures, then lets a
+// single trial call through once the cooldown has passed
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+// allow reports whether a call may go to the database now
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	if b.failures >= b.threshold {
+		// Half-open: let this call through, but reopen at once if it fails
+		b.openUntil = now.Add(b.cooldown)
+	}
+	return true
+}
+
+// isOpen reports whether calls are currently being refused
+func (b *circuitBreaker) isOpen(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Before(b.openUntil)
+}
+
+// record notes the outcome of a call
+func (b *circuitBreaker) record(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// isUniqueViolation reports whether err means a write broke a unique constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// isDBUnavailable reports whether err means the database can't be reached right now,
+// as opposed to a problem with the statement itself
+func isDBUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errCircuitOpen) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"database is locked", "busy", "i/o error", "unable to open", "connection refused", "bad connection", "database is closed"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// dbExec runs a write, retrying with backoff while the database is unavailable
+func dbExec(query string, args ...interface{}) (sql.Result, error) {
+	if !dbBreaker.allow(clock.Now()) {
+		return nil, errCircuitOpen
+	}
+	backoff := dbRetryBackoff
+	for attempt := 0; ; attempt++ {
+		var res sql.Result
+		err := dbFault()
+		if err == nil {
+			res, err = db.Exec(query, args...)
+		}
+		if !isDBUnavailable(err) {
+			dbBreaker.record(nil, clock.Now())
+			return res, err
+		}
+		dbFailures.Add(1)
+		if attempt >= dbRetries {
+			dbBreaker.record(err, clock.Now())
+			return nil, err
+		}
+		dbRetriesTotal.Add(1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// persistencePending reports whether writes are waiting for the database. New writes
+// must then queue behind them so they are stored in order.
+func persistencePending() bool {
+	pendingWritesMutex.Lock()
+	defer pendingWritesMutex.Unlock()
+	return len(pendingWrites) > 0
+}
+
+// queueWrite keeps a write in memory until the database is back. The first queued
+// write puts the server in degraded mode and tells everyone.
+func queueWrite(write func() error) {
+	pendingWritesMutex.Lock()
+	if len(pendingWrites) >= maxPendingWrites {
+		pendingWritesMutex.Unlock()
+		dbDroppedWrites.Add(1)
+		return
+	}
+	pendingWrites = append(pendingWrites, write)
+	dbPendingWrites.Add(1)
+	first := len(pendingWrites) == 1
+	pendingWritesMutex.Unlock()
+
+	if first {
+		logger.Warn("database unavailable, keeping writes in memory")
+		go func() {
+			bus.Broadcast(systemNotice("1;35", "[System] Message storage is temporarily unavailable. Chat continues, and messages will be saved once it recovers."))
+		}()
+	}
+}
+
+// replayPendingWrites stores queued writes in order until one fails again.
+// It reports whether the queue is now empty.
+func replayPendingWrites() bool {
+	for {
+		pendingWritesMutex.Lock()
+		if len(pendingWrites) == 0 {
+			pendingWritesMutex.Unlock()
+			return true
+		}
+		write := pendingWrites[0]
+		pendingWritesMutex.Unlock()
+
+		if err := write(); err != nil {
+			if isDBUnavailable(err) {
+				return false
+			}
+			// The statement itself is bad; retrying won't help
+			logger.Error("replaying write", "err", err)
+			dbDroppedWrites.Add(1)
+		} else {
+			dbReplayedWrites.Add(1)
+		}
+
+		pendingWritesMutex.Lock()
+		pendingWrites = pendingWrites[1:]
+		dbPendingWrites.Add(-1)
+		pendingWritesMutex.Unlock()
+	}
+}
+
+// startPersistenceRecovery replays queued writes whenever the database comes back
+func startPersistenceRecovery() {
+	clock.Every(time.Second, func(now time.Time) {
+		if !persistencePending() || dbBreaker.isOpen(now) {
+			return
+		}
+		if replayPendingWrites() {
+			logger.Info("database recovered, pending writes stored")
+			bus.Broadcast(systemNotice("1;35", "[System] Message storage has recovered."))
+		}
+	})
+}
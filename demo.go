@@ -0,0 +1,169 @@
+// Package main contains the demo mode, which serves a throwaway database seeded with
+// sample users, channels and history, kept lively by scripted residents
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// demoPassword is the password of every demo account
+	demoPassword = "demo"
+	// demoInterval is how often, on average, each demo resident says something
+	demoInterval = 20 * time.Second
+)
+
+// demoMode serves a temporary, seeded database that is deleted on exit
+var demoMode bool
+
+// demoResident is a demo account that a scripted client keeps logged in
+type demoResident struct {
+	account string
+	name    string
+	bot     bool
+	// channels are joined at login; the resident talks in one of them at random
+	channels []string
+	lines    []string
+}
+
+// demoResidents chat among themselves; visitors log in as alice or register
+var demoResidents = []demoResident{
+	{account: "bob", name: "Bob", channels: []string{"#general", "#random"}, lines: []string{
+		"morning all!",
+		"anyone tried the new /search? found a message from last week in a second",
+		"lunch plans? I'm thinking tacos",
+		"*stretches*",
+		"reminder: standup in 10 minutes",
+		"has anyone seen my coffee mug",
+	}},
+	{account: "carol", name: "Carol", channels: []string{"#general", "#dev"}, lines: []string{
+		"pushed a fix for the flaky test, reviews welcome",
+		"TIL you can /bookmark a message to find it later",
+		"the build is green again :tada:",
+		"does anyone know why the staging DB is slow today?",
+		"try /tictactoe @bob if you're bored",
+		"pair on the migration after lunch?",
+	}},
+	{account: "newsbot", name: "NewsBot", bot: true, channels: []string{"#dev"}, lines: []string{
+		"Deploy finished: chat-server v1.4.2 is live on staging.",
+		"Nightly backup completed in 42s.",
+		"CI: 128 tests passed on main.",
+		"Reminder: the weekly release train leaves Thursday at 15:00 UTC.",
+	}},
+}
+
+// demoSeed is the history the demo starts with, oldest first
+var demoSeed = []struct{ sender, channel, body string }{
+	{"alice", "#general", "Welcome to the demo server! Say hi :wave:"},
+	{"bob", "#general", "hi everyone"},
+	{"carol", "#general", "hey Bob, how was the weekend?"},
+	{"bob", "#general", "great, went hiking. Type /help to see everything this server can do"},
+	{"carol", "#dev", "release notes for 1.4 are up, have a look"},
+	{"newsbot", "#dev", "CI: 127 tests passed on main."},
+	{"bob", "#random", "what's everyone listening to?"},
+	{"alice", "#random", "lo-fi beats, as always"},
+}
+
+// demoTopics are set on the demo channels
+var demoTopics = map[string]string{
+	"#general": "Say hello! This is a demo: everything is deleted when the server stops",
+	"#dev":     "Builds, deploys and code review",
+	"#random":  "Anything goes",
+}
+
+// useDemoDatabase points the server at a new database in a temporary directory and
+// returns the function that deletes it
+func useDemoDatabase() (func(), error) {
+	dir, err := os.MkdirTemp("", "chat-server-demo-")
+	if err != nil {
+		return nil, err
+	}
+	dbPath = filepath.Join(dir, "chat.db")
+	return func() { os.RemoveAll(dir) }, nil
+}
+
+// seedDemo creates the demo accounts, channel topics, message of the day and history
+func seedDemo() error {
+	accounts := []string{"alice"}
+	for _, r := range demoResidents {
+		accounts = append(accounts, r.account)
+	}
+	for _, account := range accounts {
+		if err := saveUser(account, demoPassword); err != nil {
+			return fmt.Errorf("creating %s: %v", account, err)
+		}
+	}
+	for _, r := range demoResidents {
+		if r.bot {
+			if err := setUserRole(r.account, roleBot); err != nil {
+				return err
+			}
+		}
+	}
+	for channel, topic := range demoTopics {
+		if err := setRoomTopic(channel, topic, "alice"); err != nil {
+			return err
+		}
+	}
+	if err := setMOTD("alice", "This is a demo server. Log in as alice with the password demo, or /register your own account. Try /rooms, /join #dev, /search hiking and /help."); err != nil {
+		return err
+	}
+	for _, m := range demoSeed {
+		if _, err := saveMessage(m.sender, m.channel, m.body, "", ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// demoLogin is what a resident types to log in and join its channels
+func demoLogin(r demoResident) string {
+	var script strings.Builder
+	script.WriteString(fmt.Sprintf("/login %s %s\n%s\n/accept\n", r.account, demoPassword, r.name))
+	for _, channel := range r.channels {
+		script.WriteString("/join " + channel + "\n")
+	}
+	return script.String()
+}
+
+// runDemoResident keeps a resident logged in to the server at addr, saying one of
+// its lines in one of its channels every so often, and reconnects if it is dropped
+func runDemoResident(addr string, r demoResident) {
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			// The server is shutting down
+			return
+		}
+		// The resident reads nothing, but must keep up with what it is sent
+		go io.Copy(io.Discard, conn)
+		if _, err := io.WriteString(conn, demoLogin(r)); err == nil {
+			for {
+				time.Sleep(demoInterval/2 + time.Duration(rand.Int63n(int64(demoInterval))))
+				channel := r.channels[rand.Intn(len(r.channels))]
+				line := r.lines[rand.Intn(len(r.lines))]
+				if _, err := io.WriteString(conn, "/join "+channel+"\n"+line+"\n"); err != nil {
+					break
+				}
+			}
+		}
+		conn.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// startDemo starts the demo residents against the server at addr
+func startDemo(addr string) {
+	for _, r := range demoResidents {
+		go runDemoResident(addr, r)
+	}
+	fmt.Printf("Demo mode: log in as alice with the password %q; bob, carol and newsbot are chatting already.\n", demoPassword)
+	fmt.Println("Demo mode: everything is deleted when the server stops.")
+}
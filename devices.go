@@ -0,0 +1,94 @@
+// Package main contains support for one account being logged in from several devices
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connsForNameLocked returns every connection using a display name. An account's
+// sessions may share one. Callers must hold mutex.
+func connsForNameLocked(name string) []net.Conn {
+	return hub.ConnsForName(name)
+}
+
+// accountSessionsLocked returns the connections logged in with conn's account,
+// oldest first. Callers must hold mutex.
+func accountSessionsLocked(conn net.Conn) []net.Conn {
+	account := hub.Account(conn)
+	if account == "" {
+		return []net.Conn{conn}
+	}
+	conns := hub.ConnsForAccount(account)
+	sort.Slice(conns, func(i, j int) bool { return connIDs[conns[i]] < connIDs[conns[j]] })
+	return conns
+}
+
+// handleSessionsCommand handles the /sessions command, listing the connections
+// logged in with the user's account or ending some of them
+// Format: /sessions | /sessions kill <id>|others
+func handleSessionsCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 1 && (len(parts) != 3 || parts[1] != "kill") {
+		conn.Write([]byte("\033[1;31mUsage: /sessions or /sessions kill <id>|others\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	own := accountSessionsLocked(conn)
+	if len(parts) == 1 {
+		var list strings.Builder
+		list.WriteString(fmt.Sprintf("\033[1;36mYour sessions (%d):\033[0m\n", len(own)))
+		now := clock.Now()
+		for _, c := range own {
+			line := fmt.Sprintf("  #%d %s from %s in %s, idle %s", connIDs[c], hub.Name(c), c.RemoteAddr(),
+				sessionForLocked(c).room, now.Sub(lastSeen[c]).Round(time.Second))
+			if c == conn {
+				line += " (this session)"
+			}
+			list.WriteString(line + "\n")
+		}
+		mutex.Unlock()
+		conn.Write([]byte(list.String()))
+		return
+	}
+
+	var targets []net.Conn
+	if parts[2] == "others" {
+		for _, c := range own {
+			if c != conn {
+				targets = append(targets, c)
+			}
+		}
+	} else {
+		id, err := strconv.ParseInt(strings.TrimPrefix(parts[2], "#"), 10, 64)
+		for _, c := range own {
+			if err == nil && connIDs[c] == id {
+				targets = append(targets, c)
+			}
+		}
+		if len(targets) == 0 {
+			mutex.Unlock()
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mNo session %s. Type /sessions to list them.\033[0m\n", parts[2])))
+			return
+		}
+		if targets[0] == conn {
+			mutex.Unlock()
+			conn.Write([]byte("\033[1;31mThat is this session. Use /exit to leave.\033[0m\n"))
+			return
+		}
+	}
+	mutex.Unlock()
+
+	// Closing a connection makes its handleClient clean up
+	for _, c := range targets {
+		c.Write([]byte("\033[1;31mThis session was ended from another device.\033[0m\n"))
+		c.Close()
+	}
+	connLogger(conn).Info("ended sessions", "count", len(targets))
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mEnded %d session(s).\033[0m\n", len(targets))))
+}
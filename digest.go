@@ -0,0 +1,230 @@
+// Package main contains the /digest command summarizing a channel's recent activity
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultDigestPeriod is how far back /digest looks without a period
+	defaultDigestPeriod = 24 * time.Hour
+	// maxDigestPeriod caps how far back /digest may look
+	maxDigestPeriod = 7 * 24 * time.Hour
+	// digestTopParticipants is how many of the most active participants are listed
+	digestTopParticipants = 5
+	// maxDigestTranscript caps the messages sent to the summarizer, newest kept
+	maxDigestTranscript = 500
+)
+
+var (
+	// summaryURL is an optional endpoint, such as a small service in front of an LLM,
+	// that turns a transcript into a short summary for /digest
+	summaryURL string
+
+	digestSummaries       = newCounter("digest_summaries")
+	digestSummaryFailures = newCounter("digest_summary_failures")
+)
+
+// Participant is one sender and how many messages they sent
+type Participant struct {
+	Name     string `json:"name"`
+	Messages int    `json:"messages"`
+}
+
+// Digest is a channel's activity over a period
+type Digest struct {
+	Channel  string
+	Since    time.Time
+	Messages int
+	// Senders counts everyone who posted; Participants are the most active of them
+	Senders      int
+	Participants []Participant
+}
+
+// SummaryRequest is the JSON posted to -summary-url
+type SummaryRequest struct {
+	Channel      string        `json:"channel"`
+	Since        time.Time     `json:"since"`
+	Messages     []SummaryLine `json:"messages"`
+	Participants []Participant `json:"participants"`
+	// Hint is a suggested instruction for a summarizer that wraps an LLM
+	Hint string `json:"hint"`
+}
+
+// SummaryLine is one message of the transcript sent to the summarizer
+type SummaryLine struct {
+	From string    `json:"from"`
+	Body string    `json:"body"`
+	TS   time.Time `json:"ts"`
+}
+
+// SummaryResponse is the JSON -summary-url answers with
+type SummaryResponse struct {
+	Summary string `json:"summary"`
+}
+
+// buildDigest counts a channel's messages since a time and its most active participants
+func buildDigest(channel string, since time.Time) (Digest, error) {
+	d := Digest{Channel: channel, Since: since}
+	rows, err := readQuery(`SELECT sender, COUNT(*) AS n FROM messages WHERE channel = ? AND seq IS NOT NULL AND created_at >= ?
+		GROUP BY sender ORDER BY n DESC, sender`, channel, since)
+	if err != nil {
+		return d, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Participant
+		if err := rows.Scan(&p.Name, &p.Messages); err != nil {
+			return d, err
+		}
+		d.Messages += p.Messages
+		d.Senders++
+		if len(d.Participants) < digestTopParticipants {
+			d.Participants = append(d.Participants, p)
+		}
+	}
+	return d, rows.Err()
+}
+
+// digestTranscript returns a channel's most recent messages since a time, oldest first
+func digestTranscript(channel string, since time.Time) ([]SummaryLine, error) {
+	rows, err := readQuery(`SELECT sender, body, created_at FROM messages WHERE channel = ? AND seq IS NOT NULL AND created_at >= ?
+		ORDER BY seq DESC LIMIT ?`, channel, since, maxDigestTranscript)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []SummaryLine
+	for rows.Next() {
+		var l SummaryLine
+		if err := rows.Scan(&l.From, &l.Body, &l.TS); err != nil {
+			return nil, err
+		}
+		l.Body = openBody(l.Body)
+		lines = append(lines, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines, nil
+}
+
+// requestSummary asks -summary-url to summarize a transcript
+func requestSummary(d Digest, lines []SummaryLine) (string, error) {
+	body, err := json.Marshal(SummaryRequest{
+		Channel:      d.Channel,
+		Since:        d.Since,
+		Messages:     lines,
+		Participants: d.Participants,
+		Hint:         "Summarize this chat discussion in two or three sentences.",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: 20 * time.Second}
+	resp, err := client.Post(summaryURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("summary endpoint returned %s", resp.Status)
+	}
+
+	var out SummaryResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&out); err != nil {
+		return "", err
+	}
+	// The summary is shown to users as is, so it may not carry terminal escapes
+	return strings.TrimSpace(stripANSI(out.Summary)), nil
+}
+
+// String renders the digest's counts
+func (d Digest) String() string {
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("\033[1;36mDigest of %s since %s:\033[0m\n", d.Channel, d.Since.Format("Jan 2 15:04 MST")))
+	out.WriteString(fmt.Sprintf("  %d message(s) from %d participant(s)\n", d.Messages, d.Senders))
+	if len(d.Participants) > 0 {
+		names := make([]string, len(d.Participants))
+		for i, p := range d.Participants {
+			names[i] = fmt.Sprintf("%s (%d)", p.Name, p.Messages)
+		}
+		out.WriteString("  most active: " + strings.Join(names, ", ") + "\n")
+	}
+	return out.String()
+}
+
+// handleDigestCommand handles the /digest command, summarizing a channel the user is
+// in. With -summary-url set, a short summary of the discussion follows the counts.
+// Format: /digest [#channel] [period]
+func handleDigestCommand(conn net.Conn, message string) {
+	usage := "\033[1;31mUsage: /digest [#channel] [period, e.g. 6h or 2d]\033[0m\n"
+	channel := currentRoom(conn)
+	period := defaultDigestPeriod
+	for _, arg := range strings.Fields(message)[1:] {
+		if strings.HasPrefix(arg, "#") {
+			channel = strings.ToLower(arg)
+			continue
+		}
+		p, err := parsePeriod(arg)
+		if err != nil {
+			conn.Write([]byte(usage))
+			return
+		}
+		period = p
+	}
+	if period > maxDigestPeriod {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mA digest can cover at most %s.\033[0m\n", maxDigestPeriod)))
+		return
+	}
+
+	mutex.Lock()
+	member := sessionForLocked(conn).joined[channel]
+	mutex.Unlock()
+	if !member && !isAdmin(conn) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou must /join %s to see its digest.\033[0m\n", channel)))
+		return
+	}
+
+	since := time.Now().UTC().Add(-period)
+	d, err := buildDigest(channel, since)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError building digest. Please try again.\033[0m\n"))
+		return
+	}
+	d.Since = d.Since.In(userLocation(conn))
+	conn.Write([]byte(d.String()))
+	if summaryURL == "" || d.Messages == 0 {
+		return
+	}
+
+	// The summarizer may be slow, so the user can keep chatting meanwhile
+	conn.Write([]byte("\033[90m  summarizing...\033[0m\n"))
+	go func() {
+		lines, err := digestTranscript(channel, since)
+		var summary string
+		if err == nil {
+			summary, err = requestSummary(d, lines)
+		}
+		if err == nil && summary != "" {
+			digestSummaries.Add(1)
+			conn.Write([]byte(fmt.Sprintf("\033[36m  Summary: %s\033[0m\n", summary)))
+			return
+		}
+		digestSummaryFailures.Add(1)
+		connLogger(conn).Warn("digest summary failed", "channel", channel, "err", err)
+		conn.Write([]byte("\033[90m  No summary is available right now.\033[0m\n"))
+	}()
+}
@@ -0,0 +1,85 @@
+// Package main contains the compact and verbose output modes for channel messages
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// displayCompact shows channel messages without timestamps, channel prefixes or IDs
+	displayCompact = "compact"
+	// displayNormal shows timestamps, and the channel of messages from channels the
+	// user isn't talking in
+	displayNormal = "normal"
+	// displayVerbose also shows the channel of every message and its ID
+	displayVerbose = "verbose"
+)
+
+// messagePrefix renders what goes in front of a channel message for a session's
+// display mode. elsewhere is set for messages from a channel the user isn't
+// talking in. A nil session, such as a spectator's, gets the normal prefix.
+func messagePrefix(s *Session, msg OutgoingMessage, elsewhere bool) string {
+	mode := displayNormal
+	if s != nil && s.display != "" {
+		mode = s.display
+	}
+	switch mode {
+	case displayCompact:
+		return ""
+	case displayVerbose:
+		prefix := timestamp(s, msg.sent)
+		if msg.channel != "" {
+			prefix += fmt.Sprintf("\033[90m[%s]\033[0m ", msg.channel)
+		}
+		if msg.id != "" {
+			prefix += fmt.Sprintf("\033[90m(%s)\033[0m ", msg.id)
+		}
+		return prefix
+	}
+	prefix := timestamp(s, msg.sent)
+	if elsewhere {
+		prefix += fmt.Sprintf("\033[90m[%s]\033[0m ", msg.channel)
+	}
+	return prefix
+}
+
+// handleDisplayCommand handles the /display command, which shows or sets how much
+// is shown around channel messages
+// Format: /display [compact|normal|verbose]
+func handleDisplayCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) == 1 {
+		mode := sessionFor(conn).display
+		if mode == "" {
+			mode = displayNormal
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[1;33mYour display mode is %s.\033[0m\n", mode)))
+		return
+	}
+	if len(parts) != 2 || (parts[1] != displayCompact && parts[1] != displayNormal && parts[1] != displayVerbose) {
+		conn.Write([]byte("\033[1;31mUsage: /display compact|normal|verbose\033[0m\n"))
+		return
+	}
+	mode := parts[1]
+	mutex.Lock()
+	username := hub.Account(conn)
+	if s, ok := sessions[conn]; ok {
+		s.display = mode
+	}
+	mutex.Unlock()
+
+	if _, err := db.Exec("UPDATE users SET display = ? WHERE username = ?", mode, username); err != nil {
+		conn.Write([]byte("\033[1;31mError saving display mode. Please try again.\033[0m\n"))
+		return
+	}
+	switch mode {
+	case displayCompact:
+		conn.Write([]byte("\033[1;32mMessages will be shown without timestamps, channels or IDs.\033[0m\n"))
+	case displayVerbose:
+		conn.Write([]byte("\033[1;32mMessages will be shown with their timestamp, channel and ID.\033[0m\n"))
+	default:
+		conn.Write([]byte("\033[1;32mMessages will be shown with their timestamp, and their channel if you aren't talking there.\033[0m\n"))
+	}
+}
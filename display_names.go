@@ -0,0 +1,84 @@
+// Package main contains validation of the display names users pick at login
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// displayNameSymbols are the characters other than letters and digits allowed in display names
+const displayNameSymbols = "_-."
+
+// reservedDisplayNames are names that would pass for the server or its staff
+var reservedDisplayNames = []string{
+	"server", "system", "admin", "administrator", "announcement", "priority", "moderator", "root", "chatserver",
+}
+
+// lookalikeDigits maps digits to the letters they are used to imitate, as in adm1n
+var lookalikeDigits = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t")
+
+// lookalikeLetters maps Cyrillic and Greek letters to the Latin letters they can't be
+// told apart from, as in Аdmin with a Cyrillic А. Case matters: Greek ν looks like v
+// but its capital Ν looks like N.
+var lookalikeLetters = map[rune]rune{
+	// Cyrillic
+	'А': 'A', 'В': 'B', 'С': 'C', 'Е': 'E', 'Н': 'H', 'І': 'I', 'Ј': 'J', 'К': 'K', 'М': 'M',
+	'О': 'O', 'Р': 'P', 'Ѕ': 'S', 'Т': 'T', 'Х': 'X', 'Ү': 'Y', 'Ԁ': 'D', 'Ԛ': 'Q', 'Ԝ': 'W', 'Ӏ': 'l',
+	'а': 'a', 'с': 'c', 'е': 'e', 'і': 'i', 'ј': 'j', 'о': 'o', 'р': 'p', 'ѕ': 's', 'у': 'y',
+	'х': 'x', 'ԁ': 'd', 'һ': 'h', 'ԛ': 'q', 'ԝ': 'w', 'ӏ': 'l', 'ѵ': 'v',
+	// Greek
+	'Α': 'A', 'Β': 'B', 'Ε': 'E', 'Ζ': 'Z', 'Η': 'H', 'Ι': 'I', 'Κ': 'K', 'Μ': 'M', 'Ν': 'N',
+	'Ο': 'O', 'Ρ': 'P', 'Τ': 'T', 'Υ': 'Y', 'Χ': 'X',
+	'α': 'a', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u',
+}
+
+// isReservedDisplayName reports whether a name is, or imitates, a reserved name. Case,
+// the symbols allowed in names, trailing numbers, lookalike digits and lookalike
+// letters from other scripts are ignored, so S.e.r.v.e.r, Admin_2, r00t and Аdmin
+// are all reserved.
+func isReservedDisplayName(name string) bool {
+	key := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(displayNameSymbols, r) {
+			return -1
+		}
+		if latin, ok := lookalikeLetters[r]; ok {
+			return latin
+		}
+		return r
+	}, name)
+	key = strings.ToLower(key)
+	key = lookalikeDigits.Replace(strings.TrimRightFunc(key, unicode.IsDigit))
+	for _, reserved := range reservedDisplayNames {
+		if key == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDisplayName trims a typed display name and checks it. Names are one word of
+// letters, digits and _-. so they can be addressed in commands like /private, and
+// can't carry terminal escapes.
+func validateDisplayName(typed string) (string, error) {
+	name := strings.TrimSpace(typed)
+	if name == "" {
+		return "", fmt.Errorf("display name can't be empty")
+	}
+	if n := utf8.RuneCountInString(name); n < minDisplayNameLength || n > maxDisplayNameLength {
+		return "", fmt.Errorf("display name must be %d to %d characters", minDisplayNameLength, maxDisplayNameLength)
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) {
+			return "", fmt.Errorf("display name can't contain spaces")
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(displayNameSymbols, r) {
+			return "", fmt.Errorf("display name may only use letters, digits and %s", strings.Join(strings.Split(displayNameSymbols, ""), " "))
+		}
+	}
+	if isReservedDisplayName(name) {
+		return "", fmt.Errorf("%s is reserved for the server", name)
+	}
+	return name, nil
+}
@@ -0,0 +1,211 @@
+// Package main contains per-channel eligibility restrictions checked when joining
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ChannelRestriction lists the account attributes required to join a channel
+type ChannelRestriction struct {
+	channel         string
+	requireVerified bool
+	requiredRole    string
+	minAccountAge   time.Duration
+}
+
+// String describes the restriction for humans
+func (r ChannelRestriction) String() string {
+	var reqs []string
+	if r.requireVerified {
+		reqs = append(reqs, "verified account")
+	}
+	if r.requiredRole != "" {
+		reqs = append(reqs, "role "+r.requiredRole)
+	}
+	if r.minAccountAge > 0 {
+		reqs = append(reqs, "account older than "+r.minAccountAge.String())
+	}
+	if len(reqs) == 0 {
+		return "none"
+	}
+	return strings.Join(reqs, ", ")
+}
+
+// getChannelRestriction loads a channel's restriction, if any
+func getChannelRestriction(channel string) (ChannelRestriction, bool, error) {
+	r := ChannelRestriction{channel: channel}
+	var minAge int64
+	err := db.QueryRow("SELECT require_verified, required_role, min_account_age FROM channel_restrictions WHERE channel = ?", channel).
+		Scan(&r.requireVerified, &r.requiredRole, &minAge)
+	if err == sql.ErrNoRows {
+		return r, false, nil
+	}
+	if err != nil {
+		return r, false, err
+	}
+	r.minAccountAge = time.Duration(minAge) * time.Second
+	return r, true, nil
+}
+
+// setChannelRestriction stores a channel's restriction
+func setChannelRestriction(r ChannelRestriction) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO channel_restrictions (channel, require_verified, required_role, min_account_age)
+		VALUES (?, ?, ?, ?)`, r.channel, r.requireVerified, r.requiredRole, int64(r.minAccountAge/time.Second))
+	return err
+}
+
+// clearChannelRestriction removes a channel's restriction
+func clearChannelRestriction(channel string) error {
+	_, err := db.Exec("DELETE FROM channel_restrictions WHERE channel = ?", channel)
+	return err
+}
+
+// setUserVerified marks an account as verified or not
+func setUserVerified(username string, verified bool) error {
+	res, err := db.Exec("UPDATE users SET verified = ? WHERE username = ?", verified, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// checkChannelEligibility reports whether an account may join a channel,
+// and if not, a reason suitable for showing to the user
+func checkChannelEligibility(username, channel string) (bool, string) {
+	r, restricted, err := getChannelRestriction(channel)
+	if err != nil {
+		return false, "could not check channel restrictions, please try again"
+	}
+	if !restricted {
+		return true, ""
+	}
+
+	var verified bool
+	var role string
+	var createdAt sql.NullTime
+	err = db.QueryRow("SELECT verified, role, created_at FROM users WHERE username = ?", username).Scan(&verified, &role, &createdAt)
+	if err != nil {
+		return false, "could not check your account, please try again"
+	}
+
+	if r.requireVerified && !verified {
+		return false, fmt.Sprintf("%s is restricted to verified accounts", channel)
+	}
+	if r.requiredRole != "" && role != r.requiredRole && !isAdminAccount(username) {
+		// Roles granted by reaction count too
+		granted, err := hasUserRole(username, r.requiredRole)
+		if err != nil {
+			return false, "could not check your account, please try again"
+		}
+		if !granted {
+			return false, fmt.Sprintf("%s requires the %s role", channel, r.requiredRole)
+		}
+	}
+	// Accounts created before creation times were tracked count as old enough
+	if r.minAccountAge > 0 && createdAt.Valid {
+		if age := clock.Now().Sub(createdAt.Time); age < r.minAccountAge {
+			return false, fmt.Sprintf("%s requires an account older than %s (yours is %s old)",
+				channel, r.minAccountAge, age.Round(time.Minute))
+		}
+	}
+	return true, ""
+}
+
+// handleRestrictCommand handles the admin /restrict command
+// Format: /restrict <#channel> [verified] [role:<role>] [age:<period>] | off
+func handleRestrictCommand(conn net.Conn, message string) {
+	if !isAdmin(conn) {
+		conn.Write([]byte("\033[1;31mOnly admins can restrict channels.\033[0m\n"))
+		return
+	}
+	parts := strings.Fields(message)
+	if len(parts) < 2 || !strings.HasPrefix(parts[1], "#") {
+		conn.Write([]byte("\033[1;31mUsage: /restrict <#channel> [verified] [role:<role>] [age:<period>] | off\033[0m\n"))
+		return
+	}
+	channel := parts[1]
+
+	// With no requirements, show the current restriction
+	if len(parts) == 2 {
+		r, restricted, err := getChannelRestriction(channel)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError reading channel restrictions.\033[0m\n"))
+			return
+		}
+		if !restricted {
+			conn.Write([]byte(fmt.Sprintf("\033[90m%s is not restricted.\033[0m\n", channel)))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[90m%s requires: %s\033[0m\n", channel, r)))
+		return
+	}
+
+	if len(parts) == 3 && parts[2] == "off" {
+		if err := clearChannelRestriction(channel); err != nil {
+			conn.Write([]byte("\033[1;31mError clearing channel restrictions.\033[0m\n"))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[1;32m%s is no longer restricted.\033[0m\n", channel)))
+		return
+	}
+
+	r := ChannelRestriction{channel: channel}
+	for _, req := range parts[2:] {
+		switch {
+		case req == "verified":
+			r.requireVerified = true
+		case strings.HasPrefix(req, "role:"):
+			r.requiredRole = strings.TrimPrefix(req, "role:")
+		case strings.HasPrefix(req, "age:"):
+			d, err := parsePeriod(strings.TrimPrefix(req, "age:"))
+			if err != nil {
+				conn.Write([]byte("\033[1;31mInvalid age, use e.g. age:7d or age:12h.\033[0m\n"))
+				return
+			}
+			r.minAccountAge = d
+		default:
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mUnknown requirement %q.\033[0m\n", req)))
+			return
+		}
+	}
+	if err := setChannelRestriction(r); err != nil {
+		conn.Write([]byte("\033[1;31mError saving channel restrictions.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;32m%s now requires: %s\033[0m\n", channel, r)))
+}
+
+// handleVerifyCommand handles the admin /verify command
+// Format: /verify <username> [off]
+func handleVerifyCommand(conn net.Conn, message string) {
+	if !isAdmin(conn) {
+		conn.Write([]byte("\033[1;31mOnly admins can verify accounts.\033[0m\n"))
+		return
+	}
+	parts := strings.Fields(message)
+	if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "off") {
+		conn.Write([]byte("\033[1;31mUsage: /verify <username> [off]\033[0m\n"))
+		return
+	}
+	verified := len(parts) == 2
+
+	if err := setUserVerified(parts[1], verified); err == sql.ErrNoRows {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mUser %s not found.\033[0m\n", parts[1])))
+		return
+	} else if err != nil {
+		conn.Write([]byte("\033[1;31mError updating account.\033[0m\n"))
+		return
+	}
+	if verified {
+		conn.Write([]byte(fmt.Sprintf("\033[1;32m%s is now verified.\033[0m\n", parts[1])))
+	} else {
+		conn.Write([]byte(fmt.Sprintf("\033[1;32m%s is no longer verified.\033[0m\n", parts[1])))
+	}
+}
@@ -0,0 +1,129 @@
+// Package main contains :shortcode: emoji expansion
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// emojiShortcodes maps the shortcodes the server understands to their emoji
+var emojiShortcodes = map[string]string{
+	"smile":         "😄",
+	"grin":          "😁",
+	"joy":           "😂",
+	"laughing":      "😆",
+	"wink":          "😉",
+	"blush":         "😊",
+	"slight_smile":  "🙂",
+	"upside_down":   "🙃",
+	"thinking":      "🤔",
+	"neutral_face":  "😐",
+	"sweat_smile":   "😅",
+	"cry":           "😢",
+	"sob":           "😭",
+	"angry":         "😠",
+	"scream":        "😱",
+	"sunglasses":    "😎",
+	"heart_eyes":    "😍",
+	"kissing_heart": "😘",
+	"sleeping":      "😴",
+	"shrug":         "🤷",
+	"facepalm":      "🤦",
+	"wave":          "👋",
+	"+1":            "👍",
+	"thumbsup":      "👍",
+	"-1":            "👎",
+	"thumbsdown":    "👎",
+	"clap":          "👏",
+	"pray":          "🙏",
+	"ok_hand":       "👌",
+	"muscle":        "💪",
+	"eyes":          "👀",
+	"heart":         "❤️",
+	"broken_heart":  "💔",
+	"fire":          "🔥",
+	"star":          "⭐",
+	"sparkles":      "✨",
+	"tada":          "🎉",
+	"rocket":        "🚀",
+	"100":           "💯",
+	"check":         "✅",
+	"x":             "❌",
+	"warning":       "⚠️",
+	"bug":           "🐛",
+	"coffee":        "☕",
+	"beer":          "🍺",
+	"pizza":         "🍕",
+	"gopher":        "🐹",
+}
+
+// shortcodePattern matches anything that looks like a shortcode; only known ones are replaced
+var shortcodePattern = regexp.MustCompile(`:[a-z0-9_+-]+:`)
+
+// expandShortcodes replaces the known :shortcodes: in text with their emoji
+func expandShortcodes(text string) string {
+	if !strings.Contains(text, ":") {
+		return text
+	}
+	return shortcodePattern.ReplaceAllStringFunc(text, func(code string) string {
+		if emoji, ok := emojiShortcodes[strings.Trim(code, ":")]; ok {
+			return emoji
+		}
+		return code
+	})
+}
+
+// shortcodesFor returns text as a user wants to see it: expanded, unless they asked
+// for raw shortcodes
+func shortcodesFor(s *Session, text string) string {
+	if s != nil && s.rawEmoji {
+		return text
+	}
+	return expandShortcodes(text)
+}
+
+// handleEmojiCommand handles the /emoji command
+// Format: /emoji list | /emoji raw | /emoji expand
+func handleEmojiCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 2 || (parts[1] != "list" && parts[1] != "raw" && parts[1] != "expand") {
+		conn.Write([]byte("\033[1;31mUsage: /emoji list|raw|expand\033[0m\n"))
+		return
+	}
+
+	if parts[1] == "list" {
+		codes := make([]string, 0, len(emojiShortcodes))
+		for code := range emojiShortcodes {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		var list strings.Builder
+		list.WriteString("\033[1;36mEmoji shortcodes:\033[0m\n")
+		for _, code := range codes {
+			list.WriteString(fmt.Sprintf("  %s :%s:\n", emojiShortcodes[code], code))
+		}
+		conn.Write([]byte(list.String()))
+		return
+	}
+
+	raw := parts[1] == "raw"
+	mutex.Lock()
+	username := hub.Account(conn)
+	if s, ok := sessions[conn]; ok {
+		s.rawEmoji = raw
+	}
+	mutex.Unlock()
+
+	if _, err := db.Exec("UPDATE users SET raw_emoji = ? WHERE username = ?", raw, username); err != nil {
+		conn.Write([]byte("\033[1;31mError saving emoji setting. Please try again.\033[0m\n"))
+		return
+	}
+	if raw {
+		conn.Write([]byte("\033[1;32mYou will see shortcodes like :smile: as typed.\033[0m\n"))
+	} else {
+		conn.Write([]byte("\033[1;32mShortcodes like :smile: will be shown as emoji.\033[0m\n"))
+	}
+}
@@ -0,0 +1,211 @@
+// Package main contains the optional encryption of stored message bodies, so channel
+// history and private messages can't be read from the database file without the key
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// encryptedBodyPrefix marks a stored body as encrypted: the rest is the base64 of
+	// an AES-256-GCM nonce followed by the sealed body
+	encryptedBodyPrefix = "enc:v1:"
+	// plainBodyPrefix is put in front of a plain text body that starts like an encrypted
+	// or escaped one, so what a user types is never taken for either
+	plainBodyPrefix = "enc:v0:"
+	// unreadableBody stands in for a body that can't be decrypted with the current key
+	unreadableBody = "[encrypted message]"
+	// encryptBatch is how many plain text bodies are encrypted per transaction
+	encryptBatch = 500
+)
+
+var (
+	// storageKeyFile holds the key; CHAT_STORAGE_KEY is used when it isn't set
+	storageKeyFile string
+	// storageCipher seals message bodies; nil when no key is configured
+	storageCipher cipher.AEAD
+)
+
+// parseStorageKey decodes a 32-byte key written as hex or base64
+func parseStorageKey(text string) ([]byte, error) {
+	text = strings.TrimSpace(text)
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("the storage key must be 32 bytes, written as hex or base64")
+}
+
+// loadStorageKey reads the key from -storage-key-file or CHAT_STORAGE_KEY, leaving
+// bodies unencrypted if neither is set
+func loadStorageKey() error {
+	text := os.Getenv("CHAT_STORAGE_KEY")
+	if storageKeyFile != "" {
+		data, err := os.ReadFile(storageKeyFile)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	if strings.TrimSpace(text) == "" {
+		storageCipher = nil
+		return nil
+	}
+	key, err := parseStorageKey(text)
+	if err != nil {
+		return err
+	}
+	return setStorageKey(key)
+}
+
+// setStorageKey encrypts message bodies stored from now on with key
+func setStorageKey(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	storageCipher = gcm
+	return nil
+}
+
+// sealBody returns body as it should be stored: encrypted when a key is configured
+func sealBody(body string) (string, error) {
+	if storageCipher == nil {
+		if strings.HasPrefix(body, encryptedBodyPrefix) || strings.HasPrefix(body, plainBodyPrefix) {
+			return plainBodyPrefix + body, nil
+		}
+		return body, nil
+	}
+	nonce := make([]byte, storageCipher.NonceSize())
+	if err := readRandom(nonce); err != nil {
+		return "", err
+	}
+	sealed := storageCipher.Seal(nonce, nonce, []byte(body), nil)
+	return encryptedBodyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openBody returns a stored body as plain text. Bodies stored before encryption was
+// turned on are returned as they are.
+func openBody(stored string) string {
+	if strings.HasPrefix(stored, plainBodyPrefix) {
+		return strings.TrimPrefix(stored, plainBodyPrefix)
+	}
+	if !strings.HasPrefix(stored, encryptedBodyPrefix) {
+		return stored
+	}
+	if storageCipher == nil {
+		return unreadableBody
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedBodyPrefix))
+	size := storageCipher.NonceSize()
+	if err != nil || len(sealed) < size {
+		return unreadableBody
+	}
+	body, err := storageCipher.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return unreadableBody
+	}
+	return string(body)
+}
+
+// checkStorageKey refuses to serve encrypted messages without their key, or with
+// another one, rather than showing them all as unreadable
+func checkStorageKey() error {
+	var stored string
+	err := db.QueryRow("SELECT body FROM messages WHERE body LIKE ? LIMIT 1", encryptedBodyPrefix+"%").Scan(&stored)
+	if err != nil {
+		// No encrypted messages yet
+		return nil
+	}
+	if storageCipher == nil {
+		return errors.New("stored messages are encrypted; start the server with -storage-key-file or CHAT_STORAGE_KEY")
+	}
+	if openBody(stored) == unreadableBody {
+		return errors.New("the storage key doesn't decrypt the stored messages")
+	}
+	return nil
+}
+
+// encryptedColumns are the columns holding message bodies, or events that carry them
+var encryptedColumns = []struct{ table, column string }{
+	{"messages", "body"},
+	{"routed_messages", "body"},
+	{"announcements", "body"},
+	{"event_log", "data"},
+}
+
+// encryptStoredBodies encrypts the bodies stored in plain text before a key was
+// configured, and returns how many there were
+func encryptStoredBodies() (int, error) {
+	if storageCipher == nil {
+		return 0, nil
+	}
+	total := 0
+	for _, c := range encryptedColumns {
+		for {
+			n, err := encryptBodiesBatch(c.table, c.column)
+			if err != nil {
+				return total, fmt.Errorf("encrypting %s: %v", c.table, err)
+			}
+			total += n
+			if n < encryptBatch {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+// encryptBodiesBatch encrypts up to encryptBatch plain text values of a column
+func encryptBodiesBatch(table, column string) (int, error) {
+	rows, err := db.Query("SELECT rowid, "+column+" FROM "+table+" WHERE "+column+" NOT LIKE ? LIMIT ?", encryptedBodyPrefix+"%", encryptBatch)
+	if err != nil {
+		return 0, err
+	}
+	type plainBody struct {
+		id   int64
+		body string
+	}
+	var plain []plainBody
+	for rows.Next() {
+		var p plainBody
+		if err := rows.Scan(&p.id, &p.body); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plain = append(plain, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(plain) == 0 {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, p := range plain {
+		sealed, err := sealBody(openBody(p.body))
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE "+table+" SET "+column+" = ? WHERE rowid = ?", sealed, p.id); err != nil {
+			return 0, err
+		}
+	}
+	return len(plain), tx.Commit()
+}
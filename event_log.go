@@ -0,0 +1,238 @@
+// Package main contains the append-only event log, from which derived data can be
+// rebuilt by replaying the server's events
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// eventLogPage is how many events replayEvents reads per query
+const eventLogPage = 1000
+
+var (
+	// eventLogEnabled appends every event to the event_log table
+	eventLogEnabled bool
+
+	eventsLogged = newCounter("events_logged")
+)
+
+// LoggedEvent is one entry of the event log
+type LoggedEvent struct {
+	ID    int64           `json:"id"`
+	Type  string          `json:"type"`
+	Time  time.Time       `json:"ts"`
+	Event json.RawMessage `json:"event"`
+}
+
+// decodeAs decodes a logged event of type T
+func decodeAs[T Event](data []byte) (Event, error) {
+	var ev T
+	err := json.Unmarshal(data, &ev)
+	return ev, err
+}
+
+// eventDecoders decode logged events by name. Events are only ever added to the log,
+// so a new event type needs an entry here, and an existing one must keep reading
+// entries written before its fields changed.
+var eventDecoders = map[string]func([]byte) (Event, error){
+	UserConnected{}.eventName():    decodeAs[UserConnected],
+	UserDisconnected{}.eventName(): decodeAs[UserDisconnected],
+	UserJoined{}.eventName():       decodeAs[UserJoined],
+	UserLeft{}.eventName():         decodeAs[UserLeft],
+	StatusChanged{}.eventName():    decodeAs[StatusChanged],
+	MessagePosted{}.eventName():    decodeAs[MessagePosted],
+	ButtonClicked{}.eventName():    decodeAs[ButtonClicked],
+	ReactionChanged{}.eventName():  decodeAs[ReactionChanged],
+}
+
+// logEvent appends an event to the event log. It goes through the same write path
+// as messages, so it is batched when -persist-queue is on and kept in memory
+// during a database outage.
+func logEvent(ev Event) {
+	if !eventLogEnabled {
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		logger.Error("encoding event", "event", ev.eventName(), "err", err)
+		return
+	}
+	// Events such as MessagePosted carry message bodies
+	stored, err := sealBody(string(data))
+	if err != nil {
+		logger.Error("encrypting event", "event", ev.eventName(), "err", err)
+		return
+	}
+	err = persist(queuedWrite{
+		query: "INSERT INTO event_log (type, data, created_at, account) VALUES (?, ?, ?, ?)",
+		args:  []interface{}{ev.eventName(), stored, clock.Now().UTC(), eventAccount(ev)},
+	}, "")
+	if err != nil {
+		logger.Error("logging event", "event", ev.eventName(), "err", err)
+		return
+	}
+	eventsLogged.Add(1)
+}
+
+// eventAccount returns the account behind an event, "" for a guest
+func eventAccount(ev Event) string {
+	var user *UserIdentity
+	switch ev := ev.(type) {
+	case UserConnected:
+		user = ev.User
+	case UserDisconnected:
+		user = ev.User
+	case UserJoined:
+		user = ev.User
+	case UserLeft:
+		user = ev.User
+	case StatusChanged:
+		user = ev.User
+	case MessagePosted:
+		user = ev.User
+	case ButtonClicked:
+		user = ev.User
+	case ReactionChanged:
+		user = ev.User
+	}
+	if user == nil {
+		return ""
+	}
+	return user.Account
+}
+
+// deleteLoggedEventsTx removes the events of a deleted account. Events logged before
+// they named their account, and clicks on the account's buttons, are found by
+// reading them.
+func deleteLoggedEventsTx(tx *sql.Tx, username string) error {
+	if _, err := tx.Exec("DELETE FROM event_log WHERE account = ?", username); err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT id, data FROM event_log WHERE account IS NULL OR type = ?", ButtonClicked{}.eventName())
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		var ev struct {
+			User   *UserIdentity `json:"user"`
+			Author string        `json:"author"`
+		}
+		if json.Unmarshal([]byte(openBody(data)), &ev) != nil {
+			continue
+		}
+		if ev.Author == username || (ev.User != nil && ev.User.Account == username) {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec("DELETE FROM event_log WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeEvent turns a logged event back into the event that was emitted
+func decodeEvent(entry LoggedEvent) (Event, error) {
+	decode, ok := eventDecoders[entry.Type]
+	if !ok {
+		return nil, fmt.Errorf("event %d: unknown type %q", entry.ID, entry.Type)
+	}
+	ev, err := decode(entry.Event)
+	if err != nil {
+		return nil, fmt.Errorf("event %d: %v", entry.ID, err)
+	}
+	return ev, nil
+}
+
+// errStopReplay ends a replay early without an error
+var errStopReplay = errors.New("stop replay")
+
+// replayEvents calls fn with every logged event after the given ID, oldest first,
+// until fn returns an error. Returning errStopReplay ends the replay cleanly.
+func replayEvents(after int64, fn func(entry LoggedEvent) error) error {
+	for {
+		entries, err := readEventLog(after, eventLogPage)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := fn(entry); err == errStopReplay {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			after = entry.ID
+		}
+		if len(entries) < eventLogPage {
+			return nil
+		}
+	}
+}
+
+// readEventLog returns up to limit logged events after the given ID
+func readEventLog(after int64, limit int) ([]LoggedEvent, error) {
+	rows, err := db.Query("SELECT id, type, data, created_at FROM event_log WHERE id > ? ORDER BY id LIMIT ?", after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []LoggedEvent
+	for rows.Next() {
+		var entry LoggedEvent
+		var data string
+		if err := rows.Scan(&entry.ID, &entry.Type, &data, &entry.Time); err != nil {
+			return nil, err
+		}
+		entry.Event = json.RawMessage(openBody(data))
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// runEventsCommand implements `chat-server events`, which writes the event log as
+// JSON lines for a new consumer to backfill from
+func runEventsCommand(args []string) error {
+	fs := newCommandFlags("events")
+	after := fs.Int64("after", 0, "only events after this ID, to resume a backfill")
+	eventType := fs.String("type", "", "only events of this type, e.g. message_posted")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: chat-server events [-after <id>] [-type <type>]")
+	}
+	if _, ok := eventDecoders[*eventType]; *eventType != "" && !ok {
+		return fmt.Errorf("unknown event type %q", *eventType)
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer closeDB()
+
+	enc := json.NewEncoder(os.Stdout)
+	return replayEvents(*after, func(entry LoggedEvent) error {
+		if *eventType != "" && entry.Type != *eventType {
+			return nil
+		}
+		return enc.Encode(entry)
+	})
+}
@@ -0,0 +1,146 @@
+// Package main contains the typed events that describe server activity
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Event is something that happened on the server. Producers emit events on the bus
+// instead of formatting output themselves; each consumer turns them into its own
+// output, so a chat line, a presence summary, a stream record and a friend notice
+// all come from the same event.
+type Event interface {
+	// eventName names the event in logs and the event log
+	eventName() string
+}
+
+// UserConnected is a user logging in
+type UserConnected struct {
+	User *UserIdentity `json:"user"`
+	// FirstSession is set if the account had no other session on this instance
+	FirstSession bool `json:"first_session"`
+}
+
+// UserDisconnected is a logged in user's connection closing
+type UserDisconnected struct {
+	User *UserIdentity `json:"user"`
+	// Channels are the channels the user was a member of
+	Channels []string `json:"channels"`
+	// LastSession is set if the account has no other session on this instance
+	LastSession bool `json:"last_session"`
+}
+
+// UserJoined is a user joining a channel
+type UserJoined struct {
+	User    *UserIdentity `json:"user"`
+	Channel string        `json:"channel"`
+}
+
+// UserLeft is a user leaving a channel
+type UserLeft struct {
+	User    *UserIdentity `json:"user"`
+	Channel string        `json:"channel"`
+}
+
+// StatusChanged is a user setting their status
+type StatusChanged struct {
+	User   *UserIdentity `json:"user"`
+	Status string        `json:"status"`
+}
+
+// MessagePosted is a chat message accepted into a channel
+type MessagePosted struct {
+	ID      string        `json:"id"`
+	Seq     int64         `json:"seq"`
+	Channel string        `json:"channel"`
+	User    *UserIdentity `json:"user"`
+	Body    string        `json:"body"`
+	Tag     string        `json:"tag,omitempty"`
+	// Bot marks messages from bot accounts
+	Bot  bool      `json:"bot,omitempty"`
+	Time time.Time `json:"ts"`
+	// Buttons can be clicked by channel members, reporting the click to User
+	Buttons []Button `json:"buttons,omitempty"`
+}
+
+// ButtonClicked is a channel member clicking a button on a message
+type ButtonClicked struct {
+	User *UserIdentity `json:"user"`
+	// Author is the account that posted the message
+	Author    string `json:"author"`
+	Channel   string `json:"channel"`
+	MessageID string `json:"message_id"`
+	Button    string `json:"button"`
+	Label     string `json:"label"`
+}
+
+// ReactionChanged is a channel member adding or removing an emoji reaction to a message
+type ReactionChanged struct {
+	User      *UserIdentity `json:"user"`
+	Channel   string        `json:"channel"`
+	MessageID string        `json:"message_id"`
+	Emoji     string        `json:"emoji"`
+	Removed   bool          `json:"removed,omitempty"`
+}
+
+func (UserConnected) eventName() string    { return "user_connected" }
+func (UserDisconnected) eventName() string { return "user_disconnected" }
+func (UserJoined) eventName() string       { return "user_joined" }
+func (UserLeft) eventName() string         { return "user_left" }
+func (StatusChanged) eventName() string    { return "status_changed" }
+func (MessagePosted) eventName() string    { return "message_posted" }
+func (ButtonClicked) eventName() string    { return "button_clicked" }
+func (ReactionChanged) eventName() string  { return "reaction_changed" }
+
+// eventConsumers receive every event emitted on this instance, in order
+var eventConsumers = []func(Event){
+	renderChatEvent,
+	presenceConsumer,
+	streamConsumer,
+	friendsConsumer,
+	integrationsConsumer,
+	interactiveConsumer,
+	reactionsConsumer,
+	logEvent,
+}
+
+// dispatchEvent hands an event to every consumer
+func dispatchEvent(ev Event) {
+	logger.Debug("event", "name", ev.eventName())
+	for _, consume := range eventConsumers {
+		consume(ev)
+	}
+}
+
+// renderChatEvent renders chat messages as the colored lines and JSON events
+// delivered to channel members
+func renderChatEvent(ev Event) {
+	posted, ok := ev.(MessagePosted)
+	if !ok {
+		return
+	}
+	shown := posted.Body
+	if posted.Tag != "" {
+		shown = fmt.Sprintf("[%s] %s", posted.Tag, posted.Body)
+	}
+	text := fmt.Sprintf("\033[34m%s: %s\033[0m\n", posted.User.Name, shown)
+	if posted.Bot {
+		text = fmt.Sprintf("\033[34m[bot] %s: %s\033[0m\n", posted.User.Name, shown)
+	}
+	if len(posted.Buttons) > 0 {
+		text += buttonsText(posted.ID, posted.Buttons)
+	}
+	bus.Publish(OutgoingMessage{
+		channel: posted.Channel,
+		text:    text,
+		bot:     posted.Bot,
+		tag:     posted.Tag,
+		sent:    posted.Time,
+		id:      posted.ID,
+		from:    posted.User.Name,
+		body:    posted.Body,
+		seq:     posted.Seq,
+		buttons: posted.Buttons,
+	})
+}
@@ -0,0 +1,10 @@
+//go:build !chaos
+
+// Package main contains the no-op fault hooks used in normal builds; see faults_chaos.go
+package main
+
+// writeFault is called before each write to a client
+func writeFault() error { return nil }
+
+// dbFault is called before each database write
+func dbFault() error { return nil }
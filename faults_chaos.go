@@ -0,0 +1,86 @@
+//go:build chaos
+
+// Package main contains fault injection hooks, compiled in only with -tags chaos
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// faultConfig says how often and how badly injected faults strike
+type faultConfig struct {
+	// writeFailRate is the fraction of client writes that fail
+	writeFailRate float64
+	// dbFailRate is the fraction of database writes that fail as if the database were locked
+	dbFailRate float64
+	// latency is added to every client and database write
+	latency time.Duration
+}
+
+var (
+	faults      faultConfig
+	faultsMutex = &sync.Mutex{}
+	faultRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	errInjectedWrite = errors.New("injected write failure")
+	// errInjectedDB reads like a locked database, so it takes the same recovery path
+	errInjectedDB = errors.New("injected failure: database is locked")
+)
+
+// init reads faults from CHAT_FAULT_WRITE_RATE, CHAT_FAULT_DB_RATE and CHAT_FAULT_LATENCY
+func init() {
+	if v := os.Getenv("CHAT_FAULT_WRITE_RATE"); v != "" {
+		faults.writeFailRate, _ = strconv.ParseFloat(v, 64)
+	}
+	if v := os.Getenv("CHAT_FAULT_DB_RATE"); v != "" {
+		faults.dbFailRate, _ = strconv.ParseFloat(v, 64)
+	}
+	if v := os.Getenv("CHAT_FAULT_LATENCY"); v != "" {
+		faults.latency, _ = time.ParseDuration(v)
+	}
+	logger.Warn("fault injection enabled", "faults", fmt.Sprintf("%+v", faults))
+}
+
+// setFaults replaces the fault configuration and returns a function that restores it
+func setFaults(f faultConfig) (restore func()) {
+	faultsMutex.Lock()
+	defer faultsMutex.Unlock()
+	saved := faults
+	faults = f
+	return func() { setFaults(saved) }
+}
+
+// strike waits the configured latency and reports whether a fault at rate hits
+func strike(rate func(faultConfig) float64) bool {
+	faultsMutex.Lock()
+	f := faults
+	hit := faultRand.Float64() < rate(f)
+	faultsMutex.Unlock()
+
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+	return hit
+}
+
+// writeFault is called before each write to a client
+func writeFault() error {
+	if strike(func(f faultConfig) float64 { return f.writeFailRate }) {
+		return errInjectedWrite
+	}
+	return nil
+}
+
+// dbFault is called before each database write
+func dbFault() error {
+	if strike(func(f faultConfig) float64 { return f.dbFailRate }) {
+		return errInjectedDB
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+// Package main contains server-relayed file transfers between users
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// fileOfferTTL is how long a recipient has to accept a file before the offer lapses
+	fileOfferTTL = 2 * time.Minute
+	// maxTransfersPerUser caps the transfers one user may have open at once
+	maxTransfersPerUser = 3
+	// maxFileNameLength caps the length of an offered file name
+	maxFileNameLength = 100
+)
+
+var (
+	// maxFileSize is the largest file users may send each other, in bytes (0 disables /sendfile)
+	maxFileSize = 1 << 20
+
+	// transfers holds open file transfers by ID; guarded by mutex
+	transfers = make(map[string]*fileTransfer)
+
+	filesSent     = newCounter("files_sent")
+	fileBytesSent = newCounter("file_bytes_sent")
+)
+
+// fileTransfer is a file offered by one user to another. Once accepted, the sender
+// uploads it in base64 chunks that are relayed to the recipient as they arrive, so
+// the server never holds a whole file.
+type fileTransfer struct {
+	id       string
+	from, to net.Conn
+	fromName string
+	toName   string
+	filename string
+	// size is the size the sender announced, 0 if it didn't
+	size     int64
+	received int64
+	sum      hash.Hash
+	accepted bool
+}
+
+// validFileName reports whether name can be offered: a plain name without a path or
+// control characters
+func validFileName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > maxFileNameLength {
+		return false
+	}
+	for _, r := range name {
+		if r < ' ' || r == 0x7f || r == '/' || r == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// openTransfersLocked counts the transfers conn is sending or receiving.
+// Callers must hold mutex.
+func openTransfersLocked(conn net.Conn) int {
+	n := 0
+	for _, t := range transfers {
+		if t.from == conn || t.to == conn {
+			n++
+		}
+	}
+	return n
+}
+
+// cancelTransfersLocked drops every transfer of a disconnecting connection and tells
+// the other side. Callers must hold mutex.
+func cancelTransfersLocked(conn net.Conn) {
+	for id, t := range transfers {
+		switch conn {
+		case t.from:
+			delete(transfers, id)
+			t.to.Write([]byte(fmt.Sprintf("FILEABORT %s\n\033[1;31m%s disconnected, transfer of %s cancelled.\033[0m\n", id, t.fromName, t.filename)))
+		case t.to:
+			delete(transfers, id)
+			t.from.Write([]byte(fmt.Sprintf("\033[1;31m%s disconnected, transfer of %s cancelled.\033[0m\n", t.toName, t.filename)))
+		}
+	}
+}
+
+// handleSendFileCommand handles the /sendfile command, offering a file to a user
+// Format: /sendfile <user> <filename> [size]
+func handleSendFileCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) < 3 || len(parts) > 4 {
+		conn.Write([]byte("\033[1;31mUsage: /sendfile <user> <filename> [size]\033[0m\n"))
+		return
+	}
+	if maxFileSize <= 0 {
+		conn.Write([]byte("\033[1;31mFile transfers are disabled on this server.\033[0m\n"))
+		return
+	}
+	filename := parts[2]
+	if !validFileName(filename) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mFile names can't contain paths or control characters (max %d characters).\033[0m\n", maxFileNameLength)))
+		return
+	}
+	var size int64
+	if len(parts) == 4 {
+		n, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil || n <= 0 {
+			conn.Write([]byte("\033[1;31mThe size must be a positive number of bytes.\033[0m\n"))
+			return
+		}
+		size = n
+	}
+	if size > int64(maxFileSize) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mFiles can be at most %s.\033[0m\n", formatBytes(int64(maxFileSize)))))
+		return
+	}
+
+	b := make([]byte, 4)
+	if err := readRandom(b); err != nil {
+		conn.Write([]byte("\033[1;31mError starting transfer.\033[0m\n"))
+		return
+	}
+	id := hex.EncodeToString(b)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	recipient, candidates, ambiguous := resolveRecipientLocked(parts[1])
+	to, ok := hub.ByName(recipient)
+	switch {
+	case ambiguous:
+		conn.Write([]byte(fmt.Sprintf("Ambiguous recipient %s, did you mean: %s?\n", parts[1], strings.Join(candidates, ", "))))
+		return
+	case !ok:
+		conn.Write([]byte(fmt.Sprintf("User %s not found\n", parts[1])))
+		return
+	case to == conn:
+		conn.Write([]byte("\033[1;31mYou can't send a file to yourself.\033[0m\n"))
+		return
+	case openTransfersLocked(conn) >= maxTransfersPerUser:
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou can have at most %d transfers open at once.\033[0m\n", maxTransfersPerUser)))
+		return
+	}
+
+	t := &fileTransfer{id: id, from: conn, to: to, fromName: hub.Name(conn), toName: recipient, filename: filename, size: size, sum: sha256.New()}
+	transfers[id] = t
+	clock.AfterFunc(fileOfferTTL, func() { expireFileOffer(id) })
+
+	shown := "size not given"
+	if size > 0 {
+		shown = formatBytes(size)
+	}
+	to.Write([]byte(fmt.Sprintf("\033[1;36m%s wants to send you %s (%s). Type /transfer accept %s or /transfer reject %s.\033[0m\n",
+		t.fromName, filename, shown, id, id)))
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mOffered %s to %s (transfer %s). Waiting for them to accept...\033[0m\n", filename, recipient, id)))
+}
+
+// expireFileOffer withdraws an offer that wasn't accepted in time
+func expireFileOffer(id string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	t := transfers[id]
+	if t == nil || t.accepted {
+		return
+	}
+	delete(transfers, id)
+	t.from.Write([]byte(fmt.Sprintf("\033[1;31m%s didn't accept %s in time.\033[0m\n", t.toName, t.filename)))
+	t.to.Write([]byte(fmt.Sprintf("\033[90mThe offer of %s from %s has expired.\033[0m\n", t.filename, t.fromName)))
+}
+
+// handleTransferCommand handles the /transfer command. The recipient accepts or
+// rejects an offer; the sender uploads the file in base64 chunks and then ends it.
+// Either side may cancel.
+// Format: /transfer accept|reject|cancel|end <id> | /transfer chunk <id> <base64>
+func handleTransferCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) < 3 || len(parts) > 4 || (len(parts) == 4) != (parts[1] == "chunk") {
+		conn.Write([]byte("\033[1;31mUsage: /transfer accept|reject|cancel|end <id> or /transfer chunk <id> <base64>\033[0m\n"))
+		return
+	}
+	action, id := parts[1], parts[2]
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	t := transfers[id]
+	if t == nil || (t.from != conn && t.to != conn) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mNo transfer %s.\033[0m\n", id)))
+		return
+	}
+
+	switch action {
+	case "accept", "reject":
+		if conn != t.to || t.accepted {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mTransfer %s isn't waiting for your answer.\033[0m\n", id)))
+			return
+		}
+		if action == "reject" {
+			delete(transfers, id)
+			t.from.Write([]byte(fmt.Sprintf("\033[1;31m%s declined %s.\033[0m\n", t.toName, t.filename)))
+			conn.Write([]byte(fmt.Sprintf("\033[90mDeclined %s.\033[0m\n", t.filename)))
+			return
+		}
+		t.accepted = true
+		conn.Write([]byte(fmt.Sprintf("FILESTART %s %s %d\n\033[1;32mReceiving %s from %s...\033[0m\n", id, t.filename, t.size, t.filename, t.fromName)))
+		t.from.Write([]byte(fmt.Sprintf("\033[1;32m%s accepted %s. Send it with /transfer chunk %s <base64> lines, then /transfer end %s.\033[0m\n",
+			t.toName, t.filename, id, id)))
+
+	case "cancel":
+		delete(transfers, id)
+		if conn == t.from {
+			t.to.Write([]byte(fmt.Sprintf("FILEABORT %s\n\033[1;31m%s cancelled the transfer of %s.\033[0m\n", id, t.fromName, t.filename)))
+		} else {
+			t.from.Write([]byte(fmt.Sprintf("\033[1;31m%s cancelled the transfer of %s.\033[0m\n", t.toName, t.filename)))
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[90mCancelled transfer of %s.\033[0m\n", t.filename)))
+
+	case "chunk", "end":
+		if conn != t.from || !t.accepted {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mTransfer %s hasn't been accepted yet.\033[0m\n", id)))
+			return
+		}
+		if action == "chunk" {
+			relayFileChunkLocked(t, parts[3])
+			return
+		}
+		delete(transfers, id)
+		if t.size > 0 && t.received != t.size {
+			t.to.Write([]byte(fmt.Sprintf("FILEABORT %s\n\033[1;31mTransfer of %s failed: incomplete file.\033[0m\n", id, t.filename)))
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mSent %d of the %d bytes announced; transfer cancelled.\033[0m\n", t.received, t.size)))
+			return
+		}
+		filesSent.Add(1)
+		digest := hex.EncodeToString(t.sum.Sum(nil))
+		t.to.Write([]byte(fmt.Sprintf("FILEEND %s %d %s\n\033[1;32mReceived %s from %s (%s).\033[0m\n",
+			id, t.received, digest, t.filename, t.fromName, formatBytes(t.received))))
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mSent %s to %s (%s).\033[0m\n", t.filename, t.toName, formatBytes(t.received))))
+
+	default:
+		conn.Write([]byte("\033[1;31mUsage: /transfer accept|reject|cancel|end <id> or /transfer chunk <id> <base64>\033[0m\n"))
+	}
+}
+
+// relayFileChunkLocked checks one uploaded chunk and passes it on to the recipient,
+// cancelling the transfer if the file grows too large. Callers must hold mutex.
+func relayFileChunkLocked(t *fileTransfer, chunk string) {
+	data, err := base64.StdEncoding.DecodeString(chunk)
+	if err != nil {
+		t.from.Write([]byte("\033[1;31mChunks must be standard base64. Chunk not sent.\033[0m\n"))
+		return
+	}
+	limit := int64(maxFileSize)
+	if t.size > 0 {
+		limit = t.size
+	}
+	if t.received+int64(len(data)) > limit {
+		delete(transfers, t.id)
+		t.to.Write([]byte(fmt.Sprintf("FILEABORT %s\n\033[1;31mTransfer of %s failed: file too large.\033[0m\n", t.id, t.filename)))
+		t.from.Write([]byte(fmt.Sprintf("\033[1;31m%s is larger than %s; transfer cancelled.\033[0m\n", t.filename, formatBytes(limit))))
+		return
+	}
+	t.received += int64(len(data))
+	t.sum.Write(data)
+	fileBytesSent.Add(int64(len(data)))
+	t.to.Write([]byte(fmt.Sprintf("FILECHUNK %s %s\n", t.id, chunk)))
+}
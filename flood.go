@@ -0,0 +1,141 @@
+// Package main contains per-user flood protection with escalating penalties
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// floodStrikeMemory is how long a flood offence counts towards the next penalty
+const floodStrikeMemory = 5 * time.Minute
+
+var (
+	// floodMessages is how many messages a user may send per floodWindow (0 disables flood protection)
+	floodMessages int
+	// floodWindow is the period floodMessages is measured over
+	floodWindow = 10 * time.Second
+	// floodMute is how long a repeat offender is muted
+	floodMute = time.Minute
+
+	// floodStates tracks each account's message allowance across all its sessions.
+	// It outlives disconnects, so reconnecting doesn't refill the allowance or wipe
+	// the offence record; guarded by mutex.
+	floodStates = make(map[string]*floodState)
+
+	floodWarnings    = newCounter("flood_warnings")
+	floodMutes       = newCounter("flood_mutes")
+	floodDisconnects = newCounter("flood_disconnects")
+)
+
+// floodState is a token bucket of messages plus the account's offence record
+type floodState struct {
+	tokens     float64
+	last       time.Time
+	strikes    int
+	lastStrike time.Time
+	mutedUntil time.Time
+}
+
+// floodPenalty is what happens to a message under flood protection
+type floodPenalty int
+
+const (
+	floodAllowed  floodPenalty = iota
+	floodMuted                 // still muted, the message is dropped
+	floodWarned                // first offence
+	floodMutedNow              // second offence
+	floodKicked                // offence after a mute
+)
+
+// checkFloodLocked takes one message from account's allowance and returns the penalty.
+// Callers must hold mutex.
+func checkFloodLocked(account string, now time.Time) (floodPenalty, time.Duration) {
+	s := floodStates[account]
+	if s == nil {
+		s = &floodState{tokens: float64(floodMessages), last: now}
+		floodStates[account] = s
+	}
+	if now.Before(s.mutedUntil) {
+		return floodMuted, s.mutedUntil.Sub(now)
+	}
+
+	rate := float64(floodMessages) / floodWindow.Seconds()
+	s.tokens = min(float64(floodMessages), s.tokens+now.Sub(s.last).Seconds()*rate)
+	s.last = now
+	if s.tokens >= 1 {
+		s.tokens--
+		return floodAllowed, 0
+	}
+
+	if now.Sub(s.lastStrike) > floodStrikeMemory {
+		s.strikes = 0
+	}
+	s.strikes++
+	s.lastStrike = now
+	switch s.strikes {
+	case 1:
+		return floodWarned, 0
+	case 2:
+		s.mutedUntil = now.Add(floodMute)
+		return floodMutedNow, floodMute
+	default:
+		return floodKicked, 0
+	}
+}
+
+// forgettable reports whether the state is no different from a fresh one: not
+// muted, no offence remembered, and the allowance full again
+func (s *floodState) forgettable(now time.Time) bool {
+	return !now.Before(s.mutedUntil) && now.Sub(s.lastStrike) > floodStrikeMemory && now.Sub(s.last) >= floodWindow
+}
+
+// forgetFloodLocked drops an account's flood state once it no longer matters.
+// Callers must hold mutex.
+func forgetFloodLocked(account string, now time.Time) {
+	if s := floodStates[account]; s != nil && s.forgettable(now) {
+		delete(floodStates, account)
+	}
+}
+
+// pruneFloodStatesLocked drops the flood states that no longer matter, such as those
+// of offenders who left and didn't come back. Callers must hold mutex.
+func pruneFloodStatesLocked(now time.Time) {
+	for account := range floodStates {
+		forgetFloodLocked(account, now)
+	}
+}
+
+// checkFlood reports whether conn may send a message now, applying the penalty
+// for flooding: a warning, then a temporary mute, then a disconnect. Admins are exempt.
+func checkFlood(conn net.Conn) bool {
+	if floodMessages <= 0 || isAdmin(conn) {
+		return true
+	}
+
+	mutex.Lock()
+	penalty, wait := checkFloodLocked(hub.Account(conn), clock.Now())
+	name := hub.Name(conn)
+	mutex.Unlock()
+
+	switch penalty {
+	case floodAllowed:
+		return true
+	case floodMuted:
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou are muted for flooding for another %ds.\033[0m\n", int(wait.Seconds())+1)))
+	case floodWarned:
+		floodWarnings.Add(1)
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou are sending messages too fast (limit %d per %s). Message not sent. Keep going and you will be muted.\033[0m\n",
+			floodMessages, floodWindow)))
+	case floodMutedNow:
+		floodMutes.Add(1)
+		logModeration("server", "mute", name, "flooding")
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou have been muted for %s for flooding.\033[0m\n", wait)))
+	case floodKicked:
+		floodDisconnects.Add(1)
+		logModeration("server", "kick", name, "flooding")
+		conn.Write([]byte("\033[1;31mDisconnected for flooding.\033[0m\n"))
+		conn.Close()
+	}
+	return false
+}
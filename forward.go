@@ -0,0 +1,80 @@
+// Package main contains forwarding of stored messages between channels
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// forwardedMessage is a stored channel message looked up to be forwarded
+type forwardedMessage struct {
+	sender  string
+	channel string
+	body    string
+}
+
+// getChannelMessage looks up a stored channel message by ID
+func getChannelMessage(id string) (forwardedMessage, bool, error) {
+	var m forwardedMessage
+	err := db.QueryRow("SELECT sender, channel, body FROM messages WHERE message_id = ? AND seq IS NOT NULL", id).
+		Scan(&m.sender, &m.channel, &m.body)
+	if err == sql.ErrNoRows {
+		return m, false, nil
+	}
+	m.body = openBody(m.body)
+	return m, err == nil, err
+}
+
+// forwardBody attributes a forwarded message to its sender and original channel and
+// refers back to the original by ID
+func forwardBody(id string, m forwardedMessage) string {
+	return fmt.Sprintf("[forwarded from @%s in %s, %s] %s", m.sender, m.channel, id, m.body)
+}
+
+// handleForwardCommand handles the /forward command, reposting a stored message to
+// another channel. The user must be a member of both channels, so forwarding can't
+// read or post anywhere they couldn't themselves.
+// Format: /forward <message-id> <#channel>
+func handleForwardCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "#") {
+		conn.Write([]byte("\033[1;31mUsage: /forward <message-id> <#channel>\033[0m\n"))
+		return
+	}
+	id, target := parts[1], strings.ToLower(parts[2])
+
+	m, found, err := getChannelMessage(id)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError looking up the message. Please try again.\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	username := hub.Account(conn)
+	session := sessionForLocked(conn)
+	inSource, inTarget := found && session.joined[m.channel], session.joined[target]
+	mutex.Unlock()
+
+	switch {
+	case !inSource:
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mNo message %s in your channels.\033[0m\n", id)))
+		return
+	case !inTarget:
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou must /join %s before forwarding to it.\033[0m\n", target)))
+		return
+	case m.channel == target:
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mThat message is already in %s.\033[0m\n", target)))
+		return
+	}
+	// Restrictions may have changed since the user joined
+	if ok, reason := checkChannelEligibility(username, target); !ok {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou can't post in %s: %s.\033[0m\n", target, reason)))
+		return
+	}
+
+	if postChannelMessage(conn, target, forwardBody(id, m), "", "", nil) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mForwarded message %s to %s.\033[0m\n", id, target)))
+	}
+}
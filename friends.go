@@ -0,0 +1,210 @@
+// Package main contains friend lists and the presence notifications sent to friends
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// addFriend adds friend to an account's friend list
+func addFriend(username, friend string) error {
+	_, err := db.Exec("INSERT INTO friends (username, friend, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+		username, friend, time.Now().UTC())
+	return err
+}
+
+// removeFriend takes friend off an account's friend list, reporting whether it was there
+func removeFriend(username, friend string) (bool, error) {
+	res, err := db.Exec("DELETE FROM friends WHERE username = ? AND friend = ?", username, friend)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// queryAccounts returns the single column of accounts a query selects
+func queryAccounts(query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// getFriends returns an account's friends in alphabetical order
+func getFriends(username string) ([]string, error) {
+	return queryAccounts("SELECT friend FROM friends WHERE username = ? ORDER BY friend", username)
+}
+
+// getFriendOf returns the accounts that have username on their friend list
+func getFriendOf(username string) ([]string, error) {
+	return queryAccounts("SELECT username FROM friends WHERE friend = ?", username)
+}
+
+// accountOnlineLocked reports whether any connection other than except is logged in
+// to account. The caller must hold mutex.
+func accountOnlineLocked(account string, except net.Conn) bool {
+	for _, conn := range hub.ConnsForAccount(account) {
+		if conn != except {
+			return true
+		}
+	}
+	return false
+}
+
+// friendsConsumer tells users when a friend comes online, goes offline or changes status
+func friendsConsumer(ev Event) {
+	switch ev := ev.(type) {
+	case UserConnected:
+		if ev.FirstSession {
+			notifyFriends(ev.User.Account, fmt.Sprintf("Your friend @%s is now online as %s.", ev.User.Account, ev.User.Name))
+		}
+	case UserDisconnected:
+		if ev.LastSession {
+			notifyFriends(ev.User.Account, fmt.Sprintf("Your friend @%s went offline.", ev.User.Account))
+		}
+	case StatusChanged:
+		if ev.Status == "" {
+			notifyFriends(ev.User.Account, fmt.Sprintf("Your friend @%s cleared their status.", ev.User.Account))
+			return
+		}
+		notifyFriends(ev.User.Account, fmt.Sprintf("Your friend @%s changed status to: %s", ev.User.Account, ev.Status))
+	}
+}
+
+// notifyFriends tells every online user who has account as a friend about a change
+// in its presence
+func notifyFriends(account, text string) {
+	if account == "" {
+		return
+	}
+	watchers, err := getFriendOf(account)
+	if err != nil {
+		logger.Error("loading friends", "account", account, "err", err)
+		return
+	}
+	if len(watchers) == 0 {
+		return
+	}
+	watching := make(map[string]bool, len(watchers))
+	for _, w := range watchers {
+		watching[w] = true
+	}
+
+	mutex.Lock()
+	var conns []net.Conn
+	for _, c := range hub.Clients() {
+		if watching[c.Account] {
+			conns = append(conns, c.Conn)
+		}
+	}
+	mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Write([]byte("\033[1;35m" + text + "\033[0m\n"))
+	}
+}
+
+// handleFriendCommand handles the /friend command
+// Format: /friend add <account> | /friend remove <account> | /friend list
+func handleFriendCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) == 0 || (args[0] == "list" && len(args) != 1) ||
+		((args[0] == "add" || args[0] == "remove") && len(args) != 2) ||
+		(args[0] != "list" && args[0] != "add" && args[0] != "remove") {
+		conn.Write([]byte("\033[1;31mUsage: /friend add|remove <account> or /friend list\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+	if username == "" {
+		conn.Write([]byte("\033[1;31mOnly registered accounts have a friend list.\033[0m\n"))
+		return
+	}
+
+	if args[0] == "list" {
+		listFriends(conn, username)
+		return
+	}
+
+	friend := strings.TrimPrefix(args[1], "@")
+	if args[0] == "remove" {
+		removed, err := removeFriend(username, friend)
+		switch {
+		case err != nil:
+			conn.Write([]byte("\033[1;31mError updating friend list.\033[0m\n"))
+		case !removed:
+			conn.Write([]byte(fmt.Sprintf("\033[1;31m%s is not on your friend list.\033[0m\n", friend)))
+		default:
+			conn.Write([]byte(fmt.Sprintf("\033[1;32mRemoved %s from your friends.\033[0m\n", friend)))
+		}
+		return
+	}
+
+	if friend == username {
+		conn.Write([]byte("\033[1;31mYou can't add yourself as a friend.\033[0m\n"))
+		return
+	}
+	exists, err := userExists(friend)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError updating friend list.\033[0m\n"))
+		return
+	}
+	if !exists {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mNo account named %s.\033[0m\n", friend)))
+		return
+	}
+	if err := addFriend(username, friend); err != nil {
+		conn.Write([]byte("\033[1;31mError updating friend list.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mAdded %s to your friends. You'll be told when they come online.\033[0m\n", friend)))
+}
+
+// listFriends shows an account's friends with whether they are online and their status
+func listFriends(conn net.Conn, username string) {
+	friends, err := getFriends(username)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError retrieving friend list.\033[0m\n"))
+		return
+	}
+	if len(friends) == 0 {
+		conn.Write([]byte("\033[90mYour friend list is empty. Add someone with /friend add <account>.\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	online := make(map[string]bool, len(friends))
+	for _, friend := range friends {
+		online[friend] = accountOnlineLocked(friend, nil)
+	}
+	mutex.Unlock()
+
+	for _, friend := range friends {
+		line := friend
+		if online[friend] {
+			line += " - online"
+		} else {
+			line += " - offline"
+		}
+		if status, err := getUserStatus(friend); err == nil && status != "" {
+			line += " (" + status + ")"
+		}
+		conn.Write([]byte("\033[90m" + line + "\033[0m\n"))
+	}
+}
@@ -0,0 +1,454 @@
+// Package main contains the framework for two-player, turn-based games played in a
+// channel or privately. Games are stored after every move, so they survive
+// reconnects and restarts.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	gamePlaying  = "playing"
+	gameWon      = "won"
+	gameDrawn    = "drawn"
+	gameResigned = "resigned"
+	// maxActiveGames caps the unfinished games one account may be in
+	maxActiveGames = 10
+)
+
+// GameRules are the rules of a two-player, turn-based game. A game's whole state is
+// a string, stored with the game after every move.
+type GameRules interface {
+	// Title is the game's name as shown to players
+	Title() string
+	// Sides names the two players' sides, e.g. X and O; the first side moves first
+	Sides() [2]string
+	// Start returns the state of a new game
+	Start() string
+	// Move applies a move by player 0 or 1, or explains why it isn't allowed
+	Move(state string, player int, move string) (string, error)
+	// Result reports whether the game is over and who won: 0, 1, or -1 for a draw
+	Result(state string) (over bool, winner int)
+	// Render draws the state for chat
+	Render(state string) string
+	// MoveHelp describes a move for /move
+	MoveHelp() string
+}
+
+// gameKinds are the games that can be started, by command name
+var gameKinds = map[string]GameRules{
+	"tictactoe": ticTacToe{},
+}
+
+// errGameChanged is returned when a game was changed by another move or session
+// between being loaded and saved
+var errGameChanged = errors.New("game changed")
+
+// Game is one game between two accounts
+type Game struct {
+	ID   int64
+	Kind string
+	// Channel is where the game is shown, or empty for a private game
+	Channel string
+	Players [2]string
+	State   string
+	// Turn is the index of the player to move
+	Turn   int
+	Status string
+	Winner string
+}
+
+// rules returns the rules of the game's kind
+func (g Game) rules() GameRules {
+	return gameKinds[g.Kind]
+}
+
+// player returns account's index in the game, or -1 if it isn't playing
+func (g Game) player(account string) int {
+	for i, p := range g.Players {
+		if p == account {
+			return i
+		}
+	}
+	return -1
+}
+
+// board renders the game with its players and whose turn it is or how it ended
+func (g Game) board() string {
+	rules := g.rules()
+	sides := rules.Sides()
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("\033[1;36m%s game %d: @%s (%s) vs @%s (%s)\033[0m\n", rules.Title(), g.ID, g.Players[0], sides[0], g.Players[1], sides[1]))
+	out.WriteString(rules.Render(g.State))
+	switch g.Status {
+	case gamePlaying:
+		out.WriteString(fmt.Sprintf("\033[1;33m@%s to move: /move %d <move>\033[0m\n", g.Players[g.Turn], g.ID))
+	case gameWon:
+		out.WriteString(fmt.Sprintf("\033[1;32m@%s wins!\033[0m\n", g.Winner))
+	case gameDrawn:
+		out.WriteString("\033[1;32mIt's a draw.\033[0m\n")
+	case gameResigned:
+		out.WriteString(fmt.Sprintf("\033[1;32m@%s resigned; @%s wins.\033[0m\n", g.Players[1-g.player(g.Winner)], g.Winner))
+	}
+	return out.String()
+}
+
+// createGame stores a new game, with the challenger moving first
+func createGame(kind, channel, challenger, opponent string) (Game, error) {
+	g := Game{Kind: kind, Channel: channel, Players: [2]string{challenger, opponent}, State: gameKinds[kind].Start(), Status: gamePlaying}
+	now := clock.Now()
+	result, err := db.Exec(`INSERT INTO games (kind, channel, player1, player2, state, turn, status, winner, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, 0, ?, '', ?, ?)`, g.Kind, g.Channel, challenger, opponent, g.State, g.Status, now, now)
+	if err != nil {
+		return Game{}, err
+	}
+	g.ID, err = result.LastInsertId()
+	return g, err
+}
+
+// scanGame reads a game from a row selected with gameColumns
+func scanGame(row interface{ Scan(...interface{}) error }) (Game, error) {
+	var g Game
+	err := row.Scan(&g.ID, &g.Kind, &g.Channel, &g.Players[0], &g.Players[1], &g.State, &g.Turn, &g.Status, &g.Winner)
+	return g, err
+}
+
+const gameColumns = "id, kind, channel, player1, player2, state, turn, status, winner"
+
+// loadGame returns a game by ID, reporting false if there is none
+func loadGame(id int64) (Game, bool, error) {
+	g, err := scanGame(db.QueryRow("SELECT "+gameColumns+" FROM games WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return Game{}, false, nil
+	}
+	return g, err == nil, err
+}
+
+// activeGames returns account's unfinished games, oldest first
+func activeGames(account string) ([]Game, error) {
+	rows, err := db.Query("SELECT "+gameColumns+" FROM games WHERE status = ? AND (player1 = ? OR player2 = ?) ORDER BY id", gamePlaying, account, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var games []Game
+	for rows.Next() {
+		g, err := scanGame(rows)
+		if err != nil {
+			return nil, err
+		}
+		games = append(games, g)
+	}
+	return games, rows.Err()
+}
+
+// saveGame stores a move or a finished game. It fails with errGameChanged if the game
+// no longer has the state it was loaded with, so two sessions, or two servers
+// sharing the database, can't both move at once.
+func saveGame(g Game, loadedState string) error {
+	result, err := db.Exec("UPDATE games SET state = ?, turn = ?, status = ?, winner = ?, updated_at = ? WHERE id = ? AND state = ? AND status = ?",
+		g.State, g.Turn, g.Status, g.Winner, clock.Now(), g.ID, loadedState, gamePlaying)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errGameChanged
+	}
+	return nil
+}
+
+// playMove applies account's move to a game, finishing it if the move ends it
+func playMove(g Game, account, move string) (Game, error) {
+	player := g.player(account)
+	if player < 0 {
+		return g, fmt.Errorf("you aren't playing game %d", g.ID)
+	}
+	if g.Status != gamePlaying {
+		return g, fmt.Errorf("game %d is over", g.ID)
+	}
+	if g.Turn != player {
+		return g, fmt.Errorf("it is @%s's move", g.Players[g.Turn])
+	}
+	state, err := g.rules().Move(g.State, player, move)
+	if err != nil {
+		return g, err
+	}
+	g.State = state
+	if over, winner := g.rules().Result(state); over {
+		g.Status = gameDrawn
+		if winner >= 0 {
+			g.Status, g.Winner = gameWon, g.Players[winner]
+		}
+	} else {
+		g.Turn = 1 - player
+	}
+	return g, nil
+}
+
+// showGame sends a game's board to its channel, or to both players of a private
+// game. Players of a channel game who aren't in the channel get it directly.
+func showGame(g Game) {
+	text := g.board()
+	mutex.Lock()
+	for _, account := range g.Players {
+		for _, c := range hub.ConnsForAccount(account) {
+			if g.Channel == "" || !rooms[g.Channel][c] {
+				c.Write([]byte(text))
+			}
+		}
+	}
+	mutex.Unlock()
+	if g.Channel != "" {
+		bus.Publish(OutgoingMessage{channel: g.Channel, text: text})
+	}
+}
+
+// pickGame finds the game a command is about: the one whose ID is given, or else
+// the account's only unfinished game that matches
+func pickGame(account, id string, match func(Game) bool) (Game, error) {
+	if id != "" {
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return Game{}, fmt.Errorf("invalid game ID %q", id)
+		}
+		g, ok, err := loadGame(n)
+		if err != nil {
+			return Game{}, err
+		}
+		if !ok || g.player(account) < 0 {
+			return Game{}, fmt.Errorf("you aren't playing a game %d", n)
+		}
+		return g, nil
+	}
+	games, err := activeGames(account)
+	if err != nil {
+		return Game{}, err
+	}
+	var found []Game
+	for _, g := range games {
+		if match(g) {
+			found = append(found, g)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return Game{}, fmt.Errorf("you have no game in progress")
+	case 1:
+		return found[0], nil
+	}
+	return Game{}, fmt.Errorf("you are in several games; give the game ID, see /games")
+}
+
+// handleNewGameCommand starts a game named by the command, such as /tictactoe,
+// against another account, privately or in a channel the challenger is in
+// Format: /<game> <name|@account> [#channel]
+func handleNewGameCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	kind := strings.TrimPrefix(parts[0], "/")
+	if len(parts) != 2 && len(parts) != 3 {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mUsage: /%s <name|@account> [#channel]\033[0m\n", kind)))
+		return
+	}
+	mutex.Lock()
+	account := hub.Account(conn)
+	joined := sessionForLocked(conn).joined
+	channel := ""
+	if len(parts) == 3 {
+		channel = parts[2]
+		if !joined[channel] {
+			mutex.Unlock()
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mYou can only start a game in a channel you are in; /join %s first.\033[0m\n", channel)))
+			return
+		}
+	}
+	mutex.Unlock()
+
+	opponent := privateHistoryAccount(parts[1])
+	if opponent == account {
+		conn.Write([]byte("\033[1;31mYou can't play against yourself.\033[0m\n"))
+		return
+	}
+	user, err := lookupUser(opponent)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError looking up user. Please try again.\033[0m\n"))
+		return
+	}
+	if !user.exists {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mNo user %s.\033[0m\n", parts[1])))
+		return
+	}
+	for _, player := range []string{account, opponent} {
+		games, err := activeGames(player)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError starting the game. Please try again.\033[0m\n"))
+			return
+		}
+		if len(games) >= maxActiveGames {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31m@%s already has %d games in progress.\033[0m\n", player, maxActiveGames)))
+			return
+		}
+	}
+
+	g, err := createGame(kind, channel, account, opponent)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError starting the game. Please try again.\033[0m\n"))
+		return
+	}
+	showGame(g)
+}
+
+// handleMoveCommand handles the /move command
+// Format: /move [game-id] <move>
+func handleMoveCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) != 1 && len(args) != 2 {
+		conn.Write([]byte("\033[1;31mUsage: /move [game-id] <move>\033[0m\n"))
+		return
+	}
+	id, move := "", args[len(args)-1]
+	if len(args) == 2 {
+		id = args[0]
+	}
+	mutex.Lock()
+	account := hub.Account(conn)
+	mutex.Unlock()
+
+	g, err := pickGame(account, id, func(g Game) bool { return g.Players[g.Turn] == account })
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31m%s.\033[0m\n", err)))
+		return
+	}
+	loaded := g.State
+	if g, err = playMove(g, account, move); err != nil {
+		help := ""
+		if g.Status == gamePlaying && g.Turn == g.player(account) {
+			help = "; a move is " + g.rules().MoveHelp()
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[1;31m%s%s.\033[0m\n", err, help)))
+		return
+	}
+	if err := saveGame(g, loaded); err == errGameChanged {
+		conn.Write([]byte("\033[1;31mThe game changed while you moved; see /games and try again.\033[0m\n"))
+		return
+	} else if err != nil {
+		conn.Write([]byte("\033[1;31mError saving your move. Please try again.\033[0m\n"))
+		return
+	}
+	showGame(g)
+}
+
+// handleResignCommand handles the /resign command, which gives up a game
+// Format: /resign [game-id]
+func handleResignCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) > 1 {
+		conn.Write([]byte("\033[1;31mUsage: /resign [game-id]\033[0m\n"))
+		return
+	}
+	id := ""
+	if len(args) == 1 {
+		id = args[0]
+	}
+	mutex.Lock()
+	account := hub.Account(conn)
+	mutex.Unlock()
+
+	g, err := pickGame(account, id, func(Game) bool { return true })
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31m%s.\033[0m\n", err)))
+		return
+	}
+	if g.Status != gamePlaying {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mGame %d is over.\033[0m\n", g.ID)))
+		return
+	}
+	g.Status, g.Winner = gameResigned, g.Players[1-g.player(account)]
+	if err := saveGame(g, g.State); err == errGameChanged {
+		conn.Write([]byte("\033[1;31mThe game changed; see /games and try again.\033[0m\n"))
+		return
+	} else if err != nil {
+		conn.Write([]byte("\033[1;31mError resigning. Please try again.\033[0m\n"))
+		return
+	}
+	showGame(g)
+}
+
+// handleGamesCommand handles the /games command, which lists the user's games in
+// progress or shows one of them
+// Format: /games [game-id]
+func handleGamesCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	mutex.Lock()
+	account := hub.Account(conn)
+	mutex.Unlock()
+	if len(args) == 1 {
+		g, err := pickGame(account, args[0], nil)
+		if err != nil {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31m%s.\033[0m\n", err)))
+			return
+		}
+		conn.Write([]byte(g.board()))
+		return
+	}
+	if len(args) > 1 {
+		conn.Write([]byte("\033[1;31mUsage: /games [game-id]\033[0m\n"))
+		return
+	}
+
+	games, err := activeGames(account)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError loading your games. Please try again.\033[0m\n"))
+		return
+	}
+	if len(games) == 0 {
+		kinds := make([]string, 0, len(gameKinds))
+		for kind := range gameKinds {
+			kinds = append(kinds, "/"+kind)
+		}
+		sort.Strings(kinds)
+		conn.Write([]byte(fmt.Sprintf("\033[1;33mYou have no games in progress. Start one with %s <name|@account> [#channel].\033[0m\n", strings.Join(kinds, ", "))))
+		return
+	}
+	var out strings.Builder
+	out.WriteString("\033[1;36mYour games:\033[0m\n")
+	for _, g := range games {
+		opponent := g.Players[1-g.player(account)]
+		where := "private"
+		if g.Channel != "" {
+			where = "in " + g.Channel
+		}
+		turn := "waiting for @" + opponent
+		if g.Players[g.Turn] == account {
+			turn = "your move"
+		}
+		out.WriteString(fmt.Sprintf("  %d: %s vs @%s, %s, %s\n", g.ID, g.rules().Title(), opponent, where, turn))
+	}
+	out.WriteString("\033[90mShow a board with /games <id>.\033[0m\n")
+	conn.Write([]byte(out.String()))
+}
+
+// sendGameReminder tells a user who logs in which games are waiting for their move
+func sendGameReminder(conn net.Conn, account string) {
+	games, err := activeGames(account)
+	if err != nil {
+		connLogger(conn).Error("loading games", "err", err)
+		return
+	}
+	waiting := 0
+	for _, g := range games {
+		if g.Players[g.Turn] == account {
+			waiting++
+		}
+	}
+	if waiting > 0 {
+		conn.Write([]byte(fmt.Sprintf("\033[1;33mIt is your move in %d game(s); see /games.\033[0m\n", waiting)))
+	}
+}
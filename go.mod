@@ -3,6 +3,6 @@ module chat-server
 go 1.24.2
 
 require (
-	github.com/mattn/go-sqlite3 v1.14.28 // indirect
-	golang.org/x/crypto v0.37.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.28
+	golang.org/x/crypto v0.37.0
 )
@@ -0,0 +1,80 @@
+// Package main contains the liveness and readiness endpoints for orchestrators such as
+// Docker and Kubernetes
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// healthCheckTimeout bounds the database ping of a health check
+const healthCheckTimeout = 2 * time.Second
+
+// chatListening is set while the chat listener accepts clients: not while a standby
+// waits for the lease, nor once shutdown has begun
+var chatListening atomic.Bool
+
+// HealthReport is the payload of GET /healthz and GET /readyz
+type HealthReport struct {
+	// Status is "ok", or "unavailable" when a readiness check fails
+	Status    string `json:"status"`
+	Listening bool   `json:"listening"`
+	// Database is "ok", or why the database can't be used
+	Database   string `json:"database"`
+	Goroutines int    `json:"goroutines"`
+}
+
+// registerHealthRoutes adds the health check routes to mux. They need no token, so
+// report nothing about users or channels.
+func registerHealthRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", serveHealthz)
+	mux.HandleFunc("GET /readyz", serveReadyz)
+}
+
+// checkDatabase reports "ok" if the database answers a ping, or why it doesn't
+func checkDatabase(ctx context.Context) string {
+	if db == nil {
+		return "not open"
+	}
+	if dbBreaker.isOpen(clock.Now()) {
+		return errCircuitOpen.Error()
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// healthReport checks the listener, database and goroutines
+func healthReport(r *http.Request) HealthReport {
+	return HealthReport{
+		Status:     "ok",
+		Listening:  chatListening.Load(),
+		Database:   checkDatabase(r.Context()),
+		Goroutines: runtime.NumGoroutine(),
+	}
+}
+
+// serveHealthz is the liveness probe: it answers 200 as long as the process serves
+// HTTP, even while the database is down, since chat keeps running in memory then and
+// a restart wouldn't help
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthReport(r))
+}
+
+// serveReadyz is the readiness probe: it answers 503 unless the server accepts chat
+// clients and its database is reachable
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	report := healthReport(r)
+	if !report.Listening || report.Database != "ok" {
+		report.Status = "unavailable"
+		writeJSON(w, http.StatusServiceUnavailable, report)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,338 @@
+// Package main contains cursor-paginated access to stored channel history
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultHistoryLimit is the page size when the client doesn't ask for one
+	defaultHistoryLimit = 20
+	// maxHistoryLimit caps a single page so result sets stay bounded
+	maxHistoryLimit = 100
+)
+
+// errInvalidCursor is returned when a pagination cursor names an unknown message
+var errInvalidCursor = errors.New("unknown message ID")
+
+// HistoryMessage is one stored channel message
+type HistoryMessage struct {
+	ID      string `json:"id"`
+	Seq     int64  `json:"seq"`
+	Channel string `json:"channel"`
+	Sender  string `json:"sender"`
+	// Recipient is set on private messages, which have no channel
+	Recipient string    `json:"recipient,omitempty"`
+	Body      string    `json:"body"`
+	Tag       string    `json:"tag,omitempty"`
+	Time      time.Time `json:"ts"`
+}
+
+// HistoryQuery selects one page of a channel's history
+type HistoryQuery struct {
+	// Before and After are message ID cursors; at most one may be set
+	Before string
+	After  string
+	// Tag limits the page to messages with this tag
+	Tag   string
+	Limit int
+}
+
+// HistoryPage is one page of history plus the cursors to fetch its neighbours
+type HistoryPage struct {
+	Messages []HistoryMessage `json:"messages"`
+	// Before is the cursor for the next older page, empty when there is none
+	Before string `json:"before,omitempty"`
+	// After is the cursor for the next newer page
+	After string `json:"after,omitempty"`
+}
+
+// clampHistoryLimit keeps a requested page size within bounds
+func clampHistoryLimit(limit int) int {
+	if limit <= 0 {
+		return defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		return maxHistoryLimit
+	}
+	return limit
+}
+
+// cursorSeq resolves a message ID cursor to its sequence number in the channel
+func cursorSeq(channel, messageID string) (int64, error) {
+	var seq int64
+	err := readQueryRow("SELECT seq FROM messages WHERE channel = ? AND message_id = ? AND seq IS NOT NULL", channel, messageID).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidCursor
+	}
+	return seq, err
+}
+
+// getHistoryPage returns up to q.Limit messages of a channel in chronological order.
+// With q.Before, it returns the messages just older than that message ID; with q.After,
+// the messages just newer; with neither, the latest messages.
+func getHistoryPage(channel string, q HistoryQuery) (HistoryPage, error) {
+	limit := clampHistoryLimit(q.Limit)
+	page := HistoryPage{Messages: []HistoryMessage{}}
+
+	where := "channel = ? AND seq IS NOT NULL"
+	args := []interface{}{channel}
+	if q.Tag != "" {
+		where += " AND tag = ?"
+		args = append(args, q.Tag)
+	}
+	order := "DESC"
+	switch {
+	case q.After != "":
+		seq, err := cursorSeq(channel, q.After)
+		if err != nil {
+			return page, err
+		}
+		where += " AND seq > ?"
+		args = append(args, seq)
+		order = "ASC"
+	case q.Before != "":
+		seq, err := cursorSeq(channel, q.Before)
+		if err != nil {
+			return page, err
+		}
+		where += " AND seq < ?"
+		args = append(args, seq)
+	}
+	args = append(args, limit)
+
+	rows, err := readQuery(`SELECT message_id, seq, sender, body, COALESCE(tag, ''), created_at FROM messages
+		WHERE `+where+` ORDER BY seq `+order+` LIMIT ?`, args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := HistoryMessage{Channel: channel}
+		if err := rows.Scan(&m.ID, &m.Seq, &m.Sender, &m.Body, &m.Tag, &m.Time); err != nil {
+			return page, err
+		}
+		m.Body = openBody(m.Body)
+		page.Messages = append(page.Messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+
+	// Older pages are fetched newest-first; present every page oldest-first
+	if q.After == "" {
+		for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+			page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+		}
+	}
+	if n := len(page.Messages); n > 0 {
+		if page.Messages[0].Seq > 1 {
+			page.Before = page.Messages[0].ID
+		}
+		page.After = page.Messages[n-1].ID
+	}
+	return page, nil
+}
+
+// getPrivateHistory returns the last limit private messages between two accounts,
+// oldest first
+func getPrivateHistory(account, other string, limit int) ([]HistoryMessage, error) {
+	rows, err := readQuery(`SELECT message_id, sender, recipient, body, created_at FROM messages
+		WHERE channel = '' AND ((sender = ? AND recipient = ?) OR (sender = ? AND recipient = ?))
+		ORDER BY id DESC LIMIT ?`, account, other, other, account, clampHistoryLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []HistoryMessage
+	for rows.Next() {
+		var m HistoryMessage
+		if err := rows.Scan(&m.ID, &m.Sender, &m.Recipient, &m.Body, &m.Time); err != nil {
+			return nil, err
+		}
+		m.Body = openBody(m.Body)
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// privateHistoryAccount resolves the user named in /history private: "@account",
+// the display name of someone online, or else an account name
+func privateHistoryAccount(user string) string {
+	if strings.HasPrefix(user, "@") {
+		return strings.TrimPrefix(user, "@")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if conn, ok := hub.ByName(user); ok && hub.Account(conn) != "" {
+		return hub.Account(conn)
+	}
+	return user
+}
+
+// handlePrivateHistory shows the private conversation with another user
+// Format: /history private <user> [limit]
+func handlePrivateHistory(conn net.Conn, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		conn.Write([]byte("\033[1;31mUsage: /history private <user> [limit]\033[0m\n"))
+		return
+	}
+	limit := 0
+	if len(args) == 2 {
+		var err error
+		if limit, err = strconv.Atoi(args[1]); err != nil || limit <= 0 {
+			conn.Write([]byte("\033[1;31mUsage: /history private <user> [limit]\033[0m\n"))
+			return
+		}
+	}
+
+	mutex.Lock()
+	account := hub.Account(conn)
+	mutex.Unlock()
+	other := privateHistoryAccount(args[0])
+
+	messages, err := getPrivateHistory(account, other, limit)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError retrieving history.\033[0m\n"))
+		return
+	}
+	if len(messages) == 0 {
+		conn.Write([]byte(fmt.Sprintf("\033[90mNo private messages with %s.\033[0m\n", other)))
+		return
+	}
+	loc := userLocation(conn)
+	for _, m := range messages {
+		conn.Write([]byte(fmt.Sprintf("\033[90m[%s] %s -> %s: %s\033[0m\n", m.Time.In(loc).Format("2006-01-02 15:04:05"), m.Sender, m.Recipient, m.Body)))
+	}
+}
+
+// parseHistoryArgs parses "[limit] [before=<id>|after=<id>] [tag=<tag>]"
+func parseHistoryArgs(args []string) (HistoryQuery, error) {
+	var q HistoryQuery
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "before="):
+			q.Before = strings.TrimPrefix(arg, "before=")
+		case strings.HasPrefix(arg, "after="):
+			q.After = strings.TrimPrefix(arg, "after=")
+		case strings.HasPrefix(arg, "tag="):
+			q.Tag = strings.ToLower(strings.TrimPrefix(arg, "tag="))
+		default:
+			limit, err := strconv.Atoi(arg)
+			if err != nil || limit <= 0 {
+				return HistoryQuery{}, fmt.Errorf("invalid limit %q", arg)
+			}
+			q.Limit = limit
+		}
+	}
+	if q.Before != "" && q.After != "" {
+		return HistoryQuery{}, errors.New("use either before= or after=, not both")
+	}
+	return q, nil
+}
+
+// handleHistoryCommand handles the /history command
+// Format: /history [limit] [before=<message-id>|after=<message-id>] [tag=<tag>]
+// or: /history private <user> [limit]
+func handleHistoryCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) > 0 && args[0] == "private" {
+		handlePrivateHistory(conn, args[1:])
+		return
+	}
+
+	q, err := parseHistoryArgs(args)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mUsage: /history [limit] [before=<message-id>|after=<message-id>] [tag=<tag>]\033[0m\n"))
+		return
+	}
+
+	page, err := getHistoryPage(currentRoom(conn), q)
+	if err == errInvalidCursor {
+		conn.Write([]byte("\033[1;31mUnknown message ID.\033[0m\n"))
+		return
+	} else if err != nil {
+		conn.Write([]byte("\033[1;31mError retrieving history.\033[0m\n"))
+		return
+	}
+
+	if len(page.Messages) == 0 {
+		conn.Write([]byte("\033[90mNo messages.\033[0m\n"))
+		return
+	}
+	loc := userLocation(conn)
+	for _, m := range page.Messages {
+		body := m.Body
+		if m.Tag != "" {
+			body = fmt.Sprintf("[%s] %s", m.Tag, m.Body)
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[90m[%s] %s: %s\033[0m\n", m.Time.In(loc).Format("2006-01-02 15:04:05"), m.Sender, body)))
+	}
+	if page.Before != "" {
+		older := "/history before=" + page.Before
+		if q.Tag != "" {
+			older += " tag=" + q.Tag
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[90mOlder: %s\033[0m\n", older)))
+	}
+}
+
+// registerHistoryRoutes adds the REST history endpoint to mux
+func registerHistoryRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/history/{channel}", serveHistory)
+}
+
+// serveHistory returns one page of a channel's history as JSON.
+// Query parameters: before, after (message IDs), tag and limit.
+// Either the admin token or the stream token grants read access.
+func serveHistory(w http.ResponseWriter, r *http.Request) {
+	if !hasStreamToken(r) && !hasAdminToken(r) {
+		writeJSONError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 0
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	if query.Get("before") != "" && query.Get("after") != "" {
+		writeJSONError(w, http.StatusBadRequest, "use either before or after, not both")
+		return
+	}
+
+	channel := "#" + strings.TrimPrefix(r.PathValue("channel"), "#")
+	page, err := getHistoryPage(channel, HistoryQuery{
+		Before: query.Get("before"),
+		After:  query.Get("after"),
+		Tag:    strings.ToLower(query.Get("tag")),
+		Limit:  limit,
+	})
+	if err == errInvalidCursor {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error retrieving history")
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,32 @@
+// Package main contains the HTTP listener shared by the admin API, dashboard, streams and WebSocket clients
+package main
+
+import (
+	"net/http"
+)
+
+// httpAddr is the listen address of the HTTP server; empty disables it
+var httpAddr = ""
+
+// newHTTPMux builds every HTTP route the server exposes
+func newHTTPMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	registerHealthRoutes(mux)
+	registerAdminRoutes(mux)
+	registerProvisioningRoutes(mux)
+	registerStreamRoutes(mux)
+	registerHistoryRoutes(mux)
+	registerChannelRoutes(mux)
+	if websocketEnabled {
+		mux.HandleFunc("GET /ws", serveWebSocket)
+	}
+	return mux
+}
+
+// startHTTPServer serves HTTP until the process exits
+func startHTTPServer() {
+	logger.Info("HTTP server is running", "addr", httpAddr)
+	if err := http.ListenAndServe(httpAddr, newHTTPMux()); err != nil {
+		logger.Error("serving HTTP", "err", err)
+	}
+}
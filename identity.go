@@ -0,0 +1,50 @@
+// Package main contains stable user identifiers and the identity object carried by structured events
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// UserIdentity identifies the user behind an event. ID never changes, so clients
+// can follow renames; Name is the current display name.
+type UserIdentity struct {
+	ID      string `json:"id"`
+	Account string `json:"account"`
+	Name    string `json:"name"`
+}
+
+// newUUID returns a random (version 4) UUID, used for user and message IDs
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if err := readRandom(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// getUserID returns the stable ID of an account
+func getUserID(username string) (string, error) {
+	var id string
+	err := db.QueryRow("SELECT user_id FROM users WHERE username = ?", username).Scan(&id)
+	return id, err
+}
+
+// identityForConnLocked builds the identity of a logged in connection.
+// The caller must hold mutex.
+func identityForConnLocked(conn net.Conn) *UserIdentity {
+	c, ok := hub.Lookup(conn)
+	if !ok {
+		return &UserIdentity{}
+	}
+	return &UserIdentity{ID: c.UserID, Account: c.Account, Name: c.Name}
+}
+
+// identityForConn builds the identity of a logged in connection
+func identityForConn(conn net.Conn) *UserIdentity {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return identityForConnLocked(conn)
+}
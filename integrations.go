@@ -0,0 +1,319 @@
+// Package main contains per-channel integrations managed by channel owners
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// integrationWebhook posts every message of a channel to a URL as JSON
+	integrationWebhook = "webhook"
+	// maxIntegrationsPerChannel caps the integrations one channel may have
+	maxIntegrationsPerChannel = 5
+	// webhookQueueSize is how many webhook deliveries may wait before new ones are dropped
+	webhookQueueSize = 1000
+)
+
+// Integration connects a channel to an outside service
+type Integration struct {
+	ID        int64
+	Channel   string
+	Kind      string
+	Target    string
+	CreatedBy string
+}
+
+// webhookDelivery is one message waiting to be posted to a webhook
+type webhookDelivery struct {
+	url string
+	msg FeedMessage
+}
+
+var (
+	// channelIntegrations holds each channel's integrations, as stored in the database
+	channelIntegrations = make(map[string][]Integration)
+	integrationsMutex   = &sync.RWMutex{}
+
+	// webhookQueue carries deliveries to runWebhooks, so a slow endpoint never delays chat
+	webhookQueue = make(chan webhookDelivery, webhookQueueSize)
+
+	webhooksSent    = newCounter("webhooks_sent")
+	webhookFailures = newCounter("webhook_failures")
+	webhooksDropped = newCounter("webhooks_dropped")
+)
+
+// claimChannelOwner makes username the owner of channel unless it already has one,
+// so the first account to join a channel owns it
+func claimChannelOwner(channel, username string) error {
+	_, err := db.Exec("INSERT OR IGNORE INTO channel_owners (channel, username, created_at) VALUES (?, ?, ?)",
+		channel, username, time.Now().UTC())
+	return err
+}
+
+// getChannelOwner returns the account that owns a channel, "" if nobody does
+func getChannelOwner(channel string) (string, error) {
+	var owner string
+	err := db.QueryRow("SELECT username FROM channel_owners WHERE channel = ?", channel).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return owner, err
+}
+
+// canManageChannel reports whether an account may change a channel's integrations:
+// its owner and admins may
+func canManageChannel(username, channel string) bool {
+	if username == "" {
+		return false
+	}
+	if isAdminAccount(username) {
+		return true
+	}
+	owner, err := getChannelOwner(channel)
+	return err == nil && owner == username
+}
+
+// loadIntegrations reads every channel's integrations into memory
+func loadIntegrations() error {
+	rows, err := db.Query("SELECT id, channel, kind, target, created_by FROM channel_integrations ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	loaded := make(map[string][]Integration)
+	for rows.Next() {
+		var in Integration
+		if err := rows.Scan(&in.ID, &in.Channel, &in.Kind, &in.Target, &in.CreatedBy); err != nil {
+			return err
+		}
+		loaded[in.Channel] = append(loaded[in.Channel], in)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	integrationsMutex.Lock()
+	channelIntegrations = loaded
+	integrationsMutex.Unlock()
+	return nil
+}
+
+// integrationsFor returns a channel's integrations
+func integrationsFor(channel string) []Integration {
+	integrationsMutex.RLock()
+	defer integrationsMutex.RUnlock()
+	return channelIntegrations[channel]
+}
+
+// addIntegration stores a new integration and returns it with its ID
+func addIntegration(in Integration) (Integration, error) {
+	res, err := db.Exec("INSERT INTO channel_integrations (channel, kind, target, created_by, created_at) VALUES (?, ?, ?, ?, ?)",
+		in.Channel, in.Kind, in.Target, in.CreatedBy, time.Now().UTC())
+	if err != nil {
+		return in, err
+	}
+	if in.ID, err = res.LastInsertId(); err != nil {
+		return in, err
+	}
+
+	integrationsMutex.Lock()
+	channelIntegrations[in.Channel] = append(channelIntegrations[in.Channel], in)
+	integrationsMutex.Unlock()
+	return in, nil
+}
+
+// removeIntegration deletes one of a channel's integrations, reporting false if the
+// channel has no integration with that ID
+func removeIntegration(channel string, id int64) (bool, error) {
+	res, err := db.Exec("DELETE FROM channel_integrations WHERE id = ? AND channel = ?", id, channel)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	integrationsMutex.Lock()
+	defer integrationsMutex.Unlock()
+	list := channelIntegrations[channel]
+	for i, in := range list {
+		if in.ID == id {
+			channelIntegrations[channel] = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(channelIntegrations[channel]) == 0 {
+		delete(channelIntegrations, channel)
+	}
+	return true, nil
+}
+
+// validWebhookURL reports whether target is an absolute http or https URL
+func validWebhookURL(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// handleIntegrationsCommand handles the /integrations command, which lets a channel's
+// owner connect it to outside services. The channel defaults to the current one.
+// Format: /integrations list [#channel] | /integrations add webhook <url> [#channel] |
+// /integrations remove <id> [#channel]
+func handleIntegrationsCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	usage := "\033[1;31mUsage: /integrations list [#channel] | add webhook <url> [#channel] | remove <id> [#channel]\033[0m\n"
+	if len(parts) < 2 {
+		conn.Write([]byte(usage))
+		return
+	}
+	args := parts[2:]
+	channel := currentRoom(conn)
+	if n := len(args); n > 0 && strings.HasPrefix(args[n-1], "#") {
+		channel = strings.ToLower(args[n-1])
+		args = args[:n-1]
+	}
+
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	switch {
+	case parts[1] == "list" && len(args) == 0:
+		list := integrationsFor(channel)
+		if len(list) == 0 {
+			conn.Write([]byte(fmt.Sprintf("\033[90m%s has no integrations.\033[0m\n", channel)))
+			return
+		}
+		// Only those who manage the channel may see where its messages are sent
+		manage := canManageChannel(username, channel)
+		var out strings.Builder
+		out.WriteString(fmt.Sprintf("\033[1;36mIntegrations of %s:\033[0m\n", channel))
+		for _, in := range list {
+			target := "(hidden)"
+			if manage {
+				target = in.Target
+			}
+			out.WriteString(fmt.Sprintf("  %d %s %s, added by %s\n", in.ID, in.Kind, target, in.CreatedBy))
+		}
+		conn.Write([]byte(out.String()))
+
+	case parts[1] == "add" && len(args) == 2:
+		if !canManageChannel(username, channel) {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mOnly the owner of %s can change its integrations.\033[0m\n", channel)))
+			return
+		}
+		if args[0] != integrationWebhook {
+			conn.Write([]byte("\033[1;31mUnknown integration type. Supported: webhook\033[0m\n"))
+			return
+		}
+		if !validWebhookURL(args[1]) {
+			conn.Write([]byte("\033[1;31mWebhooks need an http:// or https:// URL.\033[0m\n"))
+			return
+		}
+		if len(integrationsFor(channel)) >= maxIntegrationsPerChannel {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mA channel can have at most %d integrations.\033[0m\n", maxIntegrationsPerChannel)))
+			return
+		}
+		in, err := addIntegration(Integration{Channel: channel, Kind: args[0], Target: args[1], CreatedBy: username})
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError saving integration. Please try again.\033[0m\n"))
+			return
+		}
+		connLogger(conn).Info("added integration", "channel", channel, "kind", in.Kind, "id", in.ID)
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mAdded %s %d to %s. Messages in %s will be posted to it.\033[0m\n", in.Kind, in.ID, channel, channel)))
+
+	case parts[1] == "remove" && len(args) == 1:
+		if !canManageChannel(username, channel) {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mOnly the owner of %s can change its integrations.\033[0m\n", channel)))
+			return
+		}
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			conn.Write([]byte(usage))
+			return
+		}
+		removed, err := removeIntegration(channel, id)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError removing integration. Please try again.\033[0m\n"))
+			return
+		}
+		if !removed {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31m%s has no integration %d.\033[0m\n", channel, id)))
+			return
+		}
+		connLogger(conn).Info("removed integration", "channel", channel, "id", id)
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mRemoved integration %d from %s.\033[0m\n", id, channel)))
+
+	default:
+		conn.Write([]byte(usage))
+	}
+}
+
+// integrationsConsumer queues each channel message for the channel's webhooks
+func integrationsConsumer(ev Event) {
+	posted, ok := ev.(MessagePosted)
+	if !ok {
+		return
+	}
+	for _, in := range integrationsFor(posted.Channel) {
+		if in.Kind != integrationWebhook {
+			continue
+		}
+		msg := FeedMessage{
+			ID:      posted.ID,
+			Seq:     posted.Seq,
+			Channel: posted.Channel,
+			From:    posted.User.Name,
+			User:    posted.User,
+			Body:    posted.Body,
+			Tag:     posted.Tag,
+			Time:    posted.Time,
+		}
+		select {
+		case webhookQueue <- webhookDelivery{url: in.Target, msg: msg}:
+		default:
+			webhooksDropped.Add(1)
+		}
+	}
+}
+
+// runWebhooks posts queued messages to their webhooks until the process exits
+func runWebhooks() {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for d := range webhookQueue {
+		if err := postWebhook(client, d); err != nil {
+			webhookFailures.Add(1)
+			logger.Warn("webhook delivery failed", "channel", d.msg.Channel, "err", err)
+			continue
+		}
+		webhooksSent.Add(1)
+	}
+}
+
+// postWebhook posts one message to a webhook as JSON
+func postWebhook(client *http.Client, d webhookDelivery) error {
+	body, err := json.Marshal(d.msg)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(d.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
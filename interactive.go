@@ -0,0 +1,176 @@
+// Package main contains channel messages with buttons whose clicks go back to the sender
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// interactiveTTL is how long the buttons of a message can be clicked
+	interactiveTTL = 24 * time.Hour
+	// maxButtons caps the buttons on one message
+	maxButtons = 5
+	// maxButtonLabelLength caps the length of a button's label
+	maxButtonLabelLength = 40
+	// maxInteractiveMessages caps the messages whose buttons are remembered
+	maxInteractiveMessages = 10000
+)
+
+// validButtonID matches callback IDs: short, with no spaces so /click can name them
+var validButtonID = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+// Button is a button on a channel message. A click sends its ID back to the
+// message's sender.
+type Button struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+// InteractiveRequest is the JSON accepted by /interactive
+type InteractiveRequest struct {
+	Body    string   `json:"body"`
+	Buttons []Button `json:"buttons"`
+}
+
+// interactiveMessage is a posted message whose buttons can be clicked
+type interactiveMessage struct {
+	// author is the account clicks are reported to
+	author  string
+	channel string
+	buttons []Button
+	expires time.Time
+}
+
+// interactiveMessages holds the messages with buttons, by message ID; guarded by mutex
+var interactiveMessages = make(map[string]*interactiveMessage)
+
+// validateButtons checks the buttons of an interactive message
+func validateButtons(buttons []Button) error {
+	if len(buttons) == 0 || len(buttons) > maxButtons {
+		return fmt.Errorf("a message needs 1 to %d buttons", maxButtons)
+	}
+	seen := make(map[string]bool)
+	for _, b := range buttons {
+		if !validButtonID.MatchString(b.ID) {
+			return fmt.Errorf("button IDs use letters, digits, '_', '.', ':' and '-' (max 64)")
+		}
+		if seen[b.ID] {
+			return fmt.Errorf("button ID %s is used twice", b.ID)
+		}
+		seen[b.ID] = true
+		label := strings.TrimSpace(b.Label)
+		if label == "" || len(label) > maxButtonLabelLength || stripANSI(label) != label || strings.ContainsAny(label, "\r\n") {
+			return fmt.Errorf("button labels must be plain text of 1 to %d characters", maxButtonLabelLength)
+		}
+	}
+	return nil
+}
+
+// registerInteractiveLocked remembers a message's buttons so they can be clicked.
+// Callers must hold mutex.
+func registerInteractiveLocked(id, author, channel string, buttons []Button) {
+	now := clock.Now()
+	if len(interactiveMessages) >= maxInteractiveMessages {
+		var oldest string
+		for mid, m := range interactiveMessages {
+			if now.After(m.expires) {
+				delete(interactiveMessages, mid)
+			} else if oldest == "" || m.expires.Before(interactiveMessages[oldest].expires) {
+				oldest = mid
+			}
+		}
+		if len(interactiveMessages) >= maxInteractiveMessages {
+			delete(interactiveMessages, oldest)
+		}
+	}
+	interactiveMessages[id] = &interactiveMessage{author: author, channel: channel, buttons: buttons, expires: now.Add(interactiveTTL)}
+}
+
+// buttonsText shows a message's buttons to text clients, with how to click them
+func buttonsText(id string, buttons []Button) string {
+	labels := make([]string, len(buttons))
+	for i, b := range buttons {
+		labels[i] = fmt.Sprintf("[%s] %s", b.ID, b.Label)
+	}
+	return fmt.Sprintf("\033[90m    %s  (/click %s <button>)\033[0m\n", strings.Join(labels, "  "), id)
+}
+
+// handleInteractiveCommand handles the /interactive command, posting a message with
+// buttons to the current channel
+// Format: /interactive {"body": "...", "buttons": [{"id": "...", "label": "..."}]}
+func handleInteractiveCommand(conn net.Conn, message string) {
+	var req InteractiveRequest
+	payload := strings.TrimSpace(strings.TrimPrefix(message, "/interactive"))
+	if err := json.Unmarshal([]byte(payload), &req); err != nil || strings.TrimSpace(req.Body) == "" {
+		conn.Write([]byte("\033[1;31mUsage: /interactive {\"body\": \"...\", \"buttons\": [{\"id\": \"...\", \"label\": \"...\"}]}\033[0m\n"))
+		return
+	}
+	if err := validateButtons(req.Buttons); err != nil {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mInvalid buttons: %v.\033[0m\n", err)))
+		return
+	}
+	sendChannelMessage(conn, req.Body, "", "", req.Buttons)
+}
+
+// handleClickCommand handles the /click command, which reports a button click to
+// the message's sender
+// Format: /click <message-id> <button-id>
+func handleClickCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 3 {
+		conn.Write([]byte("\033[1;31mUsage: /click <message-id> <button-id>\033[0m\n"))
+		return
+	}
+	id, buttonID := parts[1], parts[2]
+
+	mutex.Lock()
+	m := interactiveMessages[id]
+	if m != nil && clock.Now().After(m.expires) {
+		delete(interactiveMessages, id)
+		m = nil
+	}
+	if m == nil || !sessionForLocked(conn).joined[m.channel] {
+		mutex.Unlock()
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mMessage %s has no buttons you can click.\033[0m\n", id)))
+		return
+	}
+	var button *Button
+	for i := range m.buttons {
+		if m.buttons[i].ID == buttonID {
+			button = &m.buttons[i]
+		}
+	}
+	author, channel := m.author, m.channel
+	mutex.Unlock()
+
+	if button == nil {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mMessage %s has no button %s.\033[0m\n", id, buttonID)))
+		return
+	}
+	if !checkFlood(conn) {
+		return
+	}
+	bus.Emit(ButtonClicked{User: identityForConn(conn), Author: author, Channel: channel, MessageID: id, Button: button.ID, Label: button.Label})
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mYou clicked %s.\033[0m\n", button.Label)))
+}
+
+// interactiveConsumer reports button clicks to every session of the message's sender
+func interactiveConsumer(ev Event) {
+	click, ok := ev.(ButtonClicked)
+	if !ok {
+		return
+	}
+	ws := WireEvent{Type: "click", ID: click.MessageID, From: click.User.Name, Room: click.Channel, Callback: click.Button, Body: click.Label, TS: clock.Now().UTC()}
+	text := fmt.Sprintf("\033[1;36m%s clicked %s on your message %s in %s\033[0m\n", click.User.Name, click.Label, click.MessageID, click.Channel)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, conn := range connsForAccountLocked(click.Author) {
+		writeEvent(conn, ws, text)
+	}
+}
@@ -0,0 +1,218 @@
+// Package registry keeps track of the clients logged in to the chat server: their
+// connections, display names and accounts, and who last messaged whom.
+package registry
+
+import (
+	"net"
+	"sort"
+)
+
+// Client is one logged in connection
+type Client struct {
+	Conn net.Conn
+	// Name is the display name the client chose; an account's sessions may share one
+	Name string
+	// Account is the account the client logged in with
+	Account string
+	// UserID is the stable ID of the account
+	UserID string
+}
+
+// Registry holds the logged in clients and the display names they claimed.
+//
+// A Registry is not safe for concurrent use. The server guards it with the same
+// mutex as the state that has to change together with it, such as channel membership.
+type Registry struct {
+	clients map[net.Conn]*Client
+	// byName maps a display name to a connection using it, the latest if an
+	// account's sessions share the name
+	byName map[string]net.Conn
+	// claims maps each display name in use to the account that claimed it
+	claims map[string]string
+	// lastSender maps a display name to whom /reply answers
+	lastSender map[string]string
+}
+
+// New returns an empty registry
+func New() *Registry {
+	return &Registry{
+		clients:    make(map[net.Conn]*Client),
+		byName:     make(map[string]net.Conn),
+		claims:     make(map[string]string),
+		lastSender: make(map[string]string),
+	}
+}
+
+// Claim reserves a display name for an account, reporting false if another account
+// has it. The account's other sessions may use it too.
+func (r *Registry) Claim(name, account string) bool {
+	if owner, ok := r.claims[name]; ok && owner != account {
+		return false
+	}
+	r.claims[name] = account
+	return true
+}
+
+// Owner returns the account that claimed a display name
+func (r *Registry) Owner(name string) (string, bool) {
+	account, ok := r.claims[name]
+	return account, ok
+}
+
+// Rename moves every session using a display name to another name, along with the
+// claim and whom its /reply answers; others whose /reply answers the old name now
+// answer the new one. It reports false if the old name isn't in use or another
+// account has claimed the new one.
+func (r *Registry) Rename(old, name string) bool {
+	account, ok := r.claims[old]
+	if !ok || !r.Claim(name, account) {
+		return false
+	}
+	for _, c := range r.clients {
+		if c.Name == old {
+			c.Name = name
+		}
+	}
+	if conn, ok := r.byName[old]; ok {
+		r.byName[name] = conn
+	}
+	delete(r.byName, old)
+	delete(r.claims, old)
+	if sender, ok := r.lastSender[old]; ok {
+		r.lastSender[name] = sender
+		delete(r.lastSender, old)
+	}
+	for from, sender := range r.lastSender {
+		if sender == old {
+			r.lastSender[from] = name
+		}
+	}
+	return true
+}
+
+// Add registers a client under its display name, replacing any client with the same
+// connection
+func (r *Registry) Add(c *Client) {
+	if old, ok := r.clients[c.Conn]; ok {
+		r.Remove(old.Conn)
+	}
+	r.clients[c.Conn] = c
+	if c.Name != "" {
+		r.byName[c.Name] = c.Conn
+	}
+}
+
+// Remove forgets a connection and releases its display name, along with whom its
+// /reply answers, unless another session still uses it. It returns the removed
+// client, if there was one.
+func (r *Registry) Remove(conn net.Conn) (*Client, bool) {
+	c, ok := r.clients[conn]
+	if !ok {
+		return nil, false
+	}
+	delete(r.clients, conn)
+	if c.Name == "" {
+		return c, true
+	}
+	if others := r.ConnsForName(c.Name); len(others) > 0 {
+		r.byName[c.Name] = others[0]
+	} else {
+		delete(r.byName, c.Name)
+		delete(r.claims, c.Name)
+		delete(r.lastSender, c.Name)
+	}
+	return c, true
+}
+
+// Lookup returns the client of a connection
+func (r *Registry) Lookup(conn net.Conn) (*Client, bool) {
+	c, ok := r.clients[conn]
+	return c, ok
+}
+
+// Name returns the display name of a connection, "" if it isn't logged in
+func (r *Registry) Name(conn net.Conn) string {
+	if c, ok := r.clients[conn]; ok {
+		return c.Name
+	}
+	return ""
+}
+
+// Account returns the account of a connection, "" if it isn't logged in
+func (r *Registry) Account(conn net.Conn) string {
+	if c, ok := r.clients[conn]; ok {
+		return c.Account
+	}
+	return ""
+}
+
+// ByName returns a connection using a display name, the latest if several do
+func (r *Registry) ByName(name string) (net.Conn, bool) {
+	conn, ok := r.byName[name]
+	return conn, ok
+}
+
+// ConnsForName returns every connection using a display name
+func (r *Registry) ConnsForName(name string) []net.Conn {
+	var conns []net.Conn
+	for conn, c := range r.clients {
+		if c.Name == name {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// ConnsForAccount returns every connection logged in with an account
+func (r *Registry) ConnsForAccount(account string) []net.Conn {
+	var conns []net.Conn
+	for conn, c := range r.clients {
+		if c.Account == account {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// Names returns the display names in use, each once, sorted
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.byName))
+	for name := range r.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Clients returns every client, in no particular order
+func (r *Registry) Clients() []*Client {
+	list := make([]*Client, 0, len(r.clients))
+	for _, c := range r.clients {
+		list = append(list, c)
+	}
+	return list
+}
+
+// Len returns how many connections are logged in
+func (r *Registry) Len() int {
+	return len(r.clients)
+}
+
+// Broadcast writes p to every client. Write errors are left to the reader of each
+// connection to notice.
+func (r *Registry) Broadcast(p []byte) {
+	for conn := range r.clients {
+		conn.Write(p)
+	}
+}
+
+// SetLastSender records whom a display name's /reply answers
+func (r *Registry) SetLastSender(name, sender string) {
+	r.lastSender[name] = sender
+}
+
+// LastSender returns whom a display name's /reply answers
+func (r *Registry) LastSender(name string) (string, bool) {
+	sender, ok := r.lastSender[name]
+	return sender, ok
+}
@@ -0,0 +1,176 @@
+package registry
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// recordingConn is a connection that only keeps what is written to it
+type recordingConn struct {
+	net.Conn
+	written string
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.written += string(p)
+	return len(p), nil
+}
+
+func TestClaim(t *testing.T) {
+	r := New()
+	if !r.Claim("Ivy", "ivy") {
+		t.Fatal("Expected a free name to be claimed")
+	}
+	if !r.Claim("Ivy", "ivy") {
+		t.Error("Expected an account to reuse its own name")
+	}
+	if r.Claim("Ivy", "mallory") {
+		t.Error("Expected another account to be refused the name")
+	}
+	if owner, _ := r.Owner("Ivy"); owner != "ivy" {
+		t.Errorf("Expected ivy to own the name, got %q", owner)
+	}
+}
+
+func TestAddLookupRemove(t *testing.T) {
+	r := New()
+	conn := &recordingConn{}
+	r.Claim("Ann", "ann")
+	r.Add(&Client{Conn: conn, Name: "Ann", Account: "ann", UserID: "id-ann"})
+
+	c, ok := r.Lookup(conn)
+	if !ok || c.Account != "ann" || c.UserID != "id-ann" {
+		t.Fatalf("Lookup = %+v, %v", c, ok)
+	}
+	if r.Name(conn) != "Ann" || r.Account(conn) != "ann" {
+		t.Errorf("Name, Account = %q, %q", r.Name(conn), r.Account(conn))
+	}
+	if got, ok := r.ByName("Ann"); !ok || got != conn {
+		t.Error("Expected the name to lead to the connection")
+	}
+	if r.Len() != 1 {
+		t.Errorf("Len = %d, want 1", r.Len())
+	}
+
+	r.SetLastSender("Ann", "bob")
+	if removed, ok := r.Remove(conn); !ok || removed != c {
+		t.Fatal("Expected the client to be removed")
+	}
+	if _, ok := r.Remove(conn); ok {
+		t.Error("Expected removing twice to report false")
+	}
+	if _, ok := r.ByName("Ann"); ok {
+		t.Error("Expected the name to be released")
+	}
+	if _, ok := r.Owner("Ann"); ok {
+		t.Error("Expected the claim to be released")
+	}
+	if _, ok := r.LastSender("Ann"); ok {
+		t.Error("Expected /reply to be forgotten with the name")
+	}
+	if r.Name(conn) != "" || r.Account(conn) != "" || r.Len() != 0 {
+		t.Error("Expected nothing to be left of the client")
+	}
+}
+
+// TestSharedName checks an account's sessions share a name until the last one goes
+func TestSharedName(t *testing.T) {
+	r := New()
+	laptop, phone := &recordingConn{}, &recordingConn{}
+	r.Claim("Ivy", "ivy")
+	r.Add(&Client{Conn: laptop, Name: "Ivy", Account: "ivy"})
+	r.Add(&Client{Conn: phone, Name: "Ivy", Account: "ivy"})
+	r.SetLastSender("Ivy", "bob")
+
+	if got := r.ConnsForAccount("ivy"); len(got) != 2 {
+		t.Errorf("ConnsForAccount = %d connections, want 2", len(got))
+	}
+	if got := r.Names(); !reflect.DeepEqual(got, []string{"Ivy"}) {
+		t.Errorf("Names = %v, want [Ivy]", got)
+	}
+
+	r.Remove(phone)
+	if got, _ := r.ByName("Ivy"); got != laptop {
+		t.Error("Expected the name to move to the remaining session")
+	}
+	if owner, _ := r.Owner("Ivy"); owner != "ivy" {
+		t.Error("Expected the claim to be kept while a session uses the name")
+	}
+	if sender, _ := r.LastSender("Ivy"); sender != "bob" {
+		t.Error("Expected /reply to be kept while a session uses the name")
+	}
+	r.Remove(laptop)
+	if _, ok := r.Owner("Ivy"); ok {
+		t.Error("Expected the claim to be released with the last session")
+	}
+}
+
+// TestAddReplaces checks adding a connection again replaces its old entry
+func TestAddReplaces(t *testing.T) {
+	r := New()
+	conn := &recordingConn{}
+	r.Add(&Client{Conn: conn, Name: "old", Account: "a"})
+	r.Add(&Client{Conn: conn, Name: "new", Account: "a"})
+	if r.Len() != 1 || r.Name(conn) != "new" {
+		t.Errorf("Len, Name = %d, %q; want 1, new", r.Len(), r.Name(conn))
+	}
+	if _, ok := r.ByName("old"); ok {
+		t.Error("Expected the old name to be released")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	r := New()
+	a, b := &recordingConn{}, &recordingConn{}
+	r.Add(&Client{Conn: a, Name: "a"})
+	r.Add(&Client{Conn: b, Name: "b"})
+	r.Broadcast([]byte("hello\n"))
+	if a.written != "hello\n" || b.written != "hello\n" {
+		t.Errorf("Expected every client to get the broadcast, got %q and %q", a.written, b.written)
+	}
+	if len(r.Clients()) != 2 {
+		t.Errorf("Clients = %d, want 2", len(r.Clients()))
+	}
+}
+
+// TestRename checks a rename moves every session and /reply with the name
+func TestRename(t *testing.T) {
+	r := New()
+	laptop, phone, other := &recordingConn{}, &recordingConn{}, &recordingConn{}
+	r.Claim("Ivy", "ivy")
+	r.Add(&Client{Conn: laptop, Name: "Ivy", Account: "ivy"})
+	r.Add(&Client{Conn: phone, Name: "Ivy", Account: "ivy"})
+	r.Claim("Bob", "bob")
+	r.Add(&Client{Conn: other, Name: "Bob", Account: "bob"})
+	r.SetLastSender("Ivy", "@bob")
+	r.SetLastSender("Bob", "Ivy")
+
+	if r.Rename("Ivy", "Bob") {
+		t.Error("Expected a name claimed by another account to be refused")
+	}
+	if !r.Rename("Ivy", "Ivy2") {
+		t.Fatal("Expected the rename to succeed")
+	}
+	if r.Name(laptop) != "Ivy2" || r.Name(phone) != "Ivy2" {
+		t.Errorf("Expected both sessions to be renamed, got %q and %q", r.Name(laptop), r.Name(phone))
+	}
+	if _, ok := r.ByName("Ivy"); ok {
+		t.Error("Expected the old name to be released")
+	}
+	if _, ok := r.Owner("Ivy"); ok {
+		t.Error("Expected the old claim to be released")
+	}
+	if owner, _ := r.Owner("Ivy2"); owner != "ivy" {
+		t.Errorf("Expected ivy to own the new name, got %q", owner)
+	}
+	if sender, _ := r.LastSender("Ivy2"); sender != "@bob" {
+		t.Errorf("Expected /reply to move with the name, got %q", sender)
+	}
+	if sender, _ := r.LastSender("Bob"); sender != "Ivy2" {
+		t.Errorf("Expected others' /reply to follow the rename, got %q", sender)
+	}
+	if r.Rename("Nobody", "Somebody") {
+		t.Error("Expected renaming an unused name to fail")
+	}
+}
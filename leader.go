@@ -0,0 +1,100 @@
+// Package main contains lease-based leader election for active/standby deployments
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	// leaderLease is how long a leader holds the lease without renewing it (0 disables
+	// election, so the server starts serving at once)
+	leaderLease time.Duration
+	// instanceID names this server in the lease table
+	instanceID = defaultInstanceID()
+)
+
+// errLostLeadership stops a server whose lease was taken over or couldn't be renewed
+var errLostLeadership = errors.New("lost leadership lease")
+
+// defaultInstanceID identifies this process by host and process ID
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// tryAcquireLease takes or renews the lease if it is free, expired, or already ours
+func tryAcquireLease(now time.Time) (bool, error) {
+	expires := now.Add(leaderLease).UnixMilli()
+	if _, err := db.Exec("INSERT INTO leader_lease (name, holder, expires_at) VALUES ('chat', ?, ?) ON CONFLICT DO NOTHING",
+		instanceID, expires); err != nil {
+		return false, err
+	}
+	res, err := db.Exec("UPDATE leader_lease SET holder = ?, expires_at = ? WHERE name = 'chat' AND (holder = ? OR expires_at < ?)",
+		instanceID, expires, instanceID, now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// releaseLease gives up the lease so a standby can take over without waiting for it to expire
+func releaseLease() {
+	if leaderLease <= 0 {
+		return
+	}
+	if _, err := db.Exec("UPDATE leader_lease SET expires_at = 0 WHERE name = 'chat' AND holder = ?", instanceID); err != nil {
+		logger.Error("releasing leadership lease", "err", err)
+	}
+}
+
+// waitForLeadership blocks until this instance holds the lease
+func waitForLeadership() {
+	announced := false
+	for {
+		ok, err := tryAcquireLease(time.Now())
+		if err != nil {
+			logger.Error("acquiring leadership lease", "err", err)
+		}
+		if ok {
+			logger.Info("this instance is the leader", "instance", instanceID)
+			return
+		}
+		if !announced {
+			logger.Info("standing by for the leadership lease", "instance", instanceID)
+			announced = true
+		}
+		time.Sleep(leaderLease / 3)
+	}
+}
+
+// maintainLeadership renews the lease until it is lost, then calls stop. A lease that
+// can't be renewed is given up before it expires, so two leaders never overlap.
+func maintainLeadership(stop func(error)) {
+	ticker := time.NewTicker(leaderLease / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for now := range ticker.C {
+		ok, err := tryAcquireLease(now)
+		switch {
+		case ok:
+			renewed = now
+			continue
+		case err == nil:
+			logger.Warn("another instance took over the leadership lease")
+		case now.Sub(renewed) < leaderLease*2/3:
+			logger.Error("renewing leadership lease", "err", err)
+			continue
+		default:
+			logger.Error("giving up leadership, lease could not be renewed", "err", err)
+		}
+		stop(errLostLeadership)
+		return
+	}
+}
@@ -0,0 +1,221 @@
+// Package main contains the server log: leveled, timestamped records written to
+// stdout, a rotating file, or both
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// logFile is the file the server logs to (empty logs to stdout only)
+	logFile string
+	// logStdout also writes the log to stdout when logFile is set
+	logStdout bool
+	// logLevel is the least severe level logged: debug, info, warn or error
+	logLevel = "info"
+	// logMaxSize is how large the log file grows, in megabytes, before it is rotated
+	logMaxSize = 10
+	// logMaxFiles is how many rotated log files are kept
+	logMaxFiles = 5
+
+	// logger receives every server log record
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	// logLevelVar is the level logger records at, changed when the config is reloaded
+	logLevelVar = new(slog.LevelVar)
+	// recentLogs keeps the latest log records for the admin API
+	recentLogs = &logRing{size: logRingSize}
+
+	// connIDs numbers connections so their log records can be told apart; guarded by mutex
+	connIDs    = make(map[net.Conn]int64)
+	nextConnID atomic.Int64
+	// connectedAt is when each connection was accepted; guarded by mutex
+	connectedAt = make(map[net.Conn]time.Time)
+)
+
+// logRingSize is how many log records recentLogs keeps
+const logRingSize = 1000
+
+// setupLogging points logger at the configured destinations and returns the
+// function that closes the log file
+func setupLogging() (func(), error) {
+	if err := setLogLevel(logLevel); err != nil {
+		return nil, err
+	}
+
+	var out io.Writer = os.Stdout
+	closeLog := func() {}
+	if logFile != "" {
+		f, err := openRotatingFile(logFile, int64(logMaxSize)<<20, logMaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		out, closeLog = f, func() { f.Close() }
+		if logStdout {
+			out = io.MultiWriter(f, os.Stdout)
+		}
+	}
+	out = io.MultiWriter(out, recentLogs)
+	logger = slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: logLevelVar}))
+	return closeLog, nil
+}
+
+// setLogLevel changes the least severe level logged
+func setLogLevel(name string) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("-log-level must be debug, info, warn or error")
+	}
+	logLevelVar.Set(level)
+	return nil
+}
+
+// logRing keeps the last size log records in memory
+type logRing struct {
+	mu      sync.Mutex
+	size    int
+	records []string
+	next    int
+}
+
+// Write stores one log record; slog writes each record with a single call
+func (r *logRing) Write(p []byte) (int, error) {
+	record := strings.TrimRight(string(p), "\n")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.records) < r.size {
+		r.records = append(r.records, record)
+	} else {
+		r.records[r.next] = record
+	}
+	r.next = (r.next + 1) % r.size
+	return len(p), nil
+}
+
+// last returns up to n of the most recent records, oldest first
+func (r *logRing) last(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n = min(n, len(r.records))
+	out := make([]string, 0, n)
+	for i := len(r.records) - n; i < len(r.records); i++ {
+		// Once the ring is full the oldest record is at next
+		out = append(out, r.records[(r.next+i)%len(r.records)])
+	}
+	return out
+}
+
+// registerConn gives a new connection an ID for its log records and notes when it
+// connected
+func registerConn(conn net.Conn) {
+	id := nextConnID.Add(1)
+	mutex.Lock()
+	connIDs[conn] = id
+	connectedAt[conn] = clock.Now()
+	mutex.Unlock()
+}
+
+// forgetConn drops the ID and connect time of a closed connection
+func forgetConn(conn net.Conn) {
+	mutex.Lock()
+	delete(connIDs, conn)
+	delete(connectedAt, conn)
+	mutex.Unlock()
+}
+
+// connLogger returns a logger that tags records with the connection's ID and, once
+// logged in, its account. Callers must not hold mutex.
+func connLogger(conn net.Conn) *slog.Logger {
+	mutex.Lock()
+	id, account := connIDs[conn], hub.Account(conn)
+	mutex.Unlock()
+
+	l := logger.With("conn", id)
+	if account != "" {
+		l = l.With("account", account)
+	}
+	return l
+}
+
+// rotatingFile is a log file that is renamed to path.1 once it reaches maxSize,
+// shifting older files up to path.<maxFiles>
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+// openRotatingFile opens path for appending
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens or creates the current log file
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would take the file over maxSize
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files up by one, dropping the oldest, and starts a new file
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if r.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+		for i := r.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// Close closes the current log file
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
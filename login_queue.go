@@ -0,0 +1,92 @@
+// Package main contains the queue that spreads password hashing over a login burst
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var (
+	// maxConcurrentAuth is how many password checks run at once; the rest wait in line
+	// (0 for unlimited)
+	maxConcurrentAuth = runtime.NumCPU()
+
+	loginQueue = &authQueue{}
+
+	loginQueueWaits = newCounter("login_queue_waits")
+)
+
+// authQueue admits password checks up to maxConcurrentAuth at a time, first come,
+// first served
+type authQueue struct {
+	mu      sync.Mutex
+	active  int
+	waiting []*authWaiter
+}
+
+// authWaiter is a connection waiting for its turn to check a password
+type authWaiter struct {
+	conn  net.Conn
+	ready chan struct{}
+}
+
+// enter waits until conn may check a password, telling it its place in line
+// while it waits. The caller must call leave afterwards.
+func (q *authQueue) enter(conn net.Conn) {
+	q.mu.Lock()
+	if maxConcurrentAuth <= 0 || (q.active < maxConcurrentAuth && len(q.waiting) == 0) {
+		q.active++
+		q.mu.Unlock()
+		return
+	}
+	w := &authWaiter{conn: conn, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, w)
+	position := len(q.waiting)
+	q.mu.Unlock()
+
+	loginQueueWaits.Add(1)
+	conn.Write([]byte(fmt.Sprintf("\033[1;33mThe server is busy. You are #%d in the login queue, please wait...\033[0m\n", position)))
+	<-w.ready
+
+	// Time spent in line doesn't count against the login deadline
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+}
+
+// leave hands the caller's turn to the next connection in line
+func (q *authQueue) leave() {
+	q.mu.Lock()
+	if len(q.waiting) == 0 {
+		q.active--
+		q.mu.Unlock()
+		return
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	close(next.ready)
+
+	// Everyone still waiting moved up one place; tell the front of the line and
+	// every tenth place so a long queue doesn't turn into a flood of updates
+	var updates []*authWaiter
+	var positions []int
+	for i, w := range q.waiting {
+		if position := i + 1; position <= 10 || position%10 == 0 {
+			updates = append(updates, w)
+			positions = append(positions, position)
+		}
+	}
+	q.mu.Unlock()
+
+	for i, w := range updates {
+		w.conn.Write([]byte(fmt.Sprintf("\033[90mYou are now #%d in the login queue.\033[0m\n", positions[i])))
+	}
+}
+
+// waitForAuthTurn queues conn for a password check and returns the function that
+// ends its turn
+func waitForAuthTurn(conn net.Conn) func() {
+	loginQueue.enter(conn)
+	return loginQueue.leave
+}
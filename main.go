@@ -5,28 +5,33 @@ import (
 	"bufio"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"chat-server/internal/registry"
 )
 
 // Global variables for managing the chat server
 var (
-	// clients maps a connection to its username
-	clients = make(map[net.Conn]string)
-	// nameToConn maps a username to its connection
-	nameToConn = make(map[string]net.Conn)
-	// displayNames tracks all used display names
-	displayNames = make(map[string]bool)
+	// hub holds the logged in clients, their display names and accounts; guarded by mutex
+	hub = registry.New()
 	// broadcast channel for sending messages to all clients
 	broadcast = make(chan string)
+	// channelMessages carries chat messages that are filtered per recipient
+	channelMessages = make(chan OutgoingMessage)
 	// mutex for synchronizing access to shared data
-	mutex             = &sync.Mutex{}
-	lastPrivateSender = make(map[string]string) // maps recipient username to last sender username
+	mutex = &sync.Mutex{}
 
-	// Rate limiting for registration
-	registerAttempts = make(map[string]int)       // IP -> attempt count
-	registerTimes    = make(map[string]time.Time) // IP -> last attempt time
+	// Rate limiting for registration, timed with clock.Elapsed so that setting the
+	// system clock neither lifts nor extends a limit
+	registerAttempts = make(map[string]int)           // IP -> attempt count
+	registerTimes    = make(map[string]time.Duration) // IP -> clock.Elapsed at the last attempt
 	registerMutex    = &sync.Mutex{}
 )
 
@@ -35,16 +40,16 @@ func isRateLimited(ip string) bool {
 	registerMutex.Lock()
 	defer registerMutex.Unlock()
 
-	now := time.Now()
+	now := clock.Elapsed()
 	lastAttempt, exists := registerTimes[ip]
 
-	// Reset counter if more than 1 minute has passed
-	if exists && now.Sub(lastAttempt) > time.Minute {
+	// Reset counter once the window has passed
+	if exists && now-lastAttempt > registerWindow {
 		registerAttempts[ip] = 0
 	}
 
-	// Allow max 3 attempts per minute
-	if registerAttempts[ip] >= 3 {
+	// Allow max registerLimit attempts per window
+	if registerAttempts[ip] >= registerLimit {
 		return true
 	}
 
@@ -53,63 +58,371 @@ func isRateLimited(ip string) bool {
 	return false
 }
 
-// main starts the chat server
+// main runs the requested subcommand, starting the chat server by default
 func main() {
+	if err := runCLI(os.Args[1:]); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+// runServe starts the chat server
+func runServe(args []string) error {
+	fs := newCommandFlags("serve")
+	fs.StringVar(&listenAddr, "listen", listenAddr, "address of the TCP chat listener")
+	fs.IntVar(&maxMessageLength, "max-message-length", maxMessageLength, "longest chat or private message in bytes (0 for unlimited)")
+	fs.IntVar(&minDisplayNameLength, "min-display-name-length", minDisplayNameLength, "shortest allowed display name in characters")
+	fs.IntVar(&maxDisplayNameLength, "max-display-name-length", maxDisplayNameLength, "longest allowed display name in characters")
+	fs.IntVar(&registerLimit, "register-limit", registerLimit, "registration attempts allowed per IP within -register-window")
+	fs.DurationVar(&registerWindow, "register-window", registerWindow, "window for -register-limit")
+	fs.BoolVar(&colorEnabled, "color", colorEnabled, "send ANSI colors to clients that haven't turned them off with /color (false sends plain text; defaults to false when NO_COLOR is set)")
+	fs.IntVar(&powDifficulty, "pow", 0, "require a proof-of-work with this many leading zero bits before login (0 disables)")
+	fs.DurationVar(&authTimeout, "auth-timeout", authTimeout, "time allowed for a new connection to log in and pick a display name")
+	fs.IntVar(&maxFileSize, "max-file-size", maxFileSize, "largest file users may send each other with /sendfile, in bytes (0 disables file transfers)")
+	fs.IntVar(&maxSessions, "max-sessions", 0, "maximum number of connections served at once, including WebSocket and spectators; more are told the server is full (0 for unlimited)")
+	fs.IntVar(&maxSessionQueue, "session-queue", 0, "how many TCP connections may wait in line for a place once -max-sessions is reached (0 turns them away at once)")
+	fs.IntVar(&maxConcurrentAuth, "max-concurrent-auth", maxConcurrentAuth, "password checks run at once; further logins wait in a queue and are told their place (0 for unlimited)")
+	fs.IntVar(&maxPendingAuth, "max-pending", maxPendingAuth, "maximum number of connections allowed in the login phase (0 for unlimited)")
+	fs.Var(adminFlag{}, "admin", "grant admin rights to this account (may be repeated)")
+	fs.Int64Var(&storageQuota, "quota", storageQuota, "per-user storage quota in bytes (0 for unlimited)")
+	fs.BoolVar(&telemetryEnabled, "telemetry", false, "record anonymous aggregate usage statistics")
+	fs.DurationVar(&telemetryInterval, "telemetry-interval", telemetryInterval, "how often usage statistics are recorded")
+	fs.StringVar(&telemetryEndpoint, "telemetry-endpoint", "", "optional URL that receives usage statistics as JSON")
+	fs.StringVar(&summaryURL, "summary-url", "", "optional URL, e.g. a service in front of an LLM, that /digest posts a channel transcript to for a short summary")
+	fs.StringVar(&pluginList, "plugins", "", "optional command plugins to enable, separated by commas: time, calc, weather")
+	fs.IntVar(&pluginRate, "plugin-rate", pluginRate, "plugin commands each account may run per minute (0 for unlimited)")
+	fs.StringVar(&weatherAPIKey, "weather-api-key", "", "OpenWeatherMap API key for the weather plugin")
+	fs.IntVar(&weatherRate, "weather-rate", weatherRate, "requests per minute the weather plugin may make to the weather API; cached cities don't count (0 for unlimited)")
+	fs.StringVar(&httpAddr, "http-addr", "", "address for the HTTP admin API, dashboard and streams, e.g. 127.0.0.1:8081 (empty disables)")
+	fs.StringVar(&adminAPIToken, "admin-token", "", "bearer token required by the admin API")
+	fs.StringVar(&streamToken, "stream-token", "", "token required to read channel streams over HTTP")
+	fs.Var(streamRestrictedFlag{}, "stream-restricted", "let the stream token read this invite-only, password or eligibility-restricted channel (may be repeated)")
+	fs.BoolVar(&websocketEnabled, "websocket", false, "accept chat clients over WebSocket at /ws on the HTTP server")
+	fs.Var(spectateFlag{}, "spectate", "allow read-only spectators to watch this channel (may be repeated)")
+	fs.IntVar(&maxSpectators, "max-spectators", maxSpectators, "maximum number of spectators watching at once (0 for unlimited)")
+	fs.BoolVar(&showBotTraffic, "bot-traffic", true, "deliver messages from bot accounts unless a channel or user turns them off")
+	fs.DurationVar(&presenceWindow, "presence-window", presenceWindow, "collect join, leave and status events for this long and send them as one summary (0 sends each at once)")
+	fs.DurationVar(&writeTimeout, "write-timeout", writeTimeout, "disconnect clients whose socket blocks a write for this long (0 waits forever)")
+	fs.IntVar(&clientRate, "client-rate", 0, "cap on bytes per second sent to each client (0 for unlimited)")
+	fs.IntVar(&totalRate, "total-rate", 0, "cap on bytes per second sent to all clients together, shared fairly (0 for unlimited)")
+	fs.DurationVar(&reapInterval, "reap-interval", reapInterval, "how often to probe connections and evict dead ones (0 disables)")
+	fs.DurationVar(&idleEvict, "idle-evict", 0, "disconnect logged in users who send nothing for this long (0 disables)")
+	fs.IntVar(&floodMessages, "flood-messages", 0, "messages each user may send per -flood-window before being warned, then muted, then disconnected (0 disables)")
+	fs.DurationVar(&floodWindow, "flood-window", floodWindow, "window for -flood-messages")
+	fs.DurationVar(&floodMute, "flood-mute", floodMute, "how long a user who keeps flooding after a warning is muted")
+	fs.IntVar(&stormThreshold, "storm-threshold", 0, "turn on slow mode when more than this many messages arrive within -storm-window (0 disables)")
+	fs.DurationVar(&stormWindow, "storm-window", stormWindow, "window over which message volume is measured for slow mode")
+	fs.DurationVar(&slowModeInterval, "slow-mode-interval", slowModeInterval, "minimum time between messages from one user while slow mode is on")
+	fs.BoolVar(&eventLogEnabled, "event-log", false, "append every join, leave, status change and message to the event_log table so derived data can be rebuilt by replay")
+	fs.IntVar(&persistQueueSize, "persist-queue", persistQueueSize, "messages that may wait to be stored in the background (0 stores each before delivery)")
+	fs.IntVar(&persistBatchSize, "persist-batch", persistBatchSize, "most messages stored in one database transaction")
+	fs.DurationVar(&leaderLease, "leader-lease", 0, "run as one of an active/standby pair sharing -db: only the holder of this lease accepts clients (0 disables)")
+	fs.StringVar(&instanceID, "instance-id", instanceID, "name of this instance in the leadership lease and routing table")
+	fs.BoolVar(&clusterMode, "cluster", false, "run as one of several instances sharing -db that all accept clients, routing private messages between them")
+	fs.DurationVar(&snapshotInterval, "snapshot-interval", snapshotInterval, "how often channel membership is saved so it can be restored after a crash (0 disables)")
+	fs.IntVar(&userCacheSize, "user-cache", userCacheSize, "accounts kept in the in-memory lookup cache (0 disables)")
+	fs.StringVar(&readDBSpec, "read-db", "", "read replica for history queries as driver:dsn or a SQLite path, e.g. file:/replica/chat.db?mode=ro (empty reads from -db)")
+	fs.IntVar(&outboundQueue, "outbound-queue", outboundQueue, "writes that may wait for each client (0 writes to clients inline)")
+	fs.StringVar(&outboundOverflow, "outbound-overflow", outboundOverflow, "what to do when a client's queue is full: drop or disconnect")
+	fs.StringVar(&logFile, "log-file", "", "write the server log to this file, rotating it by size (empty logs to stdout)")
+	fs.BoolVar(&logStdout, "log-stdout", false, "also write the log to stdout when -log-file is set")
+	fs.StringVar(&logLevel, "log-level", logLevel, "least severe log level recorded: debug, info, warn or error (debug logs every command)")
+	fs.IntVar(&logMaxSize, "log-max-size", logMaxSize, "megabytes the log file may reach before it is rotated")
+	fs.IntVar(&logMaxFiles, "log-max-files", logMaxFiles, "rotated log files to keep")
+	fs.BoolVar(&demoMode, "demo", false, "serve a temporary database seeded with sample users, channels and chatter, deleted on exit")
+	fs.IntVar(&soakCycles, "soak", 0, "testing: run this many connect/chat/disconnect cycles against the server, report goroutine and heap growth, and exit")
+	fs.IntVar(&soakWorkers, "soak-workers", soakWorkers, "testing: soak clients connected at once")
+	rulesFile := fs.String("rules", "", "file with rules that accounts must /accept before chatting")
+	rulesVer := fs.String("rules-version", "", "version of the rules (defaults to a hash of the text)")
+	onboardingFile := fs.String("onboarding", "", "script the welcome bot sends to new accounts")
+	motdFile := fs.String("motd", "", "file with the message of the day shown on login, until an admin sets another with /motd")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	serveFlags = fs
+
+	closeLog, err := setupLogging()
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	if *onboardingFile != "" {
+		if err := loadOnboardingScript(*onboardingFile); err != nil {
+			return fmt.Errorf("loading onboarding script: %v", err)
+		}
+	}
+
+	if err := enablePlugins(pluginList); err != nil {
+		return err
+	}
+
+	if *rulesFile != "" {
+		if err := loadRules(*rulesFile, *rulesVer); err != nil {
+			return fmt.Errorf("loading rules: %v", err)
+		}
+	}
+
+	if *motdFile != "" {
+		if err := loadMOTD(*motdFile); err != nil {
+			return fmt.Errorf("loading message of the day: %v", err)
+		}
+	}
+
+	if outboundOverflow != "drop" && outboundOverflow != "disconnect" {
+		return fmt.Errorf("-outbound-overflow must be drop or disconnect")
+	}
+
+	if soakCycles > 0 && (powDifficulty > 0 || soakWorkers <= 0) {
+		return fmt.Errorf("-soak needs -soak-workers above 0 and can't be combined with -pow")
+	}
+
+	if clusterMode && leaderLease > 0 {
+		return fmt.Errorf("-cluster and -leader-lease can't be combined")
+	}
+
+	if websocketEnabled && httpAddr == "" {
+		return fmt.Errorf("-websocket requires -http-addr")
+	}
+
+	if demoMode {
+		if commandLineFlags["db"] || soakCycles > 0 {
+			return fmt.Errorf("-demo uses a database of its own and can't be combined with -db or -soak")
+		}
+		removeDemo, err := useDemoDatabase()
+		if err != nil {
+			return fmt.Errorf("creating demo database: %v", err)
+		}
+		defer removeDemo()
+	}
+
 	// Initialize database
 	if err := initDB(); err != nil {
-		fmt.Println("Error initializing database:", err)
-		return
+		return fmt.Errorf("initializing database: %v", err)
 	}
 	defer closeDB()
+	if err := checkStorageKey(); err != nil {
+		return err
+	}
+	if n, err := encryptStoredBodies(); err != nil {
+		return err
+	} else if n > 0 {
+		logger.Info("encrypted stored message bodies", "messages", n)
+	}
+	if err := openReadReplica(); err != nil {
+		return fmt.Errorf("opening read replica: %v", err)
+	}
+	defer closeReadReplica()
+	if err := loadChannelBotSettings(); err != nil {
+		return fmt.Errorf("loading channel settings: %v", err)
+	}
+	if err := loadChannelLayout(); err != nil {
+		return fmt.Errorf("loading channel categories: %v", err)
+	}
+	if err := loadIntegrations(); err != nil {
+		return fmt.Errorf("loading channel integrations: %v", err)
+	}
+	if err := loadEmojiOnlyChannels(); err != nil {
+		return fmt.Errorf("loading emoji-only channels: %v", err)
+	}
+	if err := loadStatusExpiries(); err != nil {
+		return fmt.Errorf("loading timed statuses: %v", err)
+	}
+	if demoMode {
+		if err := seedDemo(); err != nil {
+			return fmt.Errorf("seeding demo database: %v", err)
+		}
+	}
 
-	// Start listening on port 8080
-	ln, err := net.Listen("tcp", ":8080")
+	// Serve HTTP before waiting for the lease so a standby answers health checks
+	if httpAddr != "" {
+		go startHTTPServer() // Serve health checks, the admin API, dashboard and streams
+	}
+
+	// In an active/standby pair only the lease holder accepts clients
+	if leaderLease > 0 {
+		waitForLeadership()
+	}
+
+	// Start listening for chat clients
+	ln, err := net.Listen("tcp", listenAddr)
 	if err != nil {
-		fmt.Println("Error listening:", err)
-		return
+		return fmt.Errorf("listening: %v", err)
 	}
 	defer ln.Close()
+	chatListening.Store(true)
+	defer chatListening.Store(false)
 
 	// Start goroutines for handling messages
 	go handleBroadcasting()     // Handle broadcast messages
 	go processPrivateMessages() // Handle private messages
+	startPersistenceRecovery()  // Store messages kept in memory while the database was down
+	go runWebhooks()            // Post channel messages to their webhooks
+	startQuietHours()           // Tell users when their quiet hours start and end
+	if persistQueueSize > 0 {
+		startPersistWriter() // Store messages off the delivery path
+	}
+	if telemetryEnabled {
+		go runTelemetry() // Record usage statistics
+	}
+	if stormThreshold > 0 {
+		startStormMonitor() // Lift slow mode once a storm is over
+	}
+	if reapInterval > 0 {
+		startReaper() // Evict dead connections
+	}
+	if snapshotInterval > 0 {
+		startSnapshots() // Save channel membership for crash recovery
+	}
+	if clusterMode {
+		startRouting() // Deliver private messages routed from other instances
+	}
+
+	// Stop accepting on SIGINT, SIGTERM, or loss of leadership, and store queued
+	// messages before exiting
+	stopped := make(chan error, 1)
+	stopServer := func(err error) {
+		select {
+		case stopped <- err:
+			// Fail readiness checks first so no new clients are sent here
+			chatListening.Store(false)
+			ln.Close()
+		default:
+		}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logger.Info("shutting down")
+		stopServer(nil)
+	}()
+	if leaderLease > 0 {
+		go maintainLeadership(stopServer)
+	}
 
-	fmt.Println("Server is running on port 8080")
+	logger.Info("server is running", "addr", ln.Addr().String())
+	if soakCycles > 0 {
+		go runSoak(ln.Addr().String(), stopServer)
+	}
+	if demoMode {
+		startDemo(ln.Addr().String())
+	}
 
 	// Accept incoming connections
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			fmt.Println("Error accepting:", err)
+			select {
+			case err := <-stopped:
+				if snapshotInterval > 0 {
+					// Planned restarts restore membership just like crashes
+					if err := saveSnapshots(); err != nil {
+						logger.Error("saving session snapshot", "err", err)
+					}
+				}
+				flushPersistQueue()
+				clearRoutes()
+				if err == nil {
+					releaseLease()
+				}
+				return err
+			default:
+			}
+			logger.Error("accepting connection", "err", err)
+			continue
+		}
+		// Turn clients away once the server is full rather than run out of memory,
+		// or let them wait in line for a place
+		if !acquireSession() {
+			if maxSessionQueue <= 0 {
+				logger.Warn("server full, connection rejected", "remote", conn.RemoteAddr().String())
+				rejectServerFull(conn)
+				continue
+			}
+			go func() {
+				if !sessionQueue.wait(conn) {
+					logger.Warn("server full, connection rejected", "remote", conn.RemoteAddr().String())
+					return
+				}
+				defer releaseSession()
+				handleClient(wrapClientConn(newTimeoutConn(conn)))
+			}()
 			continue
 		}
 		// Handle each client in a separate goroutine
-		go handleClient(conn)
+		go func() {
+			defer releaseSession()
+			handleClient(wrapClientConn(newTimeoutConn(conn)))
+		}()
 	}
 }
 
 // handleClient manages a single client connection
 func handleClient(conn net.Conn) {
+	registerConn(conn)
+	connLogger(conn).Info("connection opened", "remote", conn.RemoteAddr().String())
+	defer func() {
+		connLogger(conn).Info("connection closed")
+		forgetConn(conn)
+	}()
+
 	reader := bufio.NewReader(conn)
 	var username string
 	var name string
 	var authenticated bool
 
+	// Cap how many connections may sit in the login phase at once
+	if !acquireAuthSlot() {
+		conn.Write([]byte("\033[1;31mServer is busy. Please try again later.\033[0m\n"))
+		conn.Close()
+		return
+	}
+	authPending := true
+	defer func() {
+		// Drop connections that never finished logging in
+		if authPending {
+			releaseAuthSlot()
+			conn.Close()
+		}
+	}()
+
+	// Unauthenticated clients only get a limited time to log in
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+
+	// Under attack, make the client pay before we touch the database
+	if powDifficulty > 0 && !requireProofOfWork(conn, reader) {
+		return
+	}
+
 	// First, handle registration/login
 	conn.Write([]byte("\033[1;36mWelcome to the Chat Server!\033[0m\n"))
 	conn.Write([]byte("\033[1;32mPlease register or login:\033[0m\n"))
-	conn.Write([]byte("\033[1;33m1. To register: /register <username> <password>\033[0m\n"))
+	conn.Write([]byte("\033[1;33m1. To register: /register <username> <password> (or just /register to be guided)\033[0m\n"))
 	conn.Write([]byte("\033[1;33m2. To login: /login <username> <password>\033[0m\n"))
+	conn.Write([]byte("\033[90m   Forgot your password? /recover <username> <recovery code> <new password>\033[0m\n"))
+	if len(spectatorChannels) > 0 {
+		conn.Write([]byte("\033[1;33m3. To watch without an account: /spectate [channel]\033[0m\n"))
+	}
+	if hasColor(conn) {
+		conn.Write([]byte("\033[90m   Seeing codes like [1;33m around the text? Type /color off.\033[0m\n"))
+	}
 
 	for !authenticated {
-		message, err := reader.ReadString('\n')
+		message, err := readLimitedLine(reader, maxPreAuthLine)
 		if err != nil {
-			fmt.Println("Error reading message:", err)
+			connLogger(conn).Debug("read failed before login", "err", err)
 			return
 		}
 		message = strings.TrimSpace(message)
 
-		if strings.HasPrefix(message, "/register") {
+		if message == "/register" {
+			// No arguments: walk the user through registration step by step
+			username = runGuidedRegistration(conn, reader)
+			if username != "" {
+				authenticated = true
+			}
+		} else if strings.HasPrefix(message, "/register") {
 			username = handleRegisterCommand(conn, message)
 			if username != "" {
 				authenticated = true
@@ -119,6 +432,24 @@ func handleClient(conn net.Conn) {
 			if username != "" {
 				authenticated = true
 			}
+		} else if strings.HasPrefix(message, "/recover") {
+			handleRecoverCommand(conn, message)
+		} else if strings.HasPrefix(message, "/spectate") {
+			channel, ok := parseSpectateCommand(conn, message)
+			if !ok || !addSpectator(conn, channel) {
+				continue
+			}
+			// Spectators stay connected, so they count toward -max-spectators instead
+			// of the pending logins
+			conn.SetReadDeadline(time.Time{})
+			releaseAuthSlot()
+			authPending = false
+			runSpectator(conn, reader, channel)
+			return
+		} else if strings.HasPrefix(message, "/proto") {
+			handleProtoCommand(conn, message)
+		} else if strings.HasPrefix(message, "/color") {
+			handleColorCommand(conn, message)
 		} else if strings.HasPrefix(message, "/exit") {
 			handleExitCommand(conn)
 			return
@@ -130,63 +461,176 @@ func handleClient(conn net.Conn) {
 	// Get client's display name after successful registration/login
 	for {
 		conn.Write([]byte("\033[1;33mEnter your display name: \033[0m"))
-		displayName, err := reader.ReadString('\n')
+		displayName, err := readLimitedLine(reader, maxPreAuthLine)
 		if err != nil {
-			fmt.Println("Error reading name:", err)
+			connLogger(conn).Info("connection lost while choosing a display name", "err", err)
 			return
 		}
-		displayName = strings.TrimSpace(displayName)
+		displayName, err = validateDisplayName(displayName)
+		if err != nil {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mInvalid display name: %s.\033[0m\n", err)))
+			continue
+		}
 
 		// Check if display name is already taken
 		mutex.Lock()
-		if displayNames[displayName] {
-			mutex.Unlock()
+		claimed := claimDisplayNameLocked(displayName, username)
+		mutex.Unlock()
+		if !claimed {
 			conn.Write([]byte("\033[1;31mDisplay name already taken. Please choose another.\033[0m\n"))
 			continue
 		}
-		displayNames[displayName] = true
-		mutex.Unlock()
 		name = displayName
 		break
 	}
 
+	// Login finished, lift the pre-auth restrictions
+	conn.SetReadDeadline(time.Time{})
+	releaseAuthSlot()
+	authPending = false
+
+	userID, err := getUserID(username)
+	if err != nil {
+		connLogger(conn).Error("loading user ID", "err", err)
+	}
+	session := loadSession(username)
+	setAccessibleOutput(conn, session.accessible)
+	if session.color != "" {
+		setColorOutput(conn, session.color == "on")
+	}
+
 	// Add client to the server's client list
 	mutex.Lock()
-	clients[conn] = name
-	nameToConn[name] = conn
+	addClientLocked(conn, name, username, userID, session)
+	recordUserCount(hub.Len())
+	firstSession := !accountOnlineLocked(username, conn)
 	mutex.Unlock()
+	connLogger(conn).Info("logged in", "name", name)
 
 	// Notify everyone that a new client has joined
-	broadcast <- fmt.Sprintf("\033[33m%s has joined the chat\033[0m\n", name)
+	if firstSession {
+		setRoute(username)
+	}
+	bus.Emit(UserConnected{User: identityForConn(conn), FirstSession: firstSession})
+
+	// Show the message of the day and anything admins pinned
+	sendMOTD(conn, false)
+
+	// New accounts get a welcome walkthrough from the bot
+	sendOnboarding(conn, username, name)
+
+	// Returning users get a summary of what they missed, counting private
+	// messages before they are delivered below
+	if firstSession {
+		sendWelcomeBack(conn, username, name)
+	}
+
+	// Private messages sent while the account was offline are delivered now
+	deliverOfflineMessages(conn, username)
+
+	// Games survive reconnects; say which are waiting for this user
+	if firstSession {
+		sendGameReminder(conn, username)
+	}
+
+	// After a crash or restart, put the user back in the channels they were in
+	restoreSession(conn, username)
+
+	// Accounts that haven't accepted the current rules must do so before chatting
+	rulesAccepted := hasAcceptedRules(username)
+	if !rulesAccepted {
+		sendRules(conn)
+		conn.Write([]byte("\033[1;33mType /accept to agree to the rules before sending messages.\033[0m\n"))
+	}
 
 	// Handle client messages
 	for {
 		message, err := reader.ReadString('\n')
 		if err != nil {
-			fmt.Println("Error reading message:", err)
+			connLogger(conn).Debug("read failed", "err", err)
 			break
 		}
-		message = strings.TrimSpace(message)
+		message = strings.TrimSpace(sanitizeInput(message))
+		touchConn(conn)
+
+		if !passRulesGate(conn, message, &rulesAccepted) {
+			continue
+		}
 
 		// Handle any commands, continue if a command was processed
 		if handleCommand(conn, message) {
 			continue
 		}
 
-		// Broadcast the message to all clients
-		broadcast <- fmt.Sprintf("\033[34m%s: %s\033[0m\n", name, message)
+		// Store and deliver the message to the current channel
+		sendChannelMessage(conn, message, "", "", nil)
 	}
 
 	// Clean up when client disconnects
+	saveReconnectPosition(conn)
 	mutex.Lock()
-	delete(clients, conn)
-	delete(nameToConn, name)
-	delete(displayNames, name)
+	identity := identityForConnLocked(conn)
+	lastSession := !accountOnlineLocked(username, conn)
+	left := removeClientLocked(conn)
 	mutex.Unlock()
-	broadcast <- fmt.Sprintf("\033[33m%s has left the chat\033[0m\n", name)
+	if lastSession {
+		clearRoute(username)
+		recordLastSeen(username)
+	}
+	bus.Emit(UserDisconnected{User: identity, Channels: left, LastSession: lastSession})
 	conn.Close()
 }
 
+// claimDisplayNameLocked reserves a display name for an account, reporting false if
+// another account has it. The account's other sessions may use it too.
+// Callers must hold mutex.
+func claimDisplayNameLocked(name, account string) bool {
+	return hub.Claim(name, account)
+}
+
+// addClientLocked registers a logged in connection under its claimed display name
+// and puts it in defaultChannel. Callers must hold mutex.
+func addClientLocked(conn net.Conn, name, username, userID string, session *Session) {
+	hub.Add(&registry.Client{Conn: conn, Name: name, Account: username, UserID: userID})
+	sessions[conn] = session
+	lastSeen[conn] = clock.Now()
+	joinRoomLocked(conn, defaultChannel)
+}
+
+// removeClientLocked forgets a connection, releases its display name unless another
+// session still uses it, and returns the rooms it left. Callers must hold mutex.
+func removeClientLocked(conn net.Conn) []string {
+	left := leaveAllRoomsLocked(conn)
+	if account := hub.Account(conn); !accountOnlineLocked(account, conn) {
+		forgetFloodLocked(account, clock.Now())
+	}
+	hub.Remove(conn)
+	delete(sessions, conn)
+	delete(lastSeen, conn)
+	delete(pendingDeletions, conn)
+	delete(typingSent, conn)
+	cancelTransfersLocked(conn)
+	return left
+}
+
+// validateUsername checks a new account name. Usernames are typed in commands like
+// /login and show up in logs and the admin API, so they are one word without control
+// characters.
+func validateUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("username can't be empty")
+	}
+	if len(username) > maxUsernameLength {
+		return fmt.Errorf("username must be %d characters or less", maxUsernameLength)
+	}
+	for _, r := range username {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == utf8.RuneError {
+			return fmt.Errorf("username can't contain spaces or control characters")
+		}
+	}
+	return nil
+}
+
 // handleRegisterCommand handles user registration
 func handleRegisterCommand(conn net.Conn, message string) string {
 	// Get client IP
@@ -194,6 +638,7 @@ func handleRegisterCommand(conn net.Conn, message string) string {
 
 	// Check rate limiting
 	if isRateLimited(ip) {
+		connLogger(conn).Warn("registration rate limited", "ip", ip)
 		conn.Write([]byte("\033[1;31mToo many registration attempts. Please try again later.\033[0m\n"))
 		return ""
 	}
@@ -207,12 +652,12 @@ func handleRegisterCommand(conn net.Conn, message string) string {
 	password := strings.TrimSpace(parts[2])
 
 	// Validate username and password length
-	if len(username) > 10 {
-		conn.Write([]byte("\033[1;31mUsername must be 10 characters or less.\033[0m\n"))
+	if err := validateUsername(username); err != nil {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mInvalid username: %s.\033[0m\n", err)))
 		return ""
 	}
-	if len(password) > 10 {
-		conn.Write([]byte("\033[1;31mPassword must be 10 characters or less.\033[0m\n"))
+	if len(password) > maxPasswordLength {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mPassword must be %d characters or less.\033[0m\n", maxPasswordLength)))
 		return ""
 	}
 
@@ -228,13 +673,18 @@ func handleRegisterCommand(conn net.Conn, message string) string {
 		return ""
 	}
 
-	// Save user to database
-	if err := saveUser(username, password); err != nil {
+	// Save user to database; hashing the password waits its turn during a login burst
+	done := waitForAuthTurn(conn)
+	err = saveUser(username, password)
+	done()
+	if err != nil {
 		conn.Write([]byte("\033[1;31mError registering user. Please try again.\033[0m\n"))
 		return ""
 	}
 
+	connLogger(conn).Info("account registered", "user", username)
 	conn.Write([]byte(fmt.Sprintf("\033[1;32mWelcome, %s! You can now start chatting.\033[0m\n", username)))
+	sendNewRecoveryCodes(conn, username)
 	return username
 }
 
@@ -249,42 +699,38 @@ func handleLoginCommand(conn net.Conn, message string) string {
 	password := strings.TrimSpace(parts[2])
 
 	// Validate username and password length
-	if len(username) > 10 {
-		conn.Write([]byte("\033[1;31mUsername must be 10 characters or less.\033[0m\n"))
+	if len(username) > maxUsernameLength {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mUsername must be %d characters or less.\033[0m\n", maxUsernameLength)))
 		return ""
 	}
-	if len(password) > 10 {
-		conn.Write([]byte("\033[1;31mPassword must be 10 characters or less.\033[0m\n"))
+	if len(password) > maxPasswordLength {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mPassword must be %d characters or less.\033[0m\n", maxPasswordLength)))
 		return ""
 	}
 
-	if !verifyUser(username, password) {
+	// bcrypt is slow on purpose, so during a login burst checks wait their turn
+	done := waitForAuthTurn(conn)
+	verified := verifyUser(username, password)
+	done()
+	if !verified {
+		connLogger(conn).Warn("login failed", "user", username, "reason", "invalid username or password")
 		conn.Write([]byte("\033[1;31mInvalid username or password.\033[0m\n"))
 		return ""
 	}
-
-	conn.Write([]byte(fmt.Sprintf("\033[1;32mWelcome back, %s!\033[0m\n", username)))
-	return username
-}
-
-// handleStatusCommand handles the /status command
-func handleStatusCommand(conn net.Conn, message string) {
-	parts := strings.SplitN(message, " ", 2)
-	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
-		conn.Write([]byte("\033[1;31mUsage: /status <set status>\033[0m\n"))
-		return
+	if isUserDisabled(username) {
+		connLogger(conn).Warn("login failed", "user", username, "reason", "disabled")
+		conn.Write([]byte("\033[1;31mThis account has been disabled.\033[0m\n"))
+		return ""
 	}
-	newStatus := parts[1]
-	mutex.Lock()
-	username := clients[conn]
-	mutex.Unlock()
-
-	if err := updateUserStatus(username, newStatus); err != nil {
-		conn.Write([]byte("\033[1;31mError updating status. Please try again.\033[0m\n"))
-		return
+	if isBanned(username) {
+		connLogger(conn).Warn("login failed", "user", username, "reason", "banned")
+		conn.Write([]byte("\033[1;31mThis account has been banned.\033[0m\n"))
+		return ""
 	}
+	connLogger(conn).Info("login succeeded", "user", username)
 
-	conn.Write([]byte(fmt.Sprintf("\033[1;32mYour status has been set to: %s\033[0m\n", newStatus)))
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mWelcome back, %s!\033[0m\n", username)))
+	return username
 }
 
 // handleUsersCommand handles the /users command
@@ -304,103 +750,143 @@ func handleUsersCommand(conn net.Conn) {
 	}
 }
 
-// handleBroadcasting sends messages to all connected clients
+// OutgoingMessage is a chat message on its way to the members of a channel
+type OutgoingMessage struct {
+	channel string
+	text    string
+	// bot marks automated messages that recipients may have filtered out
+	bot bool
+	// tag is the message's tag, empty if untagged
+	tag string
+	// sent is when the server accepted the message; zero means now
+	sent time.Time
+	// id, from and body describe chat messages for JSON clients; notices leave them empty
+	id   string
+	from string
+	body string
+	// seq is the message's position in its channel, zero for notices
+	seq int64
+	// buttons are the buttons of an interactive message
+	buttons []Button
+	// alsoTo are further channels a cross-posted announcement goes to; members of
+	// several of them get it once
+	alsoTo []string
+	// priority messages from admins go to everyone regardless of their channels and filters
+	priority bool
+	// presence marks join, leave and status summaries; without a channel they go to
+	// everyone, like a broadcast
+	presence bool
+}
+
+// handleBroadcasting sends messages to all connected clients. Writes only queue the
+// message for each client's writer, so holding the mutex here is cheap.
 func handleBroadcasting() {
-	for message := range broadcast {
-		mutex.Lock()
-		for conn := range clients {
-			conn.Write([]byte(message))
+	for {
+		select {
+		case message := <-broadcast:
+			mutex.Lock()
+			hub.Broadcast([]byte(message))
+			// Spectators watching the public channel get a read-only copy
+			for conn, channel := range spectators {
+				if channel == defaultChannel {
+					conn.Write([]byte(message))
+				}
+			}
+			mutex.Unlock()
+		case msg := <-channelMessages:
+			if msg.sent.IsZero() {
+				msg.sent = time.Now()
+			}
+			mutex.Lock()
+			deliverChannelMessageLocked(msg)
+			mutex.Unlock()
+		}
+	}
+}
+
+// deliverChannelMessageLocked writes a channel message to the channel's members and
+// spectators, honoring their filters. Priority messages go to everyone. Callers must
+// hold mutex.
+func deliverChannelMessageLocked(msg OutgoingMessage) {
+	// Shortcodes are expanded once; users who asked for raw shortcodes get the original
+	raw, rawEv := msg, msg.event()
+	msg.text, msg.body = expandShortcodes(msg.text), expandShortcodes(msg.body)
+	ev := msg.event()
+	if msg.priority {
+		for _, c := range hub.Clients() {
+			writeEvent(c.Conn, ev, messagePrefix(sessionForLocked(c.Conn), msg, false)+msg.text)
+		}
+		for conn := range spectators {
+			writeEvent(conn, ev, timestamp(nil, msg.sent)+msg.text)
+		}
+		return
+	}
+	if len(msg.alsoTo) > 0 {
+		deliverCrosspostLocked(msg, ev)
+		return
+	}
+	// Accessible users only hear presence for the channel they are talking in
+	if msg.presence && msg.channel == "" {
+		for _, c := range hub.Clients() {
+			if !isAccessible(c.Conn) {
+				writeEvent(c.Conn, ev, msg.text)
+			}
+		}
+		for conn, channel := range spectators {
+			if channel == defaultChannel {
+				writeEvent(conn, ev, msg.text)
+			}
+		}
+		return
+	}
+	for conn := range rooms[msg.channel] {
+		session := sessionForLocked(conn)
+		if s := sessions[conn]; s != nil && msg.seq > 0 {
+			if s.seen == nil {
+				s.seen = make(map[string]int64)
+			}
+			s.seen[msg.channel] = msg.seq
+		}
+		if msg.bot && !receivesBotTraffic(session, msg.channel) {
+			continue
+		}
+		if !session.tags[msg.channel].allows(msg.tag) {
+			continue
+		}
+		if msg.presence && session.room != msg.channel && isAccessible(conn) {
+			continue
+		}
+		if holdChannelMessageLocked(session, msg) {
+			continue
+		}
+		text, ev := msg.text, ev
+		if session.rawEmoji {
+			text, ev = raw.text, rawEv
+		}
+		// Messages from channels the user isn't talking in say where they're from
+		writeEvent(conn, ev, messagePrefix(session, msg, session.room != msg.channel)+text)
+	}
+	for conn, channel := range spectators {
+		if channel == msg.channel && (!msg.bot || showBotTraffic) {
+			writeEvent(conn, ev, timestamp(nil, msg.sent)+msg.text)
 		}
-		mutex.Unlock()
 	}
 }
 
 // handleExitCommand handles the /exit command
 func handleExitCommand(conn net.Conn) {
-	mutex.Lock()
-	name := clients[conn]
-	delete(clients, conn)
-	delete(nameToConn, name)
-	mutex.Unlock()
-
-	// Notify everyone that the user has left
-	broadcast <- fmt.Sprintf("\033[33m%s has left the chat\033[0m\n", name)
-
 	// Send goodbye message to the exiting user
 	conn.Write([]byte("\033[1;32mGoodbye! Thanks for chatting.\033[0m\n"))
 
-	// Close the connection
+	// Close the connection; handleClient notices, cleans up and tells everyone
 	conn.Close()
 }
 
-// handleHelpCommand displays all available commands and their descriptions
-func handleHelpCommand(conn net.Conn) {
-	helpMessage := "\033[1;36mAvailable Commands:\033[0m\n\n" +
-		"\033[1;33m/register <username> <password>\033[0m\n" +
-		"    Register a new user account\n\n" +
-		"\033[1;33m/login <username> <password>\033[0m\n" +
-		"    Login to your account\n\n" +
-		"\033[1;33m/users\033[0m\n" +
-		"    List all currently connected users\n\n" +
-		"\033[1;33m/private <username> <message>\033[0m\n" +
-		"    Send a private message to a specific user\n\n" +
-		"\033[1;33m/reply <message>\033[0m\n" +
-		"    Reply to the last private message you received\n\n" +
-		"\033[1;33m/exit\033[0m\n" +
-		"    Exit the chat server\n\n" +
-		"\033[1;33m/help\033[0m\n" +
-		"    Display this help message\n\n" +
-		"\033[1;36mRegular Messages:\033[0m\n" +
-		"    Type any message without a command to broadcast to all users\n"
-
-	conn.Write([]byte(helpMessage))
-}
-
-// handleCommand handles any commands from the client
-func handleCommand(conn net.Conn, message string) bool {
-	//register command
-	if strings.HasPrefix(message, "/register") {
-		handleRegisterCommand(conn, message)
-		return true
-	}
-	// /users command
-	if strings.HasPrefix(message, "/users") {
-		handleUsersCommand(conn)
-		return true
-	}
-	// /private command
-	if strings.HasPrefix(message, "/private") {
-		handlePrivateMessage(conn, message)
-		return true
-	}
-	// /reply command
-	if strings.HasPrefix(message, "/reply") {
-		handleReplyCommand(conn, message)
-		return true
-	}
-	// /exit command
-	if strings.HasPrefix(message, "/exit") {
-		handleExitCommand(conn)
-		return true
-	}
-	// /help command
-	if strings.HasPrefix(message, "/help") {
-		handleHelpCommand(conn)
-		return true
-	}
-	// /status command
-	if strings.HasPrefix(message, "/status") {
-		handleStatusCommand(conn, message)
-		return true
-	}
-	return false
-}
-
 // handleReplyCommand allows replying to the last private sender
 func handleReplyCommand(conn net.Conn, message string) {
 	mutex.Lock()
-	username := clients[conn]
-	lastSender, ok := lastPrivateSender[username]
+	username := hub.Name(conn)
+	lastSender, ok := hub.LastSender(username)
 	mutex.Unlock()
 	if !ok {
 		conn.Write([]byte("\033[1;31mNo private messages to reply to.\033[0m\n"))
@@ -1,11 +1,31 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"chat-server/internal/registry"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Test helper function to create a mock connection
@@ -87,10 +107,8 @@ func TestHandlePrivateMessage(t *testing.T) {
 
 	// Register and login both users
 	mutex.Lock()
-	clients[senderConn] = "sender"
-	clients[recipientConn] = "recipient"
-	nameToConn["sender"] = senderConn
-	nameToConn["recipient"] = recipientConn
+	hub.Add(&registry.Client{Conn: senderConn, Name: "sender"})
+	hub.Add(&registry.Client{Conn: recipientConn, Name: "recipient"})
 	mutex.Unlock()
 
 	// Test
@@ -102,7 +120,7 @@ func TestHandlePrivateMessage(t *testing.T) {
 
 	// Verify
 	mutex.Lock()
-	_, exists := lastPrivateSender["recipient"]
+	_, exists := hub.LastSender("recipient")
 	mutex.Unlock()
 	if !exists {
 		t.Error("Last private sender was not recorded")
@@ -117,11 +135,8 @@ func TestHandlePrivateMessage(t *testing.T) {
 
 	// Cleanup
 	mutex.Lock()
-	delete(clients, senderConn)
-	delete(clients, recipientConn)
-	delete(nameToConn, "sender")
-	delete(nameToConn, "recipient")
-	delete(lastPrivateSender, "recipient")
+	hub.Remove(senderConn)
+	hub.Remove(recipientConn)
 	mutex.Unlock()
 }
 
@@ -136,8 +151,7 @@ func TestHandleStatusCommand(t *testing.T) {
 	// Register and login a user
 	handleRegisterCommand(conn, "/register testuser testpass")
 	mutex.Lock()
-	clients[conn] = "testuser"
-	nameToConn["testuser"] = conn
+	hub.Add(&registry.Client{Conn: conn, Name: "testuser", Account: "testuser"})
 	mutex.Unlock()
 
 	// Test
@@ -154,8 +168,7 @@ func TestHandleStatusCommand(t *testing.T) {
 
 	// Cleanup
 	mutex.Lock()
-	delete(clients, conn)
-	delete(nameToConn, "testuser")
+	hub.Remove(conn)
 	mutex.Unlock()
 	db.Exec("DELETE FROM users WHERE username = ?", "testuser")
 }
@@ -164,3 +177,4468 @@ func TestSaveUsersToFile(t *testing.T) {
 	// This test is no longer needed as we're using database storage now
 	t.Skip("Skipping test as we're using database storage now")
 }
+
+func TestParseLegacyUsers(t *testing.T) {
+	list, err := parseLegacyUsers([]byte(`[{"username": "alice", "password": "pw", "status": "away"}]`))
+	if err != nil || len(list) != 1 || list[0].Username != "alice" || list[0].Status != "away" {
+		t.Errorf("Unexpected list result: %+v (%v)", list, err)
+	}
+
+	byName, err := parseLegacyUsers([]byte(`{"bob": "pw", "carol": {"password": "pw2", "status": "busy"}}`))
+	if err != nil || len(byName) != 2 {
+		t.Fatalf("Unexpected map result: %+v (%v)", byName, err)
+	}
+	for _, u := range byName {
+		if u.Username == "carol" && (u.Password != "pw2" || u.Status != "busy") {
+			t.Errorf("Unexpected carol: %+v", u)
+		}
+		if u.Username == "bob" && u.Password != "pw" {
+			t.Errorf("Unexpected bob: %+v", u)
+		}
+	}
+
+	if _, err := parseLegacyUsers([]byte(`"nope"`)); err == nil {
+		t.Error("Expected unknown format to be rejected")
+	}
+}
+
+func TestVerifyPow(t *testing.T) {
+	challenge := "deadbeef"
+	difficulty := 8
+
+	// Brute force a valid nonce the same way a client would
+	var nonce string
+	for i := 0; i < 1<<20; i++ {
+		candidate := strconv.Itoa(i)
+		if verifyPow(challenge, candidate, difficulty) {
+			nonce = candidate
+			break
+		}
+	}
+	if nonce == "" {
+		t.Fatal("Could not find a valid nonce")
+	}
+
+	if !verifyPow(challenge, nonce, difficulty) {
+		t.Error("Expected valid nonce to verify")
+	}
+	if verifyPow("otherchallenge", nonce, difficulty) {
+		t.Error("Expected nonce to fail against a different challenge")
+	}
+	if verifyPow(challenge, "", difficulty) {
+		t.Error("Expected empty nonce to be rejected")
+	}
+}
+
+func TestReadLimitedLine(t *testing.T) {
+	reader := bufio.NewReaderSize(strings.NewReader("/login bob pw\n"+strings.Repeat("a", 100)+"\n"), 16)
+
+	line, err := readLimitedLine(reader, 32)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if line != "/login bob pw\n" {
+		t.Errorf("Expected '/login bob pw', got '%s'", line)
+	}
+
+	if _, err := readLimitedLine(reader, 32); err != errLineTooLong {
+		t.Errorf("Expected errLineTooLong, got %v", err)
+	}
+}
+
+func TestAuthSlots(t *testing.T) {
+	saved := maxPendingAuth
+	maxPendingAuth = 2
+	defer func() { maxPendingAuth = saved }()
+
+	if !acquireAuthSlot() || !acquireAuthSlot() {
+		t.Fatal("Expected the first two slots to be granted")
+	}
+	if acquireAuthSlot() {
+		t.Error("Expected third slot to be refused")
+	}
+	releaseAuthSlot()
+	if !acquireAuthSlot() {
+		t.Error("Expected slot to be available after release")
+	}
+	releaseAuthSlot()
+	releaseAuthSlot()
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		0:       "0 B",
+		512:     "512 B",
+		2048:    "2.0 KiB",
+		5 << 20: "5.0 MiB",
+	}
+	for n, want := range cases {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = '%s', want '%s'", n, got, want)
+		}
+	}
+}
+
+func TestTakeTelemetrySample(t *testing.T) {
+	// Drain what earlier tests counted so the sample only holds this test's messages
+	takeTelemetrySample()
+	recordUserCount(5)
+	recordMessageSent("alice")
+	recordMessageSent("alice")
+
+	sample := takeTelemetrySample()
+	if sample.Messages != 2 {
+		t.Errorf("Expected 2 messages, got %d", sample.Messages)
+	}
+	if sample.PeakUsers < 5 {
+		t.Errorf("Expected peak of at least 5 users, got %d", sample.PeakUsers)
+	}
+
+	// A new window starts empty
+	if next := takeTelemetrySample(); next.Messages != 0 {
+		t.Errorf("Expected counters to reset, got %d messages", next.Messages)
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	if d, err := parsePeriod("7d"); err != nil || d != 7*24*time.Hour {
+		t.Errorf("Expected 7 days, got %v (%v)", d, err)
+	}
+	if d, err := parsePeriod("90m"); err != nil || d != 90*time.Minute {
+		t.Errorf("Expected 90 minutes, got %v (%v)", d, err)
+	}
+	if _, err := parsePeriod("-1d"); err == nil {
+		t.Error("Expected negative period to be rejected")
+	}
+}
+
+func TestTopTerms(t *testing.T) {
+	counts := make(map[string]int)
+	countTerms(counts, "Deploy the build, deploy it now!")
+	countTerms(counts, "build failed")
+
+	terms := topTerms(counts, 2)
+	if len(terms) != 2 || terms[0] != "build" || terms[1] != "deploy" {
+		t.Errorf("Expected [build deploy], got %v", terms)
+	}
+	if counts["the"] != 0 {
+		t.Error("Expected stop words to be ignored")
+	}
+}
+
+func TestAdminAPIRequiresToken(t *testing.T) {
+	saved := adminAPIToken
+	adminAPIToken = "secret"
+	defer func() { adminAPIToken = saved }()
+
+	mux := newHTTPMux()
+
+	req := httptest.NewRequest("GET", "/api/status", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/status", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 with token, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `"connections"`) {
+		t.Errorf("Expected status payload, got %s", rec.Body.String())
+	}
+}
+
+func TestPublishFeed(t *testing.T) {
+	general := subscribeFeed("#general")
+	defer unsubscribeFeed(general)
+	other := subscribeFeed("#other")
+	defer unsubscribeFeed(other)
+
+	publishFeed(FeedMessage{Channel: "#general", From: "alice", Body: "hi"})
+
+	select {
+	case ev := <-general:
+		msg, ok := ev.data.(FeedMessage)
+		if !ok || ev.name != "message" || msg.From != "alice" || msg.Body != "hi" {
+			t.Errorf("Unexpected event: %+v", ev)
+		}
+	default:
+		t.Error("Expected subscriber to receive the message")
+	}
+	select {
+	case ev := <-other:
+		t.Errorf("Subscriber of another channel received %+v", ev)
+	default:
+	}
+}
+
+// TestUsersCSVRoundTrip checks exported accounts are imported with their passwords,
+// roles, statuses and disabled flags, and that plain passwords are checked
+func TestUsersCSVRoundTrip(t *testing.T) {
+	openTestDB(t)
+	if err := saveUser("ann", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveUserWithHash("bob", string(hash), roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateUserStatus("bob", "on leave"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setUserDisabled("bob", true); err != nil {
+		t.Fatal(err)
+	}
+	var exported bytes.Buffer
+	if err := exportUsersCSV(&exported); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec("DELETE FROM users"); err != nil {
+		t.Fatal(err)
+	}
+	resetUserCache()
+	created, skipped, err := importUsersCSV(strings.NewReader(exported.String()))
+	if err != nil || created != 2 || skipped != 0 {
+		t.Fatalf("Expected both accounts to be imported, got %d created, %d skipped, %v", created, skipped, err)
+	}
+	if !verifyUser("ann", "secret") || !verifyUser("bob", "hunter2") {
+		t.Error("Expected the exported password hashes to keep working")
+	}
+	bob, err := lookupUser("bob")
+	if err != nil || bob.role != roleAdmin || bob.status != "on leave" || !bob.disabled {
+		t.Errorf("Expected bob to come back as a disabled admin on leave, got %+v, %v", bob, err)
+	}
+
+	for _, row := range []string{"cat,,user", "cat," + strings.Repeat("x", maxPasswordLength+1), "cat,secret,user,,maybe"} {
+		if _, _, err := importUsersCSV(strings.NewReader(row)); err == nil {
+			t.Errorf("Expected %q to be refused", row)
+		}
+	}
+	if exists, _ := userExists("cat"); exists {
+		t.Error("Expected no account from refused rows")
+	}
+}
+
+func TestStripTelnetCommands(t *testing.T) {
+	input := "\xff\xfd\x01secret\r\n"
+	if got := stripTelnetCommands(input); got != "secret\r\n" {
+		t.Errorf("Expected telnet negotiation to be stripped, got %q", got)
+	}
+	if got := stripTelnetCommands("plain"); got != "plain" {
+		t.Errorf("Expected plain text unchanged, got %q", got)
+	}
+}
+
+func TestChannelRestrictionString(t *testing.T) {
+	r := ChannelRestriction{channel: "#mods", requireVerified: true, requiredRole: "admin", minAccountAge: time.Hour}
+	if got := r.String(); got != "verified account, role admin, account older than 1h0m0s" {
+		t.Errorf("Unexpected description: %s", got)
+	}
+	if got := (ChannelRestriction{}).String(); got != "none" {
+		t.Errorf("Expected 'none', got %s", got)
+	}
+}
+
+func TestRenderOnboardingLine(t *testing.T) {
+	got := renderOnboardingLine("Hi {name} ({username}), try {channel}", "alice", "Ally")
+	if got != "Hi Ally (alice), try #general" {
+		t.Errorf("Unexpected onboarding line: %s", got)
+	}
+}
+
+func TestCompleteNames(t *testing.T) {
+	got := completeNames("al", []string{"bob", "Alice", "alfred", "carol"})
+	if strings.Join(got, ",") != "Alice,alfred" {
+		t.Errorf("Expected [Alice alfred], got %v", got)
+	}
+	if got := completeNames("zz", []string{"bob"}); len(got) != 0 {
+		t.Errorf("Expected no matches, got %v", got)
+	}
+}
+
+func TestResolveName(t *testing.T) {
+	names := []string{"bob", "Alice", "alfred", "carol"}
+
+	if got, _, _ := resolveName("Bob", names); got != "bob" {
+		t.Errorf("Expected case-insensitive match 'bob', got '%s'", got)
+	}
+	if got, _, _ := resolveName("ali", names); got != "Alice" {
+		t.Errorf("Expected unique prefix match 'Alice', got '%s'", got)
+	}
+	got, candidates, ambiguous := resolveName("al", names)
+	if got != "" || !ambiguous || strings.Join(candidates, ",") != "Alice,alfred" {
+		t.Errorf("Expected ambiguous [Alice alfred], got '%s' %v", got, candidates)
+	}
+	got, candidates, ambiguous = resolveName("carl", names)
+	if got != "" || ambiguous || strings.Join(candidates, ",") != "carol" {
+		t.Errorf("Expected suggestion [carol], got '%s' %v", got, candidates)
+	}
+}
+
+func TestFormatIdentity(t *testing.T) {
+	if got := formatIdentity("Ally", "alice"); got != "Ally (@alice)" {
+		t.Errorf("Expected 'Ally (@alice)', got '%s'", got)
+	}
+	if got := formatIdentity("alice", "alice"); got != "alice" {
+		t.Errorf("Expected 'alice', got '%s'", got)
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	a, err := newUUID()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	b, _ := newUUID()
+	if a == b {
+		t.Error("Expected distinct IDs")
+	}
+	if len(a) != 36 || a[14] != '4' {
+		t.Errorf("Expected a version 4 UUID, got %s", a)
+	}
+}
+
+func TestNextStampIsMonotonic(t *testing.T) {
+	sequenceMutex.Lock()
+	defer sequenceMutex.Unlock()
+
+	// Pretend the last message was stamped after a backwards clock jump
+	future := time.Now().UTC().Add(time.Hour)
+	channelClocks["#stamp-test"] = &channelClock{seq: 41, last: future}
+	defer delete(channelClocks, "#stamp-test")
+
+	seq, ts, err := nextStamp("#stamp-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if seq != 42 {
+		t.Errorf("Expected sequence 42, got %d", seq)
+	}
+	if ts.Before(future) {
+		t.Errorf("Expected timestamp not to go backwards, got %v before %v", ts, future)
+	}
+	if ts.Location() != time.UTC {
+		t.Errorf("Expected UTC timestamp, got %v", ts.Location())
+	}
+}
+
+func TestParseHistoryArgs(t *testing.T) {
+	q, err := parseHistoryArgs([]string{"50", "before=abc", "tag=Deploy"})
+	if err != nil || q.Limit != 50 || q.Before != "abc" || q.After != "" || q.Tag != "deploy" {
+		t.Errorf("Unexpected result: %+v %v", q, err)
+	}
+	if _, err := parseHistoryArgs([]string{"before=a", "after=b"}); err == nil {
+		t.Error("Expected before and after together to be rejected")
+	}
+	if _, err := parseHistoryArgs([]string{"lots"}); err == nil {
+		t.Error("Expected invalid limit to be rejected")
+	}
+	if clampHistoryLimit(0) != defaultHistoryLimit || clampHistoryLimit(1000) != maxHistoryLimit {
+		t.Error("Expected limits to be clamped")
+	}
+}
+
+func TestPageMembers(t *testing.T) {
+	names := []string{"dave", "alice", "carol", "bob", "erin"}
+
+	page, next := pageMembers(names, "", 2)
+	if strings.Join(page, ",") != "alice,bob" || next != "bob" {
+		t.Errorf("Unexpected first page: %v next=%s", page, next)
+	}
+	page, next = pageMembers(names, next, 2)
+	if strings.Join(page, ",") != "carol,dave" || next != "dave" {
+		t.Errorf("Unexpected second page: %v next=%s", page, next)
+	}
+	page, next = pageMembers(names, next, 2)
+	if strings.Join(page, ",") != "erin" || next != "" {
+		t.Errorf("Unexpected last page: %v next=%s", page, next)
+	}
+}
+
+func TestReceivesBotTraffic(t *testing.T) {
+	defer func() {
+		showBotTraffic = true
+		channelBotTraffic = make(map[string]bool)
+	}()
+
+	showBotTraffic = false
+	channelBotTraffic["#bots"] = true
+
+	if receivesBotTraffic(&Session{}, "#general") {
+		t.Error("Expected server default to hide bot traffic")
+	}
+	if !receivesBotTraffic(&Session{}, "#bots") {
+		t.Error("Expected channel setting to override server default")
+	}
+	if receivesBotTraffic(&Session{filterBots: "off"}, "#bots") {
+		t.Error("Expected user filter to override channel setting")
+	}
+	if !receivesBotTraffic(&Session{filterBots: "on"}, "#general") {
+		t.Error("Expected user filter to override server default")
+	}
+}
+
+func TestParseTaggedMessage(t *testing.T) {
+	tag, body, ok := parseTaggedMessage("Deploy: build 123 finished")
+	if !ok || tag != "deploy" || body != "build 123 finished" {
+		t.Errorf("Unexpected result: %q %q %v", tag, body, ok)
+	}
+	for _, text := range []string{"no tag here", "bad tag: x", "deploy:", ": body"} {
+		if _, _, ok := parseTaggedMessage(text); ok {
+			t.Errorf("Expected %q to be rejected", text)
+		}
+	}
+}
+
+func TestTagFilterAllows(t *testing.T) {
+	var none *TagFilter
+	if !none.allows("deploy") || !none.allows("") {
+		t.Error("Expected no filter to allow everything")
+	}
+
+	f := &TagFilter{follow: map[string]bool{}, mute: map[string]bool{"noise": true}}
+	if f.allows("noise") || !f.allows("deploy") || !f.allows("") {
+		t.Error("Expected only muted tags to be hidden")
+	}
+
+	f.follow["deploy"] = true
+	if !f.allows("deploy") || f.allows("other") || f.allows("") {
+		t.Error("Expected following to limit messages to followed tags")
+	}
+}
+
+func TestJoinAndLeaveRooms(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	sessions[conn] = &Session{joined: make(map[string]bool)}
+	defer delete(sessions, conn)
+
+	if !joinRoomLocked(conn, defaultChannel) || !joinRoomLocked(conn, "#golang") {
+		t.Fatal("Expected first joins to be reported")
+	}
+	if joinRoomLocked(conn, defaultChannel) {
+		t.Error("Expected rejoining to only switch rooms")
+	}
+	if sessions[conn].room != defaultChannel || !rooms["#golang"][conn] {
+		t.Errorf("Unexpected membership: room=%s", sessions[conn].room)
+	}
+
+	leaveRoomLocked(conn, defaultChannel)
+	if sessions[conn].room != "#golang" {
+		t.Errorf("Expected to switch to remaining room, got %s", sessions[conn].room)
+	}
+
+	left := leaveAllRoomsLocked(conn)
+	if len(left) != 1 || left[0] != "#golang" {
+		t.Errorf("Unexpected rooms left: %v", left)
+	}
+	if _, ok := rooms["#golang"]; ok {
+		t.Error("Expected empty room to be removed")
+	}
+	if _, ok := rooms[defaultChannel]; !ok {
+		t.Error("Expected default channel to remain")
+	}
+}
+
+func TestStormSlowMode(t *testing.T) {
+	defer func() {
+		stormThreshold = 0
+		stormTimes = nil
+		slowMode = false
+		lastSentTime = make(map[string]time.Time)
+	}()
+	stormThreshold = 3
+
+	// Drain the slow mode notices
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-broadcast:
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	now := time.Now()
+	for i, user := range []string{"a", "b", "c", "d"} {
+		if ok, _ := allowStormMessage(user, now.Add(time.Duration(i)*time.Millisecond)); !ok {
+			t.Fatalf("Expected message %d to be allowed", i)
+		}
+	}
+	if !slowMode {
+		t.Fatal("Expected slow mode after exceeding the threshold")
+	}
+	if ok, wait := allowStormMessage("a", now.Add(time.Second)); ok || wait <= 0 {
+		t.Error("Expected a second quick message to be throttled")
+	}
+	if ok, _ := allowStormMessage("a", now.Add(slowModeInterval+time.Second)); !ok {
+		t.Error("Expected message to be allowed after the interval")
+	}
+
+	later := now.Add(stormWindow * 2)
+	checkStormCalmed(later)
+	checkStormCalmed(later.Add(stormCooldown))
+	if slowMode {
+		t.Error("Expected slow mode to turn off after the cooldown")
+	}
+}
+
+func TestFormatPresence(t *testing.T) {
+	single := formatPresence("", []PresenceEvent{{Kind: presenceJoined, Name: "alice"}})
+	if single != "alice has joined the chat" {
+		t.Errorf("Unexpected single event: %q", single)
+	}
+
+	events := []PresenceEvent{
+		{Kind: presenceJoined, Name: "alice"},
+		{Kind: presenceJoined, Name: "bob"},
+		{Kind: presenceLeft, Name: "carol"},
+		{Kind: presenceStatus, Name: "dave", Status: "away"},
+	}
+	want := "#golang: +2 joined (alice, bob), 1 left (carol), 1 changed status (dave)"
+	if got := formatPresence("#golang", events); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	names := []string{"a", "b", "c", "d", "e", "f", "g"}
+	if got := listPresenceNames(names); got != "a, b, c, d, e and 2 more" {
+		t.Errorf("Unexpected name list: %q", got)
+	}
+}
+
+func TestReapConnections(t *testing.T) {
+	alive, _ := createMockConn()
+	defer alive.Close()
+	dead, peer := net.Pipe()
+	peer.Close()
+	idle, _ := createMockConn()
+	defer idle.Close()
+
+	now := time.Now()
+	idleEvict = time.Minute
+	mutex.Lock()
+	hub.Add(&registry.Client{Conn: alive, Name: "alive"})
+	hub.Add(&registry.Client{Conn: dead, Name: "dead"})
+	hub.Add(&registry.Client{Conn: idle, Name: "idle"})
+	lastSeen[alive] = now
+	lastSeen[dead] = now
+	lastSeen[idle] = now.Add(-2 * time.Minute)
+	mutex.Unlock()
+	defer func() {
+		idleEvict = 0
+		mutex.Lock()
+		for _, c := range []net.Conn{alive, dead, idle} {
+			hub.Remove(c)
+			delete(lastSeen, c)
+		}
+		mutex.Unlock()
+	}()
+
+	if n := reapConnections(now); n != 2 {
+		t.Errorf("Expected 2 connections reaped, got %d", n)
+	}
+	if _, err := alive.Write([]byte("x")); err != nil {
+		t.Error("Expected live connection to stay open")
+	}
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// Example from RFC 6455
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept value: %s", got)
+	}
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	client, server := net.Pipe()
+	ws := &wsConn{Conn: server, reader: bufio.NewReader(server)}
+	defer ws.Close()
+	defer client.Close()
+
+	// Client frames are masked
+	go func() {
+		mask := []byte{1, 2, 3, 4}
+		payload := []byte("hello")
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		client.Write(append([]byte{0x81, 0x80 | byte(len(payload))}, append(mask, payload...)...))
+	}()
+	line, err := bufio.NewReader(ws).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("Expected %q, got %q (%v)", "hello\n", line, err)
+	}
+
+	// Server frames are unmasked text, with telnet commands removed
+	go ws.Write([]byte("\xff\xfb\x01hi"))
+	frame := make([]byte, 4)
+	if _, err := io.ReadFull(client, frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame[0] != 0x81 || frame[1] != 2 || string(frame[2:]) != "hi" {
+		t.Errorf("Unexpected frame: %v", frame)
+	}
+}
+
+func TestTimeoutConnDropsStalledClient(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	old := writeTimeout
+	writeTimeout = 20 * time.Millisecond
+	defer func() { writeTimeout = old }()
+
+	before := stalledDisconnects.Load()
+	conn := newTimeoutConn(client)
+	// Nobody reads from the other end, so the write stalls
+	if _, err := conn.Write([]byte("hello")); err == nil {
+		t.Fatal("Expected stalled write to fail")
+	}
+	if stalledDisconnects.Load() != before+1 || writeTimeouts.Load() == 0 {
+		t.Error("Expected the stall to be counted")
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected stalled connection to be closed")
+	}
+	if metricsSnapshot()["stalled_disconnects"] != stalledDisconnects.Load() {
+		t.Error("Expected counter in metrics snapshot")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	listen := fs.String("listen", ":8080", "")
+	limit := fs.Int("limit", 3, "")
+	color := fs.Bool("color", true, "")
+	window := fs.Duration("window", time.Minute, "")
+	var names []string
+	fs.Func("admin", "", func(s string) error { names = append(names, s); return nil })
+	fs.Parse([]string{"-limit", "5"})
+
+	values := map[string]interface{}{
+		"listen":  ":9000",
+		"limit":   json.Number("7"),
+		"color":   false,
+		"window":  "30s",
+		"admin":   []interface{}{"alice", "bob"},
+		"unknown": "ignored",
+	}
+	if err := applyConfig(fs, values); err != nil {
+		t.Fatal(err)
+	}
+	if *listen != ":9000" || *color || *window != 30*time.Second || strings.Join(names, ",") != "alice,bob" {
+		t.Errorf("Config not applied: %s %v %s %v", *listen, *color, *window, names)
+	}
+	if *limit != 5 {
+		t.Errorf("Expected command line to win over config, got %d", *limit)
+	}
+	fresh := flag.NewFlagSet("test", flag.ContinueOnError)
+	fresh.Duration("window", time.Minute, "")
+	if err := applyConfig(fresh, map[string]interface{}{"window": "soon"}); err == nil {
+		t.Error("Expected invalid value to be rejected")
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	if got := stripANSI("\033[1;31mError\033[0m: \033[34mhi\033[0m\n"); got != "Error: hi\n" {
+		t.Errorf("Unexpected result: %q", got)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(1000)
+	b.last = now
+	b.tokens = 1000
+
+	if wait := b.reserve(1000, now); wait != 0 {
+		t.Errorf("Expected burst to be free, waited %s", wait)
+	}
+	if wait := b.reserve(500, now); wait != 500*time.Millisecond {
+		t.Errorf("Expected 500ms wait, got %s", wait)
+	}
+	// The next reservation queues behind the previous one
+	if wait := b.reserve(500, now); wait != time.Second {
+		t.Errorf("Expected 1s wait, got %s", wait)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := &circuitBreaker{threshold: 2, cooldown: time.Minute}
+
+	b.record(errors.New("database is locked"), now)
+	if !b.allow(now) {
+		t.Error("Expected breaker to stay closed below the threshold")
+	}
+	b.record(errors.New("database is locked"), now)
+	if b.allow(now) {
+		t.Error("Expected breaker to open at the threshold")
+	}
+	// After the cooldown a single trial call is let through
+	later := now.Add(time.Minute)
+	if !b.allow(later) {
+		t.Error("Expected a trial call after the cooldown")
+	}
+	if b.allow(later) {
+		t.Error("Expected only one trial call")
+	}
+	b.record(nil, later)
+	if !b.allow(later) {
+		t.Error("Expected breaker to close after a success")
+	}
+}
+
+func TestPendingWritesReplay(t *testing.T) {
+	defer func() { pendingWrites = nil }()
+
+	var stored []int
+	down := true
+	for i := 1; i <= 3; i++ {
+		i := i
+		pendingWrites = append(pendingWrites, func() error {
+			if down {
+				return errCircuitOpen
+			}
+			stored = append(stored, i)
+			return nil
+		})
+	}
+
+	if replayPendingWrites() || len(stored) != 0 {
+		t.Fatalf("Expected replay to stop while the database is down, stored %v", stored)
+	}
+	down = false
+	if !replayPendingWrites() {
+		t.Fatal("Expected the queue to drain once the database is back")
+	}
+	if len(stored) != 3 || stored[0] != 1 || stored[2] != 3 {
+		t.Errorf("Expected writes replayed in order, got %v", stored)
+	}
+	if !isDBUnavailable(errors.New("database is locked")) || isDBUnavailable(errors.New("UNIQUE constraint failed")) {
+		t.Error("Expected only connectivity errors to count as unavailable")
+	}
+}
+
+func TestWriteBehindFlush(t *testing.T) {
+	// An earlier outage is still pending, so queued writes must line up behind it
+	pendingWrites = []func() error{func() error { return errCircuitOpen }}
+	defer func() { pendingWrites = nil }()
+
+	startPersistWriter()
+	write := queuedWrite{query: "INSERT", sender: "alice", key: "k1"}
+	if err := persist(write, "id-1"); err != nil {
+		t.Fatalf("Expected queued write to succeed, got %v", err)
+	}
+	flushPersistQueue()
+
+	if persistQueue != nil {
+		t.Error("Expected the queue to be closed after a flush")
+	}
+	if len(pendingWrites) != 2 {
+		t.Errorf("Expected the write to be kept behind the outage, got %d pending", len(pendingWrites))
+	}
+	// The write isn't stored yet, so a retry must still be recognised
+	if id, ok := findInflightMessage("alice", "k1"); !ok || id != "id-1" {
+		t.Error("Expected the idempotency key to be kept while the write waits")
+	}
+	forgetInflight([]queuedWrite{write})
+}
+
+func TestOutboxConnOverflow(t *testing.T) {
+	savedQueue, savedOverflow := outboundQueue, outboundOverflow
+	defer func() { outboundQueue, outboundOverflow = savedQueue, savedOverflow }()
+	outboundQueue = 2
+
+	// Nobody is reading, so the writer blocks and the queue fills up
+	outboundOverflow = "drop"
+	client, server := net.Pipe()
+	conn := newOutboxConn(server)
+	dropped := outboundDropped.Load()
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write([]byte("x\n")); err != nil {
+			t.Fatalf("Expected writes to never block or fail, got %v", err)
+		}
+	}
+	if outboundDropped.Load()-dropped < 2 {
+		t.Error("Expected writes past the queue to be dropped")
+	}
+	conn.Close()
+	data, _ := io.ReadAll(client)
+	if n := strings.Count(string(data), "x\n"); n < 2 || n > 3 {
+		t.Errorf("Expected the queued writes to be delivered on close, got %q", data)
+	}
+
+	outboundOverflow = "disconnect"
+	client, server = net.Pipe()
+	defer client.Close()
+	conn = newOutboxConn(server)
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		_, err = conn.Write([]byte("x\n"))
+	}
+	if err == nil {
+		t.Fatal("Expected a full queue to disconnect the client")
+	}
+	if _, err := conn.Write([]byte("x\n")); err == nil {
+		t.Error("Expected writes after a disconnect to fail")
+	}
+}
+
+// TestReadReplicaUnknownDriver checks -read-db refuses a driver that isn't compiled
+// in instead of opening it as a SQLite file
+func TestReadReplicaUnknownDriver(t *testing.T) {
+	defer func(spec string) { readDBSpec = spec }(readDBSpec)
+	readDBSpec = "postgres:postgres://replica/chat"
+	if err := openReadReplica(); err == nil {
+		closeReadReplica()
+		readDB = nil
+		t.Fatal("Expected an unregistered driver to be refused")
+	}
+	if readDB != nil {
+		t.Error("Expected no read replica to be opened")
+	}
+}
+
+func TestUserCacheEviction(t *testing.T) {
+	saved := userCacheSize
+	userCacheSize = 2
+	defer func() { userCacheSize = saved }()
+
+	now := time.Now()
+	c := newLRUCache()
+	c.put("alice", userRecord{exists: true, role: "admin"}, now, c.generation())
+	c.put("bob", userRecord{exists: true}, now, c.generation())
+	c.get("alice", now)
+	c.put("carol", userRecord{exists: true}, now, c.generation())
+
+	if _, ok := c.get("bob", now); ok {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	if user, ok := c.get("alice", now); !ok || user.role != "admin" {
+		t.Error("Expected a recently used entry to stay cached")
+	}
+	if _, ok := c.get("carol", now.Add(userCacheTTL+time.Second)); ok {
+		t.Error("Expected stale entries to expire")
+	}
+
+	// A load that started before a write must not be cached
+	gen := c.generation()
+	c.remove("alice")
+	c.put("alice", userRecord{exists: true, role: "user"}, now, gen)
+	if _, ok := c.get("alice", now); ok {
+		t.Error("Expected a load that raced with a write to be discarded")
+	}
+}
+
+func BenchmarkUserLookup(b *testing.B) {
+	if err := initDB(); err != nil {
+		b.Fatalf("Error initializing database: %v", err)
+	}
+	defer closeDB()
+	saveUser("benchuser", "benchpass")
+	defer db.Exec("DELETE FROM users WHERE username = ?", "benchuser")
+
+	saved := userCacheSize
+	defer func() { userCacheSize = saved }()
+	for _, size := range []int{0, 1000} {
+		name := "uncached"
+		if size > 0 {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			userCacheSize = size
+			resetUserCache()
+			for i := 0; i < b.N; i++ {
+				if !isUserDisabled("benchuser") {
+					getUserRole("benchuser")
+					userExists("benchuser")
+				}
+			}
+		})
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	sent := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	if got := timestamp(nil, sent); got != "\033[90m[12:30]\033[0m " {
+		t.Errorf("Expected UTC timestamp by default, got %q", got)
+	}
+
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("Error loading time zone: %v", err)
+	}
+	if got := timestamp(&Session{location: tokyo}, sent); got != "\033[90m[21:30]\033[0m " {
+		t.Errorf("Expected timestamp in the user's time zone, got %q", got)
+	}
+}
+
+func TestCollectSnapshots(t *testing.T) {
+	first, _ := net.Pipe()
+	second, _ := net.Pipe()
+	defer first.Close()
+	defer second.Close()
+
+	mutex.Lock()
+	hub.Add(&registry.Client{Conn: first, Name: "alice", Account: "alice"})
+	hub.Add(&registry.Client{Conn: second, Name: "alice", Account: "alice"})
+	sessions[first] = &Session{room: "#golang", joined: map[string]bool{defaultChannel: true, "#golang": true}}
+	sessions[second] = &Session{room: defaultChannel, joined: map[string]bool{defaultChannel: true, "#rust": true}}
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		hub.Remove(first)
+		hub.Remove(second)
+		delete(sessions, first)
+		delete(sessions, second)
+		mutex.Unlock()
+	}()
+
+	snap := collectSnapshots()["alice"]
+	if snap == nil {
+		t.Fatal("Expected a snapshot for a logged in account")
+	}
+	if len(snap.Rooms) != 3 {
+		t.Errorf("Expected the rooms of every session, got %v", snap.Rooms)
+	}
+	for _, room := range []string{defaultChannel, "#golang", "#rust"} {
+		if !containsString(snap.Rooms, room) {
+			t.Errorf("Expected %s in the snapshot, got %v", room, snap.Rooms)
+		}
+	}
+}
+
+func TestProtoConnJSON(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &protoConn{Conn: server}
+	defer conn.Close()
+	lines := bufio.NewReader(client)
+
+	go handleProtoCommand(conn, "/proto json")
+	line, _ := lines.ReadString('\n')
+	var ev WireEvent
+	if err := json.Unmarshal([]byte(line), &ev); err != nil || ev.Type != "system" || ev.Body != "Protocol set to json." {
+		t.Fatalf("Expected a JSON confirmation, got %q", line)
+	}
+
+	go conn.Write([]byte("\033[1;31mUnknown command.\033[0m\n"))
+	line, _ = lines.ReadString('\n')
+	if err := json.Unmarshal([]byte(line), &ev); err != nil || ev.Type != "error" || ev.Body != "Unknown command." {
+		t.Errorf("Expected errors to be typed, got %q", line)
+	}
+
+	msg := OutgoingMessage{channel: "#golang", text: "\033[34mAlice: hi\033[0m\n", from: "Alice", body: "hi", sent: time.Now()}
+	go writeEvent(conn, msg.event(), msg.text)
+	line, _ = lines.ReadString('\n')
+	if err := json.Unmarshal([]byte(line), &ev); err != nil || ev.Type != "message" || ev.From != "Alice" || ev.Room != "#golang" || ev.Body != "hi" {
+		t.Errorf("Expected a typed chat message, got %q", line)
+	}
+}
+
+// simClock is a Clock that only moves when the test advances or sets it
+type simClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	elapsed time.Duration
+	timers  []*simTimer
+	seq     int
+}
+
+// simTimer is a callback scheduled on a simClock
+type simTimer struct {
+	at      time.Time
+	every   time.Duration // 0 for a one-off timer
+	fn      func(now time.Time)
+	seq     int
+	stopped bool
+}
+
+func (c *simClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *simClock) Elapsed() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.elapsed
+}
+
+// Set changes the wall clock to t, like an administrator or NTP setting the system
+// clock: no time elapses, and timers still fire after the same delay
+func (c *simClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	jump := t.Sub(c.now)
+	c.now = t
+	for _, timer := range c.timers {
+		timer.at = timer.at.Add(jump)
+	}
+}
+
+func (c *simClock) schedule(d, every time.Duration, fn func(time.Time)) *simTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	timer := &simTimer{at: c.now.Add(d), every: every, fn: fn, seq: c.seq}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+func (c *simClock) AfterFunc(d time.Duration, fn func()) {
+	c.schedule(d, 0, func(time.Time) { fn() })
+}
+
+func (c *simClock) Every(d time.Duration, fn func(now time.Time)) func() {
+	timer := c.schedule(d, d, fn)
+	return func() {
+		c.mu.Lock()
+		timer.stopped = true
+		c.mu.Unlock()
+	}
+}
+
+// Advance moves time forward by d, running everything that falls due in order on
+// the calling goroutine
+func (c *simClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		var next *simTimer
+		for _, timer := range c.timers {
+			if timer.stopped || timer.at.After(target) {
+				continue
+			}
+			if next == nil || timer.at.Before(next.at) || (timer.at.Equal(next.at) && timer.seq < next.seq) {
+				next = timer
+			}
+		}
+		if next == nil {
+			c.elapsed += target.Sub(c.now)
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		c.elapsed += next.at.Sub(c.now)
+		c.now = next.at
+		if next.every > 0 {
+			next.at = next.at.Add(next.every)
+		} else {
+			next.stopped = true
+		}
+		now := c.now
+		c.mu.Unlock()
+		next.fn(now)
+	}
+}
+
+// newSimulation swaps in a simulated clock and seeded randomness for the rest of the test
+func newSimulation(t *testing.T, seed int64) *simClock {
+	sim := &simClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	savedClock, savedRandom := clock, randomSource
+	clock, randomSource = sim, rand.New(rand.NewSource(seed))
+	t.Cleanup(func() { clock, randomSource = savedClock, savedRandom })
+	return sim
+}
+
+func TestSimulatedRegisterRateLimit(t *testing.T) {
+	sim := newSimulation(t, 1)
+	ip := "192.0.2.1"
+	defer func() {
+		registerMutex.Lock()
+		delete(registerAttempts, ip)
+		delete(registerTimes, ip)
+		registerMutex.Unlock()
+	}()
+
+	for i := 0; i < registerLimit; i++ {
+		if isRateLimited(ip) {
+			t.Fatalf("Expected attempt %d to be allowed", i+1)
+		}
+	}
+	if !isRateLimited(ip) {
+		t.Fatal("Expected the IP to be rate limited")
+	}
+	sim.Advance(registerWindow / 2)
+	if !isRateLimited(ip) {
+		t.Error("Expected the limit to hold within the window")
+	}
+	sim.Advance(registerWindow + time.Second)
+	if isRateLimited(ip) {
+		t.Error("Expected the limit to reset after the window")
+	}
+}
+
+func TestRegisterRateLimitClockChanges(t *testing.T) {
+	sim := newSimulation(t, 1)
+	ip := "192.0.2.2"
+	defer func() {
+		registerMutex.Lock()
+		delete(registerAttempts, ip)
+		delete(registerTimes, ip)
+		registerMutex.Unlock()
+	}()
+	exhaust := func() {
+		for i := 0; i < registerLimit; i++ {
+			isRateLimited(ip)
+		}
+		if !isRateLimited(ip) {
+			t.Fatal("Expected the IP to be rate limited")
+		}
+	}
+
+	// Setting the clock forward doesn't lift the limit early
+	exhaust()
+	sim.Set(sim.Now().Add(24 * time.Hour))
+	if !isRateLimited(ip) {
+		t.Error("Expected the limit to hold after the clock jumped forward")
+	}
+
+	// Setting it back doesn't extend the limit past the window
+	sim.Advance(registerWindow + time.Second)
+	exhaust()
+	sim.Set(sim.Now().Add(-24 * time.Hour))
+	if !isRateLimited(ip) {
+		t.Error("Expected the limit to hold after the clock jumped back")
+	}
+	sim.Advance(registerWindow + time.Second)
+	if isRateLimited(ip) {
+		t.Error("Expected the limit to reset a window after the clock jumped back")
+	}
+
+	// Timers still fire after their delay, not at their old wall clock time
+	fired := false
+	clock.AfterFunc(time.Minute, func() { fired = true })
+	sim.Set(sim.Now().Add(time.Hour))
+	sim.Advance(30 * time.Second)
+	if fired {
+		t.Error("Expected a timer not to fire early when the clock jumped forward")
+	}
+	sim.Advance(30 * time.Second)
+	if !fired {
+		t.Error("Expected a timer to fire a minute after it was scheduled")
+	}
+}
+
+func TestSimulatedIdleEviction(t *testing.T) {
+	sim := newSimulation(t, 1)
+	savedInterval := reapInterval
+	reapInterval, idleEvict = 30*time.Second, 2*time.Minute
+	defer func() { reapInterval, idleEvict = savedInterval, 0 }()
+
+	conn, _ := createMockConn()
+	defer conn.Close()
+	mutex.Lock()
+	hub.Add(&registry.Client{Conn: conn, Name: "sleepy"})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		hub.Remove(conn)
+		delete(lastSeen, conn)
+		mutex.Unlock()
+	}()
+	touchConn(conn)
+	startReaper()
+
+	sim.Advance(90 * time.Second)
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal("Expected a connection active within idleEvict to be kept")
+	}
+	touchConn(conn)
+	sim.Advance(idleEvict + reapInterval)
+	if _, err := conn.Write([]byte("ping\n")); err == nil {
+		t.Error("Expected an idle connection to be closed")
+	}
+}
+
+func TestSimulatedSlowModeLifts(t *testing.T) {
+	sim := newSimulation(t, 1)
+	defer func() {
+		stormThreshold = 0
+		stormTimes = nil
+		slowMode = false
+		lastSentTime = make(map[string]time.Time)
+	}()
+	stormThreshold = 3
+
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-broadcast:
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	startStormMonitor()
+	for _, user := range []string{"a", "b", "c", "d"} {
+		allowStormMessage(user, sim.Now())
+	}
+	if !slowMode {
+		t.Fatal("Expected slow mode after exceeding the threshold")
+	}
+	sim.Advance(stormWindow)
+	if !slowMode {
+		t.Error("Expected slow mode to last through the cooldown")
+	}
+	sim.Advance(stormWindow + stormCooldown)
+	if slowMode {
+		t.Error("Expected slow mode to lift once traffic calmed down")
+	}
+}
+
+func TestSimulatedRandomness(t *testing.T) {
+	newSimulation(t, 42)
+	first, _ := newUUID()
+	newSimulation(t, 42)
+	second, _ := newUUID()
+	if first != second {
+		t.Errorf("Expected the same seed to give the same ID, got %s and %s", first, second)
+	}
+}
+
+func TestHandleDeleteAccountCommand(t *testing.T) {
+	if err := initDB(); err != nil {
+		t.Fatalf("Error initializing database: %v", err)
+	}
+	defer closeDB()
+	sim := newSimulation(t, 1)
+
+	conn, _ := createMockConn()
+	defer conn.Close()
+	if err := saveUser("doomed", "secret"); err != nil {
+		t.Fatalf("Error saving user: %v", err)
+	}
+	defer db.Exec("DELETE FROM users WHERE username = ?", "doomed")
+	mutex.Lock()
+	hub.Add(&registry.Client{Conn: conn, Name: "doomed", Account: "doomed"})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		hub.Remove(conn)
+		delete(pendingDeletions, conn)
+		mutex.Unlock()
+	}()
+
+	handlePasswdCommand(conn, "/passwd wrong newpass")
+	if !verifyUser("doomed", "secret") {
+		t.Fatal("Expected a wrong current password to leave the password unchanged")
+	}
+	handlePasswdCommand(conn, "/passwd secret newpass")
+	if !verifyUser("doomed", "newpass") {
+		t.Fatal("Expected the password to be changed")
+	}
+
+	handleDeleteAccountCommand(conn, "/deleteaccount confirm")
+	handleDeleteAccountCommand(conn, "/deleteaccount newpass")
+	sim.Advance(deleteConfirmWindow + time.Second)
+	handleDeleteAccountCommand(conn, "/deleteaccount confirm")
+	if exists, _ := userExists("doomed"); !exists {
+		t.Fatal("Expected an expired confirmation not to delete the account")
+	}
+
+	// What the account did is logged, and it set up a webhook
+	defer func(enabled bool) { eventLogEnabled = enabled }(eventLogEnabled)
+	eventLogEnabled = true
+	doomed := &UserIdentity{ID: "id-doomed", Account: "doomed", Name: "doomed"}
+	bystander := &UserIdentity{ID: "id-bystander", Account: "bystander", Name: "bystander"}
+	defer db.Exec("DELETE FROM event_log WHERE account = ?", "bystander")
+	logEvent(MessagePosted{ID: "m1", Channel: "#general", User: doomed, Body: "my last words"})
+	logEvent(ButtonClicked{User: bystander, Author: "doomed", Channel: "#general", MessageID: "m1", Button: "ok"})
+	logEvent(UserJoined{User: bystander, Channel: "#general"})
+	if _, err := db.Exec("INSERT INTO event_log (type, data, created_at) VALUES (?, ?, ?)",
+		UserJoined{}.eventName(), `{"user":{"account":"doomed"},"channel":"#general"}`, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	hook, err := addIntegration(Integration{Channel: "#general", Kind: integrationWebhook, Target: "http://example.invalid/hook", CreatedBy: "doomed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeIntegration("#general", hook.ID)
+
+	handleDeleteAccountCommand(conn, "/deleteaccount newpass")
+	handleDeleteAccountCommand(conn, "/deleteaccount confirm")
+	if exists, _ := userExists("doomed"); exists {
+		t.Error("Expected the account to be deleted after confirming")
+	}
+	var logged, kept int
+	db.QueryRow("SELECT COUNT(*) FROM event_log WHERE account = 'doomed' OR data LIKE '%doomed%'").Scan(&logged)
+	db.QueryRow("SELECT COUNT(*) FROM event_log WHERE account = 'bystander'").Scan(&kept)
+	if logged != 0 || kept != 1 {
+		t.Errorf("Expected only the account's events to be removed, got %d left and %d kept", logged, kept)
+	}
+	var hooks int
+	db.QueryRow("SELECT COUNT(*) FROM channel_integrations WHERE created_by = 'doomed'").Scan(&hooks)
+	if hooks != 0 || len(integrationsFor("#general")) != 0 {
+		t.Errorf("Expected the account's webhook to be removed, got %d stored and %+v", hooks, integrationsFor("#general"))
+	}
+}
+
+func TestFriendList(t *testing.T) {
+	if err := initDB(); err != nil {
+		t.Fatalf("Error initializing database: %v", err)
+	}
+	defer closeDB()
+	defer db.Exec("DELETE FROM friends WHERE username = ?", "alice")
+
+	if err := addFriend("alice", "bob"); err != nil {
+		t.Fatalf("Error adding friend: %v", err)
+	}
+	if err := addFriend("alice", "bob"); err != nil {
+		t.Fatalf("Expected adding a friend twice to succeed, got %v", err)
+	}
+	if friends, _ := getFriends("alice"); len(friends) != 1 || friends[0] != "bob" {
+		t.Errorf("Expected [bob], got %v", friends)
+	}
+	if watchers, _ := getFriendOf("bob"); len(watchers) != 1 || watchers[0] != "alice" {
+		t.Errorf("Expected bob to be watched by alice, got %v", watchers)
+	}
+	if removed, _ := removeFriend("alice", "bob"); !removed {
+		t.Error("Expected bob to be removed")
+	}
+	if removed, _ := removeFriend("alice", "bob"); removed {
+		t.Error("Expected removing a missing friend to report false")
+	}
+}
+
+// recordingConn is a connection that only counts its writes and keeps the last one
+type recordingConn struct {
+	net.Conn
+	writes int
+	last   string
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.writes++
+	c.last = string(p)
+	return len(p), nil
+}
+
+// checkHubInvariants reports the first broken invariant of the client and room maps
+func checkHubInvariants() error {
+	for _, name := range hub.Names() {
+		if conn, _ := hub.ByName(name); hub.Name(conn) != name {
+			return fmt.Errorf("name %q does not map to a connection using it", name)
+		}
+	}
+	for _, c := range hub.Clients() {
+		conn, name := c.Conn, c.Name
+		if _, ok := hub.ByName(name); !ok {
+			return fmt.Errorf("client %q is missing from the names in use", name)
+		}
+		if owner, _ := hub.Owner(name); owner != c.Account || sessions[conn] == nil {
+			return fmt.Errorf("client %q has no display name or session", name)
+		}
+		session := sessions[conn]
+		if session.room != "" && !session.joined[session.room] {
+			return fmt.Errorf("client %q talks in %s without being a member", name, session.room)
+		}
+		for room := range session.joined {
+			if !rooms[room][conn] {
+				return fmt.Errorf("client %q joined %s but is not a member", name, room)
+			}
+		}
+	}
+	for _, m := range []int{len(sessions), len(lastSeen)} {
+		if m != hub.Len() {
+			return fmt.Errorf("per-connection maps hold %d entries for %d clients", m, hub.Len())
+		}
+	}
+	for room, members := range rooms {
+		if len(members) == 0 && room != defaultChannel {
+			return fmt.Errorf("empty room %s was not deleted", room)
+		}
+		for conn := range members {
+			if _, ok := hub.Lookup(conn); !ok {
+				return fmt.Errorf("room %s has a member that is not connected", room)
+			}
+			if !sessions[conn].joined[room] {
+				return fmt.Errorf("room %s has a member whose session doesn't list it", room)
+			}
+		}
+	}
+	return nil
+}
+
+// checkClaimsReleased reports a display name that is still claimed though no session
+// uses it
+func checkClaimsReleased(names []string) error {
+	for _, name := range names {
+		if _, claimed := hub.Owner(name); claimed {
+			if _, ok := hub.ByName(name); !ok {
+				return fmt.Errorf("claim on %q outlived its sessions", name)
+			}
+		}
+	}
+	return nil
+}
+
+// TestHubStateMachine applies random sequences of logins, joins, leaves, renames,
+// messages and disconnects and checks the client and room maps stay consistent. A
+// failure names the seed and step so the sequence can be replayed.
+func TestHubStateMachine(t *testing.T) {
+	names := []string{"ann", "bob", "cat", "dan"}
+	nicks := []string{"ann", "bob", "zed", "yan"}
+	roomNames := []string{defaultChannel, "#go", "#rust"}
+
+	for seed := int64(1); seed <= 200; seed++ {
+		runHubSequence(t, seed, names, nicks, roomNames)
+	}
+}
+
+// runHubSequence runs one random sequence of hub operations. Renames pick from nicks,
+// which overlap the account names so some collide with another account's claim.
+func runHubSequence(t *testing.T, seed int64, names, nicks, roomNames []string) {
+	rng := rand.New(rand.NewSource(seed))
+	var online []*recordingConn
+	var offline []*recordingConn
+
+	mutex.Lock()
+	defer func() {
+		for _, conn := range online {
+			removeClientLocked(conn)
+		}
+		mutex.Unlock()
+	}()
+	for step := 0; step < 60; step++ {
+		var op string
+		switch n := rng.Intn(11); {
+		case n < 3 || len(online) == 0:
+			op = "login"
+			name := names[rng.Intn(len(names))]
+			conn := &recordingConn{}
+			// Logging in as an account that is online opens another session
+			if claimDisplayNameLocked(name, name) {
+				addClientLocked(conn, name, name, "id-"+name, &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+				online = append(online, conn)
+			} else if _, ok := hub.ByName(name); !ok {
+				t.Fatalf("seed %d step %d: %q refused but nobody holds it", seed, step, name)
+			}
+		case n < 5:
+			op = "join"
+			joinRoomLocked(online[rng.Intn(len(online))], roomNames[rng.Intn(len(roomNames))])
+		case n < 7:
+			op = "leave"
+			conn := online[rng.Intn(len(online))]
+			if room := roomNames[rng.Intn(len(roomNames))]; sessions[conn].joined[room] {
+				leaveRoomLocked(conn, room)
+			}
+		case n < 9:
+			op = "message"
+			room := roomNames[rng.Intn(len(roomNames))]
+			for _, c := range append(online, offline...) {
+				c.writes = 0
+			}
+			deliverChannelMessageLocked(OutgoingMessage{channel: room, text: "hi\n", sent: time.Now()})
+			for _, c := range offline {
+				if c.writes > 0 {
+					t.Fatalf("seed %d step %d: message delivered to a disconnected client", seed, step)
+				}
+			}
+			for _, c := range online {
+				if c.writes > 0 && !sessions[c].joined[room] {
+					t.Fatalf("seed %d step %d: message to %s delivered outside the room", seed, step, room)
+				}
+				if c.writes == 0 && sessions[c].joined[room] {
+					t.Fatalf("seed %d step %d: member of %s missed a message", seed, step, room)
+				}
+			}
+		case n < 10:
+			op = "rename"
+			conn := online[rng.Intn(len(online))]
+			old, account, name := hub.Name(conn), hub.Account(conn), nicks[rng.Intn(len(nicks))]
+			if name == old {
+				break
+			}
+			owner, claimed := hub.Owner(name)
+			sharing := hub.ConnsForName(old)
+			if _, renamed := renameLocked(old, name, time.Now()); renamed != (!claimed || owner == account) {
+				t.Fatalf("seed %d step %d: renaming %q to %q held by %q returned %v", seed, step, old, name, owner, renamed)
+			} else if !renamed {
+				if hub.Name(conn) != old {
+					t.Fatalf("seed %d step %d: refused rename still changed %q", seed, step, old)
+				}
+				break
+			}
+			if _, ok := hub.Owner(old); ok {
+				t.Fatalf("seed %d step %d: %q is still claimed after renaming to %q", seed, step, old, name)
+			}
+			for _, c := range sharing {
+				if hub.Name(c) != name {
+					t.Fatalf("seed %d step %d: a session of %q was left behind by the rename", seed, step, old)
+				}
+			}
+		default:
+			op = "disconnect"
+			i := rng.Intn(len(online))
+			conn := online[i]
+			removeClientLocked(conn)
+			online = append(online[:i], online[i+1:]...)
+			offline = append(offline, conn)
+		}
+		if err := checkHubInvariants(); err != nil {
+			t.Fatalf("seed %d step %d (%s): %v", seed, step, op, err)
+		}
+		if err := checkClaimsReleased(append(names, nicks...)); err != nil {
+			t.Fatalf("seed %d step %d (%s): %v", seed, step, op, err)
+		}
+	}
+}
+
+func TestTypingThrottle(t *testing.T) {
+	sim := newSimulation(t, 1)
+	conn := &recordingConn{}
+	defer func() {
+		mutex.Lock()
+		delete(typingSent, conn)
+		mutex.Unlock()
+	}()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !allowTypingLocked(conn, "#general", sim.Now()) {
+		t.Fatal("Expected the first typing signal to be sent")
+	}
+	if allowTypingLocked(conn, "#general", sim.Now().Add(time.Second)) {
+		t.Error("Expected a quick second signal to be dropped")
+	}
+	if !allowTypingLocked(conn, "bob", sim.Now().Add(time.Second)) {
+		t.Error("Expected a signal to another target to be sent")
+	}
+	if !allowTypingLocked(conn, "#general", sim.Now().Add(typingInterval)) {
+		t.Error("Expected a signal after the interval to be sent")
+	}
+}
+
+func TestAcquireSessionLimit(t *testing.T) {
+	maxSessions = 2
+	defer func() { maxSessions = 0 }()
+	start := activeSessions.Load()
+	defer activeSessions.Store(start)
+	activeSessions.Store(0)
+
+	if !acquireSession() || !acquireSession() {
+		t.Fatal("Expected sessions up to the limit to be accepted")
+	}
+	if acquireSession() {
+		t.Error("Expected a session above the limit to be rejected")
+	}
+	releaseSession()
+	if !acquireSession() {
+		t.Error("Expected a released session to make room")
+	}
+}
+
+// waitingConn is a raw connection that records what it is sent from any goroutine
+type waitingConn struct {
+	net.Conn
+	mu   sync.Mutex
+	text string
+}
+
+func (c *waitingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.text += string(p)
+	return len(p), nil
+}
+
+func (c *waitingConn) received() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.text
+}
+
+func (c *waitingConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *waitingConn) Close() error { return nil }
+
+func TestSessionQueue(t *testing.T) {
+	maxSessions, maxSessionQueue = 1, 1
+	defer func() { maxSessions, maxSessionQueue = 0, 0 }()
+	start := activeSessions.Load()
+	defer activeSessions.Store(start)
+	activeSessions.Store(0)
+
+	if !acquireSession() {
+		t.Fatal("Expected the first session to be accepted")
+	}
+	first, second := &waitingConn{}, &waitingConn{}
+	admitted := make(chan bool)
+	go func() { admitted <- sessionQueue.wait(first) }()
+	for deadline := time.Now().Add(time.Second); sessionQueue.Len() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the connection to join the queue")
+		}
+	}
+
+	if sessionQueue.wait(second) {
+		t.Error("Expected a connection to be turned away once the queue is full")
+	}
+	if !strings.Contains(second.received(), "Server full") {
+		t.Errorf("Expected the server full message, got %q", second.received())
+	}
+
+	releaseSession()
+	if !<-admitted {
+		t.Fatal("Expected the waiting connection to get the freed place")
+	}
+	if !strings.Contains(first.received(), "#1 in the queue") {
+		t.Errorf("Expected the waiting connection to be told its place, got %q", first.received())
+	}
+	if n := activeSessions.Load(); n != 1 {
+		t.Errorf("Expected the place to be handed over, got %d active", n)
+	}
+	releaseSession()
+	if n := activeSessions.Load(); n != 0 {
+		t.Errorf("Expected no active sessions, got %d", n)
+	}
+}
+
+func TestFloodPenalties(t *testing.T) {
+	sim := newSimulation(t, 1)
+	floodMessages = 2
+	defer func() { floodMessages = 0 }()
+	mutex.Lock()
+	defer mutex.Unlock()
+	defer delete(floodStates, "flooder")
+	check := func(want floodPenalty, step string) {
+		t.Helper()
+		if got, _ := checkFloodLocked("flooder", sim.Now()); got != want {
+			t.Fatalf("%s: expected penalty %d, got %d", step, want, got)
+		}
+	}
+
+	check(floodAllowed, "first message")
+	check(floodAllowed, "second message")
+	check(floodWarned, "third message")
+	sim.Advance(floodWindow / 2)
+	check(floodAllowed, "after refilling one message")
+	check(floodMutedNow, "second offence")
+	sim.Advance(floodMute / 2)
+	check(floodMuted, "during the mute")
+	sim.Advance(floodMute)
+	check(floodAllowed, "after the mute")
+	check(floodAllowed, "burst after the mute")
+	check(floodKicked, "offence after a mute")
+}
+
+func TestFloodStateOutlivesSessions(t *testing.T) {
+	sim := newSimulation(t, 1)
+	floodMessages = 1
+	defer func() { floodMessages = 0 }()
+	laptop, phone := &recordingConn{}, &recordingConn{}
+	session := func() *Session {
+		return &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	defer delete(floodStates, "flooder")
+	addClientLocked(laptop, "Flooder", "flooder", "id-flooder", session())
+	addClientLocked(phone, "Flooder", "flooder", "id-flooder", session())
+	if got, _ := checkFloodLocked(hub.Account(laptop), sim.Now()); got != floodAllowed {
+		t.Fatalf("Expected the first message to be allowed, got %d", got)
+	}
+	if got, _ := checkFloodLocked(hub.Account(phone), sim.Now()); got != floodWarned {
+		t.Fatalf("Expected the account's sessions to share one allowance, got %d", got)
+	}
+
+	// Reconnecting keeps the offence record
+	removeClientLocked(laptop)
+	removeClientLocked(phone)
+	addClientLocked(laptop, "Flooder", "flooder", "id-flooder", session())
+	if got, _ := checkFloodLocked("flooder", sim.Now()); got != floodMutedNow {
+		t.Errorf("Expected a reconnect not to wipe the warning, got %d", got)
+	}
+	removeClientLocked(laptop)
+	if floodStates["flooder"] == nil {
+		t.Fatal("Expected the mute to outlive the session")
+	}
+
+	// Once nothing is remembered any more the state is dropped
+	sim.Advance(floodStrikeMemory + time.Second)
+	pruneFloodStatesLocked(sim.Now())
+	if floodStates["flooder"] != nil {
+		t.Error("Expected the state to be dropped once the offences expired")
+	}
+}
+
+func TestLoginQueueOrder(t *testing.T) {
+	saved := maxConcurrentAuth
+	maxConcurrentAuth = 1
+	defer func() { maxConcurrentAuth = saved }()
+	q := &authQueue{}
+
+	q.enter(&recordingConn{})
+	order := make(chan int, 2)
+	var wg sync.WaitGroup
+	for i := 1; i <= 2; i++ {
+		conn, _ := createMockConn()
+		defer conn.Close()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q.enter(conn)
+			order <- i
+			q.leave()
+		}(i)
+		// Wait until this client is in line before queueing the next
+		for {
+			q.mu.Lock()
+			n := len(q.waiting)
+			q.mu.Unlock()
+			if n == i {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	q.leave()
+	wg.Wait()
+	if first, second := <-order, <-order; first != 1 || second != 2 {
+		t.Errorf("Expected clients to be served in arrival order, got %d then %d", first, second)
+	}
+	if q.active != 0 || len(q.waiting) != 0 {
+		t.Errorf("Expected an empty queue, got %d active and %d waiting", q.active, len(q.waiting))
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := t.TempDir() + "/chat.log"
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Error opening log file: %v", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Error writing log: %v", err)
+		}
+	}
+	for suffix, want := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		got, err := os.ReadFile(path + suffix)
+		if err != nil || string(got) != want {
+			t.Errorf("Expected %s%s to hold %q, got %q (%v)", path, suffix, want, got, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("Expected only -log-max-files rotated files to be kept")
+	}
+}
+
+func TestReadPositions(t *testing.T) {
+	conn := &recordingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "resumer", "resumer", "id-resumer", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	joinRoomLocked(conn, "#golang")
+	deliverChannelMessageLocked(OutgoingMessage{channel: defaultChannel, text: "hello\n", sent: time.Now(), seq: 3})
+	deliverChannelMessageLocked(OutgoingMessage{channel: "#golang", text: "hi\n", sent: time.Now(), seq: 7})
+	deliverChannelMessageLocked(OutgoingMessage{channel: "#golang", text: "notice\n", sent: time.Now()})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	positions, room := readPositions(conn)
+	if positions["#golang"] != 7 || positions[defaultChannel] != 3 {
+		t.Errorf("Expected #golang read up to 7 and %s up to 3, got %v", defaultChannel, positions)
+	}
+	if room != "#golang" {
+		t.Errorf("Expected the current room to be #golang, got %q", room)
+	}
+}
+
+func TestDeliverRoutedMessage(t *testing.T) {
+	conn := &recordingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Carol", "carol", "id-carol", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	deliverRoutedMessage(RoutedMessage{sender: "Dave", recipient: "carol", body: "hi", sent: time.Now()})
+	mutex.Lock()
+	defer mutex.Unlock()
+	if conn.writes != 1 {
+		t.Errorf("Expected the routed message to be written once, got %d writes", conn.writes)
+	}
+	if sender, _ := hub.LastSender("Carol"); sender != "Dave" {
+		t.Errorf("Expected /reply to go to Dave, got %q", sender)
+	}
+}
+
+// recordingBus is a MessageBus that keeps what is published instead of delivering it
+type recordingBus struct {
+	broadcasts []string
+	published  []OutgoingMessage
+	private    []PrivateMessage
+	events     []Event
+}
+
+func (b *recordingBus) Broadcast(text string)          { b.broadcasts = append(b.broadcasts, text) }
+func (b *recordingBus) Publish(msg OutgoingMessage)    { b.published = append(b.published, msg) }
+func (b *recordingBus) SendPrivate(msg PrivateMessage) { b.private = append(b.private, msg) }
+func (b *recordingBus) Emit(ev Event)                  { b.events = append(b.events, ev) }
+
+// useBus swaps in b as the message bus for the rest of the test
+func useBus(t *testing.T, b MessageBus) {
+	setBus(b)
+	t.Cleanup(func() { setBus(localBus{}) })
+}
+
+func TestMessageBus(t *testing.T) {
+	recorder := &recordingBus{}
+	useBus(t, recorder)
+
+	roomNotice("#golang", "Alice joined #golang")
+	if len(recorder.published) != 1 || recorder.published[0].channel != "#golang" {
+		t.Errorf("Expected the notice to be published to #golang, got %+v", recorder.published)
+	}
+	handlePrivateMessage(&recordingConn{}, "/private bob hi there")
+	if len(recorder.private) != 1 || recorder.private[0].recipient != "bob" || recorder.private[0].message != "hi there" {
+		t.Errorf("Expected the private message to be sent through the bus, got %+v", recorder.private)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := t.TempDir() + "/config.json"
+	if err := os.WriteFile(path, []byte(`{"flood-messages": 5, "max-message-length": 200, "listen": ":9000"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	savedFlags, savedPath, savedFlood, savedLength := serveFlags, configPath, floodMessages, maxMessageLength
+	defer func() {
+		serveFlags, configPath, floodMessages, maxMessageLength = savedFlags, savedPath, savedFlood, savedLength
+		delete(commandLineFlags, "max-message-length")
+	}()
+
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.IntVar(&floodMessages, "flood-messages", 0, "")
+	fs.IntVar(&maxMessageLength, "max-message-length", 100, "")
+	fs.StringVar(&listenAddr, "listen", listenAddr, "")
+	fs.StringVar(&logLevel, "log-level", logLevel, "")
+	serveFlags, configPath = fs, path
+	commandLineFlags["max-message-length"] = true
+
+	changed, err := reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(changed, ",") != "flood-messages" || floodMessages != 5 {
+		t.Errorf("Expected flood-messages to be reloaded, got %v (%d)", changed, floodMessages)
+	}
+	if maxMessageLength != 100 {
+		t.Errorf("Expected the command line to win over a reload, got %d", maxMessageLength)
+	}
+	if listenAddr == ":9000" {
+		t.Error("Expected settings that need a restart to be left alone")
+	}
+}
+
+func TestLogRing(t *testing.T) {
+	ring := &logRing{size: 3}
+	for _, record := range []string{"a", "b", "c", "d"} {
+		ring.Write([]byte(record + "\n"))
+	}
+	if got := strings.Join(ring.last(10), ","); got != "b,c,d" {
+		t.Errorf("Expected the last three records oldest first, got %s", got)
+	}
+	if got := strings.Join(ring.last(2), ","); got != "c,d" {
+		t.Errorf("Expected the last two records, got %s", got)
+	}
+}
+
+func TestExpandShortcodes(t *testing.T) {
+	if got := expandShortcodes("nice :tada: :+1: at 12:30:45 :nope:"); got != "nice 🎉 👍 at 12:30:45 :nope:" {
+		t.Errorf("Unexpected expansion: %q", got)
+	}
+
+	expanded, raw := &recordingConn{}, &recordingConn{}
+	mutex.Lock()
+	defer mutex.Unlock()
+	addClientLocked(expanded, "Erin", "erin", "id-erin", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	addClientLocked(raw, "Frank", "frank", "id-frank", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool), rawEmoji: true})
+	defer removeClientLocked(expanded)
+	defer removeClientLocked(raw)
+
+	deliverChannelMessageLocked(OutgoingMessage{channel: defaultChannel, text: "Erin: hi :wave:\n", sent: time.Now()})
+	if !strings.Contains(expanded.last, "hi 👋") {
+		t.Errorf("Expected the shortcode to be expanded, got %q", expanded.last)
+	}
+	if !strings.Contains(raw.last, "hi :wave:") {
+		t.Errorf("Expected the raw shortcode for a user who asked for it, got %q", raw.last)
+	}
+}
+
+func TestEventConsumers(t *testing.T) {
+	recorder := &recordingBus{}
+	useBus(t, recorder)
+	savedWindow := presenceWindow
+	presenceWindow = 0
+	defer func() { presenceWindow = savedWindow }()
+
+	alice := &UserIdentity{ID: "id-alice", Account: "alice", Name: "Alice"}
+	dispatchEvent(MessagePosted{ID: "m1", Seq: 4, Channel: "#golang", User: alice, Body: "hi", Tag: "q", Time: time.Now()})
+	if len(recorder.published) != 1 {
+		t.Fatalf("Expected the message to be rendered once, got %+v", recorder.published)
+	}
+	if msg := recorder.published[0]; msg.text != "\033[34mAlice: [q] hi\033[0m\n" || msg.seq != 4 || msg.from != "Alice" {
+		t.Errorf("Unexpected rendering: %+v", msg)
+	}
+
+	dispatchEvent(UserJoined{User: alice, Channel: "#golang"})
+	if len(recorder.published) != 2 || !strings.Contains(recorder.published[1].text, "Alice has joined") {
+		t.Errorf("Expected a presence notice in #golang, got %+v", recorder.published)
+	}
+}
+
+func TestFileTransfer(t *testing.T) {
+	sim := newSimulation(t, 1)
+	sender, recipient := &recordingConn{}, &recordingConn{}
+	mutex.Lock()
+	addClientLocked(sender, "Gina", "gina", "id-gina", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	addClientLocked(recipient, "Hank", "hank", "id-hank", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(sender)
+		removeClientLocked(recipient)
+		mutex.Unlock()
+	}()
+	offer := func() string {
+		handleSendFileCommand(sender, "/sendfile Hank notes.txt 5")
+		mutex.Lock()
+		defer mutex.Unlock()
+		for id := range transfers {
+			return id
+		}
+		t.Fatalf("Expected an open transfer, sender got %q", sender.last)
+		return ""
+	}
+
+	id := offer()
+	handleTransferCommand(sender, "/transfer chunk "+id+" aGVsbG8=")
+	if !strings.Contains(sender.last, "hasn't been accepted") {
+		t.Errorf("Expected chunks to wait for acceptance, got %q", sender.last)
+	}
+	handleTransferCommand(recipient, "/transfer accept "+id)
+	if !strings.HasPrefix(recipient.last, "FILESTART "+id+" notes.txt 5\n") {
+		t.Errorf("Expected the recipient to be told the transfer started, got %q", recipient.last)
+	}
+	handleTransferCommand(sender, "/transfer chunk "+id+" aGVsbG8=")
+	if recipient.last != "FILECHUNK "+id+" aGVsbG8=\n" {
+		t.Errorf("Expected the chunk to be relayed, got %q", recipient.last)
+	}
+	handleTransferCommand(sender, "/transfer end "+id)
+	if !strings.HasPrefix(recipient.last, "FILEEND "+id+" 5 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\n") {
+		t.Errorf("Expected the file to end with its size and SHA-256, got %q", recipient.last)
+	}
+
+	// More data than announced cancels the transfer
+	id = offer()
+	handleTransferCommand(recipient, "/transfer accept "+id)
+	handleTransferCommand(sender, "/transfer chunk "+id+" aGVsbG8gd29ybGQ=")
+	if !strings.HasPrefix(recipient.last, "FILEABORT "+id) {
+		t.Errorf("Expected an oversized file to be aborted, got %q", recipient.last)
+	}
+
+	// Offers lapse if nobody answers
+	id = offer()
+	sim.Advance(fileOfferTTL)
+	mutex.Lock()
+	_, open := transfers[id]
+	mutex.Unlock()
+	if open {
+		t.Error("Expected an unanswered offer to expire")
+	}
+}
+
+func TestDecodeEvent(t *testing.T) {
+	sent := MessagePosted{ID: "m1", Seq: 7, Channel: "general", User: &UserIdentity{Name: "Alice"}, Body: "hi :wave:", Time: time.Unix(100, 0).UTC()}
+	data, err := json.Marshal(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, err := decodeEvent(LoggedEvent{ID: 1, Type: sent.eventName(), Event: data})
+	if err != nil {
+		t.Fatalf("decodeEvent: %v", err)
+	}
+	got, ok := ev.(MessagePosted)
+	if !ok || got.Seq != 7 || got.User.Name != "Alice" || got.Body != sent.Body || !got.Time.Equal(sent.Time) {
+		t.Errorf("decoded %#v, want %#v", ev, sent)
+	}
+
+	if _, err := decodeEvent(LoggedEvent{ID: 2, Type: "renamed", Event: data}); err == nil {
+		t.Error("expected an error for an unknown event type")
+	}
+}
+
+func TestMultipleSessions(t *testing.T) {
+	phoneConn, _ := net.Pipe()
+	laptopConn, _ := net.Pipe()
+	phone, laptop := &recordingConn{Conn: phoneConn}, &recordingConn{Conn: laptopConn}
+	defer phone.Close()
+	registerConn(phone)
+	registerConn(laptop)
+	defer forgetConn(phone)
+	defer forgetConn(laptop)
+
+	mutex.Lock()
+	for _, conn := range []net.Conn{phone, laptop} {
+		if !claimDisplayNameLocked("Ivy", "ivy") {
+			t.Fatal("an account's second session couldn't use its display name")
+		}
+		addClientLocked(conn, "Ivy", "ivy", "id-ivy", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	}
+	if claimDisplayNameLocked("Ivy", "mallory") {
+		t.Error("another account could claim a display name in use")
+	}
+	mutex.Unlock()
+
+	handleSessionsCommand(phone, "/sessions")
+	if !strings.Contains(phone.last, "Your sessions (2)") || !strings.Contains(phone.last, "(this session)") {
+		t.Errorf("unexpected /sessions output: %q", phone.last)
+	}
+	handleSessionsCommand(phone, "/sessions kill others")
+	if !strings.Contains(phone.last, "Ended 1 session") || !strings.Contains(laptop.last, "ended from another device") {
+		t.Errorf("killing the other session: phone got %q, laptop got %q", phone.last, laptop.last)
+	}
+
+	// The killed connection's cleanup leaves the name with the remaining session
+	mutex.Lock()
+	removeClientLocked(laptop)
+	conn, _ := hub.ByName("Ivy")
+	owner, _ := hub.Owner("Ivy")
+	if conn != phone || owner != "ivy" {
+		t.Error("display name not kept for the remaining session")
+	}
+	if err := checkHubInvariants(); err != nil {
+		t.Error(err)
+	}
+	removeClientLocked(phone)
+	if _, ok := hub.Owner("Ivy"); ok {
+		t.Error("display name not released after the last session")
+	}
+	mutex.Unlock()
+}
+
+func TestWebhookIntegration(t *testing.T) {
+	received := make(chan FeedMessage, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg FeedMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+		received <- msg
+	}))
+	defer server.Close()
+
+	for target, want := range map[string]bool{server.URL: true, "ftp://example.com": false, "/relative": false} {
+		if validWebhookURL(target) != want {
+			t.Errorf("validWebhookURL(%q) = %v, want %v", target, !want, want)
+		}
+	}
+
+	integrationsMutex.Lock()
+	channelIntegrations["#hooks"] = []Integration{{ID: 1, Channel: "#hooks", Kind: integrationWebhook, Target: server.URL}}
+	integrationsMutex.Unlock()
+	defer func() {
+		integrationsMutex.Lock()
+		delete(channelIntegrations, "#hooks")
+		integrationsMutex.Unlock()
+	}()
+
+	integrationsConsumer(MessagePosted{ID: "m1", Channel: "#other", User: &UserIdentity{Name: "Ann"}, Body: "elsewhere"})
+	integrationsConsumer(MessagePosted{ID: "m2", Channel: "#hooks", User: &UserIdentity{Name: "Ann"}, Body: "ship it"})
+	if len(webhookQueue) != 1 {
+		t.Fatalf("%d deliveries queued, want 1", len(webhookQueue))
+	}
+	if err := postWebhook(server.Client(), <-webhookQueue); err != nil {
+		t.Fatalf("postWebhook: %v", err)
+	}
+	if msg := <-received; msg.ID != "m2" || msg.From != "Ann" || msg.Body != "ship it" {
+		t.Errorf("webhook got %+v", msg)
+	}
+}
+
+func TestInteractiveMessage(t *testing.T) {
+	if err := validateButtons([]Button{{ID: "ok", Label: "OK"}, {ID: "ok", Label: "Again"}}); err == nil {
+		t.Error("duplicate button IDs accepted")
+	}
+	if err := validateButtons([]Button{{ID: "has space", Label: "No"}}); err == nil {
+		t.Error("button ID with a space accepted")
+	}
+	buttons := []Button{{ID: "approve", Label: "Approve"}, {ID: "reject", Label: "Reject"}}
+	if err := validateButtons(buttons); err != nil {
+		t.Fatalf("validateButtons: %v", err)
+	}
+
+	author, clicker, outsider := &recordingConn{}, &recordingConn{}, &recordingConn{}
+	mutex.Lock()
+	addClientLocked(author, "Kim", "kim", "id-kim", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	addClientLocked(clicker, "Lee", "lee", "id-lee", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	addClientLocked(outsider, "Max", "max", "id-max", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	leaveRoomLocked(outsider, defaultChannel)
+	registerInteractiveLocked("msg-1", "kim", defaultChannel, buttons)
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(author)
+		removeClientLocked(clicker)
+		removeClientLocked(outsider)
+		delete(interactiveMessages, "msg-1")
+		mutex.Unlock()
+	}()
+
+	handleClickCommand(clicker, "/click msg-1 maybe")
+	if !strings.Contains(clicker.last, "no button maybe") {
+		t.Errorf("unknown button: got %q", clicker.last)
+	}
+	handleClickCommand(outsider, "/click msg-1 approve")
+	if !strings.Contains(outsider.last, "no buttons you can click") {
+		t.Errorf("click from outside the channel: got %q", outsider.last)
+	}
+	handleClickCommand(clicker, "/click msg-1 approve")
+	if !strings.Contains(author.last, "Lee clicked Approve on your message msg-1") {
+		t.Errorf("author got %q", author.last)
+	}
+}
+
+func TestForwardBody(t *testing.T) {
+	got := forwardBody("m-42", forwardedMessage{sender: "alice", channel: "#general", body: "release is out"})
+	want := "[forwarded from @alice in #general, m-42] release is out"
+	if got != want {
+		t.Errorf("forwardBody = %q, want %q", got, want)
+	}
+}
+
+func TestCrosspostDelivery(t *testing.T) {
+	if _, err := parseChannelList("#ops,nope"); err == nil {
+		t.Error("parseChannelList accepted a name without #")
+	}
+	channels, err := parseChannelList("#ops,#dev,#ops")
+	if err != nil || len(channels) != 2 {
+		t.Fatalf("parseChannelList = %v, %v", channels, err)
+	}
+
+	both, opsOnly, neither := &recordingConn{}, &recordingConn{}, &recordingConn{}
+	mutex.Lock()
+	for conn, name := range map[*recordingConn]string{both: "Nia", opsOnly: "Oli", neither: "Pat"} {
+		addClientLocked(conn, name, strings.ToLower(name), "id-"+name, &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	}
+	joinRoomLocked(both, "#ops")
+	joinRoomLocked(both, "#dev")
+	joinRoomLocked(opsOnly, "#ops")
+	leaveRoomLocked(neither, defaultChannel)
+	joinRoomLocked(neither, "#random")
+	both.writes, opsOnly.writes, neither.writes = 0, 0, 0
+
+	deliverChannelMessageLocked(OutgoingMessage{channel: "#ops", alsoTo: []string{"#dev"}, text: "[Announcement to #ops, #dev] Admin: deploy at 5\n", sent: time.Now()})
+	if both.writes != 1 || opsOnly.writes != 1 || neither.writes != 0 {
+		t.Errorf("deliveries: both %d, ops only %d, neither %d; want 1, 1, 0", both.writes, opsOnly.writes, neither.writes)
+	}
+	for _, conn := range []*recordingConn{both, opsOnly, neither} {
+		removeClientLocked(conn)
+	}
+	mutex.Unlock()
+}
+
+func TestLoadMOTD(t *testing.T) {
+	path := t.TempDir() + "/motd.txt"
+	if err := os.WriteFile(path, []byte("\nWelcome!\nBe nice.\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { motdText = "" }()
+	if err := loadMOTD(path); err != nil {
+		t.Fatalf("loadMOTD: %v", err)
+	}
+	if motdText != "Welcome!\nBe nice." {
+		t.Errorf("motdText = %q", motdText)
+	}
+	if err := loadMOTD(path + ".missing"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestChannelDirectory(t *testing.T) {
+	categoriesMutex.Lock()
+	categories["Social"], categories["Support"] = 2, 1
+	channelPlacements["#help"] = channelPlacement{category: "Support", position: 1}
+	channelPlacements["#bugs"] = channelPlacement{category: "Support", position: 0}
+	categoriesMutex.Unlock()
+	defer func() {
+		categoriesMutex.Lock()
+		categories = make(map[string]int)
+		channelPlacements = make(map[string]channelPlacement)
+		categoriesMutex.Unlock()
+	}()
+
+	conn := &recordingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Quinn", "quinn", "id-quinn", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	joinRoomLocked(conn, "#help")
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	var got []string
+	for _, g := range channelDirectory() {
+		got = append(got, g.Name+":")
+		for _, c := range g.Channels {
+			got = append(got, fmt.Sprintf("%s(%d)", c.Name, c.Members))
+		}
+	}
+	want := "Support: #bugs(0) #help(1) Social: : #general(1)"
+	if strings.Join(got, " ") != want {
+		t.Errorf("directory = %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+// TestRecoveryCodeFormat checks that recovery codes are readable and that typed
+// codes are compared without regard to case or dashes
+func TestRecoveryCodeFormat(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			t.Fatalf("newRecoveryCode: %v", err)
+		}
+		groups := strings.Split(code, "-")
+		if len(groups) != 3 || len(code) != 17 || strings.Trim(strings.Join(groups, ""), recoveryCodeAlphabet) != "" {
+			t.Errorf("code %q has the wrong format", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q was generated twice", code)
+		}
+		seen[code] = true
+	}
+
+	if got := normalizeRecoveryCode("K7DQ2-m9xta 4EHVP"); got != "k7dq2m9xta4ehvp" {
+		t.Errorf("normalizeRecoveryCode = %q", got)
+	}
+}
+
+func TestEmojiOnlyText(t *testing.T) {
+	tests := map[string]bool{
+		"👍":                true,
+		"🎉 🎉  🚀":           true,
+		":tada: :fire:":    true,
+		"❤️":               true,
+		"👋🏽":               true,
+		"👨‍👩‍👧":            true,
+		"":                 false,
+		"   ":              false,
+		"nice 👍":           false,
+		":not_a_code:":     false,
+		"👍!":               false,
+		"\033[31m🔥\033[0m": false,
+	}
+	for text, want := range tests {
+		if got := isEmojiOnlyText(text); got != want {
+			t.Errorf("isEmojiOnlyText(%q) = %v, want %v", text, got, want)
+		}
+	}
+
+	if emoji, ok := normalizeReaction(":+1:"); !ok || emoji != "👍" {
+		t.Errorf("normalizeReaction(:+1:) = %q, %v", emoji, ok)
+	}
+	if _, ok := normalizeReaction("👍 👎"); ok {
+		t.Error("a reaction can't be two emoji separated by a space")
+	}
+}
+
+func TestWelcomeBackSummary(t *testing.T) {
+	names := []string{"alice", "Ally"}
+	for body, want := range map[string]bool{
+		"hey @alice":            true,
+		"@ALICE, look":          true,
+		"thanks @ally!":         true,
+		"@alicebot is down":     false,
+		"@al are you there":     false,
+		"mail alice@example.io": false,
+	} {
+		if got := mentions(body, names); got != want {
+			t.Errorf("mentions(%q) = %v, want %v", body, got, want)
+		}
+	}
+
+	s := WelcomeBackSummary{
+		Since:       time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC),
+		UnreadPMs:   2,
+		Mentions:    map[string]int{"#random": 1, "#general": 3},
+		TopChannels: []ChannelActivity{{"#general", 120}, {"#random", 40}},
+	}
+	want := "\033[1;36mWelcome back! Since Mar 1 09:30 UTC:\033[0m\n" +
+		"  2 unread private message(s)\n" +
+		"  4 mention(s) in #general (3), #random (1)\n" +
+		"  most active: #general (120), #random (40)\n"
+	if got := s.String(); got != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+}
+
+func TestSplitStatusDuration(t *testing.T) {
+	tests := []struct {
+		text   string
+		status string
+		ttl    time.Duration
+	}{
+		{"busy 30m", "busy", 30 * time.Minute},
+		{"on holiday 2d", "on holiday", 48 * time.Hour},
+		{"busy", "busy", 0},
+		{"30m", "30m", 0},
+		{"back in five", "back in five", 0},
+		{" lunch  1h ", "lunch", time.Hour},
+	}
+	for _, tt := range tests {
+		status, ttl := splitStatusDuration(tt.text)
+		if status != tt.status || ttl != tt.ttl {
+			t.Errorf("splitStatusDuration(%q) = %q, %v; want %q, %v", tt.text, status, ttl, tt.status, tt.ttl)
+		}
+	}
+}
+
+func TestDigestSummary(t *testing.T) {
+	var got SummaryRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"summary": "  The team agreed to ship on \u001b[31mFriday\u001b[0m.  "}`))
+	}))
+	defer srv.Close()
+	saved := summaryURL
+	summaryURL = srv.URL
+	defer func() { summaryURL = saved }()
+
+	d := Digest{
+		Channel:      "#dev",
+		Since:        time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC),
+		Messages:     12,
+		Senders:      7,
+		Participants: []Participant{{"alice", 5}, {"bob", 3}},
+	}
+	summary, err := requestSummary(d, []SummaryLine{{From: "alice", Body: "ship friday?"}})
+	if err != nil {
+		t.Fatalf("requestSummary: %v", err)
+	}
+	if summary != "The team agreed to ship on Friday." {
+		t.Errorf("summary = %q", summary)
+	}
+	if got.Channel != "#dev" || len(got.Messages) != 1 || got.Messages[0].Body != "ship friday?" || len(got.Participants) != 2 {
+		t.Errorf("summarizer got %+v", got)
+	}
+
+	want := "\033[1;36mDigest of #dev since Mar 1 09:00 UTC:\033[0m\n" +
+		"  12 message(s) from 7 participant(s)\n" +
+		"  most active: alice (5), bob (3)\n"
+	if d.String() != want {
+		t.Errorf("digest = %q, want %q", d.String(), want)
+	}
+}
+
+// TestValidateDisplayName checks display names are trimmed and bounded in characters,
+// and that spaces and escape codes are rejected
+func TestValidateDisplayName(t *testing.T) {
+	defer func(min, max int) { minDisplayNameLength, maxDisplayNameLength = min, max }(minDisplayNameLength, maxDisplayNameLength)
+	minDisplayNameLength, maxDisplayNameLength = 2, 5
+
+	valid := map[string]string{"  ivy \r": "ivy", "a.b-c": "a.b-c", "zoë_1": "zoë_1"}
+	for typed, want := range valid {
+		got, err := validateDisplayName(typed)
+		if err != nil || got != want {
+			t.Errorf("validateDisplayName(%q) = %q, %v; want %q", typed, got, err, want)
+		}
+	}
+	for _, typed := range []string{"", "   ", "x", "toolong", "a b", "\033[31mx", "a\tb", "ab!"} {
+		if name, err := validateDisplayName(typed); err == nil {
+			t.Errorf("validateDisplayName(%q) = %q, want an error", typed, name)
+		}
+	}
+}
+
+// TestRoomAccess checks invite-only and password-protected rooms turn away accounts
+// that aren't invited or don't know the password, but never their operators
+func TestRoomAccess(t *testing.T) {
+	if err := initDB(); err != nil {
+		t.Fatalf("Error initializing database: %v", err)
+	}
+	defer closeDB()
+	defer db.Exec("DELETE FROM room_settings WHERE channel = ?", "#secret")
+	defer db.Exec("DELETE FROM room_invites WHERE channel = ?", "#secret")
+	defer db.Exec("DELETE FROM room_operators WHERE channel = ?", "#secret")
+
+	if ok, _ := checkRoomAccess("bob", "#secret", ""); !ok {
+		t.Error("Expected an open room to let anyone in")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setRoomMode("#secret", false, string(hash)); err != nil {
+		t.Fatalf("Error setting room mode: %v", err)
+	}
+	if ok, _ := checkRoomAccess("bob", "#secret", "wrong"); ok {
+		t.Error("Expected a wrong password to be refused")
+	}
+	if ok, _ := checkRoomAccess("bob", "#secret", "hunter2"); !ok {
+		t.Error("Expected the right password to let bob in")
+	}
+
+	if err := setRoomMode("#secret", true, ""); err != nil {
+		t.Fatalf("Error setting room mode: %v", err)
+	}
+	if ok, _ := checkRoomAccess("bob", "#secret", ""); ok {
+		t.Error("Expected an invite-only room to refuse bob")
+	}
+	if err := setRoomOperator("#secret", "carol", "alice", true); err != nil {
+		t.Fatalf("Error adding operator: %v", err)
+	}
+	if ok, _ := checkRoomAccess("carol", "#secret", ""); !ok {
+		t.Error("Expected an operator to get into an invite-only room")
+	}
+	if err := inviteToRoom("#secret", "bob", "carol"); err != nil {
+		t.Fatalf("Error inviting: %v", err)
+	}
+	if ok, _ := checkRoomAccess("bob", "#secret", ""); !ok {
+		t.Error("Expected an invited account to get in")
+	}
+}
+
+// TestResumeAfterRoomKick checks a reconnect token issued before a /roomkick doesn't
+// put the kicked account back into an invite-only room
+func TestResumeAfterRoomKick(t *testing.T) {
+	openTestDB(t)
+	useBus(t, &recordingBus{})
+	for _, name := range []string{"ann", "bob"} {
+		if err := saveUser(name, "password123"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := setRoomMode("#vault", true, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := setRoomOperator("#vault", "bob", "bob", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := inviteToRoom("#vault", "ann", "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	ann, bob := &recordingConn{}, &recordingConn{}
+	annSession := &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)}
+	bobSession := &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)}
+	mutex.Lock()
+	addClientLocked(ann, "ann", "ann", "id-ann", annSession)
+	addClientLocked(bob, "bob", "bob", "id-bob", bobSession)
+	joinRoomLocked(ann, "#vault")
+	joinRoomLocked(bob, "#vault")
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(ann)
+		removeClientLocked(bob)
+		mutex.Unlock()
+	}()
+
+	if err := saveReconnectToken(ann, "ann", "before-kick"); err != nil {
+		t.Fatal(err)
+	}
+	handleRoomKickCommand(bob, "/roomkick ann spamming")
+	mutex.Lock()
+	joined := annSession.joined["#vault"]
+	mutex.Unlock()
+	if joined {
+		t.Fatal("Expected ann to be kicked from #vault")
+	}
+
+	handleResumeCommand(ann, "/resume before-kick")
+	mutex.Lock()
+	joined = annSession.joined["#vault"]
+	mutex.Unlock()
+	if joined {
+		t.Error("Expected a token from before the kick not to rejoin #vault")
+	}
+}
+
+// TestSimulatedReconnectTokenExpiry checks reconnect tokens expire on the simulated clock
+func TestSimulatedReconnectTokenExpiry(t *testing.T) {
+	openTestDB(t)
+	sim := newSimulation(t, 1)
+	conn := &recordingConn{}
+
+	if err := saveReconnectToken(conn, "ann", "fresh"); err != nil {
+		t.Fatal(err)
+	}
+	sim.Advance(reconnectTokenTTL - time.Minute)
+	if _, _, _, err := takeReconnectToken("ann", "fresh"); err != nil {
+		t.Errorf("Expected a token within its lifetime to resume, got %v", err)
+	}
+
+	if err := saveReconnectToken(conn, "ann", "stale"); err != nil {
+		t.Fatal(err)
+	}
+	sim.Advance(reconnectTokenTTL + time.Second)
+	if _, _, _, err := takeReconnectToken("ann", "stale"); err != sql.ErrNoRows {
+		t.Errorf("Expected an expired token to be refused, got %v", err)
+	}
+}
+
+// TestImpersonationProtection checks system-like display names are refused and that
+// input can't recolor or rewrite lines
+func TestImpersonationProtection(t *testing.T) {
+	for _, name := range []string{"Server", "ADMIN", "S.e.r.v.e.r", "Admin_2", "r00t", "adm1n", "system-"} {
+		if _, err := validateDisplayName(name); err == nil {
+			t.Errorf("Expected %q to be reserved", name)
+		}
+	}
+	// Cyrillic and Greek letters that look Latin
+	for _, name := range []string{"\u0410dmin", "\u0405\u0435rv\u0435r", "r\u03bf\u03bft", "Sy\u0455t\u0435m", "\u039cODERATOR"} {
+		if _, err := validateDisplayName(name); err == nil {
+			t.Errorf("Expected %q to be reserved", name)
+		}
+	}
+	for _, name := range []string{"Serena", "admiral", "rooty", "alice", "Андрей", "Νίκος"} {
+		if _, err := validateDisplayName(name); err != nil {
+			t.Errorf("Expected %q to be allowed, got %v", name, err)
+		}
+	}
+
+	spoof := "hi\r\033[1;35m*** [Announcement] \u202eevil\ttab"
+	if got, want := sanitizeInput(spoof), "hi[1;35m*** [Announcement] evil tab"; got != want {
+		t.Errorf("sanitizeInput(%q) = %q, want %q", spoof, got, want)
+	}
+	if got := systemNotice("33", "maintenance"); !strings.Contains(got, systemPrefix+"maintenance") {
+		t.Errorf("Expected the notice to carry the system prefix, got %q", got)
+	}
+}
+
+// TestAccessibleOutput checks accessible clients get plain text that says what each
+// message is and who it is from, and no typing indicators
+func TestAccessibleOutput(t *testing.T) {
+	rec := &recordingConn{}
+	conn := &protoConn{Conn: rec}
+	setAccessibleOutput(conn, true)
+
+	conn.Write([]byte(systemNotice("33", "alice has joined the chat")))
+	if rec.last != "Server notice: alice has joined the chat\n" {
+		t.Errorf("Expected a plain server notice, got %q", rec.last)
+	}
+	conn.Write([]byte("\033[1;36mHelp:\033[0m\n\n────\n"))
+	if rec.last != "Help:\n" {
+		t.Errorf("Expected colors, blank lines and box drawing removed, got %q", rec.last)
+	}
+
+	writeEvent(conn, WireEvent{Type: "private", From: "bob", Body: "hi " + emojiShortcodes["smile"]}, "\033[34m[Private from bob] hi\033[0m\n")
+	if rec.last != "Private message from bob: hi :smile:\n" {
+		t.Errorf("Expected a verbal private message, got %q", rec.last)
+	}
+	writeEvent(conn, WireEvent{Type: "message", From: "carol", Room: "#go", Body: "lunch?"}, "[12:00] carol: lunch?\n")
+	if rec.last != "Message from carol in #go: lunch?\n" {
+		t.Errorf("Expected a verbal channel message, got %q", rec.last)
+	}
+	writes := rec.writes
+	writeEvent(conn, WireEvent{Type: "typing", From: "carol"}, "carol is typing...\n")
+	if rec.writes != writes {
+		t.Errorf("Expected no typing indicator, got %q", rec.last)
+	}
+
+	setAccessibleOutput(conn, false)
+	writeEvent(conn, WireEvent{Type: "private", From: "bob", Body: "hi"}, "[Private from bob] hi\n")
+	if rec.last != "[Private from bob] hi\n" {
+		t.Errorf("Expected the usual text once the mode is off, got %q", rec.last)
+	}
+}
+
+// TestDisplayModes checks each display mode's prefix on channel messages
+func TestDisplayModes(t *testing.T) {
+	compact, normal, verbose := &recordingConn{}, &recordingConn{}, &recordingConn{}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, c := range []struct {
+		conn *recordingConn
+		mode string
+	}{{compact, displayCompact}, {normal, ""}, {verbose, displayVerbose}} {
+		name := fmt.Sprintf("Viewer%d", i)
+		addClientLocked(c.conn, name, strings.ToLower(name), "id-"+name, &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool), display: c.mode})
+		defer removeClientLocked(c.conn)
+	}
+
+	sent := time.Date(2026, 1, 2, 12, 30, 0, 0, time.UTC)
+	deliverChannelMessageLocked(OutgoingMessage{channel: defaultChannel, id: "m1", text: "Ann: hi\n", sent: sent})
+	if compact.last != "Ann: hi\n" {
+		t.Errorf("Expected no prefix in compact mode, got %q", compact.last)
+	}
+	if normal.last != "\033[90m[12:30]\033[0m Ann: hi\n" {
+		t.Errorf("Expected only a timestamp in normal mode, got %q", normal.last)
+	}
+	if verbose.last != "\033[90m[12:30]\033[0m \033[90m[#general]\033[0m \033[90m(m1)\033[0m Ann: hi\n" {
+		t.Errorf("Expected the timestamp, channel and ID in verbose mode, got %q", verbose.last)
+	}
+}
+
+// TestHealthChecks checks liveness holds while readiness needs the listener and database
+func TestHealthChecks(t *testing.T) {
+	savedDB := db
+	db = nil
+	defer func() { db = savedDB; chatListening.Store(false) }()
+	mux := newHTTPMux()
+	get := func(path string) (int, HealthReport) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var report HealthReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Expected a JSON report from %s, got %s", path, rec.Body.String())
+		}
+		return rec.Code, report
+	}
+
+	chatListening.Store(true)
+	code, report := get("/healthz")
+	if code != http.StatusOK || report.Status != "ok" || !report.Listening || report.Goroutines == 0 {
+		t.Errorf("Expected a live server, got %d %+v", code, report)
+	}
+	code, report = get("/readyz")
+	if code != http.StatusServiceUnavailable || report.Database != "not open" {
+		t.Errorf("Expected not ready without a database, got %d %+v", code, report)
+	}
+
+	chatListening.Store(false)
+	if code, report = get("/readyz"); code != http.StatusServiceUnavailable || report.Status != "unavailable" || report.Listening {
+		t.Errorf("Expected not ready while not listening, got %d %+v", code, report)
+	}
+	if code, _ = get("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected liveness to hold while not listening, got %d", code)
+	}
+}
+
+func TestParseSearchArgs(t *testing.T) {
+	keyword, scope, before, err := parseSearchArgs([]string{"deploy", "#ops", "before=m9"})
+	if err != nil || keyword != "deploy" || scope != "#ops" || before != "m9" {
+		t.Errorf("Unexpected parse: %q %q %q %v", keyword, scope, before, err)
+	}
+	if _, _, _, err := parseSearchArgs([]string{"before=m9"}); err == nil {
+		t.Error("Expected an error without a keyword")
+	}
+	if _, _, _, err := parseSearchArgs([]string{"a", "b", "c"}); err == nil {
+		t.Error("Expected an error for a third word")
+	}
+	if got := likePattern(`50%_off\`); got != `%50\%\_off\\%` {
+		t.Errorf("Expected LIKE wildcards escaped, got %q", got)
+	}
+	if got := ftsPhrase(`say "hi"`); got != `"say ""hi"""` {
+		t.Errorf("Expected an FTS5 phrase, got %q", got)
+	}
+}
+
+// TestQuietHours checks quiet hours hold channel messages back, let priority messages
+// through, and summarize what was held once they end
+func TestQuietHours(t *testing.T) {
+	if start, end, err := parseQuietHours("22:00-07:30"); err != nil || start != 22*60 || end != 7*60+30 {
+		t.Errorf("parseQuietHours = %d, %d, %v", start, end, err)
+	}
+	if _, _, err := parseQuietHours("22:00-22:00"); err == nil {
+		t.Error("Expected an empty range to be refused")
+	}
+	night := &Session{quietHours: true, quietStart: 22 * 60, quietEnd: 7 * 60}
+	if !night.inQuietHours(time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)) || !night.inQuietHours(time.Date(2024, 1, 2, 6, 59, 0, 0, time.UTC)) {
+		t.Error("Expected quiet hours to wrap past midnight")
+	}
+	if night.inQuietHours(time.Date(2024, 1, 2, 7, 0, 0, 0, time.UTC)) {
+		t.Error("Expected quiet hours to end at their end time")
+	}
+
+	sim := newSimulation(t, 1) // 12:00 UTC
+	conn := &recordingConn{}
+	session := &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool), quietHours: true, quietStart: 11 * 60, quietEnd: 13 * 60}
+	mutex.Lock()
+	addClientLocked(conn, "Quinn", "quinn", "id-quinn", session)
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	updateQuietLocked(conn, session, clock.Now())
+	if !strings.Contains(conn.last, "Quiet hours are on until 13:00") {
+		t.Errorf("Expected the start of quiet hours to be announced, got %q", conn.last)
+	}
+	writes := conn.writes
+	deliverChannelMessageLocked(OutgoingMessage{channel: defaultChannel, text: "Ann: hi\n", sent: clock.Now()})
+	deliverChannelMessageLocked(OutgoingMessage{channel: defaultChannel, text: "Ann: hello\n", sent: clock.Now()})
+	if conn.writes != writes || session.heldMessages[defaultChannel] != 2 {
+		t.Errorf("Expected two held messages, got %d writes and %v", conn.writes-writes, session.heldMessages)
+	}
+	deliverChannelMessageLocked(OutgoingMessage{channel: defaultChannel, text: "Outage!\n", priority: true, sent: clock.Now()})
+	if !strings.Contains(conn.last, "Outage!") {
+		t.Errorf("Expected priority messages to get through, got %q", conn.last)
+	}
+	mutex.Unlock()
+
+	sim.Advance(time.Hour)
+	checkQuietHours(clock.Now())
+	if !strings.Contains(conn.last, "2 in #general") || session.heldMessages != nil {
+		t.Errorf("Expected a summary of the held messages, got %q", conn.last)
+	}
+}
+
+func TestParseVacationEnd(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	until, err := parseVacationEnd("2024-07-15", berlin, now)
+	if err != nil || !until.Equal(time.Date(2024, 7, 15, 0, 0, 0, 0, berlin)) {
+		t.Errorf("Expected the start of the day in the user's zone, got %v, %v", until, err)
+	}
+	if formatVacationEnd(until) != "2024-07-14 22:00 UTC" {
+		t.Errorf("Expected the end in UTC, got %s", formatVacationEnd(until))
+	}
+	if until, err := parseVacationEnd("10d", time.UTC, now); err != nil || !until.Equal(now.Add(240*time.Hour)) {
+		t.Errorf("Expected a period from now, got %v, %v", until, err)
+	}
+	for _, bad := range []string{"2024-06-30", "365d", "someday"} {
+		if _, err := parseVacationEnd(bad, time.UTC, now); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+
+	summary := WelcomeBackSummary{Since: now, Mentions: map[string]int{"#general": 2}, Vacation: true}
+	if text := summary.String(); !strings.Contains(text, "muted while you are on vacation") || strings.Contains(text, "#general (2)") {
+		t.Errorf("Expected mentions to be muted on vacation, got %q", text)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	statsMutex.Lock()
+	statsMessages, statsMessagesBy, statsPeakUsers = 0, make(map[string]int), 0
+	statsMutex.Unlock()
+
+	recordMessageSent("ann")
+	recordMessageSent("bob")
+	recordMessageSent("bob")
+	recordUserCount(7)
+	recordUserCount(3)
+
+	top := topSenders(1)
+	if len(top) != 1 || top[0].Channel != "bob" || top[0].Messages != 2 {
+		t.Errorf("Expected bob to have sent the most, got %+v", top)
+	}
+	text := serverStatsText()
+	for _, want := range []string{"Messages sent: 3", "@bob (2), @ann (1)", "(peak 7)"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %q in the server stats, got %q", want, text)
+		}
+	}
+	if got := formatUptime(50*time.Hour + 90*time.Second); got != "2d 2h 1m" {
+		t.Errorf("formatUptime = %q, want 2d 2h 1m", got)
+	}
+}
+
+func TestCalcPlugin(t *testing.T) {
+	cases := map[string]float64{
+		"1 + 2 * 3":       7,
+		"(1 + 2) * 3":     9,
+		"2 ^ 3 ^ 2":       512,
+		"-2 ^ 2":          -4,
+		"10 % 4 - 1.5":    0.5,
+		"7 / 2":           3.5,
+		"--3":             3,
+		" ( ( 4 ) ) / 8 ": 0.5,
+	}
+	for expr, want := range cases {
+		if got, err := evaluate(expr); err != nil || got != want {
+			t.Errorf("evaluate(%q) = %v, %v; want %v", expr, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "1 +", "(1 + 2", "1 / 0", "2 x 3", "1.2.3"} {
+		if _, err := evaluate(bad); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestWeatherPlugin(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Query().Get("q") != "Lisbon" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"name":"Lisbon","sys":{"country":"PT"},"weather":[{"description":"clear sky"}],"main":{"temp":21.46,"humidity":60},"wind":{"speed":3.2}}`))
+	}))
+	defer srv.Close()
+	savedURL, savedKey, savedRate := weatherURL, weatherAPIKey, weatherRate
+	weatherURL, weatherAPIKey, weatherRate = srv.URL, "key", 2
+	weatherCache, weatherCalls = make(map[string]weatherEntry), &rateWindow{}
+	defer func() { weatherURL, weatherAPIKey, weatherRate = savedURL, savedKey, savedRate }()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	text, err := cityWeather("Lisbon", now)
+	if err != nil || text != "Lisbon, PT: clear sky, 21.5°C, humidity 60%, wind 3.2 m/s" {
+		t.Fatalf("cityWeather = %q, %v", text, err)
+	}
+	if _, err := cityWeather("lisbon", now.Add(time.Minute)); err != nil || requests != 1 {
+		t.Errorf("Expected the cached answer, got %v after %d requests", err, requests)
+	}
+	if text, err := cityWeather("Atlantis", now); err != nil || !strings.Contains(text, "No weather found") {
+		t.Errorf("Expected an unknown city to be reported, got %q, %v", text, err)
+	}
+	if _, err := cityWeather("Porto", now); err == nil {
+		t.Error("Expected the API rate limit to refuse a third request in a minute")
+	}
+	if _, err := cityWeather("Lisbon", now.Add(weatherCacheTTL)); err != nil || requests != 3 {
+		t.Errorf("Expected a stale answer to be fetched again, got %v after %d requests", err, requests)
+	}
+}
+
+func TestTicTacToe(t *testing.T) {
+	g := Game{ID: 1, Kind: "tictactoe", Players: [2]string{"ann", "bob"}, State: ticTacToe{}.Start(), Status: gamePlaying}
+	if _, err := playMove(g, "bob", "5"); err == nil {
+		t.Error("Expected bob to wait for ann's move")
+	}
+	if _, err := playMove(g, "eve", "5"); err == nil {
+		t.Error("Expected someone outside the game to be refused")
+	}
+	var err error
+	for i, move := range []struct{ player, square string }{{"ann", "1"}, {"bob", "4"}, {"ann", "2"}, {"bob", "5"}} {
+		if g, err = playMove(g, move.player, move.square); err != nil {
+			t.Fatalf("move %d: %v", i, err)
+		}
+	}
+	if _, err := playMove(g, "ann", "4"); err == nil {
+		t.Error("Expected a taken square to be refused")
+	}
+	if _, err := playMove(g, "ann", "10"); err == nil {
+		t.Error("Expected a square off the board to be refused")
+	}
+	if g, err = playMove(g, "ann", "3"); err != nil || g.Status != gameWon || g.Winner != "ann" {
+		t.Fatalf("Expected ann to win the top row, got %+v, %v", g, err)
+	}
+	if board := g.board(); !strings.Contains(board, "X | X | X") || !strings.Contains(board, "@ann wins!") {
+		t.Errorf("Unexpected board %q", board)
+	}
+	if _, err := playMove(g, "bob", "9"); err == nil {
+		t.Error("Expected no moves after the game is over")
+	}
+
+	if over, winner := (ticTacToe{}).Result("XOXXOOOXX"); !over || winner != -1 {
+		t.Errorf("Expected a full board without a line to be a draw, got %v, %d", over, winner)
+	}
+}
+
+func TestColorCommand(t *testing.T) {
+	rec := &recordingConn{}
+	conn := &protoConn{Conn: rec}
+	if !hasColor(conn) {
+		t.Fatal("Expected a new connection to have colors")
+	}
+
+	// Before login the choice only applies to the connection
+	handleColorCommand(conn, "/color off")
+	if hasColor(conn) || rec.last != "Colors are off.\n" {
+		t.Fatalf("Expected colors to be off, got %q", rec.last)
+	}
+	conn.Write([]byte("\033[1;31mError\033[0m\n"))
+	if rec.last != "Error\n" {
+		t.Errorf("Expected plain text, got %q", rec.last)
+	}
+	handleColorCommand(conn, "/color")
+	if rec.last != "Colors are off.\n" {
+		t.Errorf("Expected the setting to be shown, got %q", rec.last)
+	}
+	handleColorCommand(conn, "/color on")
+	if !hasColor(conn) || rec.last != "\033[1;32mColors are on.\033[0m\n" {
+		t.Errorf("Expected colors to be on again, got %q", rec.last)
+	}
+	handleColorCommand(conn, "/color maybe")
+	if !strings.Contains(rec.last, "Usage") {
+		t.Errorf("Expected usage, got %q", rec.last)
+	}
+}
+
+func TestBookmarkUsage(t *testing.T) {
+	if got := excerpt("short", 10); got != "short" {
+		t.Errorf("excerpt = %q, want short", got)
+	}
+	if got := excerpt("héllo wörld", 6); got != "héllo…" {
+		t.Errorf("excerpt = %q, want héllo…", got)
+	}
+
+	conn := &recordingConn{}
+	handleBookmarkCommand(conn, "/bookmark")
+	if !strings.Contains(conn.last, "Usage: /bookmark") {
+		t.Errorf("Expected usage, got %q", conn.last)
+	}
+	handleUnbookmarkCommand(conn, "/unbookmark")
+	if !strings.Contains(conn.last, "Usage: /unbookmark") {
+		t.Errorf("Expected usage, got %q", conn.last)
+	}
+	handleBookmarksCommand(conn, "/bookmarks 1 2")
+	if !strings.Contains(conn.last, "Usage: /bookmarks") {
+		t.Errorf("Expected usage, got %q", conn.last)
+	}
+}
+
+func TestNickRename(t *testing.T) {
+	sim := newSimulation(t, 1)
+	now := sim.Now()
+	ivy, bob := &recordingConn{}, &recordingConn{}
+	mutex.Lock()
+	claimDisplayNameLocked("Ivy", "ivy")
+	addClientLocked(ivy, "Ivy", "ivy", "id-ivy", &Session{joined: make(map[string]bool)})
+	claimDisplayNameLocked("Bob", "bob")
+	addClientLocked(bob, "Bob", "bob", "id-bob", &Session{joined: make(map[string]bool)})
+	transfers["t1"] = &fileTransfer{id: "t1", from: ivy, to: bob, fromName: "Ivy", toName: "Bob"}
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(ivy)
+		removeClientLocked(bob)
+		delete(transfers, "t1")
+		mutex.Unlock()
+	}()
+
+	if _, ok := renameLocked("Ivy", "Bob", now); ok {
+		t.Error("Expected another account's name to be refused")
+	}
+	channels, ok := renameLocked("Ivy", "Ivy2", now)
+	mutex.Unlock()
+	if !ok || len(channels) != 1 || channels[0] != defaultChannel {
+		t.Fatalf("renameLocked = %v, %v", channels, ok)
+	}
+	if hub.Name(ivy) != "Ivy2" || transfers["t1"].fromName != "Ivy2" {
+		t.Errorf("Expected the name to change everywhere, got %q and %q", hub.Name(ivy), transfers["t1"].fromName)
+	}
+	if !sessionFor(ivy).nickChanged.Equal(now) {
+		t.Error("Expected the change to be timed for the cooldown")
+	}
+
+	handleNickCommand(ivy, "/nick Ivy3")
+	if !strings.Contains(ivy.last, "try again in") {
+		t.Errorf("Expected the cooldown to apply, got %q", ivy.last)
+	}
+	handleNickCommand(ivy, "/nick Admin")
+	if !strings.Contains(ivy.last, "Invalid display name") {
+		t.Errorf("Expected a reserved name to be refused, got %q", ivy.last)
+	}
+}
+
+func TestWhoisSessions(t *testing.T) {
+	sim := newSimulation(t, 1)
+	laptop, _ := createMockConn()
+	phone, _ := createMockConn()
+	defer laptop.Close()
+	defer phone.Close()
+	registerConn(laptop)
+	sim.Advance(time.Hour)
+	registerConn(phone)
+	defer forgetConn(laptop)
+	defer forgetConn(phone)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	addClientLocked(laptop, "Ivy", "ivy", "id-ivy", &Session{joined: make(map[string]bool)})
+	addClientLocked(phone, "IvyPhone", "ivy", "id-ivy", &Session{joined: make(map[string]bool)})
+	joinRoomLocked(phone, "#dev")
+	defer func() {
+		removeClientLocked(laptop)
+		removeClientLocked(phone)
+	}()
+
+	list := whoisSessionsLocked("ivy")
+	if len(list) != 2 || list[0].name != "Ivy" || list[1].name != "IvyPhone" {
+		t.Fatalf("Expected both sessions, oldest first, got %+v", list)
+	}
+	if !list[0].connected.Equal(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)) || !list[1].connected.Equal(time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the connect times to be kept, got %v and %v", list[0].connected, list[1].connected)
+	}
+	if len(list[1].rooms) != 2 || list[1].rooms[0] != "#dev" || list[1].rooms[1] != defaultChannel {
+		t.Errorf("Expected the phone's channels, got %v", list[1].rooms)
+	}
+	if visible := visibleRooms([]string{"#dev"}, map[string]bool{"#dev": true}); len(visible) != 1 {
+		t.Errorf("Expected a shared channel to be shown, got %v", visible)
+	}
+}
+
+func TestDemoResidents(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, r := range demoResidents {
+		if len(r.account) > maxUsernameLength || seen[r.account] || r.account == "alice" {
+			t.Errorf("resident account %q is too long or not unique", r.account)
+		}
+		seen[r.account] = true
+		if _, err := validateDisplayName(r.name); err != nil {
+			t.Errorf("resident %s: display name %q: %v", r.account, r.name, err)
+		}
+		if len(r.channels) == 0 || len(r.lines) == 0 {
+			t.Errorf("resident %s has nowhere to talk or nothing to say", r.account)
+		}
+		script := demoLogin(r)
+		if !strings.HasPrefix(script, "/login "+r.account+" "+demoPassword+"\n"+r.name+"\n") {
+			t.Errorf("resident %s logs in with %q", r.account, script)
+		}
+		for _, channel := range r.channels {
+			if !strings.Contains(script, "/join "+channel+"\n") {
+				t.Errorf("resident %s doesn't join %s", r.account, channel)
+			}
+		}
+	}
+	for _, m := range demoSeed {
+		if m.sender != "alice" && !seen[m.sender] {
+			t.Errorf("seed message from unknown account %q", m.sender)
+		}
+	}
+
+	oldPath := dbPath
+	defer func() { dbPath = oldPath }()
+	removeDemo, err := useDemoDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(dbPath)
+	removeDemo()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("demo directory %s left behind: %v", dir, err)
+	}
+}
+
+func TestCommandRegistry(t *testing.T) {
+	for _, c := range commandOrder {
+		if commands[c.Name] != c || c.Run == nil || (c.Help != "" && !strings.HasPrefix(c.Usage, "/"+c.Name)) {
+			t.Errorf("command /%s is registered wrongly", c.Name)
+		}
+	}
+
+	conn := &recordingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Alice", "alice", "id-alice", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	if handleCommand(conn, "hello /world") {
+		t.Error("Expected a chat message not to be handled as a command")
+	}
+	if !handleCommand(conn, "/frobnicate now") || !strings.Contains(conn.last, "Unknown command /frobnicate") {
+		t.Errorf("Expected an unknown command error, got %q", conn.last)
+	}
+	if !handleCommand(conn, "/private Bob") || !strings.Contains(conn.last, "Usage: /private") {
+		t.Errorf("Expected the usage for too few arguments, got %q", conn.last)
+	}
+
+	handleCommand(conn, "/help")
+	if !strings.Contains(conn.last, "/bookmarks [number|message-id]") || !strings.Contains(conn.last, "(admin only)") || strings.Contains(conn.last, "/pong") {
+		t.Errorf("Expected /help to list the registered commands, got %q", conn.last)
+	}
+}
+
+func TestStorageEncryption(t *testing.T) {
+	defer func() { storageCipher = nil }()
+	if stored, _ := sealBody("hello"); stored != "hello" || openBody(stored) != "hello" {
+		t.Fatalf("Expected bodies to be stored as they are without a key, got %q", stored)
+	}
+
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, text := range []string{fmt.Sprintf("%x", key), "  " + base64.StdEncoding.EncodeToString(key) + "\n"} {
+		if parsed, err := parseStorageKey(text); err != nil || !bytes.Equal(parsed, key) {
+			t.Errorf("Expected %q to parse as the key, got %v", text, err)
+		}
+	}
+	if _, err := parseStorageKey("too short"); err == nil {
+		t.Error("Expected a short key to be refused")
+	}
+
+	if err := setStorageKey(key); err != nil {
+		t.Fatal(err)
+	}
+	first, err := sealBody("meet me at noon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := sealBody("meet me at noon")
+	if !strings.HasPrefix(first, encryptedBodyPrefix) || strings.Contains(first, "noon") || first == second {
+		t.Errorf("Expected a freshly encrypted body, got %q and %q", first, second)
+	}
+	if body := openBody(first); body != "meet me at noon" {
+		t.Errorf("Expected the body back, got %q", body)
+	}
+	if body := openBody("stored before encryption"); body != "stored before encryption" {
+		t.Errorf("Expected plain text bodies to pass through, got %q", body)
+	}
+
+	setStorageKey(bytes.Repeat([]byte{8}, 32))
+	if body := openBody(first); body != unreadableBody {
+		t.Errorf("Expected another key not to decrypt the body, got %q", body)
+	}
+	storageCipher = nil
+	if body := openBody(first); body != unreadableBody {
+		t.Errorf("Expected no key not to decrypt the body, got %q", body)
+	}
+}
+
+// openTestDB points the server at a new database for the rest of the test
+func openTestDB(t *testing.T) {
+	oldPath := dbPath
+	dbPath = filepath.Join(t.TempDir(), "chat.db")
+	if err := initDB(); err != nil {
+		t.Fatalf("Error initializing database: %v", err)
+	}
+	t.Cleanup(func() {
+		closeDB()
+		dbPath = oldPath
+	})
+}
+
+func TestEncryptStoredBodies(t *testing.T) {
+	openTestDB(t)
+	defer func() { storageCipher = nil }()
+
+	if _, err := saveMessage("alice", "#vault", "stored before the key", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveAnnouncement("a1", "alice", "announced before the key", []string{"#vault"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO event_log (type, data, created_at) VALUES (?, ?, ?)",
+		MessagePosted{}.eventName(), `{"body":"logged before the key"}`, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setStorageKey(bytes.Repeat([]byte{7}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := encryptStoredBodies(); err != nil || n != 3 {
+		t.Fatalf("Expected 3 bodies to be encrypted, got %d, %v", n, err)
+	}
+	if _, err := saveMessage("alice", "#vault", "stored with the key", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range encryptedColumns {
+		var plain int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + c.table + " WHERE " + c.column + " NOT LIKE 'enc:v1:%'").Scan(&plain); err != nil || plain != 0 {
+			t.Errorf("Expected no plain text left in %s.%s, got %d, %v", c.table, c.column, plain, err)
+		}
+	}
+
+	page, err := getHistoryPage("#vault", HistoryQuery{Limit: 10})
+	if err != nil || len(page.Messages) != 2 || page.Messages[0].Body != "stored before the key" || page.Messages[1].Body != "stored with the key" {
+		t.Errorf("Expected history to be decrypted, got %+v, %v", page.Messages, err)
+	}
+	if entries, err := readEventLog(0, 10); err != nil || len(entries) != 1 || !strings.Contains(string(entries[0].Event), "logged before the key") {
+		t.Errorf("Expected the event log to be decrypted, got %+v, %v", entries, err)
+	}
+
+	if err := checkStorageKey(); err != nil {
+		t.Errorf("Expected the key to match, got %v", err)
+	}
+	setStorageKey(bytes.Repeat([]byte{8}, 32))
+	if err := checkStorageKey(); err == nil {
+		t.Error("Expected another key to be refused")
+	}
+	storageCipher = nil
+	if err := checkStorageKey(); err == nil {
+		t.Error("Expected starting without the key to be refused")
+	}
+}
+
+// TestPlainBodyLikeEncrypted checks a message typed to look encrypted is stored as
+// plain text without a key, doesn't stop the server starting, and survives turning
+// encryption on
+func TestPlainBodyLikeEncrypted(t *testing.T) {
+	openTestDB(t)
+	defer func() { storageCipher = nil }()
+
+	body := encryptedBodyPrefix + "AAAA"
+	if _, err := saveMessage("alice", "#vault", body, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStorageKey(); err != nil {
+		t.Errorf("Expected a plain text message not to need a key, got %v", err)
+	}
+	page, err := getHistoryPage("#vault", HistoryQuery{Limit: 10})
+	if err != nil || len(page.Messages) != 1 || page.Messages[0].Body != body {
+		t.Errorf("Expected the message as typed, got %+v, %v", page.Messages, err)
+	}
+
+	if err := setStorageKey(bytes.Repeat([]byte{7}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := encryptStoredBodies(); err != nil || n != 1 {
+		t.Fatalf("Expected the message to be encrypted, got %d, %v", n, err)
+	}
+	page, err = getHistoryPage("#vault", HistoryQuery{Limit: 10})
+	if err != nil || len(page.Messages) != 1 || page.Messages[0].Body != body {
+		t.Errorf("Expected the message as typed once encrypted, got %+v, %v", page.Messages, err)
+	}
+}
+
+func TestDeleteUserGames(t *testing.T) {
+	openTestDB(t)
+	for _, account := range []string{"ann", "bob"} {
+		if err := saveUser(account, "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := createGame("tictactoe", "", "ann", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteUser("ann"); err != nil {
+		t.Fatal(err)
+	}
+	for _, account := range []string{"ann", "bob"} {
+		if games, err := activeGames(account); err != nil || len(games) != 0 {
+			t.Errorf("Expected %s's games with a deleted account to go, got %+v, %v", account, games, err)
+		}
+	}
+}
+
+func TestDeleteUserRoutes(t *testing.T) {
+	openTestDB(t)
+	if err := saveUser("ann", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO user_routes (username, instance, updated_at) VALUES ('ann', 'other', ?)", time.Now().UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range [][2]string{{"bob", "ann"}, {"ann", "bob"}} {
+		if _, err := db.Exec(`INSERT INTO routed_messages (instance, sender, sender_account, recipient, body, store, created_at)
+			VALUES ('other', ?, ?, ?, 'hi', 1, ?)`, route[0], route[0], route[1], time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := deleteUser("ann"); err != nil {
+		t.Fatal(err)
+	}
+	var routes, routed int
+	db.QueryRow("SELECT COUNT(*) FROM user_routes").Scan(&routes)
+	db.QueryRow("SELECT COUNT(*) FROM routed_messages").Scan(&routed)
+	if routes != 0 || routed != 0 {
+		t.Errorf("Expected ann's routes and routed messages to go, got %d routes and %d messages", routes, routed)
+	}
+}
+
+func TestStorageQuotaRelease(t *testing.T) {
+	openTestDB(t)
+	defer func(quota int64) { storageQuota = quota }(storageQuota)
+	storageQuota = 10
+	usage := func() int64 {
+		t.Helper()
+		total, err := getTotalStorage("bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+
+	if err := savePrivateMessage("bob", "ann", "hello", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePrivateMessage("bob", "ann", "world!", true); err != errQuotaExceeded {
+		t.Errorf("Expected the quota to refuse the message, got %v", err)
+	}
+	if err := savePrivateMessage("bob", "cat", "hey", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := usage(); got != 8 {
+		t.Fatalf("Expected bob to be charged 8 bytes, got %d", got)
+	}
+
+	if err := deleteUser("ann"); err != nil {
+		t.Fatal(err)
+	}
+	if got := usage(); got != 3 {
+		t.Errorf("Expected deleting ann to give bob's 5 bytes back, got %d stored", got)
+	}
+}
+
+func TestSpectatorCap(t *testing.T) {
+	defer func(max int) { maxSpectators = max }(maxSpectators)
+	maxSpectators = 1
+	first, second := &recordingConn{}, &recordingConn{}
+	defer func() {
+		mutex.Lock()
+		delete(spectators, first)
+		delete(spectators, second)
+		mutex.Unlock()
+	}()
+
+	if !addSpectator(first, defaultChannel) {
+		t.Fatal("Expected the first spectator to be let in")
+	}
+	if addSpectator(second, defaultChannel) {
+		t.Error("Expected a spectator beyond -max-spectators to be refused")
+	}
+	if !strings.Contains(second.last, "Too many spectators") {
+		t.Errorf("Expected the refused spectator to be told why, got %q", second.last)
+	}
+}
+
+// TestStreamRestrictedChannels checks the stream token can't read channels whose
+// access is restricted unless they are opened to the stream
+func TestStreamRestrictedChannels(t *testing.T) {
+	openTestDB(t)
+	defer func(saved string) { streamToken = saved }(streamToken)
+	defer func() { streamRestricted = make(map[string]bool) }()
+	streamToken = "right"
+	if err := setRoomMode("#vault", true, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := setRoomMode("#locked", false, "$2a$10$notarealhash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setChannelRestriction(ChannelRestriction{channel: "#beta", requireVerified: true}); err != nil {
+		t.Fatal(err)
+	}
+	mux := newHTTPMux()
+	get := func(channel string) int {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("GET", "/stream/"+channel+"?token=right", nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := get("general"); code != http.StatusOK {
+		t.Errorf("Expected an open channel to stream, got %d", code)
+	}
+	for _, channel := range []string{"vault", "locked", "beta"} {
+		if code := get(channel); code != http.StatusForbidden {
+			t.Errorf("Expected #%s to be refused, got %d", channel, code)
+		}
+	}
+	streamRestrictedFlag{}.Set("#vault")
+	if code := get("vault"); code != http.StatusOK {
+		t.Errorf("Expected -stream-restricted to open #vault, got %d", code)
+	}
+}
+
+// TestProvisioningRequiresToken checks accounts can't be created or disabled
+// without the admin token, or at all when no token is configured
+func TestProvisioningRequiresToken(t *testing.T) {
+	openTestDB(t)
+	defer func(saved string) { adminAPIToken = saved }(adminAPIToken)
+	if err := saveUser("ann", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	mux := newHTTPMux()
+	post := func(path, token, body string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	create := `{"username": "mallory", "password": "hunter22"}`
+
+	adminAPIToken = ""
+	if code := post("/api/users", "", create); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 when no token is configured, got %d", code)
+	}
+	adminAPIToken = "right"
+	for _, token := range []string{"", "wrong", "righ", "right2"} {
+		if code := post("/api/users", token, create); code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 creating an account with token %q, got %d", token, code)
+		}
+		if code := post("/api/users/ann/disable", token, ""); code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 disabling an account with token %q, got %d", token, code)
+		}
+	}
+	if exists, _ := userExists("mallory"); exists {
+		t.Error("Expected no account to be created without the token")
+	}
+	if isUserDisabled("ann") {
+		t.Error("Expected ann to stay enabled without the token")
+	}
+
+	if code := post("/api/users", "right", create); code != http.StatusCreated {
+		t.Errorf("Expected 201 with the token, got %d", code)
+	}
+	if code := post("/api/users/ann/disable", "right", ""); code != http.StatusOK || !isUserDisabled("ann") {
+		t.Errorf("Expected the token to disable ann, got %d", code)
+	}
+}
+
+// TestProvisionUserValidation checks provisioned usernames follow the /register rules
+// and SSO identities can disable the account they map to
+func TestProvisionUserValidation(t *testing.T) {
+	openTestDB(t)
+	defer func(saved string) { adminAPIToken = saved }(adminAPIToken)
+	adminAPIToken = "right"
+	mux := newHTTPMux()
+	post := func(path, body string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer right")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, name := range []string{"", "ann smith", "ann\tb", "ann\x1b[2J", "ann\nroot"} {
+		body := fmt.Sprintf(`{"username": %q, "password": "hunter22"}`, name)
+		if code := post("/api/users", body); code != http.StatusBadRequest {
+			t.Errorf("Expected username %q to be refused, got %d", name, code)
+		}
+		if err := validateUsername(name); err == nil {
+			t.Errorf("Expected validateUsername(%q) to fail", name)
+		}
+	}
+
+	if code := post("/api/users", `{"username": "ann", "sso_subject": "hr-42"}`); code != http.StatusCreated {
+		t.Fatalf("Expected 201 for an SSO account, got %d", code)
+	}
+	if code := post("/api/users", `{"username": "bob", "sso_subject": "hr-42"}`); code != http.StatusConflict {
+		t.Errorf("Expected a second account for the same SSO identity to conflict, got %d", code)
+	}
+	if code := post("/api/sso/hr-42/disable", ""); code != http.StatusOK || !isUserDisabled("ann") {
+		t.Errorf("Expected the SSO identity to disable ann, got %d", code)
+	}
+	if code := post("/api/sso/hr-42/enable", ""); code != http.StatusOK || isUserDisabled("ann") {
+		t.Errorf("Expected the SSO identity to enable ann, got %d", code)
+	}
+	if code := post("/api/sso/nobody/disable", ""); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown SSO identity, got %d", code)
+	}
+}
+
+// TestRulesGate checks an account that hasn't accepted the current rules can't post
+// or run commands other than reading and accepting them
+func TestRulesGate(t *testing.T) {
+	openTestDB(t)
+	defer func(text, version string) { rulesText, rulesVersion = text, version }(rulesText, rulesVersion)
+	rulesText, rulesVersion = "Be kind.", "1"
+	if err := saveUser("ann", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	conn := &recordingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Ann", "ann", "id-ann", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	accepted := hasAcceptedRules("ann")
+	if accepted {
+		t.Fatal("Expected a new account not to have accepted the rules")
+	}
+	for _, message := range []string{"hello", "/private bob hi", "/join #random", "/me waves"} {
+		if passRulesGate(conn, message, &accepted) {
+			t.Errorf("Expected %q to be refused before /accept", message)
+		}
+		if !strings.Contains(conn.last, "You must /accept the rules") {
+			t.Errorf("Expected %q to be refused with a reason, got %q", message, conn.last)
+		}
+	}
+	if !passRulesGate(conn, "/rules", &accepted) {
+		t.Error("Expected /rules to be allowed before /accept")
+	}
+
+	if passRulesGate(conn, "/accept", &accepted) || !accepted || !hasAcceptedRules("ann") {
+		t.Fatal("Expected /accept to be handled and recorded")
+	}
+	if !passRulesGate(conn, "hello", &accepted) {
+		t.Error("Expected messages to pass once the rules are accepted")
+	}
+
+	rulesVersion = "2"
+	if hasAcceptedRules("ann") {
+		t.Error("Expected changed rules to need accepting again")
+	}
+}
+
+// TestPrivateHistoryScope checks /history private only shows the conversation between
+// the two accounts, never what either of them said to someone else
+func TestPrivateHistoryScope(t *testing.T) {
+	openTestDB(t)
+	for _, m := range [][3]string{{"ann", "bob", "ann to bob"}, {"bob", "ann", "bob to ann"}, {"bob", "cat", "bob to cat"}, {"cat", "ann", "cat to ann"}} {
+		if err := savePrivateMessage(m[0], m[1], m[2], false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := saveMessage("ann", "#general", "ann to everyone", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := getPrivateHistory("ann", "bob", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for _, m := range messages {
+		bodies = append(bodies, m.Body)
+	}
+	if got := strings.Join(bodies, ", "); got != "ann to bob, bob to ann" {
+		t.Errorf("Expected only ann and bob's messages, got %q", got)
+	}
+
+	// Nobody can read a conversation they weren't part of
+	conn := &recordingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Dave", "dave", "id-dave", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+	handlePrivateHistory(conn, []string{"@ann"})
+	if conn.writes != 1 || !strings.Contains(conn.last, "No private messages with ann") {
+		t.Errorf("Expected dave to see none of ann's private messages, got %d writes, last %q", conn.writes, conn.last)
+	}
+}
+
+// TestOfflineMessagesScope checks held private messages reach only their recipient,
+// and that delivering one account's messages leaves the others waiting
+func TestOfflineMessagesScope(t *testing.T) {
+	openTestDB(t)
+	if err := savePrivateMessage("cat", "ann", "for ann only", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePrivateMessage("cat", "bob", "for bob", true); err != nil {
+		t.Fatal(err)
+	}
+	conn := &recordingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Bob", "bob", "id-bob", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	deliverOfflineMessages(conn, "bob")
+	handleInboxCommand(conn, "/inbox 50")
+	inbox, err := getOfflineMessages("bob", false, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inbox) != 1 || inbox[0].Body != "for bob" || strings.Contains(conn.last, "for ann") {
+		t.Errorf("Expected bob's inbox to hold only his message, got %+v", inbox)
+	}
+
+	waiting, err := getOfflineMessages("ann", true, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(waiting) != 1 || waiting[0].Body != "for ann only" {
+		t.Errorf("Expected ann's message to still wait for her, got %+v", waiting)
+	}
+}
+
+// TestLeaderElection checks only one instance holds the lease at a time: a standby
+// can't take it while the leader renews it, and the old leader can't take it back
+func TestLeaderElection(t *testing.T) {
+	openTestDB(t)
+	defer func(lease time.Duration, id string) { leaderLease, instanceID = lease, id }(leaderLease, instanceID)
+	leaderLease = 3 * time.Second
+	start := time.Unix(1700000000, 0)
+	acquire := func(id string, after time.Duration) bool {
+		t.Helper()
+		instanceID = id
+		ok, err := tryAcquireLease(start.Add(after))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if !acquire("a", 0) {
+		t.Fatal("Expected the first instance to take the free lease")
+	}
+	if acquire("b", time.Second) {
+		t.Error("Expected the standby to be refused a held lease")
+	}
+	if !acquire("a", 2*time.Second) {
+		t.Error("Expected the leader to renew its lease")
+	}
+	if acquire("b", 4*time.Second) {
+		t.Error("Expected the standby to be refused a renewed lease")
+	}
+	if !acquire("b", 6*time.Second) {
+		t.Fatal("Expected the standby to take over an expired lease")
+	}
+	if acquire("a", 6*time.Second) {
+		t.Error("Expected the old leader to be refused once the standby took over")
+	}
+
+	// Only the holder can give the lease up
+	instanceID = "a"
+	releaseLease()
+	if acquire("a", 7*time.Second) {
+		t.Error("Expected a release by a former leader to leave the lease held")
+	}
+	instanceID = "b"
+	releaseLease()
+	if !acquire("a", 7*time.Second) {
+		t.Error("Expected a released lease to be free at once")
+	}
+}
+
+// TestCopyDatabase checks migrate copy carries over every table, row and column,
+// including user IDs and private message recipients
+func TestCopyDatabase(t *testing.T) {
+	openTestDB(t)
+	for _, name := range []string{"ann", "bob"} {
+		if err := saveUser(name, "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	annID, err := getUserID("ann")
+	if err != nil || annID == "" {
+		t.Fatalf("Expected ann to have a user ID, got %q, %v", annID, err)
+	}
+	if err := setUserDisabled("bob", true); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := saveMessage("ann", "#general", "hello", "deploy", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := savePrivateMessage("ann", "bob", "psst", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := addFriend("ann", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addBookmark("ann", stored.id, "later"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createGame("tictactoe", "#general", "ann", "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(t.TempDir(), "copy.db")
+	if err := copyDatabase(dbPath, target); err != nil {
+		t.Fatalf("Error copying database: %v", err)
+	}
+	copied, err := sql.Open("sqlite3", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+
+	tables, err := sourceTables(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) < 30 {
+		t.Errorf("Expected every table to be copied, got only %d", len(tables))
+	}
+	for _, table := range tables {
+		var want, got int
+		db.QueryRow("SELECT COUNT(*) FROM " + table.name).Scan(&want)
+		copied.QueryRow("SELECT COUNT(*) FROM " + table.name).Scan(&got)
+		if got != want {
+			t.Errorf("Expected %d rows in %s, got %d", want, table.name, got)
+		}
+	}
+
+	var userID string
+	var disabled bool
+	copied.QueryRow("SELECT user_id FROM users WHERE username = 'ann'").Scan(&userID)
+	copied.QueryRow("SELECT disabled FROM users WHERE username = 'bob'").Scan(&disabled)
+	if userID != annID || !disabled {
+		t.Errorf("Expected ann's ID %s and bob disabled, got %s and %v", annID, userID, disabled)
+	}
+	var recipient, tag string
+	var offline bool
+	copied.QueryRow("SELECT recipient, offline FROM messages WHERE channel = ''").Scan(&recipient, &offline)
+	copied.QueryRow("SELECT tag FROM messages WHERE channel = '#general'").Scan(&tag)
+	if recipient != "bob" || !offline || tag != "deploy" {
+		t.Errorf("Expected the private message to bob and the message tag to survive, got %q %v %q", recipient, offline, tag)
+	}
+}
+
+// TestCopyDatabaseMissingSource checks migrate copy refuses a source that doesn't
+// exist instead of creating it and copying nothing
+func TestCopyDatabaseMissingSource(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "typo.db")
+	if err := copyDatabase(source, filepath.Join(dir, "copy.db")); err == nil {
+		t.Error("Expected copying from a missing database to fail")
+	}
+	if _, err := os.Stat(source); !os.IsNotExist(err) {
+		t.Errorf("Expected the missing source not to be created, got %v", err)
+	}
+}
+
+// TestParseDatabaseSpec checks bare paths open SQLite files and that a driver that
+// isn't compiled in is refused rather than taken for a file name
+func TestParseDatabaseSpec(t *testing.T) {
+	for spec, want := range map[string]string{
+		"./chat.db":                     "./chat.db",
+		"sqlite3:./chat.db":             "./chat.db",
+		"file:/replica/chat.db?mode=ro": "file:/replica/chat.db?mode=ro",
+	} {
+		driver, dsn, err := parseDatabaseSpec(spec)
+		if err != nil || driver != "sqlite3" || dsn != want {
+			t.Errorf("parseDatabaseSpec(%q) = %q, %q, %v; want sqlite3, %q", spec, driver, dsn, err, want)
+		}
+	}
+	if _, _, err := parseDatabaseSpec("postgres:postgres://chat@localhost/chat"); err == nil || err.Error() != "driver postgres is not compiled in" {
+		t.Errorf("Expected postgres to be refused, got %v", err)
+	}
+}
+
+// TestClusterSequenceNumbers checks instances sharing a database continue each other's
+// channel sequence numbers, and that a message losing the race takes the next one
+func TestClusterSequenceNumbers(t *testing.T) {
+	openTestDB(t)
+	defer func(cluster bool) { clusterMode = cluster }(clusterMode)
+	clusterMode = true
+	const channel = "#cluster"
+	defer func() {
+		sequenceMutex.Lock()
+		delete(channelClocks, channel)
+		sequenceMutex.Unlock()
+	}()
+	otherInstance := func(seq int64) {
+		t.Helper()
+		if _, err := db.Exec("INSERT INTO messages (message_id, sender, channel, body, created_at, seq) VALUES (?, 'bob', ?, 'hi', ?, ?)",
+			fmt.Sprintf("other-%d", seq), channel, time.Now().UTC(), seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if first, err := saveMessage("ann", channel, "one", "", ""); err != nil || first.seq != 1 {
+		t.Fatalf("Expected the first message to be number 1, got %d, %v", first.seq, err)
+	}
+	otherInstance(2)
+	if pos, err := channelPosition(channel); err != nil || pos != 2 {
+		t.Errorf("Expected the channel position to include the other instance's message, got %d, %v", pos, err)
+	}
+	third, err := saveMessage("ann", channel, "three", "", "")
+	if err != nil || third.seq != 3 {
+		t.Fatalf("Expected to continue after the other instance's message, got %d, %v", third.seq, err)
+	}
+
+	// Both instances hand out 4 at once; the one stored second becomes 5
+	renumbered := persistRenumbered.Load()
+	otherInstance(4)
+	if err := channelMessageWrite("late", "ann", channel, "four", time.Now().UTC(), nil, 4, nil).exec(); err != nil {
+		t.Fatalf("Expected the losing message to be renumbered, got %v", err)
+	}
+	var seq int64
+	db.QueryRow("SELECT seq FROM messages WHERE message_id = 'late'").Scan(&seq)
+	if seq != 5 || persistRenumbered.Load() != renumbered+1 {
+		t.Errorf("Expected the losing message to be stored as 5 and counted, got %d", seq)
+	}
+}
+
+// TestReserveStorageConcurrent checks senders racing for the last of a quota can't
+// go over it together
+func TestReserveStorageConcurrent(t *testing.T) {
+	openTestDB(t)
+	defer func(quota int64) { storageQuota = quota }(storageQuota)
+	storageQuota = 10
+
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := reserveStorage("bob", storageMessages, 3)
+			for isDBUnavailable(err) {
+				err = reserveStorage("bob", storageMessages, 3)
+			}
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	charged := 0
+	for err := range results {
+		switch err {
+		case nil:
+			charged++
+		case errQuotaExceeded:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if total, _ := getTotalStorage("bob"); charged != 3 || total != 9 {
+		t.Errorf("Expected 3 reservations of 3 bytes within the 10 byte quota, got %d for %d bytes", charged, total)
+	}
+}
+
+// TestIdempotentSend checks a message sent twice with the same key, even at once,
+// is stored and delivered once and the retry is acknowledged as a duplicate
+func TestIdempotentSend(t *testing.T) {
+	openTestDB(t)
+	recorder := &recordingBus{}
+	useBus(t, recorder)
+	conn := &waitingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Ann", "ann", "id-ann", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handleSendCommand(conn, "/send k1 hello")
+		}()
+	}
+	wg.Wait()
+
+	var stored int
+	db.QueryRow("SELECT COUNT(*) FROM messages WHERE sender = 'ann' AND idempotency_key = 'k1'").Scan(&stored)
+	if stored != 1 {
+		t.Errorf("Expected one stored message, got %d", stored)
+	}
+	out := conn.received()
+	if strings.Count(out, "ACK k1 ") != 2 || strings.Count(out, " duplicate\n") != 1 {
+		t.Errorf("Expected one ACK and one duplicate ACK, got %q", out)
+	}
+	if len(recorder.events) != 1 {
+		t.Errorf("Expected the message to be delivered once, got %+v", recorder.events)
+	}
+
+	// A second store under the same key is refused by the database itself
+	if _, err := saveMessage("ann", "#general", "hello", "", "k1"); !isDuplicateKey(err) {
+		t.Errorf("Expected the database to refuse a reused key, got %v", err)
+	}
+}
+
+// TestIdempotencyKeyClaims checks a keyed send waits only while another send holds
+// the same key, and not for keyed sends in general
+func TestIdempotencyKeyClaims(t *testing.T) {
+	openTestDB(t)
+	useBus(t, &recordingBus{})
+	conn := &waitingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Ann", "ann", "id-ann", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	release := claimIdempotencyKey("ann", "k1")
+	defer release()
+	send := func(message string) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleSendCommand(conn, message)
+		}()
+		return done
+	}
+
+	select {
+	case <-send("/send k2 hello"):
+	case <-time.After(time.Second):
+		t.Fatal("Expected a send with another key not to wait")
+	}
+	held := send("/send k1 hello")
+	select {
+	case <-held:
+		t.Fatal("Expected a send with a held key to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-held:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the send to go through once the key was let go")
+	}
+}
+
+// TestIdempotentSendDuringOutage checks a retry sent while the database is down is
+// recognised as a duplicate of the message waiting to be stored, which is stored
+// once the database is back
+func TestIdempotentSendDuringOutage(t *testing.T) {
+	openTestDB(t)
+	recorder := &recordingBus{}
+	useBus(t, recorder)
+	defer func() { pendingWrites = nil }()
+	conn := &waitingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Ann", "ann", "id-ann", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	db.Close()
+	handleSendCommand(conn, "/send k1 hello")
+	handleSendCommand(conn, "/send k1 hello")
+	out := conn.received()
+	if strings.Count(out, "ACK k1 ") != 2 || strings.Count(out, " duplicate\n") != 1 {
+		t.Errorf("Expected one ACK and one duplicate ACK, got %q", out)
+	}
+	if len(recorder.events) != 1 {
+		t.Errorf("Expected the message to be delivered once, got %+v", recorder.events)
+	}
+
+	if err := initDB(); err != nil {
+		t.Fatal(err)
+	}
+	if !replayPendingWrites() {
+		t.Fatal("Expected the kept message to be stored once the database was back")
+	}
+	var stored int
+	db.QueryRow("SELECT COUNT(*) FROM messages WHERE sender = 'ann' AND idempotency_key = 'k1'").Scan(&stored)
+	if stored != 1 {
+		t.Errorf("Expected one stored message, got %d", stored)
+	}
+	if _, ok := findInflightMessage("ann", "k1"); ok {
+		t.Error("Expected the key to be found in the database once the message was stored")
+	}
+}
+
+// TestRoutePrivateMessage checks a message routed to an account on two other
+// instances is collected once by each, stored by one, and kept for the recipient
+// when an instance crashes before collecting it
+func TestRoutePrivateMessage(t *testing.T) {
+	openTestDB(t)
+	sim := newSimulation(t, 1)
+	defer func(cluster bool, id string) { clusterMode, instanceID = cluster, id }(clusterMode, instanceID)
+	clusterMode = true
+	for _, id := range []string{"b", "c"} {
+		instanceID = id
+		setRoute("bob")
+	}
+
+	instanceID = "a"
+	if !routePrivateMessage("Ann", "ann", "bob", "hi") {
+		t.Fatal("Expected the message to be routed")
+	}
+	if routePrivateMessage("Ann", "ann", "nobody", "hi") {
+		t.Error("Expected no route to an account that isn't logged in anywhere")
+	}
+	take := func(id string) []RoutedMessage {
+		t.Helper()
+		instanceID = id
+		messages, err := takeRoutedMessages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return messages
+	}
+	if got := take("a"); len(got) != 0 {
+		t.Errorf("Expected nothing routed to the sender's instance, got %+v", got)
+	}
+	b := take("b")
+	if len(b) != 1 || !b[0].store || b[0].body != "hi" || b[0].senderAccount != "ann" {
+		t.Fatalf("Expected instance b to collect the stored copy, got %+v", b)
+	}
+	if again := take("b"); len(again) != 0 {
+		t.Errorf("Expected a collected message to be gone, got %+v", again)
+	}
+
+	// Instance c crashed: its copy expires, but the stored copy went to b so nothing is kept
+	sim.Advance(routeTTL + time.Second)
+	if err := expireRoutedMessages(sim.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := take("c"); len(got) != 0 {
+		t.Errorf("Expected the uncollected copy to expire, got %+v", got)
+	}
+
+	// When both instances crash, the stored copy becomes an offline message
+	for _, id := range []string{"b", "c"} {
+		instanceID = id
+		setRoute("bob")
+	}
+	instanceID = "a"
+	if !routePrivateMessage("Ann", "ann", "bob", "are you there?") {
+		t.Fatal("Expected the message to be routed while the routes are still valid")
+	}
+	for i := 0; i < 2; i++ {
+		sim.Advance(routeTTL + time.Second)
+		if err := expireRoutedMessages(sim.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offline, err := getOfflineMessages("bob", true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offline) != 1 || offline[0].Body != "are you there?" || offline[0].Sender != "ann" {
+		t.Errorf("Expected the expired message to wait for bob once, got %+v", offline)
+	}
+}
+
+// TestRejectedWrite checks a queued message the database refuses gives its quota
+// back, tells the sender, and keeps its idempotency key for the rest of the window
+func TestRejectedWrite(t *testing.T) {
+	openTestDB(t)
+	sim := newSimulation(t, 1)
+	conn := &recordingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Bob", "bob", "id-bob", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	if err := reserveStorage("bob", storageMessages, 5); err != nil {
+		t.Fatal(err)
+	}
+	inflightKeysMutex.Lock()
+	inflightKeys[inflightKey("bob", "k1")] = "m1"
+	inflightKeysMutex.Unlock()
+	rejected := persistRejected.Load()
+
+	writeBatch([]queuedWrite{
+		{query: "INSERT INTO no_such_table (body) VALUES (?)", args: []interface{}{"hello"}, sender: "bob", key: "k1", charged: 5},
+	})
+	if persistRejected.Load() != rejected+1 {
+		t.Error("Expected the rejected write to be counted")
+	}
+	if total, _ := getTotalStorage("bob"); total != 0 {
+		t.Errorf("Expected the quota to be given back, got %d bytes", total)
+	}
+	if !strings.Contains(conn.last, "couldn't be saved") {
+		t.Errorf("Expected bob to be told, got %q", conn.last)
+	}
+	if id, ok := findInflightMessage("bob", "k1"); !ok || id != "m1" {
+		t.Error("Expected a retry to be recognised as a duplicate")
+	}
+	sim.Advance(idempotencyWindow)
+	if _, ok := findInflightMessage("bob", "k1"); ok {
+		t.Error("Expected the key to be forgotten after the idempotency window")
+	}
+}
+
+// TestChargeWhenStored checks a message that couldn't be charged when it was sent is
+// charged once stored, alone or in a batch, and that nothing is given back for it
+// if it fails
+func TestChargeWhenStored(t *testing.T) {
+	openTestDB(t)
+	if err := reserveStorage("ann", storageMessages, 4); err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("not stored")
+	releaseUnsaved("ann", 0, &failed)
+	if total, _ := getTotalStorage("ann"); total != 4 {
+		t.Errorf("Expected nothing to be given back for an uncharged message, got %d bytes", total)
+	}
+
+	alone := channelMessageWrite("m1", "ann", "#general", "hello", time.Now().UTC(), nil, 1, nil)
+	alone.uncharged = 5
+	if err := alone.exec(); err != nil {
+		t.Fatal(err)
+	}
+	batched := channelMessageWrite("m2", "ann", "#general", "hi", time.Now().UTC(), nil, 2, nil)
+	batched.uncharged = 2
+	writeBatch([]queuedWrite{batched})
+	if total, _ := getTotalStorage("ann"); total != 11 {
+		t.Errorf("Expected stored messages to be charged, got %d bytes", total)
+	}
+}
+
+// TestRejectedDuplicateWrite checks a queued retry refused because another instance
+// stored the original gives its quota back without telling the sender it was lost
+func TestRejectedDuplicateWrite(t *testing.T) {
+	openTestDB(t)
+	conn := &recordingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Bob", "bob", "id-bob", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	original, err := saveMessage("bob", "#general", "hello", "", "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reserveStorage("bob", storageMessages, 5); err != nil {
+		t.Fatal(err)
+	}
+	retry := channelMessageWrite("m2", "bob", "#general", "hello", time.Now().UTC(), "k1", original.seq+1, nil)
+	retry.key, retry.charged = "k1", 5
+	inflightKeysMutex.Lock()
+	inflightKeys[inflightKey("bob", "k1")] = "m2"
+	inflightKeysMutex.Unlock()
+	rejected := persistRejected.Load()
+	writes := conn.writes
+
+	writeBatch([]queuedWrite{retry})
+	if persistRejected.Load() != rejected || conn.writes != writes {
+		t.Errorf("Expected the duplicate not to be reported as lost, got %q", conn.last)
+	}
+	if total, _ := getTotalStorage("bob"); total != 5 {
+		t.Errorf("Expected only the original to be charged, got %d bytes", total)
+	}
+	if id, found, _ := findMessageByIdempotencyKey("bob", "k1"); !found || id != original.id {
+		t.Errorf("Expected the key to find the stored original %s, got %s", original.id, id)
+	}
+}
+
+// TestPriorityBypassesFilters checks a priority notice reaches a user whose bot, tag
+// and quiet hours filters drop an ordinary message, and that it stands out
+func TestPriorityBypassesFilters(t *testing.T) {
+	openTestDB(t)
+	newSimulation(t, 1)
+	recorder := &recordingBus{}
+	useBus(t, recorder)
+	conn := &recordingConn{}
+	session := &Session{
+		tags:       map[string]*TagFilter{defaultChannel: {follow: map[string]bool{"deploy": true}}},
+		joined:     make(map[string]bool),
+		filterBots: "off",
+		quietHours: true, quietStart: 0, quietEnd: 24*60 - 1,
+	}
+	mutex.Lock()
+	addClientLocked(conn, "Ann", "ann", "id-ann", session)
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	mutex.Lock()
+	deliverChannelMessageLocked(OutgoingMessage{channel: defaultChannel, text: "ordinary\n", tag: "chatter", bot: true})
+	mutex.Unlock()
+	if conn.writes != 0 {
+		t.Fatalf("Expected the filters to drop an ordinary message, got %q", conn.last)
+	}
+
+	announcePriority("admin", "servers restarting")
+	if len(recorder.published) != 1 {
+		t.Fatalf("Expected one priority notice, got %+v", recorder.published)
+	}
+	msg := recorder.published[0]
+	msg.channel, msg.tag, msg.bot = defaultChannel, "chatter", true
+	mutex.Lock()
+	deliverChannelMessageLocked(msg)
+	mutex.Unlock()
+	if conn.writes != 1 || !strings.Contains(conn.last, "[PRIORITY] servers restarting") || !strings.Contains(conn.last, "\a") {
+		t.Errorf("Expected the marked priority notice to get through, got %q", conn.last)
+	}
+}
+
+// TestHistoryPaging checks paging back and forth through a channel with message ID
+// cursors, the tag filter, and that unknown cursors are refused
+func TestHistoryPaging(t *testing.T) {
+	openTestDB(t)
+	const channel = "#paging"
+	defer func() {
+		sequenceMutex.Lock()
+		delete(channelClocks, channel)
+		sequenceMutex.Unlock()
+	}()
+	ids := make(map[string]string)
+	for i, tag := range []string{"", "deploy", "", "deploy", ""} {
+		body := fmt.Sprintf("m%d", i+1)
+		stored, err := saveMessage("ann", channel, body, tag, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[body] = stored.id
+	}
+	page := func(q HistoryQuery) (string, HistoryPage) {
+		t.Helper()
+		p, err := getHistoryPage(channel, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bodies []string
+		for _, m := range p.Messages {
+			bodies = append(bodies, m.Body)
+		}
+		return strings.Join(bodies, " "), p
+	}
+
+	got, latest := page(HistoryQuery{Limit: 2})
+	if got != "m4 m5" || latest.Before != ids["m4"] {
+		t.Fatalf("Expected the latest page m4 m5 with a cursor to m4, got %q %+v", got, latest)
+	}
+	got, older := page(HistoryQuery{Limit: 2, Before: latest.Before})
+	if got != "m2 m3" {
+		t.Errorf("Expected m2 m3 before m4, got %q", got)
+	}
+	got, oldest := page(HistoryQuery{Limit: 2, Before: older.Before})
+	if got != "m1" || oldest.Before != "" {
+		t.Errorf("Expected m1 alone with no older cursor, got %q %+v", got, oldest)
+	}
+	if got, _ := page(HistoryQuery{Limit: 2, After: ids["m1"]}); got != "m2 m3" {
+		t.Errorf("Expected m2 m3 after m1, got %q", got)
+	}
+	if got, _ := page(HistoryQuery{Tag: "deploy"}); got != "m2 m4" {
+		t.Errorf("Expected only the deploy messages, got %q", got)
+	}
+
+	for _, q := range []HistoryQuery{{Before: "no-such-id"}, {After: "no-such-id"}} {
+		if _, err := getHistoryPage(channel, q); err != errInvalidCursor {
+			t.Errorf("Expected an unknown cursor to be refused, got %v", err)
+		}
+	}
+}
+
+// TestJoinRestrictedChannel checks that /join refuses an account that doesn't meet
+// a channel's restriction and lets it in once it does
+func TestJoinRestrictedChannel(t *testing.T) {
+	openTestDB(t)
+	useBus(t, &recordingBus{})
+	if err := saveUser("ann", "password123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setChannelRestriction(ChannelRestriction{channel: "#vault", requireVerified: true}); err != nil {
+		t.Fatal(err)
+	}
+	conn := &recordingConn{}
+	session := &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)}
+	mutex.Lock()
+	addClientLocked(conn, "Ann", "ann", "id-ann", session)
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	handleJoinCommand(conn, "/join #vault")
+	if !strings.Contains(conn.last, "You can't join #vault: #vault is restricted to verified accounts") {
+		t.Errorf("Expected an unverified account to be refused, got %q", conn.last)
+	}
+	mutex.Lock()
+	joined := session.joined["#vault"]
+	mutex.Unlock()
+	if joined {
+		t.Fatal("Expected the refused account not to be in #vault")
+	}
+
+	if err := setUserVerified("ann", true); err != nil {
+		t.Fatal(err)
+	}
+	handleJoinCommand(conn, "/join #vault")
+	mutex.Lock()
+	joined, room := session.joined["#vault"], session.room
+	mutex.Unlock()
+	if !joined || room != "#vault" {
+		t.Errorf("Expected a verified account to join #vault, got joined=%v room=%s", joined, room)
+	}
+}
+
+// withStdin runs fn with os.Stdin reading input
+func withStdin(t *testing.T, input string, fn func()) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString(input)
+	w.Close()
+	old := os.Stdin
+	os.Stdin = r
+	defer func() {
+		os.Stdin = old
+		r.Close()
+	}()
+	fn()
+}
+
+// TestCLIUseraddAndBackup creates an account with the useradd subcommand, backs the
+// database up, and checks the account in the backup
+func TestCLIUseraddAndBackup(t *testing.T) {
+	oldPath := dbPath
+	defer func() { dbPath = oldPath }()
+	dir := t.TempDir()
+	live := filepath.Join(dir, "chat.db")
+	backup := filepath.Join(dir, "backup.db")
+
+	withStdin(t, "s3cret\n", func() {
+		if err := runCLI([]string{"useradd", "-db", live, "-role", roleAdmin, "root"}); err != nil {
+			t.Fatalf("useradd failed: %v", err)
+		}
+	})
+	withStdin(t, "other\n", func() {
+		if err := runCLI([]string{"useradd", "-db", live, "root"}); err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Errorf("Expected a second useradd of root to fail, got %v", err)
+		}
+	})
+	if err := runCLI([]string{"backup", "-db", live, backup}); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	if err := runCLI([]string{"backup", "-db", live, backup}); err == nil {
+		t.Error("Expected backup to refuse to overwrite an existing file")
+	}
+	typo := filepath.Join(dir, "typo.db")
+	if err := runCLI([]string{"backup", "-db", typo, filepath.Join(dir, "typo-backup.db")}); err == nil {
+		t.Error("Expected backup of a missing database to fail")
+	}
+	withStdin(t, "other\n", func() {
+		if err := runCLI([]string{"passwd", "-db", typo, "root"}); err == nil {
+			t.Error("Expected passwd against a missing database to fail")
+		}
+	})
+	if _, err := os.Stat(typo); !os.IsNotExist(err) {
+		t.Errorf("Expected the missing database not to be created, got %v", err)
+	}
+
+	dbPath = backup
+	if err := initDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB()
+	if !verifyUser("root", "s3cret") {
+		t.Error("Expected the backup to hold root with the password from stdin")
+	}
+	if role, err := getUserRole("root"); err != nil || role != roleAdmin {
+		t.Errorf("Expected root to be an admin, got %q %v", role, err)
+	}
+}
+
+// captureStdout returns what fn writes to os.Stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	defer func() {
+		os.Stdout = old
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+// TestCtlAgainstAdminAPI runs ctl against the admin API, checking the rendered
+// output and that a wrong token fails the command
+func TestCtlAgainstAdminAPI(t *testing.T) {
+	saved := adminAPIToken
+	adminAPIToken = "secret"
+	defer func() { adminAPIToken = saved }()
+	srv := httptest.NewServer(newHTTPMux())
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	conn := &recordingConn{}
+	mutex.Lock()
+	addClientLocked(conn, "Ann", "ann", "id-ann", &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)})
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		removeClientLocked(conn)
+		mutex.Unlock()
+	}()
+
+	var err error
+	out := captureStdout(t, func() {
+		err = runCLI([]string{"ctl", "-addr", addr, "-token", "secret", "users"})
+	})
+	if err != nil {
+		t.Fatalf("ctl users failed: %v", err)
+	}
+	if !strings.HasPrefix(out, "1 connected\n  Ann\n") {
+		t.Errorf("Unexpected ctl users output: %q", out)
+	}
+
+	out = captureStdout(t, func() {
+		err = runCLI([]string{"ctl", "-addr", addr, "-token", "wrong", "users"})
+	})
+	if err == nil || err.Error() != "invalid admin token" {
+		t.Errorf("Expected ctl to fail with the API's error, got %v", err)
+	}
+	if out != "" {
+		t.Errorf("Expected no output on a rejected token, got %q", out)
+	}
+}
+
+// TestSoakShortRun runs a few soak cycles against a live listener and checks the
+// report is printed and goroutines return to the baseline
+func TestSoakShortRun(t *testing.T) {
+	openTestDB(t)
+	useBus(t, &recordingBus{})
+	savedCycles, savedWorkers, savedWindow := soakCycles, soakWorkers, presenceWindow
+	soakCycles, soakWorkers, presenceWindow = 4, 2, 0
+	defer func() { soakCycles, soakWorkers, presenceWindow = savedCycles, savedWorkers, savedWindow }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleClient(wrapClientConn(newTimeoutConn(conn)))
+		}
+	}()
+
+	stopped := make(chan error, 1)
+	out := captureStdout(t, func() {
+		runSoak(ln.Addr().String(), func(err error) { stopped <- err })
+	})
+	if err := <-stopped; err != nil {
+		t.Fatalf("Expected goroutine growth within %d, got %v:\n%s", soakGoroutineSlack, err, out)
+	}
+	for _, want := range []string{"Soak: 4 cycles in ", ", 0 failed\n", "Soak: goroutines ", "Soak: heap "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected the report to contain %q, got:\n%s", want, out)
+		}
+	}
+}
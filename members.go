@@ -0,0 +1,63 @@
+// Package main contains paged member listings for large channels
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultMembersLimit is the page size of /members
+	defaultMembersLimit = 50
+	// maxMembersLimit caps a single /members page
+	maxMembersLimit = 200
+)
+
+// pageMembers returns up to limit names that sort after the cursor, and
+// the cursor for the next page ("" when this is the last page)
+func pageMembers(names []string, after string, limit int) ([]string, string) {
+	sort.Strings(names)
+	start := sort.SearchStrings(names, after)
+	if start < len(names) && names[start] == after {
+		start++
+	}
+	end := start + limit
+	if end >= len(names) {
+		return names[start:], ""
+	}
+	return names[start:end], names[end-1]
+}
+
+// handleMembersCommand handles the /members command
+// Format: /members [limit] [after=<name>]
+func handleMembersCommand(conn net.Conn, message string) {
+	limit := defaultMembersLimit
+	after := ""
+	for _, arg := range strings.Fields(message)[1:] {
+		if strings.HasPrefix(arg, "after=") {
+			after = strings.TrimPrefix(arg, "after=")
+			continue
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			conn.Write([]byte("\033[1;31mUsage: /members [limit] [after=<name>]\033[0m\n"))
+			return
+		}
+		limit = min(n, maxMembersLimit)
+	}
+
+	room := currentRoom(conn)
+	names := roomMemberNames(room)
+	page, next := pageMembers(names, after, limit)
+
+	conn.Write([]byte(fmt.Sprintf("\033[1;36mMembers of %s (%d online):\033[0m\n", room, len(names))))
+	for _, name := range page {
+		conn.Write([]byte("\033[90m" + name + "\033[0m\n"))
+	}
+	if next != "" {
+		conn.Write([]byte(fmt.Sprintf("\033[90mMore: /members %d after=%s\033[0m\n", limit, next)))
+	}
+}
@@ -0,0 +1,339 @@
+// Package main contains persistence and delivery of channel messages
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultChannel is the channel every user joins on login
+const defaultChannel = "#general"
+
+var (
+	// idempotencyWindow is how long a client-supplied idempotency key deduplicates retries
+	idempotencyWindow = 10 * time.Minute
+	// claimedKeys holds the idempotency keys of sends between checking the key and
+	// storing the message, so concurrent retries can't both get through. Each entry
+	// is closed when its send lets go of the key.
+	claimedKeys      = make(map[string]chan struct{})
+	claimedKeysMutex = &sync.Mutex{}
+)
+
+// claimIdempotencyKey waits until no other send holds the sender's key, then holds
+// it. The returned func lets go of the key and may be called more than once.
+func claimIdempotencyKey(sender, key string) func() {
+	k := inflightKey(sender, key)
+	for {
+		claimedKeysMutex.Lock()
+		held, ok := claimedKeys[k]
+		if !ok {
+			released := make(chan struct{})
+			claimedKeys[k] = released
+			claimedKeysMutex.Unlock()
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					claimedKeysMutex.Lock()
+					delete(claimedKeys, k)
+					claimedKeysMutex.Unlock()
+					close(released)
+				})
+			}
+		}
+		claimedKeysMutex.Unlock()
+		<-held
+	}
+}
+
+// isDuplicateKey reports whether err, from storing a message with an idempotency key,
+// means the sender already stored one under the same key, as when a retry raced the
+// original to another instance. A sequence conflict breaks a unique index too, but is
+// renumbered before the error gets back to the caller.
+func isDuplicateKey(err error) bool {
+	return isUniqueViolation(err)
+}
+
+// expireIdempotencyKey frees a key for reuse once the message stored under it is
+// older than the idempotency window
+func expireIdempotencyKey(sender, key string) error {
+	_, err := db.Exec("UPDATE messages SET idempotency_key = NULL WHERE sender = ? AND idempotency_key = ? AND created_at < ?",
+		sender, key, clock.Now().UTC().Add(-idempotencyWindow))
+	return err
+}
+
+// findMessageByIdempotencyKey returns the ID of a message the sender already sent
+// with the same key within the idempotency window
+func findMessageByIdempotencyKey(sender, key string) (string, bool, error) {
+	if id, ok := findInflightMessage(sender, key); ok {
+		return id, true, nil
+	}
+	var id string
+	err := db.QueryRow(`SELECT message_id FROM messages
+		WHERE sender = ? AND idempotency_key = ? AND created_at >= ?
+		ORDER BY id DESC LIMIT 1`, sender, key, clock.Now().UTC().Add(-idempotencyWindow)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return id, err == nil, err
+}
+
+// StoredMessage is the server-assigned identity and position of a saved message
+type StoredMessage struct {
+	id   string
+	seq  int64
+	time time.Time
+}
+
+// channelMessageWrite is the insert that stores a channel message under seq. If
+// another instance sharing the database stored a message under seq first, the
+// message is stored under the channel's next free number instead.
+func channelMessageWrite(id, sender, channel, body string, created time.Time, key interface{}, seq int64, tag interface{}) queuedWrite {
+	return queuedWrite{
+		query:  "INSERT INTO messages (message_id, sender, channel, body, created_at, idempotency_key, seq, tag) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		args:   []interface{}{id, sender, channel, body, created, key, seq, tag},
+		sender: sender,
+		renumbered: &queuedWrite{
+			query: `INSERT INTO messages (message_id, sender, channel, body, created_at, idempotency_key, seq, tag)
+				SELECT ?, ?, ?, ?, ?, ?, COALESCE(MAX(seq), 0) + 1, ? FROM messages WHERE channel = ?`,
+			args:   []interface{}{id, sender, channel, body, created, key, tag, channel},
+			sender: sender,
+		},
+	}
+}
+
+// reserveMessage charges a message to the sender's storage quota and returns how many
+// bytes were charged. While the database is unavailable nothing can be charged, so
+// the message is let through and charged once it is stored.
+func reserveMessage(sender, body string) (int64, error) {
+	err := reserveStorage(sender, storageMessages, int64(len(body)))
+	if isDBUnavailable(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return int64(len(body)), nil
+}
+
+// releaseUnsaved gives back the bytes charged for a message that couldn't be stored
+func releaseUnsaved(sender string, charged int64, err *error) {
+	if *err != nil && charged > 0 {
+		releaseStorage(sender, storageMessages, charged)
+	}
+}
+
+// saveMessage stores a public message, charges it to the sender's storage quota,
+// and returns its ID, its sequence number in the channel, and its server timestamp.
+// The insert itself happens in the background when the write-behind queue is running.
+// While the database is unavailable the message is kept in memory and stored once it
+// recovers; the quota isn't enforced in the meantime, but the message is charged
+// when it is stored.
+func saveMessage(sender, channel, body, tag, idempotencyKey string) (stored StoredMessage, err error) {
+	charged, err := reserveMessage(sender, body)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	defer releaseUnsaved(sender, charged, &err)
+	uncharged := int64(len(body)) - charged
+
+	id, err := newUUID()
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	storedBody, err := sealBody(body)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+
+	var key, tagValue interface{}
+	if idempotencyKey != "" {
+		key = idempotencyKey
+	}
+	if tag != "" {
+		tagValue = tag
+	}
+
+	// Hold the sequence lock until the insert is queued so sequence numbers are stored in order
+	sequenceMutex.Lock()
+	defer sequenceMutex.Unlock()
+
+	seq, now, err := nextStamp(channel)
+	if isDBUnavailable(err) {
+		// The channel's last sequence number is unknown until the database is back,
+		// so the stored copy is numbered when it is written
+		now = clock.Now().UTC()
+		addInflight(sender, idempotencyKey, id)
+		queuePending(queuedWrite{sender: sender, key: idempotencyKey}, func() error {
+			sequenceMutex.Lock()
+			defer sequenceMutex.Unlock()
+			seq, _, err := nextStamp(channel)
+			if err != nil {
+				return err
+			}
+			write := channelMessageWrite(id, sender, channel, storedBody, now, key, seq, tagValue)
+			write.uncharged = uncharged
+			if err := write.exec(); err != nil {
+				channelClocks[channel].seq--
+				return err
+			}
+			return nil
+		})
+		return StoredMessage{id: id, time: now}, nil
+	} else if err != nil {
+		return StoredMessage{}, err
+	}
+
+	write := channelMessageWrite(id, sender, channel, storedBody, now, key, seq, tagValue)
+	write.key = idempotencyKey
+	write.charged, write.uncharged = charged, uncharged
+	if err := persist(write, id); err != nil {
+		// Give the sequence number back so the channel has no gaps
+		channelClocks[channel].seq--
+		return StoredMessage{}, err
+	}
+	return StoredMessage{id: id, seq: seq, time: now}, nil
+}
+
+// savePrivateMessage stores a private message between two accounts and charges it
+// to the sender's storage quota. Private messages have no channel or sequence number.
+// Offline messages are held for the recipient's next login.
+func savePrivateMessage(sender, recipient, body string, offline bool) (err error) {
+	charged, err := reserveMessage(sender, body)
+	if err != nil {
+		return err
+	}
+	defer releaseUnsaved(sender, charged, &err)
+
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	storedBody, err := sealBody(body)
+	if err != nil {
+		return err
+	}
+	return persist(queuedWrite{
+		query:     "INSERT INTO messages (message_id, sender, channel, recipient, body, created_at, offline) VALUES (?, ?, '', ?, ?, ?, ?)",
+		args:      []interface{}{id, sender, recipient, storedBody, clock.Now().UTC(), offline},
+		sender:    sender,
+		charged:   charged,
+		uncharged: int64(len(body)) - charged,
+	}, id)
+}
+
+// checkMessageLength tells the user and returns false if body is over the configured limit
+func checkMessageLength(conn net.Conn, body string) bool {
+	if maxMessageLength > 0 && len(body) > maxMessageLength {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mMessage is too long (max %d characters). Message not sent.\033[0m\n", maxMessageLength)))
+		return false
+	}
+	return true
+}
+
+// sendChannelMessage stores and delivers a message from conn to its channel,
+// optionally tagged so recipients can follow or mute it. With an idempotency key,
+// a retry of an already delivered message is acknowledged again instead of being
+// delivered twice.
+func sendChannelMessage(conn net.Conn, body, tag, idempotencyKey string, buttons []Button) {
+	postChannelMessage(conn, currentRoom(conn), body, tag, idempotencyKey, buttons)
+}
+
+// postChannelMessage stores and delivers a message from conn to room, which conn
+// must be a member of. It reports whether the message was sent; if not, the user
+// has been told why.
+func postChannelMessage(conn net.Conn, room, body, tag, idempotencyKey string, buttons []Button) bool {
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	if !checkMessageLength(conn, body) || !checkEmojiOnly(conn, room, body) {
+		return false
+	}
+
+	release := func() {}
+	defer func() { release() }()
+	if idempotencyKey != "" {
+		release = claimIdempotencyKey(username, idempotencyKey)
+		id, found, err := findMessageByIdempotencyKey(username, idempotencyKey)
+		if err == nil && !found {
+			err = expireIdempotencyKey(username, idempotencyKey)
+		}
+		if err != nil {
+			connLogger(conn).Error("checking idempotency key", "err", err)
+		} else if found {
+			conn.Write([]byte(fmt.Sprintf("ACK %s %s duplicate\n", idempotencyKey, id)))
+			return true
+		}
+	}
+
+	if !checkFlood(conn) || !checkSlowMode(conn, username) {
+		return false
+	}
+
+	// Store the message before delivering it
+	stored, err := saveMessage(username, room, body, tag, idempotencyKey)
+	// Once stored or queued, retries find the message, so they needn't wait for delivery
+	release()
+	if err == errQuotaExceeded {
+		conn.Write([]byte("\033[1;31mYour storage quota is full. Message not sent.\033[0m\n"))
+		return false
+	} else if isDuplicateKey(err) {
+		// The original was stored by another instance sharing the database
+		id, _, _ := findMessageByIdempotencyKey(username, idempotencyKey)
+		conn.Write([]byte(fmt.Sprintf("ACK %s %s duplicate\n", idempotencyKey, id)))
+		return true
+	} else if err != nil {
+		// Keep the chat going even if persistence fails
+		connLogger(conn).Error("saving message", "err", err)
+		stored.time = clock.Now().UTC()
+	}
+	if len(buttons) > 0 {
+		if stored.id == "" {
+			conn.Write([]byte("\033[1;31mError posting message. Please try again.\033[0m\n"))
+			return false
+		}
+		// Remember the buttons before anyone can see them
+		mutex.Lock()
+		registerInteractiveLocked(stored.id, username, room, buttons)
+		mutex.Unlock()
+	}
+
+	// Deliver the message to the channel's members, marking automated traffic
+	bus.Emit(MessagePosted{
+		ID:      stored.id,
+		Seq:     stored.seq,
+		Channel: room,
+		User:    identityForConn(conn),
+		Body:    body,
+		Tag:     tag,
+		Bot:     sessionFor(conn).bot,
+		Time:    stored.time,
+		Buttons: buttons,
+	})
+	recordMessageSent(username)
+	clearAway(conn)
+
+	if idempotencyKey != "" {
+		conn.Write([]byte(fmt.Sprintf("ACK %s %s\n", idempotencyKey, stored.id)))
+	}
+	return true
+}
+
+// handleSendCommand handles the /send command
+// Format: /send <idempotency-key> <message>
+func handleSendCommand(conn net.Conn, message string) {
+	parts := strings.SplitN(message, " ", 3)
+	if len(parts) != 3 || strings.TrimSpace(parts[2]) == "" {
+		conn.Write([]byte("\033[1;31mUsage: /send <idempotency-key> <message>\033[0m\n"))
+		return
+	}
+	key := parts[1]
+	if len(key) > 64 {
+		conn.Write([]byte("\033[1;31mIdempotency key must be 64 characters or less.\033[0m\n"))
+		return
+	}
+	sendChannelMessage(conn, parts[2], "", key, nil)
+}
@@ -0,0 +1,41 @@
+// Package main contains the counters operators read through the admin API
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// counters holds every registered counter by name
+	counters      = make(map[string]*atomic.Int64)
+	countersMutex = &sync.Mutex{}
+)
+
+// newCounter registers a named counter
+func newCounter(name string) *atomic.Int64 {
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+
+	c := &atomic.Int64{}
+	counters[name] = c
+	return c
+}
+
+// metricsSnapshot returns the current value of every counter
+func metricsSnapshot() map[string]int64 {
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+
+	snapshot := make(map[string]int64, len(counters))
+	for name, c := range counters {
+		snapshot[name] = c.Load()
+	}
+	return snapshot
+}
+
+// serveAdminMetrics reports every counter as JSON
+func serveAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, metricsSnapshot())
+}
@@ -0,0 +1,378 @@
+// Package main contains the `migrate` subcommand for moving data into and between databases
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// legacyUser is an account as stored in the old users.json file
+type legacyUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Status   string `json:"status"`
+}
+
+// migratedTable is a table copied between databases, with the columns copied
+type migratedTable struct {
+	name    string
+	columns []string
+}
+
+// runMigrateCommand implements `chat-server migrate users-json <file>` and
+// `chat-server migrate copy <from> <to>`
+func runMigrateCommand(args []string) error {
+	fs := newCommandFlags("migrate")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	args = fs.Args()
+
+	if len(args) < 1 {
+		return errors.New("usage: chat-server migrate users-json <users.json> | copy <from> <to>")
+	}
+
+	switch args[0] {
+	case "users-json":
+		if len(args) != 2 {
+			return errors.New("usage: chat-server migrate users-json <users.json>")
+		}
+		if err := initDB(); err != nil {
+			return err
+		}
+		defer closeDB()
+
+		created, skipped, err := importLegacyUsers(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d users from %s, skipped %d\n", created, args[1], skipped)
+		return nil
+	case "copy":
+		if len(args) != 3 {
+			return errors.New("usage: chat-server migrate copy <driver:dsn> <driver:dsn>")
+		}
+		return copyDatabase(args[1], args[2])
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
+// parseLegacyUsers reads users.json, which was written either as a list of
+// users or as an object keyed by username
+func parseLegacyUsers(data []byte) ([]legacyUser, error) {
+	var list []legacyUser
+	if err := json.Unmarshal(data, &list); err == nil {
+		return list, nil
+	}
+
+	var byName map[string]json.RawMessage
+	if err := json.Unmarshal(data, &byName); err != nil {
+		return nil, fmt.Errorf("unrecognized users.json format: %v", err)
+	}
+	for name, raw := range byName {
+		u := legacyUser{Username: name}
+		// Values are either a bare password or an object with password and status
+		if err := json.Unmarshal(raw, &u.Password); err != nil {
+			if err := json.Unmarshal(raw, &u); err != nil {
+				return nil, fmt.Errorf("user %s: %v", name, err)
+			}
+			u.Username = name
+		}
+		list = append(list, u)
+	}
+	return list, nil
+}
+
+// importLegacyUsers copies accounts from a users.json file into the database
+func importLegacyUsers(path string) (created, skipped int, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	users, err := parseLegacyUsers(data)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, u := range users {
+		if u.Username == "" || u.Password == "" {
+			skipped++
+			continue
+		}
+		exists, err := userExists(u.Username)
+		if err != nil {
+			return created, skipped, err
+		}
+		if exists {
+			skipped++
+			continue
+		}
+
+		if isBcryptHash(u.Password) {
+			err = saveUserWithHash(u.Username, u.Password, roleUser)
+		} else {
+			err = saveUser(u.Username, u.Password)
+		}
+		if err == nil && u.Status != "" {
+			err = updateUserStatus(u.Username, u.Status)
+		}
+		if err != nil {
+			return created, skipped, fmt.Errorf("user %s: %v", u.Username, err)
+		}
+		created++
+	}
+	return created, skipped, nil
+}
+
+// openMigrationTarget opens a "driver:dsn" database spec
+func openMigrationTarget(spec string) (*sql.DB, string, error) {
+	driver, dsn, err := parseDatabaseSpec(spec)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// SQLite targets get the schema created for them; other backends must already have it
+	if driver == "sqlite3" {
+		sqlDB, err := openDatabase(dsn)
+		return sqlDB, driver, err
+	}
+	sqlDB, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, "", err
+	}
+	return sqlDB, driver, sqlDB.Ping()
+}
+
+// openMigrationSource opens the database a copy reads from. A SQLite source is
+// opened read-only and must already exist, so a mistyped path isn't created empty.
+func openMigrationSource(spec string) (*sql.DB, string, error) {
+	driver, dsn, err := parseDatabaseSpec(spec)
+	if err != nil {
+		return nil, "", err
+	}
+	if driver == "sqlite3" && !strings.HasPrefix(dsn, "file:") {
+		if _, err := os.Stat(dsn); err != nil {
+			return nil, "", err
+		}
+		dsn = "file:" + dsn + "?mode=ro"
+	}
+	sqlDB, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, "", err
+	}
+	return sqlDB, driver, nil
+}
+
+// knownDrivers are the database/sql drivers a "driver:dsn" spec may name
+var knownDrivers = map[string]bool{"sqlite3": true, "postgres": true, "pgx": true, "mysql": true}
+
+// parseDatabaseSpec splits a "driver:dsn" database spec. A spec that doesn't start
+// with a known driver is treated as a SQLite file; naming a driver that isn't
+// compiled into this binary is an error rather than a file name.
+func parseDatabaseSpec(spec string) (driver, dsn string, err error) {
+	driver, dsn, found := strings.Cut(spec, ":")
+	if !found || !knownDrivers[driver] {
+		return "sqlite3", spec, nil
+	}
+	if !isRegisteredDriver(driver) {
+		return "", "", fmt.Errorf("driver %s is not compiled in", driver)
+	}
+	return driver, dsn, nil
+}
+
+// isRegisteredDriver reports whether a database/sql driver is compiled in
+func isRegisteredDriver(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// placeholders returns n bind parameters in the syntax the driver expects
+func placeholders(driver string, n int) string {
+	marks := make([]string, n)
+	for i := range marks {
+		if driver == "postgres" || driver == "pgx" {
+			marks[i] = fmt.Sprintf("$%d", i+1)
+		} else {
+			marks[i] = "?"
+		}
+	}
+	return strings.Join(marks, ", ")
+}
+
+// sourceTables reads the tables of the source database and all their columns from
+// its schema, in the order they were created. Full-text indexes and their shadow
+// tables are left out: a SQLite destination builds its own from the messages.
+func sourceTables(sqlDB *sql.DB, driver string) ([]migratedTable, error) {
+	query := `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'
+		AND NOT EXISTS (SELECT 1 FROM sqlite_master v WHERE v.type = 'table' AND v.sql LIKE 'CREATE VIRTUAL TABLE%'
+			AND (sqlite_master.name = v.name OR sqlite_master.name LIKE v.name || '_%'))
+		ORDER BY rowid`
+	if driver != "sqlite3" {
+		query = "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' ORDER BY table_name"
+	}
+	rows, err := sqlDB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	var tables []migratedTable
+	for rows.Next() {
+		var t migratedTable
+		if err := rows.Scan(&t.name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range tables {
+		if tables[i].columns, err = tableColumns(sqlDB, driver, tables[i].name); err != nil {
+			return nil, fmt.Errorf("reading columns of %s: %v", tables[i].name, err)
+		}
+	}
+	return tables, nil
+}
+
+// tableColumns lists a table's columns in the order they were declared
+func tableColumns(sqlDB *sql.DB, driver, table string) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	if driver == "sqlite3" {
+		rows, err = sqlDB.Query("SELECT name FROM pragma_table_info(?) ORDER BY cid", table)
+	} else {
+		rows, err = sqlDB.Query("SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = "+placeholders(driver, 1)+" ORDER BY ordinal_position", table)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, errors.New("table not found")
+	}
+	return columns, nil
+}
+
+// checkDestinationTable makes sure the destination can hold every column of a table,
+// so a copy never drops data silently
+func checkDestinationTable(to *sql.DB, toDriver string, table migratedTable) error {
+	columns, err := tableColumns(to, toDriver, table.name)
+	if err != nil {
+		return fmt.Errorf("the destination has no table %s", table.name)
+	}
+	have := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		have[c] = true
+	}
+	for _, c := range table.columns {
+		if !have[c] {
+			return fmt.Errorf("the destination table %s has no column %s", table.name, c)
+		}
+	}
+	return nil
+}
+
+// copyDatabase copies every table of one database to another, with the tables and
+// columns read from the source's schema. Rows that already exist in the destination
+// are left untouched.
+func copyDatabase(fromSpec, toSpec string) error {
+	from, fromDriver, err := openMigrationSource(fromSpec)
+	if err != nil {
+		return fmt.Errorf("opening source: %v", err)
+	}
+	defer from.Close()
+
+	to, toDriver, err := openMigrationTarget(toSpec)
+	if err != nil {
+		return fmt.Errorf("opening destination: %v", err)
+	}
+	defer to.Close()
+
+	tables, err := sourceTables(from, fromDriver)
+	if err != nil {
+		return fmt.Errorf("reading source schema: %v", err)
+	}
+	// Check everything first so a mismatch doesn't leave a half-copied destination
+	for _, table := range tables {
+		if err := checkDestinationTable(to, toDriver, table); err != nil {
+			return err
+		}
+	}
+	for _, table := range tables {
+		n, err := copyTable(from, to, toDriver, table.name, table.columns)
+		if err != nil {
+			return fmt.Errorf("copying %s: %v", table.name, err)
+		}
+		fmt.Printf("Copied %d rows from %s\n", n, table.name)
+	}
+	return nil
+}
+
+// copyTable copies the given columns of one table inside a single destination transaction
+func copyTable(from, to *sql.DB, toDriver, table string, columns []string) (int, error) {
+	cols := strings.Join(columns, ", ")
+	rows, err := from.Query(fmt.Sprintf("SELECT %s FROM %s", cols, table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	tx, err := to.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING",
+		table, cols, placeholders(toDriver, len(columns))))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	count := 0
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return count, err
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	return count, tx.Commit()
+}
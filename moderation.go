@@ -0,0 +1,180 @@
+// Package main contains moderation actions shared by chat commands and the admin API
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// errUserNotConnected is returned when a moderation target is not online
+var errUserNotConnected = errors.New("user not connected")
+
+// ModerationAction is one entry in the moderation log
+type ModerationAction struct {
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// logModeration records a moderation action
+func logModeration(actor, action, target, reason string) {
+	_, err := db.Exec("INSERT INTO moderation_log (actor, action, target, reason, created_at) VALUES (?, ?, ?, ?, ?)",
+		actor, action, target, reason, time.Now().UTC())
+	if err != nil {
+		logger.Error("logging moderation action", "err", err)
+	}
+}
+
+// getRecentModeration returns the latest moderation actions, newest first
+func getRecentModeration(limit int) ([]ModerationAction, error) {
+	rows, err := db.Query("SELECT actor, action, target, reason, created_at FROM moderation_log ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := []ModerationAction{}
+	for rows.Next() {
+		var a ModerationAction
+		if err := rows.Scan(&a.Actor, &a.Action, &a.Target, &a.Reason, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
+
+// isBanned reports whether an account is banned
+func isBanned(username string) bool {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM bans WHERE username = ?", username).Scan(&count)
+	return err == nil && count > 0
+}
+
+// disconnectUser closes every connection using the given display name
+func disconnectUser(name, notice string) error {
+	mutex.Lock()
+	conns := connsForNameLocked(name)
+	mutex.Unlock()
+	if len(conns) == 0 {
+		return errUserNotConnected
+	}
+
+	for _, conn := range conns {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31m%s\033[0m\n", notice)))
+		// Closing the connection makes handleClient clean up and announce the departure
+		conn.Close()
+	}
+	return nil
+}
+
+// sessionsForAccount returns the display names used by connections logged in as username
+func sessionsForAccount(username string) []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, c := range hub.Clients() {
+		if c.Account == username && !seen[c.Name] {
+			seen[c.Name] = true
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// kickUser disconnects a connected user
+func kickUser(actor, name, reason string) error {
+	if err := disconnectUser(name, "You have been kicked: "+reason); err != nil {
+		return err
+	}
+	logModeration(actor, "kick", name, reason)
+	return nil
+}
+
+// banUser bans an account and disconnects any session using it
+func banUser(actor, username, reason string) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO bans (username, reason, banned_by, created_at) VALUES (?, ?, ?, ?)",
+		username, reason, actor, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	// Kick every connection logged in with the banned account
+	for _, name := range sessionsForAccount(username) {
+		disconnectUser(name, "You have been banned: "+reason)
+	}
+
+	logModeration(actor, "ban", username, reason)
+	return nil
+}
+
+// unbanUser lifts a ban
+func unbanUser(actor, username string) error {
+	_, err := db.Exec("DELETE FROM bans WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+	logModeration(actor, "unban", username, "")
+	return nil
+}
+
+// announce broadcasts a highlighted system message to everyone
+func announce(actor, text string) {
+	bus.Broadcast(systemNotice("1;35", "[Announcement] "+text))
+	logModeration(actor, "announce", "", text)
+}
+
+// handlePriorityCommand handles the admin /priority command
+// Format: /priority <message>
+func handlePriorityCommand(conn net.Conn, message string) {
+	if !isAdmin(conn) {
+		conn.Write([]byte("\033[1;31mOnly admins can send priority messages.\033[0m\n"))
+		return
+	}
+	text := strings.TrimSpace(strings.TrimPrefix(message, "/priority"))
+	if text == "" {
+		conn.Write([]byte("\033[1;31mUsage: /priority <message>\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	actor := hub.Account(conn)
+	mutex.Unlock()
+	announcePriority(actor, text)
+}
+
+// announcePriority sends an urgent operational notice to everyone in every channel.
+// Priority notices skip the recipients' message filters, so they are rung and clearly marked.
+func announcePriority(actor, text string) {
+	bus.Publish(OutgoingMessage{
+		text:     "\a" + systemNotice("1;41;97", "[PRIORITY] "+text),
+		priority: true,
+	})
+	logModeration(actor, "priority", "", text)
+}
+
+// connectedUsers returns the display names of everyone online
+func connectedUsers() []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	names := make([]string, 0, hub.Len())
+	for _, c := range hub.Clients() {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// connectionCount returns the number of logged in connections
+func connectionCount() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return hub.Len()
+}
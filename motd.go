@@ -0,0 +1,216 @@
+// Package main contains the message of the day and pinned announcements shown on login
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// motdText is the message of the day from -motd, shown unless an admin set another
+var motdText string
+
+// PinnedAnnouncement is an announcement shown to everyone who logs in until unpinned
+type PinnedAnnouncement struct {
+	ID        int64
+	Text      string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// loadMOTD reads the message of the day from a file
+func loadMOTD(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	motdText = strings.TrimSpace(string(data))
+	return nil
+}
+
+// getMOTD returns the message of the day: the one an admin set, or else -motd's
+func getMOTD() (string, error) {
+	var text string
+	err := db.QueryRow("SELECT text FROM motd WHERE id = 1").Scan(&text)
+	if err == sql.ErrNoRows {
+		return motdText, nil
+	}
+	return text, err
+}
+
+// setMOTD stores a message of the day; an empty text goes back to -motd's
+func setMOTD(actor, text string) error {
+	var err error
+	if text == "" {
+		_, err = db.Exec("DELETE FROM motd WHERE id = 1")
+	} else {
+		_, err = db.Exec("INSERT OR REPLACE INTO motd (id, text, set_by, updated_at) VALUES (1, ?, ?, ?)", text, actor, time.Now().UTC())
+	}
+	if err == nil {
+		logModeration(actor, "motd", "", text)
+	}
+	return err
+}
+
+// pinAnnouncement stores an announcement to show everyone who logs in later
+func pinAnnouncement(actor, text string) (int64, error) {
+	res, err := db.Exec("INSERT INTO pinned_announcements (text, created_by, created_at) VALUES (?, ?, ?)", text, actor, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// unpinAnnouncement removes a pinned announcement, reporting false if there is none with that ID
+func unpinAnnouncement(actor string, id int64) (bool, error) {
+	res, err := db.Exec("DELETE FROM pinned_announcements WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n > 0 {
+		logModeration(actor, "unpin", strconv.FormatInt(id, 10), "")
+	}
+	return n > 0, err
+}
+
+// getPinnedAnnouncements returns the pinned announcements, oldest first
+func getPinnedAnnouncements() ([]PinnedAnnouncement, error) {
+	rows, err := db.Query("SELECT id, text, created_by, created_at FROM pinned_announcements ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pins []PinnedAnnouncement
+	for rows.Next() {
+		var p PinnedAnnouncement
+		if err := rows.Scan(&p.ID, &p.Text, &p.CreatedBy, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		pins = append(pins, p)
+	}
+	return pins, rows.Err()
+}
+
+// sendMOTD writes the message of the day and the pinned announcements to a
+// connection. With showEmpty, it also says when there are none.
+func sendMOTD(conn net.Conn, showEmpty bool) {
+	motd, err := getMOTD()
+	if err != nil {
+		connLogger(conn).Error("loading message of the day", "err", err)
+	}
+	pins, err := getPinnedAnnouncements()
+	if err != nil {
+		connLogger(conn).Error("loading pinned announcements", "err", err)
+	}
+	if motd == "" && len(pins) == 0 {
+		if showEmpty {
+			conn.Write([]byte("\033[90mThere is no message of the day.\033[0m\n"))
+		}
+		return
+	}
+
+	var out strings.Builder
+	if motd != "" {
+		out.WriteString("\033[1;36mMessage of the day:\033[0m\n")
+		for _, line := range strings.Split(motd, "\n") {
+			out.WriteString("\033[36m" + line + "\033[0m\n")
+		}
+	}
+	for _, p := range pins {
+		out.WriteString(fmt.Sprintf("\033[1;35m[Pinned %d] %s\033[0m\n", p.ID, p.Text))
+	}
+	conn.Write([]byte(out.String()))
+}
+
+// handleMOTDCommand handles the /motd command; setting it is for admins
+// Format: /motd | /motd set <text> | /motd clear
+func handleMOTDCommand(conn net.Conn, message string) {
+	parts := strings.SplitN(message, " ", 3)
+	if len(parts) == 1 {
+		sendMOTD(conn, true)
+		return
+	}
+	if !isAdmin(conn) {
+		conn.Write([]byte("\033[1;31mOnly admins can change the message of the day.\033[0m\n"))
+		return
+	}
+	var text string
+	switch {
+	case parts[1] == "set" && len(parts) == 3 && strings.TrimSpace(parts[2]) != "":
+		text = strings.TrimSpace(parts[2])
+	case parts[1] == "clear" && len(parts) == 2:
+	default:
+		conn.Write([]byte("\033[1;31mUsage: /motd | /motd set <text> | /motd clear\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	actor := hub.Account(conn)
+	mutex.Unlock()
+	if err := setMOTD(actor, text); err != nil {
+		conn.Write([]byte("\033[1;31mError saving the message of the day.\033[0m\n"))
+		return
+	}
+	if text == "" {
+		conn.Write([]byte("\033[1;32mMessage of the day cleared.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte("\033[1;32mMessage of the day set.\033[0m\n"))
+}
+
+// handleAnnounceCommand handles the admin /announce command, which broadcasts a
+// highlighted message and can pin it for users who connect later
+// Format: /announce [-pin] <text> | /announce unpin <id>
+func handleAnnounceCommand(conn net.Conn, message string) {
+	if !isAdmin(conn) {
+		conn.Write([]byte("\033[1;31mOnly admins can send announcements.\033[0m\n"))
+		return
+	}
+	text := strings.TrimSpace(strings.TrimPrefix(message, "/announce"))
+	mutex.Lock()
+	actor := hub.Account(conn)
+	mutex.Unlock()
+
+	if rest, ok := strings.CutPrefix(text, "unpin "); ok {
+		id, err := strconv.ParseInt(strings.TrimSpace(rest), 10, 64)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mUsage: /announce unpin <id>\033[0m\n"))
+			return
+		}
+		removed, err := unpinAnnouncement(actor, id)
+		switch {
+		case err != nil:
+			conn.Write([]byte("\033[1;31mError unpinning announcement.\033[0m\n"))
+		case !removed:
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mNo pinned announcement %d.\033[0m\n", id)))
+		default:
+			conn.Write([]byte(fmt.Sprintf("\033[1;32mUnpinned announcement %d.\033[0m\n", id)))
+		}
+		return
+	}
+
+	pin := false
+	if rest, ok := strings.CutPrefix(text, "-pin"); ok && (rest == "" || rest[0] == ' ') {
+		pin, text = true, strings.TrimSpace(rest)
+	}
+	if text == "" {
+		conn.Write([]byte("\033[1;31mUsage: /announce [-pin] <text> | /announce unpin <id>\033[0m\n"))
+		return
+	}
+
+	announce(actor, text)
+	if pin {
+		id, err := pinAnnouncement(actor, text)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mAnnounced, but the announcement couldn't be pinned.\033[0m\n"))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mAnnouncement pinned as %d; /announce unpin %d removes it.\033[0m\n", id, id)))
+	}
+}
@@ -0,0 +1,116 @@
+// Package main contains /nick, which changes a display name mid-session, and the
+// history of names each account went by
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// nickCooldown is how long a user must wait between name changes, which every
+	// channel they are in is told about
+	nickCooldown = 30 * time.Second
+	// maxAliases is how many earlier names /whois shows
+	maxAliases = 10
+)
+
+// recordNickname remembers a name an account went by
+func recordNickname(account, name string) error {
+	_, err := db.Exec("INSERT INTO nickname_history (username, name, changed_at) VALUES (?, ?, ?)", account, name, clock.Now())
+	return err
+}
+
+// previousNicknames returns the names an account went by before, most recent first
+func previousNicknames(account string) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM nickname_history WHERE username = ? GROUP BY name ORDER BY MAX(changed_at) DESC LIMIT ?", account, maxAliases)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// renameLocked changes the display name of every session using old, and returns
+// the channels those sessions are in. It reports false if another account has
+// claimed name. Callers must hold mutex.
+func renameLocked(old, name string, now time.Time) ([]string, bool) {
+	if !hub.Rename(old, name) {
+		return nil, false
+	}
+	inRoom := make(map[string]bool)
+	for _, c := range hub.ConnsForName(name) {
+		s := sessionForLocked(c)
+		s.nickChanged = now
+		for room := range s.joined {
+			inRoom[room] = true
+		}
+	}
+	for _, t := range transfers {
+		if t.fromName == old {
+			t.fromName = name
+		}
+		if t.toName == old {
+			t.toName = name
+		}
+	}
+	return sortedKeys(inRoom), true
+}
+
+// handleNickCommand handles the /nick command, which changes the display name of
+// the user's sessions that share it
+// Format: /nick <newname>
+func handleNickCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 2 {
+		conn.Write([]byte("\033[1;31mUsage: /nick <newname>\033[0m\n"))
+		return
+	}
+	name, err := validateDisplayName(parts[1])
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mInvalid display name: %s.\033[0m\n", err)))
+		return
+	}
+
+	now := clock.Now()
+	mutex.Lock()
+	old, account := hub.Name(conn), hub.Account(conn)
+	wait := sessionForLocked(conn).nickChanged.Add(nickCooldown).Sub(now)
+	var channels []string
+	renamed := false
+	if name != old && wait <= 0 {
+		channels, renamed = renameLocked(old, name, now)
+	}
+	mutex.Unlock()
+
+	switch {
+	case name == old:
+		conn.Write([]byte(fmt.Sprintf("\033[1;33mYou are already %s.\033[0m\n", name)))
+		return
+	case wait > 0:
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou changed your name recently; try again in %s.\033[0m\n", wait.Round(time.Second))))
+		return
+	case !renamed:
+		conn.Write([]byte("\033[1;31mDisplay name already taken. Please choose another.\033[0m\n"))
+		return
+	}
+
+	connLogger(conn).Info("changed display name", "old", old, "name", name)
+	if err := recordNickname(account, old); err != nil {
+		connLogger(conn).Error("recording nickname", "err", err)
+	}
+	for _, channel := range channels {
+		roomNotice(channel, fmt.Sprintf("%s (@%s) is now known as %s.", old, account, name))
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mYou are now known as %s.\033[0m\n", name)))
+}
@@ -0,0 +1,157 @@
+// Package main contains private messages held for offline accounts until their next login
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultInboxLimit is how many offline messages /inbox shows by default
+const defaultInboxLimit = 20
+
+// OfflineMessage is a private message that arrived while its recipient was offline
+type OfflineMessage struct {
+	ID     string
+	Sender string
+	Body   string
+	Time   time.Time
+}
+
+// offlineRecipient returns the account a private message to typed should be held
+// for, if typed names an existing account. A leading @ is optional.
+func offlineRecipient(typed string) (string, bool) {
+	account := strings.TrimPrefix(typed, "@")
+	if account == "" {
+		return "", false
+	}
+	exists, err := userExists(account)
+	if err != nil {
+		logger.Error("checking recipient", "recipient", account, "err", err)
+		return "", false
+	}
+	return account, exists
+}
+
+// getOfflineMessages returns offline messages to an account, oldest first. With
+// undelivered set only those not yet delivered are returned, otherwise the last limit.
+func getOfflineMessages(account string, undelivered bool, limit int) ([]OfflineMessage, error) {
+	where := "recipient = ? AND offline = 1"
+	if undelivered {
+		where += " AND delivered_at IS NULL"
+	}
+	rows, err := db.Query(`SELECT message_id, sender, body, created_at FROM messages
+		WHERE `+where+` ORDER BY id DESC LIMIT ?`, account, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []OfflineMessage
+	for rows.Next() {
+		var m OfflineMessage
+		if err := rows.Scan(&m.ID, &m.Sender, &m.Body, &m.Time); err != nil {
+			return nil, err
+		}
+		m.Body = openBody(m.Body)
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// markOfflineDelivered records that offline messages have reached their recipient
+func markOfflineDelivered(messages []OfflineMessage) error {
+	now := time.Now().UTC()
+	for _, m := range messages {
+		if _, err := db.Exec("UPDATE messages SET delivered_at = ? WHERE message_id = ?", now, m.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOfflineMessage shows an offline message with the time it was sent, in loc
+func writeOfflineMessage(conn net.Conn, m OfflineMessage, loc *time.Location) {
+	ev := WireEvent{Type: "private", ID: m.ID, From: "@" + m.Sender, Body: m.Body, TS: m.Time.UTC()}
+	writeEvent(conn, ev, fmt.Sprintf("\033[34m[%s] [Private from @%s] %s\033[0m\n", m.Time.In(loc).Format("2006-01-02 15:04:05 MST"), m.Sender, m.Body))
+}
+
+// deliverOfflineMessages sends an account the private messages it missed while offline
+func deliverOfflineMessages(conn net.Conn, account string) {
+	messages, err := getOfflineMessages(account, true, maxHistoryLimit)
+	if err != nil {
+		connLogger(conn).Error("loading offline messages", "err", err)
+		return
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("\033[1;36mYou have %d private message(s) from while you were away:\033[0m\n", len(messages))))
+	loc := userLocation(conn)
+	for _, m := range messages {
+		writeOfflineMessage(conn, m, loc)
+	}
+	conn.Write([]byte("\033[90mUse /inbox to read them again.\033[0m\n"))
+
+	// /reply answers the most recent sender
+	mutex.Lock()
+	hub.SetLastSender(hub.Name(conn), "@"+messages[len(messages)-1].Sender)
+	mutex.Unlock()
+
+	if err := markOfflineDelivered(messages); err != nil {
+		connLogger(conn).Error("marking offline messages delivered", "err", err)
+	}
+}
+
+// handleInboxCommand handles the /inbox command
+// Format: /inbox [limit]
+func handleInboxCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	limit := defaultInboxLimit
+	if len(args) > 1 {
+		conn.Write([]byte("\033[1;31mUsage: /inbox [limit]\033[0m\n"))
+		return
+	}
+	if len(args) == 1 {
+		var err error
+		if limit, err = strconv.Atoi(args[0]); err != nil || limit <= 0 {
+			conn.Write([]byte("\033[1;31mUsage: /inbox [limit]\033[0m\n"))
+			return
+		}
+	}
+
+	mutex.Lock()
+	account := hub.Account(conn)
+	mutex.Unlock()
+	if account == "" {
+		conn.Write([]byte("\033[1;31mOnly registered accounts have an inbox.\033[0m\n"))
+		return
+	}
+
+	messages, err := getOfflineMessages(account, false, clampHistoryLimit(limit))
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError retrieving inbox.\033[0m\n"))
+		return
+	}
+	if len(messages) == 0 {
+		conn.Write([]byte("\033[90mYour inbox is empty.\033[0m\n"))
+		return
+	}
+	loc := userLocation(conn)
+	for _, m := range messages {
+		writeOfflineMessage(conn, m, loc)
+	}
+	if err := markOfflineDelivered(messages); err != nil {
+		connLogger(conn).Error("marking offline messages delivered", "err", err)
+	}
+}
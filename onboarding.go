@@ -0,0 +1,71 @@
+// Package main contains the welcome bot that onboards new users with a private message
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// welcomeBotName is the sender shown on onboarding messages
+const welcomeBotName = "WelcomeBot"
+
+// onboardingScript holds the lines the welcome bot sends; empty disables onboarding
+var onboardingScript []string
+
+// loadOnboardingScript reads the onboarding script. Each non-empty line is sent as
+// one private message; lines starting with "//" are comments. The placeholders
+// {username}, {name} and {channel} are filled in per user.
+func loadOnboardingScript(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	onboardingScript = nil
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "//") {
+			continue
+		}
+		onboardingScript = append(onboardingScript, line)
+	}
+	return nil
+}
+
+// renderOnboardingLine fills in the placeholders of one script line
+func renderOnboardingLine(line, username, name string) string {
+	return strings.NewReplacer(
+		"{username}", username,
+		"{name}", name,
+		"{channel}", defaultChannel,
+	).Replace(line)
+}
+
+// isOnboarded reports whether an account has already received the welcome messages
+func isOnboarded(username string) bool {
+	var onboardedAt *time.Time
+	err := db.QueryRow("SELECT onboarded_at FROM users WHERE username = ?", username).Scan(&onboardedAt)
+	return err != nil || onboardedAt != nil
+}
+
+// markOnboarded records that an account received the welcome messages
+func markOnboarded(username string) error {
+	_, err := db.Exec("UPDATE users SET onboarded_at = ? WHERE username = ?", time.Now().UTC(), username)
+	return err
+}
+
+// sendOnboarding sends the onboarding script to a user on their first login
+func sendOnboarding(conn net.Conn, username, name string) {
+	if len(onboardingScript) == 0 || isOnboarded(username) {
+		return
+	}
+	for _, line := range onboardingScript {
+		text := renderOnboardingLine(line, username, name)
+		conn.Write([]byte(fmt.Sprintf("\033[34m[Private from %s] %s\033[0m\n", welcomeBotName, text)))
+	}
+	if err := markOnboarded(username); err != nil {
+		connLogger(conn).Error("marking user onboarded", "err", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Package main contains per-client outbound queues, so a slow client never holds up others
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// outboundQueue is how many writes may wait for one client (0 writes inline)
+	outboundQueue = 256
+	// outboundOverflow is what happens when a client's queue is full: "drop" discards
+	// the write, "disconnect" closes the client
+	outboundOverflow = "disconnect"
+
+	outboundDropped     = newCounter("outbound_dropped")
+	overflowDisconnects = newCounter("outbound_overflow_disconnects")
+)
+
+// errOutboxClosed is returned for writes to a client that is closed or has failed
+var errOutboxClosed = errors.New("connection closed")
+
+// outboundItem is one queued write, or a liveness probe when probe is set
+type outboundItem struct {
+	data  []byte
+	probe chan error
+}
+
+// outboxConn queues writes for a writer goroutine of its own. Write returns at once,
+// so callers can fan out to every client while holding the global mutex.
+type outboxConn struct {
+	net.Conn
+	queue     chan outboundItem
+	mu        sync.Mutex // guards sends on queue against Close
+	closed    bool
+	failed    atomic.Bool
+	closeOnce sync.Once
+}
+
+// newOutboxConn starts a writer for conn, or returns it unchanged when queuing is off
+func newOutboxConn(conn net.Conn) net.Conn {
+	if outboundQueue <= 0 {
+		return conn
+	}
+	c := &outboxConn{Conn: conn, queue: make(chan outboundItem, outboundQueue)}
+	go c.run()
+	return c
+}
+
+// run writes queued items in order until the connection is closed
+func (c *outboxConn) run() {
+	defer c.Conn.Close()
+	for item := range c.queue {
+		if item.probe != nil {
+			if c.failed.Load() {
+				item.probe <- errOutboxClosed
+			} else {
+				item.probe <- c.probeInner()
+			}
+			continue
+		}
+		if c.failed.Load() {
+			continue
+		}
+		if _, err := c.Conn.Write(item.data); err != nil {
+			c.fail()
+		}
+	}
+}
+
+// probeInner checks the wrapped connection the way the reaper would
+func (c *outboxConn) probeInner() error {
+	if p, ok := c.Conn.(prober); ok {
+		return p.Probe()
+	}
+	_, err := c.Conn.Write(telnetNOP)
+	return err
+}
+
+// fail stops all further writes and closes the client so its reader exits
+func (c *outboxConn) fail() {
+	if c.failed.CompareAndSwap(false, true) {
+		c.Conn.Close()
+	}
+}
+
+// Write queues a copy of p. A full queue drops p or disconnects the client,
+// depending on -outbound-overflow.
+func (c *outboxConn) Write(p []byte) (int, error) {
+	return len(p), c.enqueue(outboundItem{data: append([]byte(nil), p...)})
+}
+
+// enqueue adds item to the queue without blocking
+func (c *outboxConn) enqueue(item outboundItem) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.failed.Load() {
+		return errOutboxClosed
+	}
+	select {
+	case c.queue <- item:
+		return nil
+	default:
+	}
+	if outboundOverflow == "drop" {
+		outboundDropped.Add(1)
+		return nil
+	}
+	overflowDisconnects.Add(1)
+	c.fail()
+	return errOutboxClosed
+}
+
+// Probe checks the client behind the queue, failing if the writer can't get to the
+// probe within probeTimeout
+func (c *outboxConn) Probe() error {
+	result := make(chan error, 1)
+	if err := c.enqueue(outboundItem{probe: result}); err != nil {
+		return err
+	}
+	timer := time.NewTimer(probeTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return errors.New("probe timed out")
+	}
+}
+
+// Close lets the writer send what is already queued, then closes the connection.
+// The client's reader is woken at once so its cleanup isn't delayed.
+func (c *outboxConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Conn.SetReadDeadline(time.Now())
+		c.mu.Lock()
+		c.closed = true
+		close(c.queue)
+		c.mu.Unlock()
+	})
+	return nil
+}
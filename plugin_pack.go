@@ -0,0 +1,320 @@
+// Package main contains the bundled plugin pack: /time, /calc, and /weather, which
+// shows how a plugin calls an outside API with caching and rate limiting
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// weatherCacheTTL is how long a city's weather is reused before it is fetched again
+	weatherCacheTTL = 10 * time.Minute
+	// weatherCacheSize caps the cities kept in the weather cache
+	weatherCacheSize = 256
+)
+
+var (
+	// weatherAPIKey is the OpenWeatherMap API key /weather uses
+	weatherAPIKey string
+	// weatherURL is the current weather endpoint of the OpenWeatherMap API
+	weatherURL = "https://api.openweathermap.org/data/2.5/weather"
+	// weatherRate is how many requests per minute /weather may make to the API, so
+	// a busy server stays within the key's quota (0 for unlimited)
+	weatherRate = 30
+
+	weatherMutex = &sync.Mutex{}
+	// weatherCache holds recent answers by lower-case city, including unknown cities
+	weatherCache = make(map[string]weatherEntry)
+	// weatherCalls counts the requests made to the API this minute
+	weatherCalls = &rateWindow{}
+
+	weatherRequests  = newCounter("weather_requests")
+	weatherCacheHits = newCounter("weather_cache_hits")
+)
+
+// weatherEntry is a cached /weather answer
+type weatherEntry struct {
+	text    string
+	fetched time.Time
+}
+
+func init() {
+	registerPlugin(&Plugin{Name: "time", Usage: "/time [zone]", Help: "Show the time in a time zone such as Asia/Tokyo, or in yours", Run: runTimePlugin})
+	registerPlugin(&Plugin{Name: "calc", Usage: "/calc <expression>", Help: "Work out an expression, e.g. /calc (2 + 3) * 4 ^ 2", Run: runCalcPlugin})
+	registerPlugin(&Plugin{Name: "weather", Usage: "/weather <city>", Help: "Show the current weather in a city", Run: runWeatherPlugin})
+}
+
+// runTimePlugin handles /time [zone]
+func runTimePlugin(conn net.Conn, args []string) {
+	if len(args) > 1 {
+		conn.Write([]byte("\033[1;31mUsage: /time [zone]\033[0m\n"))
+		return
+	}
+	loc := userLocation(conn)
+	if len(args) == 1 {
+		var err error
+		if loc, err = time.LoadLocation(args[0]); err != nil {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mUnknown time zone %q; use a name such as Europe/Paris.\033[0m\n", args[0])))
+			return
+		}
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;36mIt is %s in %s.\033[0m\n", clock.Now().In(loc).Format("Mon 2006-01-02 15:04 MST"), loc)))
+}
+
+// runCalcPlugin handles /calc <expression>
+func runCalcPlugin(conn net.Conn, args []string) {
+	if len(args) == 0 {
+		conn.Write([]byte("\033[1;31mUsage: /calc <expression>\033[0m\n"))
+		return
+	}
+	expr := strings.Join(args, " ")
+	result, err := evaluate(expr)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mCan't work out %s: %v.\033[0m\n", expr, err)))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;36m%s = %s\033[0m\n", expr, strconv.FormatFloat(result, 'g', 12, 64))))
+}
+
+// calcParser evaluates arithmetic with + - * / % ^ and parentheses by recursive
+// descent; ^ binds tightest and to the right
+type calcParser struct {
+	input []rune
+	pos   int
+}
+
+// evaluate works out an arithmetic expression
+func evaluate(expr string) (float64, error) {
+	p := &calcParser{input: []rune(expr)}
+	v, err := p.sum()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q", string(p.input[p.pos]))
+	}
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, fmt.Errorf("the result is not a number")
+	}
+	return v, nil
+}
+
+func (p *calcParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// next consumes op if it comes next
+func (p *calcParser) next(op rune) bool {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *calcParser) sum() (float64, error) {
+	v, err := p.product()
+	for err == nil {
+		var w float64
+		switch {
+		case p.next('+'):
+			w, err = p.product()
+			v += w
+		case p.next('-'):
+			w, err = p.product()
+			v -= w
+		default:
+			return v, nil
+		}
+	}
+	return 0, err
+}
+
+func (p *calcParser) product() (float64, error) {
+	v, err := p.unary()
+	for err == nil {
+		var w float64
+		switch {
+		case p.next('*'):
+			w, err = p.unary()
+			v *= w
+		case p.next('/'), p.next('%'):
+			op := p.input[p.pos-1]
+			if w, err = p.unary(); err == nil && w == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			if op == '/' {
+				v /= w
+			} else {
+				v = math.Mod(v, w)
+			}
+		default:
+			return v, nil
+		}
+	}
+	return 0, err
+}
+
+func (p *calcParser) unary() (float64, error) {
+	if p.next('-') {
+		v, err := p.unary()
+		return -v, err
+	}
+	if p.next('+') {
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *calcParser) power() (float64, error) {
+	base, err := p.operand()
+	if err != nil || !p.next('^') {
+		return base, err
+	}
+	exp, err := p.unary()
+	return math.Pow(base, exp), err
+}
+
+func (p *calcParser) operand() (float64, error) {
+	if p.next('(') {
+		v, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+		if !p.next(')') {
+			return 0, fmt.Errorf("missing )")
+		}
+		return v, nil
+	}
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos == len(p.input) {
+			return 0, fmt.Errorf("unexpected end")
+		}
+		return 0, fmt.Errorf("unexpected %q", string(p.input[p.pos]))
+	}
+	v, err := strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", string(p.input[start:p.pos]))
+	}
+	return v, nil
+}
+
+// openWeather is the part of an OpenWeatherMap current weather response shown
+type openWeather struct {
+	Name string `json:"name"`
+	Sys  struct {
+		Country string `json:"country"`
+	} `json:"sys"`
+	Weather []struct {
+		Description string `json:"description"`
+	} `json:"weather"`
+	Main struct {
+		Temp     float64 `json:"temp"`
+		Humidity int     `json:"humidity"`
+	} `json:"main"`
+	Wind struct {
+		Speed float64 `json:"speed"`
+	} `json:"wind"`
+}
+
+// fetchWeather asks the API for a city's current weather and describes it
+func fetchWeather(city string) (string, error) {
+	query := url.Values{"q": {city}, "appid": {weatherAPIKey}, "units": {"metric"}}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(weatherURL + "?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Sprintf("No weather found for %s.", city), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("weather service returned %s", resp.Status)
+	}
+	var w openWeather
+	if err := json.NewDecoder(resp.Body).Decode(&w); err != nil {
+		return "", err
+	}
+	conditions := "unknown conditions"
+	if len(w.Weather) > 0 {
+		conditions = w.Weather[0].Description
+	}
+	return fmt.Sprintf("%s, %s: %s, %.1f°C, humidity %d%%, wind %.1f m/s", w.Name, w.Sys.Country, conditions, w.Main.Temp, w.Main.Humidity, w.Wind.Speed), nil
+}
+
+// cityWeather returns a city's weather from the cache, or from the API if the
+// cached answer is stale and the API rate allows
+func cityWeather(city string, now time.Time) (string, error) {
+	key := strings.ToLower(city)
+	weatherMutex.Lock()
+	if entry, ok := weatherCache[key]; ok && now.Sub(entry.fetched) < weatherCacheTTL {
+		weatherMutex.Unlock()
+		weatherCacheHits.Add(1)
+		return entry.text, nil
+	}
+	if weatherRate > 0 {
+		if allowed, _ := weatherCalls.allow(now, weatherRate); !allowed {
+			weatherMutex.Unlock()
+			return "", fmt.Errorf("the weather service is busy")
+		}
+	}
+	weatherMutex.Unlock()
+
+	weatherRequests.Add(1)
+	text, err := fetchWeather(city)
+	if err != nil {
+		return "", err
+	}
+
+	weatherMutex.Lock()
+	defer weatherMutex.Unlock()
+	if len(weatherCache) >= weatherCacheSize {
+		for k, entry := range weatherCache {
+			if now.Sub(entry.fetched) >= weatherCacheTTL {
+				delete(weatherCache, k)
+			}
+		}
+	}
+	if len(weatherCache) < weatherCacheSize {
+		weatherCache[key] = weatherEntry{text: text, fetched: now}
+	}
+	return text, nil
+}
+
+// runWeatherPlugin handles /weather <city>
+func runWeatherPlugin(conn net.Conn, args []string) {
+	if len(args) == 0 {
+		conn.Write([]byte("\033[1;31mUsage: /weather <city>\033[0m\n"))
+		return
+	}
+	if weatherAPIKey == "" {
+		conn.Write([]byte("\033[1;31m/weather needs the server to be started with -weather-api-key.\033[0m\n"))
+		return
+	}
+	text, err := cityWeather(strings.Join(args, " "), clock.Now())
+	if err != nil {
+		connLogger(conn).Warn("fetching weather", "err", err)
+		conn.Write([]byte("\033[1;31mThe weather service is unavailable; try again in a minute.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte("\033[1;36m" + text + "\033[0m\n"))
+}
@@ -0,0 +1,137 @@
+// Package main contains optional command plugins, which are compiled in but only
+// answer once enabled with -plugins
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugin is an optional command such as /calc
+type Plugin struct {
+	// Name is the command without its slash
+	Name string
+	// Usage and Help are shown by /help while the plugin is enabled
+	Usage string
+	Help  string
+	// Run answers the command; args are the words after it
+	Run func(conn net.Conn, args []string)
+}
+
+var (
+	// pluginList names the plugins to enable, separated by commas
+	pluginList string
+	// pluginRate is how many plugin commands one account may run per minute (0 for unlimited)
+	pluginRate = 10
+
+	// plugins are the plugins that exist, by name; enabledPlugins the ones turned on
+	plugins        = make(map[string]*Plugin)
+	enabledPlugins = make(map[string]*Plugin)
+
+	pluginMutex = &sync.Mutex{}
+	// pluginCalls counts each account's plugin commands in the current minute
+	pluginCalls = make(map[string]*rateWindow)
+
+	pluginCallsRun     = newCounter("plugin_calls")
+	pluginCallsLimited = newCounter("plugin_calls_limited")
+)
+
+// registerPlugin makes a plugin available to -plugins
+func registerPlugin(p *Plugin) {
+	plugins[p.Name] = p
+}
+
+// enablePlugins turns on the plugins named in a comma-separated list
+func enablePlugins(list string) error {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		p, ok := plugins[name]
+		if !ok {
+			return fmt.Errorf("unknown plugin %q", name)
+		}
+		enabledPlugins[name] = p
+	}
+	return nil
+}
+
+// rateWindow counts calls in fixed windows of one minute
+type rateWindow struct {
+	start time.Time
+	calls int
+}
+
+// allow counts a call at now if fewer than limit were made this minute, otherwise
+// it returns how long until the next window
+func (w *rateWindow) allow(now time.Time, limit int) (bool, time.Duration) {
+	if now.Sub(w.start) >= time.Minute {
+		w.start, w.calls = now, 0
+	}
+	if w.calls >= limit {
+		return false, w.start.Add(time.Minute).Sub(now)
+	}
+	w.calls++
+	return true, 0
+}
+
+// allowPluginCall reports whether account may run another plugin command now, and
+// if not, how long it has to wait
+func allowPluginCall(account string, now time.Time) (bool, time.Duration) {
+	if pluginRate <= 0 {
+		return true, 0
+	}
+	pluginMutex.Lock()
+	defer pluginMutex.Unlock()
+	w, ok := pluginCalls[account]
+	if !ok {
+		w = &rateWindow{}
+		pluginCalls[account] = w
+	}
+	return w.allow(now, pluginRate)
+}
+
+// pluginHelp lists the enabled plugins for /help
+func pluginHelp() string {
+	names := make([]string, 0, len(enabledPlugins))
+	for name := range enabledPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var help strings.Builder
+	for _, name := range names {
+		p := enabledPlugins[name]
+		help.WriteString(fmt.Sprintf("\033[1;33m%s\033[0m\n    %s\n\n", p.Usage, p.Help))
+	}
+	return help.String()
+}
+
+// handlePluginCommand runs an enabled plugin's command, reporting false if message
+// isn't one
+func handlePluginCommand(conn net.Conn, message string) bool {
+	fields := strings.Fields(message)
+	if len(fields) == 0 {
+		return false
+	}
+	p, ok := enabledPlugins[strings.TrimPrefix(fields[0], "/")]
+	if !ok || !strings.HasPrefix(fields[0], "/") {
+		return false
+	}
+
+	mutex.Lock()
+	account := hub.Account(conn)
+	mutex.Unlock()
+	if allowed, wait := allowPluginCall(account, clock.Now()); !allowed {
+		pluginCallsLimited.Add(1)
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mToo many commands; try /%s again in %s.\033[0m\n", p.Name, wait.Round(time.Second))))
+		return true
+	}
+	pluginCallsRun.Add(1)
+	p.Run(conn, fields[1:])
+	return true
+}
@@ -0,0 +1,74 @@
+// Package main contains the proof-of-work challenge used to throttle unauthenticated connections
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+	"strings"
+)
+
+// powDifficulty is the number of leading zero bits a solution must have.
+// Zero disables the challenge entirely.
+var powDifficulty = 0
+
+// newPowChallenge returns a random hex string for the client to solve
+func newPowChallenge() (string, error) {
+	b := make([]byte, 8)
+	if err := readRandom(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// leadingZeroBits counts the leading zero bits of a hash
+func leadingZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		if b == 0 {
+			n += 8
+			continue
+		}
+		n += bits.LeadingZeros8(b)
+		break
+	}
+	return n
+}
+
+// verifyPow checks that sha256(challenge + ":" + nonce) has at least difficulty leading zero bits
+func verifyPow(challenge, nonce string, difficulty int) bool {
+	if nonce == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+	return leadingZeroBits(sum[:]) >= difficulty
+}
+
+// requireProofOfWork sends a challenge to a new connection and waits for a valid answer.
+// It returns false if the client failed or timed out, in which case the caller should drop it.
+func requireProofOfWork(conn net.Conn, reader *bufio.Reader) bool {
+	challenge, err := newPowChallenge()
+	if err != nil {
+		connLogger(conn).Error("generating challenge", "err", err)
+		return false
+	}
+
+	conn.Write([]byte("\033[1;33mThe server is under heavy load and requires a proof-of-work.\033[0m\n"))
+	conn.Write([]byte(fmt.Sprintf("\033[1;33mFind a nonce so that sha256(\"%s:<nonce>\") starts with %d zero bits.\033[0m\n", challenge, powDifficulty)))
+	conn.Write([]byte("\033[1;33mReply with: /pow <nonce>\033[0m\n"))
+
+	// The caller's auth deadline also bounds how long we wait for an answer
+	message, err := readLimitedLine(reader, maxPreAuthLine)
+	if err != nil {
+		return false
+	}
+	parts := strings.Fields(message)
+	if len(parts) != 2 || parts[0] != "/pow" || !verifyPow(challenge, parts[1], powDifficulty) {
+		conn.Write([]byte("\033[1;31mInvalid proof-of-work.\033[0m\n"))
+		return false
+	}
+	return true
+}
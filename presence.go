@@ -0,0 +1,140 @@
+// Package main contains coalescing of join, leave and status events into summaries
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	presenceJoined = "joined"
+	presenceLeft   = "left"
+	presenceStatus = "status"
+)
+
+// maxPresenceNames caps how many names a summary lists per kind of event
+const maxPresenceNames = 5
+
+var (
+	// presenceWindow is how long presence events are collected before being sent as one line (0 sends each at once)
+	presenceWindow = 2 * time.Second
+
+	// pendingPresence holds events not yet sent, keyed by scope ("" for the whole server, else a channel)
+	pendingPresence = make(map[string][]PresenceEvent)
+	presenceMutex   = &sync.Mutex{}
+)
+
+// PresenceEvent is one user joining, leaving, or changing status
+type PresenceEvent struct {
+	Kind   string
+	Name   string
+	Status string
+}
+
+// presenceConsumer turns joins, leaves and status changes into presence events
+func presenceConsumer(ev Event) {
+	switch ev := ev.(type) {
+	case UserConnected:
+		// An account's other devices come and go without a notice
+		if ev.FirstSession {
+			publishPresence("", PresenceEvent{Kind: presenceJoined, Name: ev.User.Name})
+		}
+	case UserDisconnected:
+		if ev.LastSession {
+			publishPresence("", PresenceEvent{Kind: presenceLeft, Name: ev.User.Name})
+		}
+	case UserJoined:
+		publishPresence(ev.Channel, PresenceEvent{Kind: presenceJoined, Name: ev.User.Name})
+	case UserLeft:
+		publishPresence(ev.Channel, PresenceEvent{Kind: presenceLeft, Name: ev.User.Name})
+	case StatusChanged:
+		publishPresence("", PresenceEvent{Kind: presenceStatus, Name: ev.User.Name, Status: ev.Status})
+	}
+}
+
+// publishPresence queues a presence event for scope, sending it once the window closes
+// together with any other events for the same scope
+func publishPresence(scope string, event PresenceEvent) {
+	if presenceWindow <= 0 {
+		sendPresence(bus, scope, []PresenceEvent{event})
+		return
+	}
+
+	presenceMutex.Lock()
+	defer presenceMutex.Unlock()
+	if len(pendingPresence[scope]) == 0 {
+		clock.AfterFunc(presenceWindow, func() { flushPresence(scope) })
+	}
+	pendingPresence[scope] = append(pendingPresence[scope], event)
+}
+
+// flushPresence sends the queued events of a scope. It runs on a timer, so it reads
+// bus under presenceMutex, which setBus holds while replacing it.
+func flushPresence(scope string) {
+	presenceMutex.Lock()
+	events := pendingPresence[scope]
+	delete(pendingPresence, scope)
+	target := bus
+	presenceMutex.Unlock()
+
+	if len(events) > 0 {
+		sendPresence(target, scope, events)
+	}
+}
+
+// sendPresence delivers presence events to everyone in scope as a single line
+func sendPresence(target MessageBus, scope string, events []PresenceEvent) {
+	text := formatPresence(scope, events)
+	target.Publish(OutgoingMessage{channel: scope, text: systemNotice("33", text), presence: true})
+}
+
+// formatPresence describes presence events; a single event reads as before,
+// several are summarized as e.g. "+3 joined (a, b, c), 1 left (d)"
+func formatPresence(scope string, events []PresenceEvent) string {
+	where := "the chat"
+	if scope != "" {
+		where = scope
+	}
+
+	if len(events) == 1 {
+		e := events[0]
+		switch e.Kind {
+		case presenceJoined:
+			return fmt.Sprintf("%s has joined %s", e.Name, where)
+		case presenceLeft:
+			return fmt.Sprintf("%s has left %s", e.Name, where)
+		default:
+			return fmt.Sprintf("%s is now: %s", e.Name, e.Status)
+		}
+	}
+
+	names := make(map[string][]string)
+	for _, e := range events {
+		names[e.Kind] = append(names[e.Kind], e.Name)
+	}
+	var parts []string
+	if n := names[presenceJoined]; len(n) > 0 {
+		parts = append(parts, fmt.Sprintf("+%d joined (%s)", len(n), listPresenceNames(n)))
+	}
+	if n := names[presenceLeft]; len(n) > 0 {
+		parts = append(parts, fmt.Sprintf("%d left (%s)", len(n), listPresenceNames(n)))
+	}
+	if n := names[presenceStatus]; len(n) > 0 {
+		parts = append(parts, fmt.Sprintf("%d changed status (%s)", len(n), listPresenceNames(n)))
+	}
+	text := strings.Join(parts, ", ")
+	if scope != "" {
+		text = scope + ": " + text
+	}
+	return text
+}
+
+// listPresenceNames joins names, shortening long lists
+func listPresenceNames(names []string) string {
+	if len(names) <= maxPresenceNames {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(names[:maxPresenceNames], ", "), len(names)-maxPresenceNames)
+}
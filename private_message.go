@@ -5,13 +5,15 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 )
 
 // PrivateMessage represents a private message between two users
 type PrivateMessage struct {
-	sender    string // Username of the sender
-	recipient string // Username of the recipient
-	message   string // The actual message content
+	sender    string   // Username of the sender
+	recipient string   // Username of the recipient
+	message   string   // The actual message content
+	conn      net.Conn // Connection it was sent from, which gets any errors
 }
 
 // privateMsg channel for sending private messages between goroutines
@@ -32,33 +34,147 @@ func handlePrivateMessage(conn net.Conn, message string) {
 	// Extract recipient and message content
 	recipient := parts[1]
 	content := parts[2]
+	if !checkMessageLength(conn, content) || !checkFlood(conn) {
+		return
+	}
+	clearAway(conn)
 
 	// Create and send the private message
-	privateMsg <- PrivateMessage{
-		sender:    clients[conn],
+	bus.SendPrivate(PrivateMessage{
+		sender:    hub.Name(conn),
 		recipient: recipient,
 		message:   content,
+		conn:      conn,
+	})
+}
+
+// formatIdentity shows a user's display name together with their account,
+// so a display name can't be used to impersonate someone else's account
+func formatIdentity(name, account string) string {
+	if account == "" || account == name {
+		return name
 	}
+	return fmt.Sprintf("%s (@%s)", name, account)
+}
+
+// connsForAccountLocked returns every connection logged in with an account,
+// matched case-insensitively. The caller must hold mutex.
+func connsForAccountLocked(account string) []net.Conn {
+	var conns []net.Conn
+	for _, c := range hub.Clients() {
+		if strings.EqualFold(c.Account, account) {
+			conns = append(conns, c.Conn)
+		}
+	}
+	return conns
+}
+
+// storePrivateMessage saves a private message for each recipient account. It returns
+// false if the sender's storage quota is full, in which case the message isn't delivered.
+func storePrivateMessage(senderConn net.Conn, sender string, recipients map[string]bool, body string, offline bool) bool {
+	for recipient := range recipients {
+		err := savePrivateMessage(sender, recipient, body, offline)
+		if err == errQuotaExceeded {
+			senderConn.Write([]byte("\033[1;31mYour storage quota is full. Message not sent.\033[0m\n"))
+			return false
+		} else if err != nil {
+			// Keep the conversation going even if persistence fails
+			connLogger(senderConn).Error("saving private message", "err", err)
+		}
+	}
+	return true
 }
 
 // processPrivateMessages handles the private message channel
-// It receives messages and delivers them to the intended recipient
+// It receives messages and delivers them to the intended recipient.
+// Recipients are addressed by display name, or by account as @username.
 func processPrivateMessages() {
 	for msg := range privateMsg {
 		mutex.Lock()
-		// Look up the recipient's connection
-		conn, ok := nameToConn[msg.recipient]
 		// Get the sender's connection for error messages
-		senderConn := nameToConn[msg.sender]
+		senderConn := msg.conn
+		if senderConn == nil {
+			senderConn, _ = hub.ByName(msg.sender)
+		}
+		senderAccount := hub.Account(senderConn)
+
+		var recipients []net.Conn
+		var candidates []string
+		var ambiguous bool
+		if strings.HasPrefix(msg.recipient, "@") {
+			// Address the account directly, reaching every session it has
+			recipients = connsForAccountLocked(strings.TrimPrefix(msg.recipient, "@"))
+		} else {
+			// Resolve the display name forgivingly: case-insensitive, then by prefix
+			var recipient string
+			recipient, candidates, ambiguous = resolveRecipientLocked(msg.recipient)
+			if conn, ok := hub.ByName(recipient); ok {
+				// The message reaches every device the recipient's account is logged in on
+				recipients = accountSessionsLocked(conn)
+			}
+		}
+
+		// Record the last private sender for each recipient, by account when known
+		replyTo := msg.sender
+		if senderAccount != "" {
+			replyTo = "@" + senderAccount
+		}
+		// Each recipient account gets one stored copy, however many sessions it has
+		recipientAccounts := make(map[string]bool)
+		recipientNames := make(map[net.Conn]string)
+		for _, conn := range recipients {
+			recipientNames[conn] = hub.Name(conn)
+			hub.SetLastSender(hub.Name(conn), replyTo)
+			if a := hub.Account(conn); a != "" {
+				recipientAccounts[a] = true
+			}
+		}
 		mutex.Unlock()
 
-		if ok {
-			// Record the last private sender for the recipient
-			mutex.Lock()
-			lastPrivateSender[msg.recipient] = msg.sender
-			mutex.Unlock()
+		if len(recipients) > 0 && senderAccount != "" {
+			if !storePrivateMessage(senderConn, senderAccount, recipientAccounts, msg.message, false) {
+				continue
+			}
+		}
+
+		if len(recipients) > 0 {
 			// Send the message to the recipient
-			conn.Write([]byte(fmt.Sprintf("\033[34m[Private from %s] %s\033[0m\n", msg.sender, msg.message)))
+			from := formatIdentity(msg.sender, senderAccount)
+			now := time.Now()
+			held := false
+			for _, conn := range recipients {
+				if holdPrivateMessage(conn, senderAccount, from) {
+					held = true
+					continue
+				}
+				session := sessionFor(conn)
+				body := shortcodesFor(session, msg.message)
+				ev := WireEvent{Type: "private", From: from, To: recipientNames[conn], Body: body, TS: now.UTC()}
+				writeEvent(conn, ev, fmt.Sprintf("%s\033[34m[Private from %s] %s\033[0m\n", timestamp(session, now), from, body))
+			}
+			recordMessageSent(senderAccount)
+			if held {
+				senderConn.Write([]byte(fmt.Sprintf("\033[90m%s has quiet hours now and will see your message later.\033[0m\n", msg.recipient)))
+			}
+			for account := range recipientAccounts {
+				sendAwayReply(senderConn, replyTo, account)
+			}
+		} else if ambiguous {
+			// Several users match what was typed
+			senderConn.Write([]byte(fmt.Sprintf("Ambiguous recipient %s, did you mean: %s?\n", msg.recipient, strings.Join(candidates, ", "))))
+		} else if account, ok := offlineRecipient(msg.recipient); ok && routePrivateMessage(msg.sender, senderAccount, account, msg.message) {
+			// The account is logged in on another instance, which delivers the message
+			recordMessageSent(senderAccount)
+			sendAwayReply(senderConn, replyTo, account)
+		} else if ok && senderAccount != "" {
+			// The account exists but isn't logged in; hold the message for its next login
+			if storePrivateMessage(senderConn, senderAccount, map[string]bool{account: true}, msg.message, true) {
+				senderConn.Write([]byte(fmt.Sprintf("\033[90m%s is offline. They will get your message when they next log in.\033[0m\n", account)))
+				sendAwayReply(senderConn, replyTo, account)
+			}
+		} else if len(candidates) > 0 {
+			// Nobody matches, but some names are close
+			senderConn.Write([]byte(fmt.Sprintf("User %s not found. Did you mean: %s?\n", msg.recipient, strings.Join(candidates, ", "))))
 		} else {
 			// Notify sender if recipient is not found
 			senderConn.Write([]byte(fmt.Sprintf("User %s not found\n", msg.recipient)))
@@ -0,0 +1,142 @@
+// Package main contains the JSON wire protocol that programmatic clients can switch to
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// WireEvent is one line of output in the JSON protocol
+type WireEvent struct {
+	// Type is "message", "private", "notice", "priority", "announcement", "typing", "click", "reaction",
+	// "unreaction", "system", or "error"
+	Type string    `json:"type"`
+	ID   string    `json:"id,omitempty"`
+	From string    `json:"from,omitempty"`
+	To   string    `json:"to,omitempty"`
+	Room string    `json:"room,omitempty"`
+	Tag  string    `json:"tag,omitempty"`
+	Bot  bool      `json:"bot,omitempty"`
+	Body string    `json:"body"`
+	TS   time.Time `json:"ts"`
+	// Buttons are the buttons of an interactive message
+	Buttons []Button `json:"buttons,omitempty"`
+	// Callback is the ID of the clicked button in a click event
+	Callback string `json:"callback,omitempty"`
+	// Rooms are all the channels a cross-posted announcement went to
+	Rooms []string `json:"rooms,omitempty"`
+}
+
+// protoConn lets a client switch its output between colored text and newline-delimited
+// JSON. In JSON mode, plain writes become "system" or "error" events. In accessible
+// mode, text is rendered for screen readers.
+type protoConn struct {
+	net.Conn
+	json       atomic.Bool
+	accessible atomic.Bool
+	// plain removes colors from the client's output
+	plain atomic.Bool
+}
+
+// Write sends p as is, or as one JSON event in JSON mode
+func (c *protoConn) Write(p []byte) (int, error) {
+	if !c.json.Load() {
+		if c.accessible.Load() {
+			if text := accessibleText(string(p)); text != "" {
+				if _, err := c.Conn.Write([]byte(text)); err != nil {
+					return 0, err
+				}
+			}
+			return len(p), nil
+		}
+		if c.plain.Load() {
+			if _, err := c.Conn.Write([]byte(stripANSI(string(p)))); err != nil {
+				return 0, err
+			}
+			return len(p), nil
+		}
+		return c.Conn.Write(p)
+	}
+	text := string(p)
+	ev := WireEvent{Type: "system", TS: time.Now().UTC()}
+	if strings.HasPrefix(text, "\033[1;31m") {
+		ev.Type = "error"
+	}
+	ev.Body = strings.TrimRight(stripANSI(text), "\n")
+	if strings.TrimSpace(ev.Body) == "" {
+		return len(p), nil
+	}
+	if err := c.writeEvent(ev); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeEvent sends ev as one line of JSON
+func (c *protoConn) writeEvent(ev WireEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = c.Conn.Write(append(data, '\n'))
+	return err
+}
+
+// Probe passes the reaper's liveness check through to the wrapped connection
+func (c *protoConn) Probe() error {
+	if p, ok := c.Conn.(prober); ok {
+		return p.Probe()
+	}
+	_, err := c.Conn.Write(telnetNOP)
+	return err
+}
+
+// writeEvent sends ev to a JSON client, ev in words to an accessible client, or text
+// to everyone else
+func writeEvent(conn net.Conn, ev WireEvent, text string) {
+	if pc, ok := conn.(*protoConn); ok && pc.json.Load() {
+		pc.writeEvent(ev)
+		return
+	}
+	if pc, ok := conn.(*protoConn); ok && pc.accessible.Load() {
+		if line, ok := verbalEvent(ev, text); ok {
+			pc.Conn.Write([]byte(line))
+		}
+		return
+	}
+	conn.Write([]byte(text))
+}
+
+// event describes a channel message for JSON clients
+func (m OutgoingMessage) event() WireEvent {
+	ev := WireEvent{Type: "notice", ID: m.id, From: m.from, Room: m.channel, Tag: m.tag, Bot: m.bot, Body: m.body, TS: m.sent.UTC(), Buttons: m.buttons}
+	switch {
+	case m.priority:
+		ev.Type = "priority"
+	case len(m.alsoTo) > 0:
+		ev.Type = "announcement"
+		ev.Rooms = append([]string{m.channel}, m.alsoTo...)
+	case m.from != "":
+		ev.Type = "message"
+	}
+	if ev.Body == "" {
+		ev.Body = strings.TrimRight(stripANSI(m.text), "\n")
+	}
+	return ev
+}
+
+// handleProtoCommand handles the /proto command, which may be sent before logging in
+// Format: /proto json|text
+func handleProtoCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	pc, ok := conn.(*protoConn)
+	if len(args) != 1 || (args[0] != "json" && args[0] != "text") || !ok {
+		conn.Write([]byte("\033[1;31mUsage: /proto json|text\033[0m\n"))
+		return
+	}
+	pc.json.Store(args[0] == "json")
+	conn.Write([]byte("\033[1;32mProtocol set to " + args[0] + ".\033[0m\n"))
+}
@@ -0,0 +1,136 @@
+// Package main contains the admin API endpoints for provisioning accounts from external systems
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// provisionRequest is the body of POST /api/users
+type provisionRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	SSOSubject string `json:"sso_subject"`
+}
+
+// registerProvisioningRoutes adds the account provisioning routes to mux
+func registerProvisioningRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/users", requireAdminToken(serveProvisionUser))
+	mux.HandleFunc("POST /api/users/{username}/disable", requireAdminToken(serveSetUserDisabled(true)))
+	mux.HandleFunc("POST /api/users/{username}/enable", requireAdminToken(serveSetUserDisabled(false)))
+	mux.HandleFunc("POST /api/sso/{subject}/disable", requireAdminToken(serveSetUserDisabled(true)))
+	mux.HandleFunc("POST /api/sso/{subject}/enable", requireAdminToken(serveSetUserDisabled(false)))
+}
+
+// randomPassword generates an unguessable password for SSO-only accounts
+func randomPassword() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// serveProvisionUser creates an account with an initial password and/or an SSO mapping
+func serveProvisionUser(w http.ResponseWriter, r *http.Request) {
+	var req provisionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	if err := validateUsername(req.Username); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Password == "" && req.SSOSubject == "" {
+		writeJSONError(w, http.StatusBadRequest, "password or sso_subject is required")
+		return
+	}
+	if len(req.Password) > maxPasswordLength {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("password must be %d characters or less", maxPasswordLength))
+		return
+	}
+
+	exists, err := userExists(req.Username)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error checking username")
+		return
+	}
+	if exists {
+		writeJSONError(w, http.StatusConflict, "username already exists")
+		return
+	}
+	if req.SSOSubject != "" {
+		if _, err := userForSSOSubject(req.SSOSubject); err == nil {
+			writeJSONError(w, http.StatusConflict, "sso_subject is already mapped to an account")
+			return
+		} else if err != sql.ErrNoRows {
+			writeJSONError(w, http.StatusInternalServerError, "error checking SSO mapping")
+			return
+		}
+	}
+
+	// SSO-only accounts get a random password nobody knows
+	password := req.Password
+	if password == "" {
+		if password, err = randomPassword(); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "error generating password")
+			return
+		}
+	}
+	if err := saveUser(req.Username, password); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error creating user")
+		return
+	}
+	if req.SSOSubject != "" {
+		if err := setUserSSOSubject(req.Username, req.SSOSubject); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "error saving SSO mapping")
+			return
+		}
+	}
+
+	logModeration(adminAPIActor, "provision", req.Username, "")
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "created", "username": req.Username})
+}
+
+// serveSetUserDisabled returns a handler that disables or re-enables an account, named
+// either by username or by the SSO identity it was provisioned with
+func serveSetUserDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+		if subject := r.PathValue("subject"); subject != "" {
+			var err error
+			if username, err = userForSSOSubject(subject); err == sql.ErrNoRows {
+				writeJSONError(w, http.StatusNotFound, "no account for sso_subject")
+				return
+			} else if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "error looking up SSO mapping")
+				return
+			}
+		}
+		if err := setUserDisabled(username, disabled); err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, "user not found")
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "error updating user")
+			return
+		}
+
+		action := "enable"
+		if disabled {
+			action = "disable"
+			// Disabled accounts lose any session they still have
+			for _, name := range sessionsForAccount(username) {
+				disconnectUser(name, "Your account has been disabled.")
+			}
+		}
+
+		logModeration(adminAPIActor, action, username, "")
+		writeJSON(w, http.StatusOK, map[string]string{"status": fmt.Sprintf("%sd", action)})
+	}
+}
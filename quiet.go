@@ -0,0 +1,227 @@
+// Package main contains per-user quiet hours, during which only priority messages and
+// private messages from friends are delivered live
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// parseQuietHours parses a range such as 22:00-07:00 into minutes after midnight.
+// The range may wrap past midnight.
+func parseQuietHours(text string) (start, end int, err error) {
+	from, to, ok := strings.Cut(text, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected a range like 22:00-07:00")
+	}
+	startTime, err := time.Parse("15:04", from)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time %q", from)
+	}
+	endTime, err := time.Parse("15:04", to)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time %q", to)
+	}
+	start, end = startTime.Hour()*60+startTime.Minute(), endTime.Hour()*60+endTime.Minute()
+	if start == end {
+		return 0, 0, fmt.Errorf("quiet hours must start and end at different times")
+	}
+	return start, end, nil
+}
+
+// formatQuietHours shows quiet hours as they are typed
+func formatQuietHours(start, end int) string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", start/60, start%60, end/60, end%60)
+}
+
+// inQuietHours reports whether now falls in the session's quiet hours, in its time zone
+func (s *Session) inQuietHours(now time.Time) bool {
+	if !s.quietHours {
+		return false
+	}
+	t := now.In(sessionLocation(s))
+	minute := t.Hour()*60 + t.Minute()
+	if s.quietStart < s.quietEnd {
+		return minute >= s.quietStart && minute < s.quietEnd
+	}
+	return minute >= s.quietStart || minute < s.quietEnd
+}
+
+// holdChannelMessageLocked reports whether a channel message is held back from a
+// session in its quiet hours, counting it unless it is a presence notice. Callers
+// must hold mutex.
+func holdChannelMessageLocked(s *Session, msg OutgoingMessage) bool {
+	if !s.inQuietHours(clock.Now()) {
+		return false
+	}
+	if !msg.presence {
+		if s.heldMessages == nil {
+			s.heldMessages = make(map[string]int)
+		}
+		s.heldMessages[msg.channel]++
+	}
+	return true
+}
+
+// isFriend reports whether friend is on account's friend list
+func isFriend(account, friend string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM friends WHERE username = ? AND friend = ?", account, friend).Scan(&n)
+	return n > 0, err
+}
+
+// holdPrivateMessage reports whether a private message from senderAccount, shown as
+// from, is held back from conn because its user is in quiet hours and the sender
+// isn't a friend. Held messages are counted; they are stored like any other.
+func holdPrivateMessage(conn net.Conn, senderAccount, from string) bool {
+	mutex.Lock()
+	s, ok := sessions[conn]
+	quiet := ok && s.inQuietHours(clock.Now())
+	account := hub.Account(conn)
+	mutex.Unlock()
+	if !quiet {
+		return false
+	}
+	if senderAccount != "" {
+		friend, err := isFriend(account, senderAccount)
+		if err != nil {
+			// Deliver rather than hold a message nobody is told about
+			connLogger(conn).Error("checking friends for quiet hours", "err", err)
+			return false
+		}
+		if friend {
+			return false
+		}
+	}
+
+	mutex.Lock()
+	if s.heldPrivate == nil {
+		s.heldPrivate = make(map[string]int)
+	}
+	s.heldPrivate[from]++
+	mutex.Unlock()
+	return true
+}
+
+// heldSummaryLocked describes the messages held back from a session and resets the
+// counts. It is empty if nothing was held. Callers must hold mutex.
+func heldSummaryLocked(s *Session) string {
+	var parts []string
+	channels := make([]string, 0, len(s.heldMessages))
+	for channel := range s.heldMessages {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	for _, channel := range channels {
+		parts = append(parts, fmt.Sprintf("%d in %s", s.heldMessages[channel], channel))
+	}
+	senders := make([]string, 0, len(s.heldPrivate))
+	for sender := range s.heldPrivate {
+		senders = append(senders, sender)
+	}
+	sort.Strings(senders)
+	for _, sender := range senders {
+		parts = append(parts, fmt.Sprintf("%d private from %s", s.heldPrivate[sender], sender))
+	}
+	s.heldMessages, s.heldPrivate = nil, nil
+	if len(parts) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\033[1;36mWhile your quiet hours were on: %s. Use /history or /history private <user> to read them.\033[0m\n", strings.Join(parts, ", "))
+}
+
+// updateQuietLocked tells a user when their quiet hours start, and when they end,
+// what was held back in the meantime. Callers must hold mutex.
+func updateQuietLocked(conn net.Conn, s *Session, now time.Time) {
+	on := s.inQuietHours(now)
+	if on == s.quiet {
+		return
+	}
+	s.quiet = on
+	if on {
+		conn.Write([]byte(fmt.Sprintf("\033[1;33mQuiet hours are on until %02d:%02d: only priority messages and private messages from friends are shown.\033[0m\n", s.quietEnd/60, s.quietEnd%60)))
+		return
+	}
+	conn.Write([]byte("\033[1;33mQuiet hours are over.\033[0m\n"))
+	if summary := heldSummaryLocked(s); summary != "" {
+		conn.Write([]byte(summary))
+	}
+}
+
+// checkQuietHours starts and ends the quiet hours of every logged in user
+func checkQuietHours(now time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for conn, s := range sessions {
+		updateQuietLocked(conn, s, now)
+	}
+}
+
+// startQuietHours checks every minute whose quiet hours start or end
+func startQuietHours() {
+	clock.Every(time.Minute, checkQuietHours)
+}
+
+// handleQuietCommand handles the /quiet command, which shows or sets the account's
+// quiet hours in the user's time zone
+// Format: /quiet [HH:MM-HH:MM|off]
+func handleQuietCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) == 0 {
+		mutex.Lock()
+		s := sessionForLocked(conn)
+		text := "\033[1;33mYou have no quiet hours. Set them with /quiet 22:00-07:00.\033[0m\n"
+		if s.quietHours {
+			state := "off"
+			if s.inQuietHours(clock.Now()) {
+				state = "on"
+			}
+			text = fmt.Sprintf("\033[1;33mYour quiet hours are %s (%s), and are %s now.\033[0m\n", formatQuietHours(s.quietStart, s.quietEnd), sessionLocation(s), state)
+		}
+		mutex.Unlock()
+		conn.Write([]byte(text))
+		return
+	}
+	if len(args) != 1 {
+		conn.Write([]byte("\033[1;31mUsage: /quiet [HH:MM-HH:MM|off]\033[0m\n"))
+		return
+	}
+
+	on := args[0] != "off"
+	var start, end int
+	var stored interface{}
+	if on {
+		var err error
+		if start, end, err = parseQuietHours(args[0]); err != nil {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mInvalid quiet hours: %v.\033[0m\n", err)))
+			return
+		}
+		stored = formatQuietHours(start, end)
+	}
+
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+	if _, err := db.Exec("UPDATE users SET quiet_hours = ? WHERE username = ?", stored, username); err != nil {
+		conn.Write([]byte("\033[1;31mError saving quiet hours. Please try again.\033[0m\n"))
+		return
+	}
+
+	if on {
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mQuiet hours set to %s. Priority messages and private messages from friends still reach you; other messages are counted for later.\033[0m\n", stored)))
+	} else {
+		conn.Write([]byte("\033[1;32mQuiet hours turned off.\033[0m\n"))
+	}
+	// Every session of the account follows the new quiet hours at once
+	mutex.Lock()
+	for _, c := range hub.ConnsForAccount(username) {
+		if s, ok := sessions[c]; ok {
+			s.quietHours, s.quietStart, s.quietEnd = on, start, end
+			updateQuietLocked(c, s, clock.Now())
+		}
+	}
+	mutex.Unlock()
+}
@@ -0,0 +1,213 @@
+// Package main contains per-user storage accounting and quota enforcement
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// storageMessages is the kind of storage charged for stored messages. File
+// transfers go straight between users and aren't stored, so messages are the only
+// kind charged.
+const storageMessages = "messages"
+
+// storageQuota is the maximum number of bytes a user may store across all kinds.
+// Zero means unlimited.
+var storageQuota int64 = 0
+
+// errQuotaExceeded is returned when storing data would put a user over quota
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// StorageUsage is one user's total stored bytes
+type StorageUsage struct {
+	username string
+	bytes    int64
+}
+
+// getStorageUsage returns the bytes stored by a user, broken down by kind
+func getStorageUsage(username string) (map[string]int64, error) {
+	rows, err := db.Query("SELECT kind, bytes FROM storage_usage WHERE username = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[string]int64)
+	for rows.Next() {
+		var kind string
+		var bytes int64
+		if err := rows.Scan(&kind, &bytes); err != nil {
+			return nil, err
+		}
+		usage[kind] = bytes
+	}
+	return usage, rows.Err()
+}
+
+// getTotalStorage returns the total bytes stored by a user
+func getTotalStorage(username string) (int64, error) {
+	var total int64
+	err := db.QueryRow("SELECT COALESCE(SUM(bytes), 0) FROM storage_usage WHERE username = ?", username).Scan(&total)
+	return total, err
+}
+
+// reserveStorage charges size bytes of the given kind to a user.
+// It returns errQuotaExceeded without charging anything if the user would go over quota.
+// The check and the charge are one statement, so concurrent senders can't both
+// squeeze under the quota.
+func reserveStorage(username, kind string, size int64) error {
+	if storageQuota <= 0 {
+		return chargeStorage(username, kind, size)
+	}
+
+	res, err := db.Exec(`INSERT INTO storage_usage (username, kind, bytes)
+		SELECT ?, ?, ? WHERE (SELECT COALESCE(SUM(bytes), 0) FROM storage_usage WHERE username = ?) + ? <= ?
+		ON CONFLICT(username, kind) DO UPDATE SET bytes = bytes + excluded.bytes`,
+		username, kind, size, username, size, storageQuota)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// chargeStorage charges size bytes of the given kind to a user without checking the quota
+func chargeStorage(username, kind string, size int64) error {
+	_, err := db.Exec(`INSERT INTO storage_usage (username, kind, bytes) VALUES (?, ?, ?)
+		ON CONFLICT(username, kind) DO UPDATE SET bytes = bytes + excluded.bytes`, username, kind, size)
+	return err
+}
+
+// releaseStorage gives back size bytes of the given kind to a user
+func releaseStorage(username, kind string, size int64) error {
+	_, err := db.Exec("UPDATE storage_usage SET bytes = MAX(bytes - ?, 0) WHERE username = ? AND kind = ?", size, username, kind)
+	return err
+}
+
+// releaseMessagesTx gives back the bytes of the messages matched by where to their
+// senders, in the transaction that deletes them. Bodies are counted in plain text,
+// as they were when reserved.
+func releaseMessagesTx(tx *sql.Tx, where string, args ...interface{}) error {
+	rows, err := tx.Query("SELECT sender, body FROM messages WHERE "+where, args...)
+	if err != nil {
+		return err
+	}
+	freed := make(map[string]int64)
+	for rows.Next() {
+		var sender, body string
+		if err := rows.Scan(&sender, &body); err != nil {
+			rows.Close()
+			return err
+		}
+		freed[sender] += int64(len(openBody(body)))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for sender, size := range freed {
+		if _, err := tx.Exec("UPDATE storage_usage SET bytes = MAX(bytes - ?, 0) WHERE username = ? AND kind = ?", size, sender, storageMessages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTopStorageConsumers returns the users storing the most data, largest first
+func getTopStorageConsumers(limit int) ([]StorageUsage, error) {
+	rows, err := db.Query(`SELECT username, SUM(bytes) AS total FROM storage_usage
+		GROUP BY username ORDER BY total DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var top []StorageUsage
+	for rows.Next() {
+		var u StorageUsage
+		if err := rows.Scan(&u.username, &u.bytes); err != nil {
+			return nil, err
+		}
+		top = append(top, u)
+	}
+	return top, rows.Err()
+}
+
+// formatBytes renders a byte count for humans
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// handleQuotaCommand handles the /quota command
+// Format: /quota shows your own usage, /quota top lists the biggest consumers (admin only)
+func handleQuotaCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) == 2 && parts[1] == "top" {
+		handleQuotaTopCommand(conn)
+		return
+	}
+	if len(parts) != 1 {
+		conn.Write([]byte("\033[1;31mUsage: /quota [top]\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	usage, err := getStorageUsage(username)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError retrieving storage usage.\033[0m\n"))
+		return
+	}
+
+	var total int64
+	for kind, bytes := range usage {
+		total += bytes
+		conn.Write([]byte(fmt.Sprintf("\033[90m%-9s %s\033[0m\n", kind, formatBytes(bytes))))
+	}
+	if storageQuota > 0 {
+		conn.Write([]byte(fmt.Sprintf("\033[1;36mUsing %s of %s\033[0m\n", formatBytes(total), formatBytes(storageQuota))))
+	} else {
+		conn.Write([]byte(fmt.Sprintf("\033[1;36mUsing %s (no quota)\033[0m\n", formatBytes(total))))
+	}
+}
+
+// handleQuotaTopCommand lists the top storage consumers for admins
+func handleQuotaTopCommand(conn net.Conn) {
+	if !isAdmin(conn) {
+		conn.Write([]byte("\033[1;31mOnly admins can view the storage report.\033[0m\n"))
+		return
+	}
+
+	top, err := getTopStorageConsumers(10)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError retrieving storage report.\033[0m\n"))
+		return
+	}
+	if len(top) == 0 {
+		conn.Write([]byte("\033[90mNo stored data yet.\033[0m\n"))
+		return
+	}
+
+	conn.Write([]byte("\033[1;36mTop storage consumers:\033[0m\n"))
+	for i, u := range top {
+		conn.Write([]byte(fmt.Sprintf("\033[90m%2d. %-10s %s\033[0m\n", i+1, u.username, formatBytes(u.bytes))))
+	}
+}
@@ -0,0 +1,466 @@
+// Package main contains emoji reactions, emoji-only channels and reaction roles
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// maxReactionLength caps the bytes of one reaction; a flag or a family emoji fits
+const maxReactionLength = 32
+
+// validSelfRole matches roles that reaction roles can grant, such as events or beta-testers
+var validSelfRole = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var (
+	// emojiOnlyChannels are the channels where only emoji may be posted
+	emojiOnlyChannels = make(map[string]bool)
+	emojiOnlyMutex    = &sync.RWMutex{}
+)
+
+// isEmojiOnlyText reports whether text, once shortcodes are expanded, is made of
+// emoji and spaces and has at least one emoji
+func isEmojiOnlyText(text string) bool {
+	found := false
+	for _, r := range expandShortcodes(text) {
+		switch {
+		case unicode.IsSpace(r):
+		// Joiners, variation selectors, skin tones, keycaps and flag tags modify an emoji
+		case r == 0x200d || (r >= 0xfe00 && r <= 0xfe0f) || (r >= 0x1f3fb && r <= 0x1f3ff) ||
+			r == 0x20e3 || (r >= 0xe0020 && r <= 0xe007f):
+		case unicode.Is(unicode.So, r):
+			found = true
+		default:
+			return false
+		}
+	}
+	return found
+}
+
+// normalizeReaction turns a typed reaction into the emoji stored for it, reporting
+// false if it isn't a single short emoji
+func normalizeReaction(reaction string) (string, bool) {
+	emoji := expandShortcodes(reaction)
+	if len(emoji) > maxReactionLength || strings.ContainsFunc(emoji, unicode.IsSpace) || !isEmojiOnlyText(emoji) {
+		return "", false
+	}
+	return emoji, true
+}
+
+// loadEmojiOnlyChannels reads the emoji-only channels into memory
+func loadEmojiOnlyChannels() error {
+	rows, err := db.Query("SELECT channel FROM emoji_only_channels")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	emojiOnlyMutex.Lock()
+	defer emojiOnlyMutex.Unlock()
+	for rows.Next() {
+		var channel string
+		if err := rows.Scan(&channel); err != nil {
+			return err
+		}
+		emojiOnlyChannels[channel] = true
+	}
+	return rows.Err()
+}
+
+// isEmojiOnlyChannel reports whether only emoji may be posted in a channel
+func isEmojiOnlyChannel(channel string) bool {
+	emojiOnlyMutex.RLock()
+	defer emojiOnlyMutex.RUnlock()
+	return emojiOnlyChannels[channel]
+}
+
+// setEmojiOnly turns a channel's emoji-only mode on or off
+func setEmojiOnly(channel, actor string, on bool) error {
+	emojiOnlyMutex.Lock()
+	defer emojiOnlyMutex.Unlock()
+	var err error
+	if on {
+		_, err = db.Exec("INSERT OR REPLACE INTO emoji_only_channels (channel, set_by, created_at) VALUES (?, ?, ?)", channel, actor, time.Now().UTC())
+	} else {
+		_, err = db.Exec("DELETE FROM emoji_only_channels WHERE channel = ?", channel)
+	}
+	if err != nil {
+		return err
+	}
+	if on {
+		emojiOnlyChannels[channel] = true
+	} else {
+		delete(emojiOnlyChannels, channel)
+	}
+	return nil
+}
+
+// checkEmojiOnly tells the user and returns false if body can't be posted in channel
+// because the channel is emoji-only
+func checkEmojiOnly(conn net.Conn, channel, body string) bool {
+	if !isEmojiOnlyChannel(channel) || isEmojiOnlyText(body) {
+		return true
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;31m%s is emoji-only: post emoji or /react to a message.\033[0m\n", channel)))
+	return false
+}
+
+// handleEmojiOnlyCommand handles the /emojionly command, which the channel's owner
+// uses to allow only emoji in it. The channel defaults to the current one.
+// Format: /emojionly on|off [#channel]
+func handleEmojiOnlyCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) < 2 || len(parts) > 3 || (parts[1] != "on" && parts[1] != "off") {
+		conn.Write([]byte("\033[1;31mUsage: /emojionly on|off [#channel]\033[0m\n"))
+		return
+	}
+	channel := currentRoom(conn)
+	if len(parts) == 3 {
+		channel = strings.ToLower(parts[2])
+	}
+	if !validRoomName.MatchString(channel) {
+		conn.Write([]byte("\033[1;31mUsage: /emojionly on|off [#channel]\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+	if !canManageChannel(username, channel) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mOnly the owner of %s can change its mode.\033[0m\n", channel)))
+		return
+	}
+	on := parts[1] == "on"
+	if err := setEmojiOnly(channel, username, on); err != nil {
+		conn.Write([]byte("\033[1;31mError saving channel mode. Please try again.\033[0m\n"))
+		return
+	}
+	connLogger(conn).Info("changed emoji-only mode", "channel", channel, "on", on)
+	if on {
+		conn.Write([]byte(fmt.Sprintf("\033[1;32m%s is now emoji-only.\033[0m\n", channel)))
+	} else {
+		conn.Write([]byte(fmt.Sprintf("\033[1;32m%s allows text again.\033[0m\n", channel)))
+	}
+}
+
+// addReaction stores a reaction, reporting false if the user had already reacted
+// to the message with that emoji
+func addReaction(messageID, username, emoji string) (bool, error) {
+	res, err := db.Exec("INSERT OR IGNORE INTO reactions (message_id, username, emoji, created_at) VALUES (?, ?, ?, ?)",
+		messageID, username, emoji, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// removeReaction deletes a reaction, reporting false if there was none
+func removeReaction(messageID, username, emoji string) (bool, error) {
+	res, err := db.Exec("DELETE FROM reactions WHERE message_id = ? AND username = ? AND emoji = ?", messageID, username, emoji)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// reactionCounts returns how many accounts reacted to a message with each emoji,
+// most popular first
+func reactionCounts(messageID string) ([]string, error) {
+	rows, err := db.Query("SELECT emoji, COUNT(*) FROM reactions WHERE message_id = ? GROUP BY emoji ORDER BY COUNT(*) DESC, MIN(created_at)", messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []string
+	for rows.Next() {
+		var emoji string
+		var n int
+		if err := rows.Scan(&emoji, &n); err != nil {
+			return nil, err
+		}
+		counts = append(counts, fmt.Sprintf("%s %d", emoji, n))
+	}
+	return counts, rows.Err()
+}
+
+// getReactionRole returns the role granted for reacting to a message with an emoji,
+// "" if there is none
+func getReactionRole(messageID, emoji string) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM reaction_roles WHERE message_id = ? AND emoji = ?", messageID, emoji).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// grantReactionRole gives an account a role for reacting to a message. It reports
+// false if the account already had the role.
+func grantReactionRole(username, role, messageID string) (bool, error) {
+	res, err := db.Exec("INSERT OR IGNORE INTO user_roles (username, role, message_id, granted_at) VALUES (?, ?, ?, ?)",
+		username, role, messageID, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// revokeReactionRole takes back a role that reacting to a message granted. Roles
+// granted through another message are kept.
+func revokeReactionRole(username, role, messageID string) (bool, error) {
+	res, err := db.Exec("DELETE FROM user_roles WHERE username = ? AND role = ? AND message_id = ?", username, role, messageID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// hasUserRole reports whether an account was granted a role through a reaction
+func hasUserRole(username, role string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM user_roles WHERE username = ? AND role = ?", username, role).Scan(&n)
+	return n > 0, err
+}
+
+// handleReactCommand handles the /react and /unreact commands. Reacting to a message
+// that has a reaction role grants the role; removing the reaction takes it back.
+// Format: /react <message-id> <emoji> | /unreact <message-id> <emoji>
+func handleReactCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	remove := parts[0] == "/unreact"
+	if len(parts) != 3 {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mUsage: %s <message-id> <emoji>\033[0m\n", parts[0])))
+		return
+	}
+	id := parts[1]
+	emoji, ok := normalizeReaction(parts[2])
+	if !ok {
+		conn.Write([]byte("\033[1;31mReact with a single emoji, like 👍 or :+1:.\033[0m\n"))
+		return
+	}
+
+	m, found, err := getChannelMessage(id)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError looking up the message. Please try again.\033[0m\n"))
+		return
+	}
+	mutex.Lock()
+	username := hub.Account(conn)
+	inChannel := found && sessionForLocked(conn).joined[m.channel]
+	mutex.Unlock()
+	if !inChannel {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mNo message %s in your channels.\033[0m\n", id)))
+		return
+	}
+	if !checkFlood(conn) {
+		return
+	}
+
+	var changed bool
+	if remove {
+		changed, err = removeReaction(id, username, emoji)
+	} else {
+		changed, err = addReaction(id, username, emoji)
+	}
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError saving reaction. Please try again.\033[0m\n"))
+		return
+	}
+	if !changed {
+		if remove {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mYou haven't reacted %s to message %s.\033[0m\n", emoji, id)))
+		} else {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mYou already reacted %s to message %s.\033[0m\n", emoji, id)))
+		}
+		return
+	}
+	bus.Emit(ReactionChanged{User: identityForConn(conn), Channel: m.channel, MessageID: id, Emoji: emoji, Removed: remove})
+
+	role, err := getReactionRole(id, emoji)
+	if err != nil {
+		connLogger(conn).Error("looking up reaction role", "message", id, "err", err)
+		return
+	}
+	if role == "" {
+		return
+	}
+	if remove {
+		if revoked, err := revokeReactionRole(username, role, id); err != nil {
+			conn.Write([]byte("\033[1;31mError updating your roles. Please try again.\033[0m\n"))
+		} else if revoked {
+			connLogger(conn).Info("reaction role revoked", "role", role, "message", id)
+			conn.Write([]byte(fmt.Sprintf("\033[1;32mYou no longer have the %s role.\033[0m\n", role)))
+		}
+		return
+	}
+	if granted, err := grantReactionRole(username, role, id); err != nil {
+		conn.Write([]byte("\033[1;31mError updating your roles. Please try again.\033[0m\n"))
+	} else if granted {
+		connLogger(conn).Info("reaction role granted", "role", role, "message", id)
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mYou now have the %s role.\033[0m\n", role)))
+	}
+}
+
+// handleReactionsCommand handles the /reactions command, showing the reactions to a message
+// Format: /reactions <message-id>
+func handleReactionsCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 2 {
+		conn.Write([]byte("\033[1;31mUsage: /reactions <message-id>\033[0m\n"))
+		return
+	}
+	id := parts[1]
+	m, found, err := getChannelMessage(id)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError looking up the message. Please try again.\033[0m\n"))
+		return
+	}
+	mutex.Lock()
+	inChannel := found && sessionForLocked(conn).joined[m.channel]
+	mutex.Unlock()
+	if !inChannel {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mNo message %s in your channels.\033[0m\n", id)))
+		return
+	}
+
+	counts, err := reactionCounts(id)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError loading reactions. Please try again.\033[0m\n"))
+		return
+	}
+	if len(counts) == 0 {
+		conn.Write([]byte(fmt.Sprintf("\033[90mNo reactions to message %s.\033[0m\n", id)))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;36mReactions to %s:\033[0m %s\n", id, strings.Join(counts, "  "))))
+}
+
+// handleReactionRoleCommand handles the /reactionrole command, with which a channel's
+// owner makes reacting to one of its messages grant a role
+// Format: /reactionrole add <message-id> <emoji> <role> | /reactionrole remove <message-id> <emoji> |
+// /reactionrole list [#channel]
+func handleReactionRoleCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	usage := "\033[1;31mUsage: /reactionrole add <message-id> <emoji> <role> | remove <message-id> <emoji> | list [#channel]\033[0m\n"
+	if len(parts) < 2 {
+		conn.Write([]byte(usage))
+		return
+	}
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	if parts[1] == "list" && len(parts) <= 3 {
+		channel := currentRoom(conn)
+		if len(parts) == 3 {
+			channel = strings.ToLower(parts[2])
+		}
+		rows, err := db.Query("SELECT message_id, emoji, role FROM reaction_roles WHERE channel = ? ORDER BY created_at", channel)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError loading reaction roles.\033[0m\n"))
+			return
+		}
+		defer rows.Close()
+		var lines []string
+		for rows.Next() {
+			var id, emoji, role string
+			if err := rows.Scan(&id, &emoji, &role); err != nil {
+				conn.Write([]byte("\033[1;31mError loading reaction roles.\033[0m\n"))
+				return
+			}
+			lines = append(lines, fmt.Sprintf("  /react %s %s  grants %s\n", id, emoji, role))
+		}
+		if len(lines) == 0 {
+			conn.Write([]byte(fmt.Sprintf("\033[90m%s has no reaction roles.\033[0m\n", channel)))
+			return
+		}
+		sort.Strings(lines)
+		conn.Write([]byte(fmt.Sprintf("\033[1;36mReaction roles in %s:\033[0m\n%s", channel, strings.Join(lines, ""))))
+		return
+	}
+
+	if (parts[1] != "add" || len(parts) != 5) && (parts[1] != "remove" || len(parts) != 4) {
+		conn.Write([]byte(usage))
+		return
+	}
+	id := parts[2]
+	emoji, ok := normalizeReaction(parts[3])
+	if !ok {
+		conn.Write([]byte("\033[1;31mReaction roles use a single emoji, like 👍 or :+1:.\033[0m\n"))
+		return
+	}
+	m, found, err := getChannelMessage(id)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError looking up the message. Please try again.\033[0m\n"))
+		return
+	}
+	if !found {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mNo message %s.\033[0m\n", id)))
+		return
+	}
+	if !canManageChannel(username, m.channel) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mOnly the owner of %s can set up reaction roles.\033[0m\n", m.channel)))
+		return
+	}
+
+	if parts[1] == "remove" {
+		res, err := db.Exec("DELETE FROM reaction_roles WHERE message_id = ? AND emoji = ?", id, emoji)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError removing reaction role.\033[0m\n"))
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mReacting %s to %s grants no role.\033[0m\n", emoji, id)))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mReacting %s to %s no longer grants a role. Roles already granted are kept.\033[0m\n", emoji, id)))
+		return
+	}
+
+	role := strings.ToLower(parts[4])
+	// Account roles carry privileges, so they can't be handed out by reaction
+	if !validSelfRole.MatchString(role) || isValidRole(role) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mRoles use lowercase letters, digits, '-' and '_' (max 32), and can't be %s, %s or %s.\033[0m\n", roleUser, roleAdmin, roleBot)))
+		return
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO reaction_roles (message_id, emoji, role, channel, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, emoji, role, m.channel, username, time.Now().UTC())
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError saving reaction role.\033[0m\n"))
+		return
+	}
+	connLogger(conn).Info("added reaction role", "channel", m.channel, "message", id, "role", role)
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mReacting %s to %s now grants the %s role.\033[0m\n", emoji, id, role)))
+}
+
+// reactionsConsumer shows reactions to the members of the message's channel
+func reactionsConsumer(ev Event) {
+	reaction, ok := ev.(ReactionChanged)
+	if !ok {
+		return
+	}
+	ws := WireEvent{Type: "reaction", ID: reaction.MessageID, From: reaction.User.Name, Room: reaction.Channel, Body: reaction.Emoji, TS: clock.Now().UTC()}
+	text := fmt.Sprintf("\033[90m%s reacted %s to %s\033[0m\n", reaction.User.Name, reaction.Emoji, reaction.MessageID)
+	if reaction.Removed {
+		ws.Type = "unreaction"
+		text = fmt.Sprintf("\033[90m%s removed their %s from %s\033[0m\n", reaction.User.Name, reaction.Emoji, reaction.MessageID)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for member := range rooms[reaction.Channel] {
+		writeEvent(member, ws, text)
+	}
+}
@@ -0,0 +1,90 @@
+// Package main contains the reaper that evicts connections that died without the TCP stack noticing
+package main
+
+import (
+	"net"
+	"time"
+)
+
+var (
+	// reapInterval is how often connections are health-checked (0 disables the reaper)
+	reapInterval = 30 * time.Second
+	// probeTimeout is how long a probe write may block before the connection counts as dead
+	probeTimeout = 5 * time.Second
+	// idleEvict evicts logged in connections that have sent nothing for this long (0 disables)
+	idleEvict time.Duration
+
+	// lastSeen records when each logged in connection last sent a line; guarded by mutex
+	lastSeen = make(map[net.Conn]time.Time)
+)
+
+// telnetNOP is IAC NOP: terminals ignore it, but writing it fails on a connection whose peer is gone
+var telnetNOP = []byte{255, 241}
+
+// touchConn records activity from a connection
+func touchConn(conn net.Conn) {
+	mutex.Lock()
+	lastSeen[conn] = clock.Now()
+	mutex.Unlock()
+}
+
+// prober is implemented by connections with their own way of checking liveness
+type prober interface {
+	Probe() error
+}
+
+// probeConn writes a no-op to conn and reports whether the write went through in time
+func probeConn(conn net.Conn) bool {
+	conn.SetWriteDeadline(time.Now().Add(probeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	if p, ok := conn.(prober); ok {
+		return p.Probe() == nil
+	}
+	_, err := conn.Write(telnetNOP)
+	return err == nil
+}
+
+// reapConnections health-checks every connection once, closing the dead and the idle.
+// Closing makes the connection's reader fail, so its usual cleanup runs.
+func reapConnections(now time.Time) int {
+	mutex.Lock()
+	conns := make([]net.Conn, 0, hub.Len()+len(spectators))
+	var idle []net.Conn
+	for _, c := range hub.Clients() {
+		conn := c.Conn
+		if idleEvict > 0 && now.Sub(lastSeen[conn]) > idleEvict {
+			idle = append(idle, conn)
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	for conn := range spectators {
+		conns = append(conns, conn)
+	}
+	pruneFloodStatesLocked(now)
+	mutex.Unlock()
+
+	reaped := 0
+	for _, conn := range idle {
+		conn.Write([]byte("\033[1;31mDisconnected for inactivity.\033[0m\n"))
+		conn.Close()
+		reaped++
+	}
+	for _, conn := range conns {
+		if !probeConn(conn) {
+			conn.Close()
+			reaped++
+		}
+	}
+	return reaped
+}
+
+// startReaper periodically evicts dead connections so clients reflects reality
+func startReaper() {
+	clock.Every(reapInterval, func(now time.Time) {
+		if n := reapConnections(now); n > 0 {
+			logger.Info("reaped dead or idle connections", "count", n)
+		}
+	})
+}
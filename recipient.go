@@ -0,0 +1,73 @@
+// Package main contains forgiving resolution of private message recipients
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxSuggestionDistance is how many edits a name may be off and still be suggested
+const maxSuggestionDistance = 2
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// resolveName matches a name typed by a user against the available names.
+// An exact match wins, then a unique case-insensitive match, then a unique
+// case-insensitive prefix. If nothing matches uniquely, it returns "" and the
+// candidates worth suggesting: every match when ambiguous, otherwise close misspellings.
+func resolveName(typed string, names []string) (match string, candidates []string, ambiguous bool) {
+	lower := strings.ToLower(typed)
+	var exactFold, prefix, close []string
+	for _, name := range names {
+		if name == typed {
+			return name, nil, false
+		}
+		l := strings.ToLower(name)
+		switch {
+		case l == lower:
+			exactFold = append(exactFold, name)
+		case strings.HasPrefix(l, lower):
+			prefix = append(prefix, name)
+		case levenshtein(l, lower) <= maxSuggestionDistance:
+			close = append(close, name)
+		}
+	}
+
+	for _, group := range [][]string{exactFold, prefix} {
+		if len(group) == 1 {
+			return group[0], nil, false
+		}
+		if len(group) > 1 {
+			sort.Strings(group)
+			return "", group, true
+		}
+	}
+	sort.Strings(close)
+	return "", close, false
+}
+
+// resolveRecipientLocked resolves a private message recipient among online users.
+// The caller must hold mutex.
+func resolveRecipientLocked(typed string) (string, []string, bool) {
+	return resolveName(typed, hub.Names())
+}
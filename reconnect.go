@@ -0,0 +1,247 @@
+// Package main contains reconnect tokens, which let a client that lands on another
+// instance catch up on the channel messages it missed
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reconnectTokenTTL is how long an unused reconnect token stays valid
+const reconnectTokenTTL = 24 * time.Hour
+
+// newReconnectToken returns a random token
+func newReconnectToken() (string, error) {
+	b := make([]byte, 16)
+	if err := readRandom(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// channelPosition returns the sequence number of the latest message in a channel
+func channelPosition(channel string) (int64, error) {
+	sequenceMutex.Lock()
+	defer sequenceMutex.Unlock()
+	c, err := channelClockLocked(channel)
+	if err != nil {
+		return 0, err
+	}
+	return c.seq, nil
+}
+
+// readPositions returns how far conn has read each channel it is in: the last
+// message delivered to it, or the channel's latest message if nothing was delivered
+func readPositions(conn net.Conn) (map[string]int64, string) {
+	mutex.Lock()
+	session := sessions[conn]
+	if session == nil {
+		mutex.Unlock()
+		return nil, ""
+	}
+	positions := make(map[string]int64, len(session.joined))
+	for room := range session.joined {
+		positions[room] = session.seen[room]
+	}
+	room := session.room
+	mutex.Unlock()
+
+	for channel, seq := range positions {
+		if seq > 0 {
+			continue
+		}
+		latest, err := channelPosition(channel)
+		if err != nil {
+			connLogger(conn).Error("loading channel position", "channel", channel, "err", err)
+			continue
+		}
+		positions[channel] = latest
+	}
+	return positions, room
+}
+
+// saveReconnectToken stores where conn has read up to under token, along with this
+// instance's ID
+func saveReconnectToken(conn net.Conn, account, token string) error {
+	positions, room := readPositions(conn)
+	data, err := json.Marshal(positions)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO reconnect_tokens (token, username, instance, positions, room, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (token) DO UPDATE SET positions = excluded.positions, room = excluded.room, updated_at = excluded.updated_at`,
+		token, account, instanceID, string(data), room, clock.Now().UTC())
+	return err
+}
+
+// issueReconnectToken gives conn a new token and tells the client about it
+func issueReconnectToken(conn net.Conn, account string) {
+	token, err := newReconnectToken()
+	if err == nil {
+		err = saveReconnectToken(conn, account, token)
+	}
+	if err != nil {
+		connLogger(conn).Error("issuing reconnect token", "err", err)
+		conn.Write([]byte("\033[1;31mError issuing reconnect token.\033[0m\n"))
+		return
+	}
+	mutex.Lock()
+	if session := sessions[conn]; session != nil {
+		session.reconnectToken = token
+	}
+	mutex.Unlock()
+	conn.Write([]byte(fmt.Sprintf("\033[1;36mReconnect token: %s\033[0m\n\033[90mIf you are disconnected, log in again on any instance and type /resume %s to catch up.\033[0m\n", token, token)))
+}
+
+// saveReconnectPosition records how far a disconnecting client had read, so its
+// token resumes from there
+func saveReconnectPosition(conn net.Conn) {
+	mutex.Lock()
+	account := hub.Account(conn)
+	token := ""
+	if session := sessions[conn]; session != nil {
+		token = session.reconnectToken
+	}
+	mutex.Unlock()
+	if token == "" {
+		return
+	}
+	if err := saveReconnectToken(conn, account, token); err != nil {
+		connLogger(conn).Error("saving reconnect position", "err", err)
+	}
+}
+
+// takeReconnectToken returns and deletes an account's token
+func takeReconnectToken(account, token string) (instance string, positions map[string]int64, room string, err error) {
+	var data string
+	var updated time.Time
+	err = db.QueryRow("SELECT instance, positions, room, updated_at FROM reconnect_tokens WHERE token = ? AND username = ?", token, account).
+		Scan(&instance, &data, &room, &updated)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if _, err := db.Exec("DELETE FROM reconnect_tokens WHERE token = ?", token); err != nil {
+		return "", nil, "", err
+	}
+	if clock.Now().Sub(updated) > reconnectTokenTTL {
+		return "", nil, "", sql.ErrNoRows
+	}
+	err = json.Unmarshal([]byte(data), &positions)
+	return instance, positions, room, err
+}
+
+// getMessagesAfter returns up to limit channel messages after seq, oldest first
+func getMessagesAfter(channel string, seq int64, limit int) ([]HistoryMessage, error) {
+	rows, err := readQuery(`SELECT message_id, seq, sender, body, COALESCE(tag, ''), created_at FROM messages
+		WHERE channel = ? AND seq > ? ORDER BY seq ASC LIMIT ?`, channel, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []HistoryMessage
+	for rows.Next() {
+		m := HistoryMessage{Channel: channel}
+		if err := rows.Scan(&m.ID, &m.Seq, &m.Sender, &m.Body, &m.Tag, &m.Time); err != nil {
+			return nil, err
+		}
+		m.Body = openBody(m.Body)
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// handleResumeCommand handles the /resume command. Without a token it issues one;
+// with a token it rejoins the channels the token's session was in and replays the
+// messages it missed, then issues a fresh token.
+// Format: /resume [token]
+func handleResumeCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) > 1 {
+		conn.Write([]byte("\033[1;31mUsage: /resume [token]\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	account := hub.Account(conn)
+	mutex.Unlock()
+	if account == "" {
+		conn.Write([]byte("\033[1;31mOnly registered accounts can resume a session.\033[0m\n"))
+		return
+	}
+	if len(args) == 0 {
+		issueReconnectToken(conn, account)
+		return
+	}
+
+	instance, positions, lastRoom, err := takeReconnectToken(account, args[0])
+	if err == sql.ErrNoRows {
+		conn.Write([]byte("\033[1;31mUnknown or expired reconnect token.\033[0m\n"))
+		return
+	} else if err != nil {
+		connLogger(conn).Error("loading reconnect token", "err", err)
+		conn.Write([]byte("\033[1;31mError loading reconnect token.\033[0m\n"))
+		return
+	}
+
+	channels := make([]string, 0, len(positions))
+	for channel := range positions {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	loc := userLocation(conn)
+	missed := 0
+	var resumed []string
+	for _, channel := range channels {
+		if ok, _ := checkChannelEligibility(account, channel); !ok {
+			continue
+		}
+		// The account may have been kicked or the room locked since the token was
+		// issued. Passwords aren't kept, so password rooms are rejoined with /join.
+		if ok, reason := checkRoomAccess(account, channel, ""); !ok {
+			conn.Write([]byte(fmt.Sprintf("\033[1;33mNot rejoining %s: %s.\033[0m\n", channel, reason)))
+			continue
+		}
+		resumed = append(resumed, channel)
+		mutex.Lock()
+		joined := joinRoomLocked(conn, channel)
+		mutex.Unlock()
+		if joined {
+			bus.Emit(UserJoined{User: identityForConn(conn), Channel: channel})
+		}
+
+		messages, err := getMessagesAfter(channel, positions[channel], maxHistoryLimit)
+		if err != nil {
+			connLogger(conn).Error("loading missed messages", "channel", channel, "err", err)
+			continue
+		}
+		for _, m := range messages {
+			body := m.Body
+			if m.Tag != "" {
+				body = fmt.Sprintf("[%s] %s", m.Tag, m.Body)
+			}
+			ev := WireEvent{Type: "message", ID: m.ID, From: m.Sender, Room: channel, Tag: m.Tag, Body: m.Body, TS: m.Time.UTC()}
+			writeEvent(conn, ev, fmt.Sprintf("\033[90m[%s] [%s] %s: %s\033[0m\n", m.Time.In(loc).Format("15:04"), channel, m.Sender, body))
+		}
+		missed += len(messages)
+	}
+
+	// Talk where the old session was talking, if that channel could be rejoined
+	mutex.Lock()
+	if session := sessions[conn]; session != nil && session.joined[lastRoom] {
+		session.room = lastRoom
+	}
+	mutex.Unlock()
+
+	connLogger(conn).Info("session resumed", "from_instance", instance, "missed", missed)
+	conn.Write([]byte(fmt.Sprintf("\033[1;36mResumed your session from instance %s: %d missed message(s) in %s.\033[0m\n",
+		instance, missed, strings.Join(resumed, ", "))))
+	issueReconnectToken(conn, account)
+}
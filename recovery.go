@@ -0,0 +1,228 @@
+// Package main contains one-time recovery codes for resetting a forgotten password
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes an account is given
+	recoveryCodeCount = 8
+	// recoveryCodeAlphabet has 32 characters, leaving out the easily misread 0, 1, l and o
+	recoveryCodeAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+)
+
+// newRecoveryCode returns a random code of the form xxxxx-xxxxx-xxxxx
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 15)
+	if err := readRandom(b); err != nil {
+		return "", err
+	}
+	var code strings.Builder
+	for i, c := range b {
+		if i > 0 && i%5 == 0 {
+			code.WriteByte('-')
+		}
+		code.WriteByte(recoveryCodeAlphabet[int(c)%len(recoveryCodeAlphabet)])
+	}
+	return code.String(), nil
+}
+
+// normalizeRecoveryCode makes a typed code comparable: lower case, without spaces or dashes
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// generateRecoveryCodes replaces an account's recovery codes with new ones and returns
+// them. Only bcrypt hashes are stored, so the codes can't be shown again.
+func generateRecoveryCodes(username string) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(normalizeRecoveryCode(code)), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		codes[i], hashes[i] = code, hash
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE username = ?", username); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	for _, hash := range hashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (username, code_hash, created_at) VALUES (?, ?, ?)", username, string(hash), now); err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// useRecoveryCode checks a code against an account's unused recovery codes and, if
+// one matches, marks it used. It reports whether a code matched.
+func useRecoveryCode(username, code string) (bool, error) {
+	rows, err := db.Query("SELECT id, code_hash FROM recovery_codes WHERE username = ? AND used_at IS NULL", username)
+	if err != nil {
+		return false, err
+	}
+	type storedCode struct {
+		id   int64
+		hash string
+	}
+	var stored []storedCode
+	for rows.Next() {
+		var s storedCode
+		if err := rows.Scan(&s.id, &s.hash); err != nil {
+			rows.Close()
+			return false, err
+		}
+		stored = append(stored, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	code = normalizeRecoveryCode(code)
+	for _, s := range stored {
+		if bcrypt.CompareHashAndPassword([]byte(s.hash), []byte(code)) != nil {
+			continue
+		}
+		// The used_at check stops two connections from spending the same code
+		res, err := db.Exec("UPDATE recovery_codes SET used_at = ? WHERE id = ? AND used_at IS NULL", time.Now().UTC(), s.id)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n == 1, err
+	}
+	return false, nil
+}
+
+// remainingRecoveryCodes counts an account's unused recovery codes
+func remainingRecoveryCodes(username string) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE username = ? AND used_at IS NULL", username).Scan(&n)
+	return n, err
+}
+
+// recoveryCodesText lists new recovery codes with a reminder to keep them safe
+func recoveryCodesText(codes []string) string {
+	var out strings.Builder
+	out.WriteString("\033[1;33mYour recovery codes. Each can be used once with /recover if you forget your password.\n")
+	out.WriteString("Write them down now: they won't be shown again.\033[0m\n")
+	for _, code := range codes {
+		out.WriteString("  " + code + "\n")
+	}
+	return out.String()
+}
+
+// sendNewRecoveryCodes gives a newly registered account its recovery codes. Failing
+// to create them doesn't undo the registration; /recoverycodes can be used later.
+func sendNewRecoveryCodes(conn net.Conn, username string) {
+	codes, err := generateRecoveryCodes(username)
+	if err != nil {
+		connLogger(conn).Error("creating recovery codes", "user", username, "err", err)
+		conn.Write([]byte("\033[1;31mRecovery codes couldn't be created. Type /recoverycodes once logged in.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte(recoveryCodesText(codes)))
+}
+
+// handleRecoverCommand handles the /recover command, which sets a new password for
+// an account using one of its recovery codes. It is available before login and
+// shares the registration rate limit.
+// Format: /recover <username> <code> <newpassword>
+func handleRecoverCommand(conn net.Conn, message string) {
+	ip := conn.RemoteAddr().String()
+	if isRateLimited(ip) {
+		connLogger(conn).Warn("recovery rate limited", "ip", ip)
+		conn.Write([]byte("\033[1;31mToo many attempts. Please try again later.\033[0m\n"))
+		return
+	}
+
+	parts := strings.Fields(message)
+	if len(parts) != 4 {
+		conn.Write([]byte("Usage: /recover <username> <code> <newpassword>\n"))
+		return
+	}
+	username, code, password := parts[1], parts[2], parts[3]
+	if len(username) > maxUsernameLength {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mUsername must be %d characters or less.\033[0m\n", maxUsernameLength)))
+		return
+	}
+	if len(password) > maxPasswordLength {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mPassword must be %d characters or less.\033[0m\n", maxPasswordLength)))
+		return
+	}
+
+	// Checking the codes and hashing the new password are bcrypt work, like a login
+	done := waitForAuthTurn(conn)
+	ok, err := useRecoveryCode(username, code)
+	if ok {
+		err = updateUserPassword(username, password)
+	}
+	done()
+	if err != nil {
+		connLogger(conn).Error("password recovery failed", "user", username, "err", err)
+		conn.Write([]byte("\033[1;31mError resetting password. Please try again.\033[0m\n"))
+		return
+	}
+	if !ok {
+		connLogger(conn).Warn("password recovery failed", "user", username, "reason", "invalid code")
+		conn.Write([]byte("\033[1;31mInvalid username or recovery code.\033[0m\n"))
+		return
+	}
+
+	connLogger(conn).Info("password recovered", "user", username)
+	left, err := remainingRecoveryCodes(username)
+	if err != nil {
+		conn.Write([]byte("\033[1;32mPassword changed. You can now /login with it.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mPassword changed. You can now /login with it. You have %d recovery code(s) left.\033[0m\n", left)))
+}
+
+// handleRecoveryCodesCommand handles the /recoverycodes command, which shows how many
+// recovery codes are left or replaces them all with new ones
+// Format: /recoverycodes | /recoverycodes new
+func handleRecoveryCodesCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	switch {
+	case len(parts) == 1:
+		left, err := remainingRecoveryCodes(username)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError loading recovery codes.\033[0m\n"))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[1;36mYou have %d unused recovery code(s). /recoverycodes new replaces them all.\033[0m\n", left)))
+	case len(parts) == 2 && parts[1] == "new":
+		codes, err := generateRecoveryCodes(username)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError creating recovery codes.\033[0m\n"))
+			return
+		}
+		connLogger(conn).Info("recovery codes replaced", "user", username)
+		conn.Write([]byte(recoveryCodesText(codes)))
+	default:
+		conn.Write([]byte("\033[1;31mUsage: /recoverycodes | /recoverycodes new\033[0m\n"))
+	}
+}
@@ -0,0 +1,130 @@
+// Package main contains the guided, prompt-based registration flow
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Telnet commands used to hide password input on terminals that honor them
+var (
+	telnetWillEcho = []byte{255, 251, 1} // IAC WILL ECHO: the server echoes, so the client stops
+	telnetWontEcho = []byte{255, 252, 1} // IAC WONT ECHO: the client echoes again
+)
+
+// stripTelnetCommands removes telnet IAC sequences a client may send in reply to our options
+func stripTelnetCommands(s string) string {
+	if !strings.Contains(s, "\xff") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == 255 && i+1 < len(s) {
+			// IAC DO/DONT/WILL/WONT carry an option byte; other commands don't
+			if s[i+1] >= 251 && s[i+1] <= 254 {
+				i += 2
+			} else {
+				i++
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// promptLine writes a prompt and reads the answer, returning false if the client
+// disconnected or typed /cancel
+func promptLine(conn net.Conn, reader *bufio.Reader, prompt string) (string, bool) {
+	conn.Write([]byte(fmt.Sprintf("\033[1;33m%s\033[0m", prompt)))
+	line, err := readLimitedLine(reader, maxPreAuthLine)
+	if err != nil {
+		return "", false
+	}
+	line = strings.TrimSpace(stripTelnetCommands(line))
+	if line == "/cancel" {
+		conn.Write([]byte("\033[1;31mRegistration cancelled.\033[0m\n"))
+		return "", false
+	}
+	return line, true
+}
+
+// promptPassword reads a password with terminal echo turned off where supported
+func promptPassword(conn net.Conn, reader *bufio.Reader, prompt string) (string, bool) {
+	conn.Write(telnetWillEcho)
+	password, ok := promptLine(conn, reader, prompt)
+	conn.Write(telnetWontEcho)
+	// The client didn't echo the newline either
+	conn.Write([]byte("\n"))
+	return password, ok
+}
+
+// runGuidedRegistration walks a user through registration one step at a time.
+// It returns the new username, or "" if registration did not complete.
+func runGuidedRegistration(conn net.Conn, reader *bufio.Reader) string {
+	if isRateLimited(conn.RemoteAddr().String()) {
+		conn.Write([]byte("\033[1;31mToo many registration attempts. Please try again later.\033[0m\n"))
+		return ""
+	}
+	conn.Write([]byte("\033[1;36mLet's create your account. Type /cancel at any time to stop.\033[0m\n"))
+
+	// Step 1: username
+	var username string
+	for {
+		var ok bool
+		if username, ok = promptLine(conn, reader, "Choose a username: "); !ok {
+			return ""
+		}
+		if err := validateUsername(username); err != nil {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mInvalid username: %s.\033[0m\n", err)))
+			continue
+		}
+		exists, err := userExists(username)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError checking username. Please try again.\033[0m\n"))
+			return ""
+		}
+		if exists {
+			conn.Write([]byte("\033[1;31mUsername already exists. Please choose another.\033[0m\n"))
+			continue
+		}
+		break
+	}
+
+	// Step 2 and 3: password and confirmation
+	var password string
+	for {
+		var ok bool
+		if password, ok = promptPassword(conn, reader, "Choose a password: "); !ok {
+			return ""
+		}
+		if password == "" || len(password) > maxPasswordLength {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mPassword must be 1 to %d characters.\033[0m\n", maxPasswordLength)))
+			continue
+		}
+		confirm, ok := promptPassword(conn, reader, "Confirm password: ")
+		if !ok {
+			return ""
+		}
+		if confirm != password {
+			conn.Write([]byte("\033[1;31mPasswords do not match. Please try again.\033[0m\n"))
+			continue
+		}
+		break
+	}
+
+	done := waitForAuthTurn(conn)
+	err := saveUser(username, password)
+	done()
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError registering user. Please try again.\033[0m\n"))
+		return ""
+	}
+
+	connLogger(conn).Info("account registered", "user", username)
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mWelcome, %s! You can now start chatting.\033[0m\n", username)))
+	sendNewRecoveryCodes(conn, username)
+	return username
+}
@@ -0,0 +1,61 @@
+// Package main contains the optional read-only database that serves history queries
+package main
+
+import "database/sql"
+
+var (
+	// readDBSpec is the "driver:dsn" of a read replica; empty reads from the main database
+	readDBSpec string
+	// readDB serves history reads when a replica is configured
+	readDB *sql.DB
+)
+
+// openReadReplica connects to the database named by -read-db, if any
+func openReadReplica() error {
+	if readDBSpec == "" {
+		return nil
+	}
+	driver, dsn, err := parseDatabaseSpec(readDBSpec)
+	if err != nil {
+		return err
+	}
+	sqlDB, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return err
+	}
+	readDB = sqlDB
+	return nil
+}
+
+// closeReadReplica closes the read replica, if one is open
+func closeReadReplica() error {
+	if readDB == nil {
+		return nil
+	}
+	return readDB.Close()
+}
+
+// readQuery runs a read on the replica, falling back to the main database when
+// there is no replica or it can't be reached
+func readQuery(query string, args ...interface{}) (*sql.Rows, error) {
+	if readDB != nil {
+		rows, err := readDB.Query(query, args...)
+		if !isDBUnavailable(err) {
+			return rows, err
+		}
+		logger.Warn("read replica unavailable, reading from the main database", "err", err)
+	}
+	return db.Query(query, args...)
+}
+
+// readQueryRow runs a single-row read on the replica when there is one
+func readQueryRow(query string, args ...interface{}) *sql.Row {
+	if readDB != nil {
+		return readDB.QueryRow(query, args...)
+	}
+	return db.QueryRow(query, args...)
+}
@@ -0,0 +1,401 @@
+// Package main contains room operators, topics, and invite-only or password-protected rooms
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxTopicLength limits room topics in bytes
+const maxTopicLength = 200
+
+// RoomSettings is a room's metadata, as stored in room_settings
+type RoomSettings struct {
+	Channel      string
+	Topic        string
+	TopicSetBy   string
+	TopicSetAt   time.Time
+	InviteOnly   bool
+	PasswordHash string
+}
+
+// getRoomSettings loads a room's settings; a room without any has the zero settings
+func getRoomSettings(channel string) (RoomSettings, error) {
+	s := RoomSettings{Channel: channel}
+	var setAt sql.NullTime
+	err := db.QueryRow("SELECT topic, topic_set_by, topic_set_at, invite_only, password_hash FROM room_settings WHERE channel = ?", channel).
+		Scan(&s.Topic, &s.TopicSetBy, &setAt, &s.InviteOnly, &s.PasswordHash)
+	if err == sql.ErrNoRows {
+		return s, nil
+	}
+	s.TopicSetAt = setAt.Time
+	return s, err
+}
+
+// setRoomTopic stores a room's topic; an empty topic clears it
+func setRoomTopic(channel, topic, setBy string) error {
+	_, err := db.Exec(`INSERT INTO room_settings (channel, topic, topic_set_by, topic_set_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(channel) DO UPDATE SET topic = excluded.topic, topic_set_by = excluded.topic_set_by, topic_set_at = excluded.topic_set_at`,
+		channel, topic, setBy, time.Now().UTC())
+	return err
+}
+
+// setRoomMode stores whether a room is invite-only and its password hash ("" for none)
+func setRoomMode(channel string, inviteOnly bool, passwordHash string) error {
+	_, err := db.Exec(`INSERT INTO room_settings (channel, invite_only, password_hash) VALUES (?, ?, ?)
+		ON CONFLICT(channel) DO UPDATE SET invite_only = excluded.invite_only, password_hash = excluded.password_hash`,
+		channel, inviteOnly, passwordHash)
+	return err
+}
+
+// Mode describes how a room may be joined
+func (s RoomSettings) Mode() string {
+	switch {
+	case s.InviteOnly:
+		return "invite-only"
+	case s.PasswordHash != "":
+		return "password-protected"
+	}
+	return "open"
+}
+
+// isRoomOperator reports whether an account is an operator of a room. The room's
+// owner (its creator) and admins always are; others are made operators with /op.
+func isRoomOperator(username, channel string) bool {
+	if canManageChannel(username, channel) {
+		return true
+	}
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM room_operators WHERE channel = ? AND username = ?", channel, username).Scan(&count)
+	return err == nil && count > 0
+}
+
+// setRoomOperator grants or revokes operator status in a room
+func setRoomOperator(channel, username, grantedBy string, op bool) error {
+	if !op {
+		_, err := db.Exec("DELETE FROM room_operators WHERE channel = ? AND username = ?", channel, username)
+		return err
+	}
+	_, err := db.Exec("INSERT OR IGNORE INTO room_operators (channel, username, granted_by, created_at) VALUES (?, ?, ?, ?)",
+		channel, username, grantedBy, time.Now().UTC())
+	return err
+}
+
+// inviteToRoom lets an account join an invite-only room
+func inviteToRoom(channel, username, invitedBy string) error {
+	_, err := db.Exec("INSERT OR IGNORE INTO room_invites (channel, username, invited_by, created_at) VALUES (?, ?, ?, ?)",
+		channel, username, invitedBy, time.Now().UTC())
+	return err
+}
+
+// isInvited reports whether an account was invited to a room
+func isInvited(channel, username string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM room_invites WHERE channel = ? AND username = ?", channel, username).Scan(&count)
+	return count > 0, err
+}
+
+// checkRoomAccess reports whether an account may join a room with the given password,
+// and if not, a reason suitable for showing to the user. Operators always may.
+func checkRoomAccess(username, channel, password string) (bool, string) {
+	s, err := getRoomSettings(channel)
+	if err != nil {
+		return false, "could not check the room settings, please try again"
+	}
+	if !s.InviteOnly && s.PasswordHash == "" {
+		return true, ""
+	}
+	if username != "" && isRoomOperator(username, channel) {
+		return true, ""
+	}
+	if s.InviteOnly {
+		invited, err := isInvited(channel, username)
+		if err != nil {
+			return false, "could not check your invite, please try again"
+		}
+		if !invited {
+			return false, fmt.Sprintf("%s is invite-only", channel)
+		}
+		return true, ""
+	}
+	if password == "" {
+		return false, fmt.Sprintf("%s needs a password: /join %s <password>", channel, channel)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) != nil {
+		return false, "wrong password"
+	}
+	return true, ""
+}
+
+// sendRoomTopic shows conn a room's topic, if it has one
+func sendRoomTopic(conn net.Conn, channel string) {
+	s, err := getRoomSettings(channel)
+	if err != nil {
+		connLogger(conn).Error("loading room settings", "channel", channel, "err", err)
+		return
+	}
+	if s.Topic != "" {
+		conn.Write([]byte(fmt.Sprintf("\033[36mTopic of %s: %s (set by %s)\033[0m\n", channel, s.Topic, s.TopicSetBy)))
+	}
+}
+
+// requireRoomOperator returns conn's account and current room, writing an error and
+// returning ok false unless the account is an operator there
+func requireRoomOperator(conn net.Conn) (username, channel string, ok bool) {
+	mutex.Lock()
+	username = hub.Account(conn)
+	mutex.Unlock()
+	channel = currentRoom(conn)
+	if !isRoomOperator(username, channel) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mOnly operators of %s can do that.\033[0m\n", channel)))
+		return "", "", false
+	}
+	return username, channel, true
+}
+
+// handleTopicCommand handles the /topic command for the current room. Anyone may see
+// the topic; operators may change it.
+// Format: /topic [text | off]
+func handleTopicCommand(conn net.Conn, message string) {
+	text := strings.TrimSpace(strings.TrimPrefix(message, "/topic"))
+	if text == "" {
+		channel := currentRoom(conn)
+		s, err := getRoomSettings(channel)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError reading the topic. Please try again.\033[0m\n"))
+			return
+		}
+		if s.Topic == "" {
+			conn.Write([]byte(fmt.Sprintf("\033[90m%s has no topic.\033[0m\n", channel)))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[36mTopic of %s: %s (set by %s, %s)\033[0m\n",
+			channel, s.Topic, s.TopicSetBy, s.TopicSetAt.In(userLocation(conn)).Format("Jan 2 15:04 MST"))))
+		return
+	}
+	if len(text) > maxTopicLength {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mA topic can be at most %d characters.\033[0m\n", maxTopicLength)))
+		return
+	}
+	username, channel, ok := requireRoomOperator(conn)
+	if !ok {
+		return
+	}
+	// The topic is shown to everyone who joins, so it may not carry terminal escapes
+	topic := stripANSI(text)
+	if topic == "off" {
+		topic = ""
+	}
+	if err := setRoomTopic(channel, topic, username); err != nil {
+		conn.Write([]byte("\033[1;31mError saving the topic. Please try again.\033[0m\n"))
+		return
+	}
+	if topic == "" {
+		roomNotice(channel, fmt.Sprintf("%s cleared the topic.", username))
+	} else {
+		roomNotice(channel, fmt.Sprintf("%s set the topic: %s", username, topic))
+	}
+}
+
+// handleOpCommand handles the /op and /deop commands for the current room
+// Format: /op <username> | /deop <username>
+func handleOpCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	op := parts[0] == "/op"
+	if len(parts) != 2 || (!op && parts[0] != "/deop") {
+		conn.Write([]byte("\033[1;31mUsage: /op <username> | /deop <username>\033[0m\n"))
+		return
+	}
+	username, channel, ok := requireRoomOperator(conn)
+	if !ok {
+		return
+	}
+	target := strings.TrimPrefix(parts[1], "@")
+	if user, err := lookupUser(target); err != nil {
+		conn.Write([]byte("\033[1;31mError looking up the user. Please try again.\033[0m\n"))
+		return
+	} else if !user.exists {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mUser %s not found.\033[0m\n", target)))
+		return
+	}
+	if !op && canManageChannel(target, channel) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31m%s owns or administers %s and stays an operator.\033[0m\n", target, channel)))
+		return
+	}
+	if err := setRoomOperator(channel, target, username, op); err != nil {
+		conn.Write([]byte("\033[1;31mError updating operators. Please try again.\033[0m\n"))
+		return
+	}
+	if op {
+		roomNotice(channel, fmt.Sprintf("%s made %s an operator.", username, target))
+	} else {
+		roomNotice(channel, fmt.Sprintf("%s removed %s as an operator.", username, target))
+	}
+}
+
+// handleRoomKickCommand handles the /roomkick command, removing a user from the current
+// room. They may join again unless the room is invite-only, since the kick also
+// withdraws their invite.
+// Format: /roomkick <name> [reason]
+func handleRoomKickCommand(conn net.Conn, message string) {
+	parts := strings.SplitN(message, " ", 3)
+	if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+		conn.Write([]byte("\033[1;31mUsage: /roomkick <name> [reason]\033[0m\n"))
+		return
+	}
+	username, channel, ok := requireRoomOperator(conn)
+	if !ok {
+		return
+	}
+	if channel == defaultChannel {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mNobody can be kicked from %s.\033[0m\n", defaultChannel)))
+		return
+	}
+	name := strings.TrimSpace(parts[1])
+	reason := "no reason given"
+	if len(parts) == 3 && strings.TrimSpace(parts[2]) != "" {
+		reason = strings.TrimSpace(parts[2])
+	}
+
+	mutex.Lock()
+	var targets []net.Conn
+	for _, c := range connsForNameLocked(name) {
+		if rooms[channel][c] {
+			targets = append(targets, c)
+		}
+	}
+	target := ""
+	if len(targets) > 0 {
+		target = hub.Account(targets[0])
+	}
+	mutex.Unlock()
+	if len(targets) == 0 {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31m%s is not in %s.\033[0m\n", name, channel)))
+		return
+	}
+	if canManageChannel(target, channel) {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31m%s owns or administers %s and can't be kicked.\033[0m\n", name, channel)))
+		return
+	}
+
+	for _, c := range targets {
+		mutex.Lock()
+		identity := identityForConnLocked(c)
+		leaveRoomLocked(c, channel)
+		// A user kicked from their only room goes back to the default channel
+		rejoined := false
+		if s := sessions[c]; s != nil && len(s.joined) == 0 {
+			rejoined = joinRoomLocked(c, defaultChannel)
+		}
+		mutex.Unlock()
+		bus.Emit(UserLeft{User: identity, Channel: channel})
+		if rejoined {
+			bus.Emit(UserJoined{User: identity, Channel: defaultChannel})
+		}
+		c.Write([]byte(fmt.Sprintf("\033[1;31mYou have been kicked from %s by %s: %s\033[0m\n", channel, username, reason)))
+	}
+	if _, err := db.Exec("DELETE FROM room_invites WHERE channel = ? AND username = ?", channel, target); err != nil {
+		connLogger(conn).Error("withdrawing room invite", "channel", channel, "err", err)
+	}
+	logModeration(username, "roomkick", name, channel+": "+reason)
+	roomNotice(channel, fmt.Sprintf("%s kicked %s: %s", username, name, reason))
+}
+
+// handleRoomModeCommand handles the /roommode command for the current room. Without
+// arguments it shows the mode.
+// Format: /roommode [open | invite | password <password>]
+func handleRoomModeCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) == 1 {
+		channel := currentRoom(conn)
+		s, err := getRoomSettings(channel)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError reading the room settings. Please try again.\033[0m\n"))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[90m%s is %s.\033[0m\n", channel, s.Mode())))
+		return
+	}
+	usage := "\033[1;31mUsage: /roommode [open | invite | password <password>]\033[0m\n"
+	var inviteOnly bool
+	var password string
+	switch {
+	case len(parts) == 2 && parts[1] == "open":
+	case len(parts) == 2 && parts[1] == "invite":
+		inviteOnly = true
+	case len(parts) == 3 && parts[1] == "password":
+		password = parts[2]
+	default:
+		conn.Write([]byte(usage))
+		return
+	}
+	username, channel, ok := requireRoomOperator(conn)
+	if !ok {
+		return
+	}
+	if channel == defaultChannel {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31m%s is always open.\033[0m\n", defaultChannel)))
+		return
+	}
+	if len(password) > maxPasswordLength {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mPassword must be %d characters or less.\033[0m\n", maxPasswordLength)))
+		return
+	}
+
+	var hash string
+	if password != "" {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError saving the room settings. Please try again.\033[0m\n"))
+			return
+		}
+		hash = string(h)
+	}
+	if err := setRoomMode(channel, inviteOnly, hash); err != nil {
+		conn.Write([]byte("\033[1;31mError saving the room settings. Please try again.\033[0m\n"))
+		return
+	}
+	mode := RoomSettings{InviteOnly: inviteOnly, PasswordHash: hash}.Mode()
+	logModeration(username, "roommode", channel, mode)
+	roomNotice(channel, fmt.Sprintf("%s made %s %s.", username, channel, mode))
+}
+
+// handleInviteCommand handles the /invite command, letting an account join the
+// current room while it is invite-only
+// Format: /invite <username>
+func handleInviteCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 2 {
+		conn.Write([]byte("\033[1;31mUsage: /invite <username>\033[0m\n"))
+		return
+	}
+	username, channel, ok := requireRoomOperator(conn)
+	if !ok {
+		return
+	}
+	target := strings.TrimPrefix(parts[1], "@")
+	if user, err := lookupUser(target); err != nil {
+		conn.Write([]byte("\033[1;31mError looking up the user. Please try again.\033[0m\n"))
+		return
+	} else if !user.exists {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mUser %s not found.\033[0m\n", target)))
+		return
+	}
+	if err := inviteToRoom(channel, target, username); err != nil {
+		conn.Write([]byte("\033[1;31mError saving the invite. Please try again.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;32m%s is invited to %s.\033[0m\n", target, channel)))
+
+	mutex.Lock()
+	conns := connsForAccountLocked(target)
+	mutex.Unlock()
+	for _, c := range conns {
+		c.Write([]byte(fmt.Sprintf("\033[1;33m%s invited you to %s. /join %s to enter.\033[0m\n", username, channel, channel)))
+	}
+}
@@ -0,0 +1,236 @@
+// Package main contains chat rooms: named channels users join, leave, and talk in
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// validRoomName matches channel names such as #golang
+var validRoomName = regexp.MustCompile(`^#[a-z0-9_-]{1,32}$`)
+
+// rooms maps a channel name to the connections that joined it; guarded by mutex.
+// A room exists while it has members; defaultChannel always exists.
+var rooms = map[string]map[net.Conn]bool{defaultChannel: {}}
+
+// joinRoomLocked adds conn to a room and makes it the room conn talks in.
+// It reports whether conn was not a member before. Callers must hold mutex.
+func joinRoomLocked(conn net.Conn, room string) bool {
+	session := sessions[conn]
+	if session == nil {
+		return false
+	}
+	session.room = room
+	if session.joined[room] {
+		return false
+	}
+	session.joined[room] = true
+	if rooms[room] == nil {
+		rooms[room] = make(map[net.Conn]bool)
+	}
+	rooms[room][conn] = true
+	return true
+}
+
+// leaveRoomLocked removes conn from a room, deleting the room once it is empty.
+// If conn was talking in the room it switches to another room it has joined.
+// Callers must hold mutex.
+func leaveRoomLocked(conn net.Conn, room string) {
+	delete(rooms[room], conn)
+	if len(rooms[room]) == 0 && room != defaultChannel {
+		delete(rooms, room)
+	}
+
+	session := sessions[conn]
+	if session == nil {
+		return
+	}
+	delete(session.joined, room)
+	if session.room != room {
+		return
+	}
+	session.room = ""
+	if session.joined[defaultChannel] {
+		session.room = defaultChannel
+		return
+	}
+	for _, r := range sortedKeys(session.joined) {
+		session.room = r
+		return
+	}
+}
+
+// leaveAllRoomsLocked removes conn from every room and returns the rooms it left.
+// Callers must hold mutex.
+func leaveAllRoomsLocked(conn net.Conn) []string {
+	session := sessions[conn]
+	if session == nil {
+		return nil
+	}
+	left := sortedKeys(session.joined)
+	for _, room := range left {
+		leaveRoomLocked(conn, room)
+	}
+	return left
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// currentRoom returns the room conn is talking in
+func currentRoom(conn net.Conn) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if s, ok := sessions[conn]; ok && s.room != "" {
+		return s.room
+	}
+	return defaultChannel
+}
+
+// roomMemberNames returns the display names of a room's members
+func roomMemberNames(room string) []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	names := make([]string, 0, len(rooms[room]))
+	for conn := range rooms[room] {
+		names = append(names, hub.Name(conn))
+	}
+	return names
+}
+
+// listRooms returns every active room with its member count, sorted by name
+func listRooms() []ChannelInfo {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	list := make([]ChannelInfo, 0, len(rooms))
+	for name, members := range rooms {
+		list = append(list, ChannelInfo{Name: name, Members: len(members)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// roomNotice sends a system line to the members of a room
+func roomNotice(room, text string) {
+	bus.Publish(OutgoingMessage{channel: room, text: systemNotice("33", text)})
+}
+
+// handleJoinCommand handles the /join command
+// Format: /join <#channel> [password]; the channel is created if it doesn't exist
+func handleJoinCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) != 2 && len(parts) != 3 {
+		conn.Write([]byte("\033[1;31mUsage: /join <#channel> [password]\033[0m\n"))
+		return
+	}
+	room := strings.ToLower(parts[1])
+	if !strings.HasPrefix(room, "#") {
+		room = "#" + room
+	}
+	if !validRoomName.MatchString(room) {
+		conn.Write([]byte("\033[1;31mChannel names start with # and use a-z, 0-9, '-' and '_' (max 32).\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	username := hub.Account(conn)
+	member := sessionForLocked(conn).joined[room]
+	mutex.Unlock()
+
+	if ok, reason := checkChannelEligibility(username, room); !ok {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou can't join %s: %s.\033[0m\n", room, reason)))
+		return
+	}
+	// Members switching back to a room don't need an invite or the password again
+	if !member {
+		password := ""
+		if len(parts) == 3 {
+			password = parts[2]
+		}
+		if ok, reason := checkRoomAccess(username, room, password); !ok {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mYou can't join %s: %s.\033[0m\n", room, reason)))
+			return
+		}
+	}
+
+	mutex.Lock()
+	joined := joinRoomLocked(conn, room)
+	mutex.Unlock()
+
+	if joined {
+		bus.Emit(UserJoined{User: identityForConn(conn), Channel: room})
+	}
+	// The first account to join a channel owns it
+	if room != defaultChannel && username != "" {
+		if err := claimChannelOwner(room, username); err != nil {
+			connLogger(conn).Error("claiming channel owner", "channel", room, "err", err)
+		}
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mNow talking in %s.\033[0m\n", room)))
+	if joined {
+		sendRoomTopic(conn, room)
+	}
+}
+
+// handleLeaveCommand handles the /leave command
+// Format: /leave [#channel]; without a channel, leaves the current one
+func handleLeaveCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	if len(parts) > 2 {
+		conn.Write([]byte("\033[1;31mUsage: /leave [#channel]\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	session := sessions[conn]
+	if session == nil {
+		mutex.Unlock()
+		return
+	}
+	room := session.room
+	if len(parts) == 2 {
+		room = strings.ToLower(parts[1])
+	}
+	if !session.joined[room] {
+		mutex.Unlock()
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mYou are not in %s.\033[0m\n", room)))
+		return
+	}
+	if len(session.joined) == 1 {
+		mutex.Unlock()
+		conn.Write([]byte("\033[1;31mYou can't leave your only channel. /join another one first.\033[0m\n"))
+		return
+	}
+	identity := identityForConnLocked(conn)
+	leaveRoomLocked(conn, room)
+	now := session.room
+	mutex.Unlock()
+
+	bus.Emit(UserLeft{User: identity, Channel: room})
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mLeft %s. Now talking in %s.\033[0m\n", room, now)))
+}
+
+// handleRoomsCommand handles the /rooms command, listing active channels
+func handleRoomsCommand(conn net.Conn) {
+	current := currentRoom(conn)
+	conn.Write([]byte("\033[1;36mChannels:\033[0m\n"))
+	for _, r := range listRooms() {
+		marker := " "
+		if r.Name == current {
+			marker = "*"
+		}
+		conn.Write([]byte(fmt.Sprintf("\033[90m%s %s (%d)\033[0m\n", marker, r.Name, r.Members)))
+	}
+}
@@ -0,0 +1,267 @@
+// Package main contains the routing table that carries private messages between
+// instances sharing one database
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// routeRefresh is how often an instance renews the routes of its logged in accounts
+	routeRefresh = 10 * time.Second
+	// routeTTL is how long a route stays valid without being renewed, so a crashed
+	// instance stops receiving messages
+	routeTTL = 3 * routeRefresh
+	// routePoll is how often an instance collects the messages routed to it
+	routePoll = 500 * time.Millisecond
+)
+
+var (
+	// clusterMode lets several instances share -db and accept clients at once,
+	// routing private messages to whichever instance the recipient is on
+	clusterMode bool
+
+	routedSent      = newCounter("routed_messages_sent")
+	routedDelivered = newCounter("routed_messages_delivered")
+	routedFallbacks = newCounter("routed_messages_offline")
+	routedExpired   = newCounter("routed_messages_expired")
+)
+
+// RoutedMessage is a private message waiting to be collected by the recipient's instance
+type RoutedMessage struct {
+	id            int64
+	sender        string
+	senderAccount string
+	recipient     string
+	body          string
+	// store marks the one copy of the message that is saved to the database
+	store bool
+	sent  time.Time
+}
+
+// setRoute records that account is logged in on this instance
+func setRoute(account string) {
+	if !clusterMode || account == "" {
+		return
+	}
+	_, err := db.Exec(`INSERT INTO user_routes (username, instance, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (username, instance) DO UPDATE SET updated_at = excluded.updated_at`,
+		account, instanceID, clock.Now().UnixMilli())
+	if err != nil {
+		logger.Error("saving route", "account", account, "err", err)
+	}
+}
+
+// clearRoute removes the route of an account whose last session on this instance ended
+func clearRoute(account string) {
+	if !clusterMode || account == "" {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM user_routes WHERE username = ? AND instance = ?", account, instanceID); err != nil {
+		logger.Error("clearing route", "account", account, "err", err)
+	}
+}
+
+// clearRoutes removes every route to this instance when it shuts down
+func clearRoutes() {
+	if !clusterMode {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM user_routes WHERE instance = ?", instanceID); err != nil {
+		logger.Error("clearing routes", "err", err)
+	}
+}
+
+// refreshRoutes renews the routes of every account logged in here
+func refreshRoutes() {
+	mutex.Lock()
+	local := make(map[string]bool)
+	for _, c := range hub.Clients() {
+		if c.Account != "" {
+			local[c.Account] = true
+		}
+	}
+	mutex.Unlock()
+
+	for account := range local {
+		setRoute(account)
+	}
+}
+
+// remoteInstances returns the other instances account is logged in on
+func remoteInstances(account string) ([]string, error) {
+	return queryAccounts("SELECT instance FROM user_routes WHERE username = ? AND instance != ? AND updated_at > ? ORDER BY instance",
+		account, instanceID, clock.Now().Add(-routeTTL).UnixMilli())
+}
+
+// routePrivateMessage hands a private message to the instances account is logged in
+// on, reporting false if it isn't logged in anywhere else
+func routePrivateMessage(sender, senderAccount, account, body string) bool {
+	if !clusterMode {
+		return false
+	}
+	instances, err := remoteInstances(account)
+	if err != nil {
+		logger.Error("looking up route", "account", account, "err", err)
+		return false
+	}
+	storedBody, err := sealBody(body)
+	if err != nil {
+		logger.Error("routing private message", "err", err)
+		return false
+	}
+	now := clock.Now().UTC()
+	routed := false
+	for i, instance := range instances {
+		_, err := db.Exec(`INSERT INTO routed_messages (instance, sender, sender_account, recipient, body, store, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, instance, sender, senderAccount, account, storedBody, i == 0, now)
+		if err != nil {
+			logger.Error("routing private message", "instance", instance, "err", err)
+			continue
+		}
+		routedSent.Add(1)
+		routed = true
+	}
+	return routed
+}
+
+// takeRoutedMessages removes and returns the messages routed to this instance.
+// They are deleted before they are delivered, so each is delivered at most once.
+func takeRoutedMessages() ([]RoutedMessage, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, sender, sender_account, recipient, body, store, created_at FROM routed_messages
+		WHERE instance = ? ORDER BY id`, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	var messages []RoutedMessage
+	for rows.Next() {
+		var m RoutedMessage
+		if err := rows.Scan(&m.id, &m.sender, &m.senderAccount, &m.recipient, &m.body, &m.store, &m.sent); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m.body = openBody(m.body)
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(messages) == 0 {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM routed_messages WHERE instance = ? AND id <= ?", instanceID, messages[len(messages)-1].id); err != nil {
+		return nil, err
+	}
+	return messages, tx.Commit()
+}
+
+// expireRoutedMessages takes over the messages routed to an instance that stopped
+// collecting them, as after a crash while its routes were still valid. The stored
+// copy of each is kept as an offline message for the recipient's next login; the
+// others are dropped. Each is deleted before it is kept, so when several instances
+// expire messages at once every message is kept only once.
+func expireRoutedMessages(now time.Time) error {
+	rows, err := db.Query("SELECT id, sender_account, recipient, body, store FROM routed_messages WHERE created_at < ? ORDER BY id",
+		now.Add(-routeTTL).UTC())
+	if err != nil {
+		return err
+	}
+	var stale []RoutedMessage
+	for rows.Next() {
+		var m RoutedMessage
+		if err := rows.Scan(&m.id, &m.senderAccount, &m.recipient, &m.body, &m.store); err != nil {
+			rows.Close()
+			return err
+		}
+		stale = append(stale, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range stale {
+		res, err := db.Exec("DELETE FROM routed_messages WHERE id = ?", m.id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// Collected or expired by another instance meanwhile
+			continue
+		}
+		routedExpired.Add(1)
+		if !m.store || m.senderAccount == "" {
+			continue
+		}
+		if err := savePrivateMessage(m.senderAccount, m.recipient, openBody(m.body), true); err != nil {
+			logger.Error("keeping expired routed message", "recipient", m.recipient, "err", err)
+		}
+	}
+	return nil
+}
+
+// deliverRoutedMessage writes a routed message to the recipient's sessions here. If
+// the recipient has logged out since it was routed, it is kept for their next login.
+func deliverRoutedMessage(m RoutedMessage) {
+	replyTo := m.sender
+	if m.senderAccount != "" {
+		replyTo = "@" + m.senderAccount
+	}
+
+	mutex.Lock()
+	recipients := connsForAccountLocked(m.recipient)
+	names := make(map[net.Conn]string, len(recipients))
+	for _, conn := range recipients {
+		names[conn] = hub.Name(conn)
+		hub.SetLastSender(hub.Name(conn), replyTo)
+	}
+	mutex.Unlock()
+
+	if m.store && m.senderAccount != "" {
+		if err := savePrivateMessage(m.senderAccount, m.recipient, m.body, len(recipients) == 0); err != nil {
+			logger.Error("saving routed private message", "recipient", m.recipient, "err", err)
+		}
+	}
+	if len(recipients) == 0 {
+		routedFallbacks.Add(1)
+		return
+	}
+
+	from := formatIdentity(m.sender, m.senderAccount)
+	for _, conn := range recipients {
+		session := sessionFor(conn)
+		body := shortcodesFor(session, m.body)
+		ev := WireEvent{Type: "private", From: from, To: names[conn], Body: body, TS: m.sent.UTC()}
+		writeEvent(conn, ev, fmt.Sprintf("%s\033[34m[Private from %s] %s\033[0m\n", timestamp(session, m.sent), from, body))
+	}
+	routedDelivered.Add(1)
+}
+
+// startRouting renews this instance's routes and delivers the private messages other
+// instances route to it
+func startRouting() {
+	refreshRoutes()
+	clock.Every(routeRefresh, func(now time.Time) {
+		refreshRoutes()
+		if err := expireRoutedMessages(now); err != nil {
+			logger.Error("expiring routed messages", "err", err)
+		}
+	})
+	clock.Every(routePoll, func(time.Time) {
+		messages, err := takeRoutedMessages()
+		if err != nil {
+			logger.Error("collecting routed messages", "err", err)
+			return
+		}
+		for _, m := range messages {
+			deliverRoutedMessage(m)
+		}
+	})
+}
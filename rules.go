@@ -0,0 +1,110 @@
+// Package main contains the server rules that accounts must accept before chatting
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// rulesText is shown to users who have not accepted the current rules; empty disables the gate
+	rulesText = ""
+	// rulesVersion identifies the current rules so changed rules must be accepted again
+	rulesVersion = ""
+)
+
+// loadRules reads the rules text from a file. When no version is given,
+// a short hash of the text is used so any edit requires re-acceptance.
+func loadRules(path, version string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rulesText = strings.TrimSpace(string(data))
+	if version == "" {
+		sum := sha256.Sum256([]byte(rulesText))
+		version = hex.EncodeToString(sum[:4])
+	}
+	rulesVersion = version
+	return nil
+}
+
+// hasAcceptedRules reports whether an account accepted the current rules version
+func hasAcceptedRules(username string) bool {
+	if rulesText == "" {
+		return true
+	}
+	var version string
+	err := db.QueryRow("SELECT COALESCE(rules_version, '') FROM users WHERE username = ?", username).Scan(&version)
+	return err == nil && version == rulesVersion
+}
+
+// acceptRules records that an account accepted the current rules
+func acceptRules(username string) error {
+	_, err := db.Exec("UPDATE users SET rules_version = ?, rules_accepted_at = ? WHERE username = ?",
+		rulesVersion, time.Now().UTC(), username)
+	return err
+}
+
+// sendRules writes the rules text to a connection
+func sendRules(conn net.Conn) {
+	if rulesText == "" {
+		conn.Write([]byte("\033[90mThis server has no rules configured.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;36mServer rules (version %s):\033[0m\n", rulesVersion)))
+	for _, line := range strings.Split(rulesText, "\n") {
+		conn.Write([]byte("\033[90m" + line + "\033[0m\n"))
+	}
+}
+
+// isAllowedBeforeRules reports whether a command may be used before accepting the rules
+func isAllowedBeforeRules(message string) bool {
+	for _, cmd := range []string{"/accept", "/rules", "/help", "/exit"} {
+		if strings.HasPrefix(message, cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// passRulesGate reports whether a message may go on to be handled. Until the rules
+// are accepted it handles /accept itself and refuses everything but the commands
+// allowed before the rules.
+func passRulesGate(conn net.Conn, message string, accepted *bool) bool {
+	if *accepted {
+		return true
+	}
+	if strings.HasPrefix(message, "/accept") {
+		*accepted = handleAcceptCommand(conn)
+		return false
+	}
+	if !isAllowedBeforeRules(message) {
+		conn.Write([]byte("\033[1;31mYou must /accept the rules before sending messages. Type /rules to read them.\033[0m\n"))
+		return false
+	}
+	return true
+}
+
+// handleAcceptCommand handles the /accept command
+func handleAcceptCommand(conn net.Conn) bool {
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	if rulesText == "" || hasAcceptedRules(username) {
+		conn.Write([]byte("\033[90mThere is nothing to accept.\033[0m\n"))
+		return true
+	}
+	if err := acceptRules(username); err != nil {
+		conn.Write([]byte("\033[1;31mError recording acceptance. Please try again.\033[0m\n"))
+		return false
+	}
+	conn.Write([]byte("\033[1;32mThanks for accepting the rules. You can now start chatting.\033[0m\n"))
+	return true
+}
@@ -0,0 +1,252 @@
+// Package main contains keyword search over stored channel messages, using a SQLite
+// FTS5 index when the driver was built with it
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// messageSearchIndexed is set when the messages_fts full-text index is kept up to
+// date; otherwise /search scans message bodies with LIKE
+var messageSearchIndexed bool
+
+// encryptedSearchScan is how many of the newest messages /search decrypts and checks
+// when bodies are encrypted
+const encryptedSearchScan = 5000
+
+// searchIndexSchema creates the full-text index over message bodies and the triggers
+// that keep it in step with the messages table
+const searchIndexSchema = `
+	CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(body, content='messages', content_rowid='id');
+	CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts (rowid, body) VALUES (new.id, new.body);
+	END;
+	CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, body) VALUES ('delete', old.id, old.body);
+	END;
+	CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF body ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, body) VALUES ('delete', old.id, old.body);
+		INSERT INTO messages_fts (rowid, body) VALUES (new.id, new.body);
+	END`
+
+// dropSearchTriggers removes the index triggers, which would make every insert fail
+// on a build without FTS5
+const dropSearchTriggers = `
+	DROP TRIGGER IF EXISTS messages_fts_insert;
+	DROP TRIGGER IF EXISTS messages_fts_delete;
+	DROP TRIGGER IF EXISTS messages_fts_update`
+
+// createSearchIndex sets up the full-text index, reporting false if SQLite has no
+// FTS5. The index is rebuilt from the stored messages whenever its triggers weren't
+// in place, so messages stored by a build without FTS5 are found too.
+func createSearchIndex(sqlDB *sql.DB) bool {
+	if storageCipher != nil {
+		// An index of encrypted bodies finds nothing, and one built before encryption
+		// was turned on holds their words in plain text
+		if _, err := sqlDB.Exec(dropSearchTriggers + ";\n\tDROP TABLE IF EXISTS messages_fts"); err != nil {
+			logger.Error("removing search index", "err", err)
+		}
+		return false
+	}
+	var triggers int
+	if err := sqlDB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'messages_fts_insert'").Scan(&triggers); err != nil {
+		return false
+	}
+	if _, err := sqlDB.Exec(searchIndexSchema); err != nil {
+		logger.Info("full-text search unavailable, /search scans messages instead", "err", err)
+		if _, err := sqlDB.Exec(dropSearchTriggers); err != nil {
+			logger.Error("removing search index triggers", "err", err)
+		}
+		return false
+	}
+	if triggers == 0 {
+		if _, err := sqlDB.Exec("INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')"); err != nil {
+			logger.Error("building search index", "err", err)
+			return false
+		}
+	}
+	return true
+}
+
+// SearchQuery selects one page of messages matching a keyword
+type SearchQuery struct {
+	Keyword string
+	// Channels are the channels searched
+	Channels []string
+	// Sender limits the results to one account's messages
+	Sender string
+	// Before is a message ID cursor; only older messages match
+	Before string
+	Limit  int
+}
+
+// ftsPhrase quotes a keyword as an FTS5 phrase so its punctuation isn't read as syntax
+func ftsPhrase(keyword string) string {
+	return `"` + strings.ReplaceAll(keyword, `"`, `""`) + `"`
+}
+
+// likePattern matches a keyword anywhere in a body, with LIKE's wildcards escaped
+func likePattern(keyword string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(keyword)
+	return "%" + escaped + "%"
+}
+
+// searchMessages returns the newest messages matching q, newest first, and whether
+// there are older ones
+func searchMessages(q SearchQuery) ([]HistoryMessage, bool, error) {
+	if len(q.Channels) == 0 {
+		return nil, false, nil
+	}
+	limit := clampHistoryLimit(q.Limit)
+
+	from := "messages m"
+	where := "m.body LIKE ? ESCAPE '\\'"
+	args := []interface{}{likePattern(q.Keyword)}
+	query := readQuery
+	scan := limit + 1
+	if storageCipher != nil {
+		// Encrypted bodies can only be matched once decrypted, below
+		where, args = "1 = 1", nil
+		scan = encryptedSearchScan
+	} else if messageSearchIndexed {
+		// The index only exists in the main database
+		from = "messages_fts JOIN messages m ON m.id = messages_fts.rowid"
+		where = "messages_fts MATCH ?"
+		args = []interface{}{ftsPhrase(q.Keyword)}
+		query = db.Query
+	}
+	where += " AND m.seq IS NOT NULL AND m.channel IN (?" + strings.Repeat(", ?", len(q.Channels)-1) + ")"
+	for _, channel := range q.Channels {
+		args = append(args, channel)
+	}
+	if q.Sender != "" {
+		where += " AND m.sender = ?"
+		args = append(args, q.Sender)
+	}
+	if q.Before != "" {
+		var id int64
+		err := readQueryRow("SELECT id FROM messages WHERE message_id = ?", q.Before).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, false, errInvalidCursor
+		} else if err != nil {
+			return nil, false, err
+		}
+		where += " AND m.id < ?"
+		args = append(args, id)
+	}
+	// One extra match tells whether there is an older page
+	args = append(args, scan)
+
+	rows, err := query(`SELECT m.message_id, m.seq, m.channel, m.sender, m.body, COALESCE(m.tag, ''), m.created_at FROM `+from+`
+		WHERE `+where+` ORDER BY m.id DESC LIMIT ?`, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var messages []HistoryMessage
+	for rows.Next() {
+		var m HistoryMessage
+		if err := rows.Scan(&m.ID, &m.Seq, &m.Channel, &m.Sender, &m.Body, &m.Tag, &m.Time); err != nil {
+			return nil, false, err
+		}
+		m.Body = openBody(m.Body)
+		if storageCipher != nil && !strings.Contains(strings.ToLower(m.Body), strings.ToLower(q.Keyword)) {
+			continue
+		}
+		messages = append(messages, m)
+		if len(messages) > limit {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(messages) > limit {
+		return messages[:limit], true, nil
+	}
+	return messages, false, nil
+}
+
+// parseSearchArgs parses "<keyword> [#channel|user] [before=<id>]"
+func parseSearchArgs(args []string) (keyword, scope, before string, err error) {
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "before="):
+			before = strings.TrimPrefix(arg, "before=")
+		case keyword == "":
+			keyword = arg
+		case scope == "":
+			scope = arg
+		default:
+			return "", "", "", fmt.Errorf("unexpected %q", arg)
+		}
+	}
+	if keyword == "" {
+		return "", "", "", fmt.Errorf("missing keyword")
+	}
+	return keyword, scope, before, nil
+}
+
+// handleSearchCommand handles the /search command, which finds stored messages
+// containing a keyword in the channels the user is a member of, newest first
+// Format: /search <keyword> [#channel|name|@account] [before=<message-id>]
+func handleSearchCommand(conn net.Conn, message string) {
+	keyword, scope, before, err := parseSearchArgs(strings.Fields(message)[1:])
+	if err != nil {
+		conn.Write([]byte("\033[1;31mUsage: /search <keyword> [#channel|name|@account] [before=<message-id>]\033[0m\n"))
+		return
+	}
+
+	q := SearchQuery{Keyword: keyword, Before: before}
+	mutex.Lock()
+	for channel := range sessionForLocked(conn).joined {
+		q.Channels = append(q.Channels, channel)
+	}
+	mutex.Unlock()
+	switch {
+	case strings.HasPrefix(scope, "#"):
+		if !containsString(q.Channels, scope) {
+			conn.Write([]byte(fmt.Sprintf("\033[1;31mYou can only search channels you are in; /join %s first.\033[0m\n", scope)))
+			return
+		}
+		q.Channels = []string{scope}
+	case scope != "":
+		q.Sender = privateHistoryAccount(scope)
+	}
+
+	messages, more, err := searchMessages(q)
+	if err == errInvalidCursor {
+		conn.Write([]byte("\033[1;31mUnknown message ID.\033[0m\n"))
+		return
+	} else if err != nil {
+		conn.Write([]byte("\033[1;31mError searching messages. Please try again.\033[0m\n"))
+		return
+	}
+	if len(messages) == 0 {
+		conn.Write([]byte(fmt.Sprintf("\033[90mNo messages matching %q.\033[0m\n", keyword)))
+		return
+	}
+
+	loc := userLocation(conn)
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("\033[1;36mMessages matching %q, newest first:\033[0m\n", keyword))
+	for _, m := range messages {
+		body := m.Body
+		if m.Tag != "" {
+			body = fmt.Sprintf("[%s] %s", m.Tag, m.Body)
+		}
+		out.WriteString(fmt.Sprintf("\033[90m[%s] %s %s:\033[0m %s\n", m.Time.In(loc).Format("2006-01-02 15:04:05"), m.Channel, m.Sender, body))
+	}
+	if more {
+		older := "/search " + keyword
+		if scope != "" {
+			older += " " + scope
+		}
+		out.WriteString(fmt.Sprintf("\033[90mOlder: %s before=%s\033[0m\n", older, messages[len(messages)-1].ID))
+	}
+	conn.Write([]byte(out.String()))
+}
@@ -0,0 +1,83 @@
+// Package main contains server-side message ordering: UTC timestamps and per-channel sequence numbers
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// channelClock tracks the last sequence number and timestamp handed out in a channel
+type channelClock struct {
+	seq  int64
+	last time.Time
+}
+
+var (
+	// channelClocks holds the ordering state of each channel, loaded lazily from the database
+	channelClocks = make(map[string]*channelClock)
+	sequenceMutex = &sync.Mutex{}
+)
+
+// loadChannelClock reads the latest sequence number and timestamp of a channel
+func loadChannelClock(channel string) (*channelClock, error) {
+	var seq sql.NullInt64
+	var last sql.NullTime
+	err := db.QueryRow("SELECT seq, created_at FROM messages WHERE channel = ? AND seq IS NOT NULL ORDER BY seq DESC LIMIT 1", channel).
+		Scan(&seq, &last)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return &channelClock{seq: seq.Int64, last: last.Time}, nil
+}
+
+// channelClockLocked returns a channel's ordering state. With -cluster other
+// instances store messages in the same channels, so the clock is caught up with
+// the database every time. The caller must hold sequenceMutex.
+func channelClockLocked(channel string) (*channelClock, error) {
+	clock, ok := channelClocks[channel]
+	if ok && !clusterMode {
+		return clock, nil
+	}
+	stored, err := loadChannelClock(channel)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		channelClocks[channel] = stored
+		return stored, nil
+	}
+	if stored.seq > clock.seq {
+		clock.seq = stored.seq
+	}
+	if stored.last.After(clock.last) {
+		clock.last = stored.last
+	}
+	return clock, nil
+}
+
+// isSeqConflict reports whether err means a message may already be stored under the
+// same channel sequence number, as when two instances sharing -db send at once. A
+// reused idempotency key breaks a unique index too, and fails again when renumbered.
+func isSeqConflict(err error) bool {
+	return isUniqueViolation(err)
+}
+
+// nextStamp returns the next sequence number and a UTC timestamp for a channel.
+// Timestamps never go backwards within a channel, even if the system clock does,
+// so ordering by either field gives the same deterministic replay.
+// The caller must hold sequenceMutex.
+func nextStamp(channel string) (int64, time.Time, error) {
+	c, err := channelClockLocked(channel)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	now := clock.Now().UTC()
+	if now.Before(c.last) {
+		now = c.last
+	}
+	c.seq++
+	c.last = now
+	return c.seq, now, nil
+}
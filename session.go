@@ -0,0 +1,98 @@
+// Package main contains per-connection settings loaded when a user logs in
+package main
+
+import (
+	"database/sql"
+	"net"
+	"time"
+)
+
+// Session holds the settings of one logged in connection
+type Session struct {
+	// bot is set for accounts whose messages are automated
+	bot bool
+	// filterBots is "on" or "off" to override whether bot traffic is shown, "" to use the default
+	filterBots string
+	// tags holds the user's tag subscriptions, keyed by channel
+	tags map[string]*TagFilter
+	// room is the channel the user's messages go to
+	room string
+	// joined is the set of channels the user is a member of
+	joined map[string]bool
+	// location is the time zone messages are timestamped in; nil means UTC
+	location *time.Location
+	// seen is the sequence number of the last message delivered to the user, keyed by channel
+	seen map[string]int64
+	// rawEmoji shows :shortcodes: as typed instead of expanding them to emoji
+	rawEmoji bool
+	// accessible is the account's accessibility mode, applied to the connection's output at login
+	accessible bool
+	// color is the account's choice of colored output, on or off; "" leaves the
+	// connection as it was when logging in
+	color string
+	// nickChanged is when the user last changed their display name with /nick
+	nickChanged time.Time
+	// display is the display mode of channel messages; "" means normal
+	display string
+	// quietHours is set when the account has quiet hours, from quietStart to quietEnd
+	// in minutes after midnight in its time zone
+	quietHours           bool
+	quietStart, quietEnd int
+	// quiet is set while the quiet hours are on, as last announced to the user
+	quiet bool
+	// heldMessages counts the channel messages held back during quiet hours, keyed by channel
+	heldMessages map[string]int
+	// heldPrivate counts the private messages held back during quiet hours, keyed by sender
+	heldPrivate map[string]int
+	// reconnectToken is the token the user can resume this session with, if one was issued
+	reconnectToken string
+}
+
+// sessions maps a logged in connection to its settings; guarded by mutex
+var sessions = make(map[net.Conn]*Session)
+
+// loadSession reads the settings of an account from the database
+func loadSession(username string) *Session {
+	s := &Session{tags: make(map[string]*TagFilter), joined: make(map[string]bool)}
+	if tags, err := loadTagFilters(username); err == nil {
+		s.tags = tags
+	}
+
+	var role string
+	var filterBots, timezone, display, quietHours, color sql.NullString
+	err := db.QueryRow("SELECT role, filter_bots, timezone, raw_emoji, accessible, display, quiet_hours, color FROM users WHERE username = ?", username).
+		Scan(&role, &filterBots, &timezone, &s.rawEmoji, &s.accessible, &display, &quietHours, &color)
+	if err != nil {
+		return s
+	}
+	s.bot = role == roleBot
+	s.filterBots = filterBots.String
+	s.display = display.String
+	s.color = color.String
+	if quietHours.String != "" {
+		if start, end, err := parseQuietHours(quietHours.String); err == nil {
+			s.quietHours, s.quietStart, s.quietEnd = true, start, end
+		}
+	}
+	if timezone.String != "" {
+		if loc, err := time.LoadLocation(timezone.String); err == nil {
+			s.location = loc
+		}
+	}
+	return s
+}
+
+// sessionFor returns the settings of a connection, or defaults if it has none
+func sessionFor(conn net.Conn) *Session {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return sessionForLocked(conn)
+}
+
+// sessionForLocked is sessionFor for callers that already hold mutex
+func sessionForLocked(conn net.Conn) *Session {
+	if s, ok := sessions[conn]; ok {
+		return s
+	}
+	return &Session{}
+}
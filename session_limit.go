@@ -0,0 +1,156 @@
+// Package main contains the cap on concurrent connections that keeps a small server within its memory
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// serverFullMessage is sent to connections turned away by maxSessions
+const serverFullMessage = "\033[1;31mServer full. Please try again later.\033[0m\n"
+
+var (
+	// maxSessions caps the connections served at once, logged in or not (0 for unlimited)
+	maxSessions int
+	// maxSessionQueue is how many TCP connections may wait for a free place while the
+	// server is full (0 turns them away at once)
+	maxSessionQueue int
+	// sessionQueueTimeout is how long a connection waits in line before giving up
+	sessionQueueTimeout = 10 * time.Minute
+
+	sessionQueue = &connQueue{}
+
+	activeSessions   = newCounter("sessions_active")
+	rejectedSessions = newCounter("sessions_rejected")
+	queuedSessions   = newCounter("sessions_queued")
+)
+
+// acquireSession reserves room for a new connection, returning false when the
+// server already has maxSessions
+func acquireSession() bool {
+	if n := activeSessions.Add(1); maxSessions > 0 && n > int64(maxSessions) {
+		activeSessions.Add(-1)
+		return false
+	}
+	return true
+}
+
+// releaseSession frees the room taken by acquireSession, handing it straight to the
+// first connection waiting in line if there is one
+func releaseSession() {
+	if sessionQueue.handOff() {
+		return
+	}
+	activeSessions.Add(-1)
+}
+
+// writeRaw writes a notice to a connection that isn't being served yet, without
+// letting a slow client hold anything up
+func writeRaw(conn net.Conn, msg string) error {
+	if !colorEnabled {
+		msg = stripANSI(msg)
+	}
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err := conn.Write([]byte(msg))
+	return err
+}
+
+// rejectServerFull tells a raw connection the server is full and closes it,
+// without letting a slow client hold up the accept loop
+func rejectServerFull(conn net.Conn) {
+	rejectedSessions.Add(1)
+	writeRaw(conn, serverFullMessage)
+	conn.Close()
+}
+
+// connQueue holds the connections waiting for a place on a full server, first come,
+// first served
+type connQueue struct {
+	mu      sync.Mutex
+	waiting []*connWaiter
+}
+
+// connWaiter is a connection waiting for a place
+type connWaiter struct {
+	conn  net.Conn
+	ready chan struct{}
+}
+
+// Len returns how many connections are waiting
+func (q *connQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// wait queues conn until a place is free, telling it its position as it moves up.
+// It reports false, having turned conn away, if the queue is full or conn waited
+// longer than sessionQueueTimeout. On true, conn holds a place the caller must
+// release with releaseSession.
+func (q *connQueue) wait(conn net.Conn) bool {
+	q.mu.Lock()
+	if len(q.waiting) >= maxSessionQueue {
+		q.mu.Unlock()
+		rejectServerFull(conn)
+		return false
+	}
+	w := &connWaiter{conn: conn, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, w)
+	position := len(q.waiting)
+	q.mu.Unlock()
+
+	queuedSessions.Add(1)
+	writeRaw(conn, fmt.Sprintf("\033[1;33mServer full. You are #%d in the queue and will be let in when someone leaves, please wait...\033[0m\n", position))
+
+	timer := time.NewTimer(sessionQueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return true
+	case <-timer.C:
+	}
+
+	q.mu.Lock()
+	for i, other := range q.waiting {
+		if other == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.mu.Unlock()
+			rejectServerFull(conn)
+			return false
+		}
+	}
+	// A place was handed over just as the wait ran out
+	q.mu.Unlock()
+	return true
+}
+
+// handOff gives a freed place to the first connection in line, reporting false if
+// nobody is waiting
+func (q *connQueue) handOff() bool {
+	q.mu.Lock()
+	if len(q.waiting) == 0 {
+		q.mu.Unlock()
+		return false
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	// Like the login queue, update the front of the line and every tenth place
+	var updates []*connWaiter
+	var positions []int
+	for i, w := range q.waiting {
+		if position := i + 1; position <= 10 || position%10 == 0 {
+			updates = append(updates, w)
+			positions = append(positions, position)
+		}
+	}
+	q.mu.Unlock()
+
+	close(next.ready)
+	for i, w := range updates {
+		writeRaw(w.conn, fmt.Sprintf("\033[90mYou are now #%d in the queue.\033[0m\n", positions[i]))
+	}
+	return true
+}
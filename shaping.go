@@ -0,0 +1,103 @@
+// Package main contains outbound bandwidth shaping so no single client monopolizes the uplink
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// clientRate caps the bytes per second sent to one client (0 for unlimited)
+	clientRate = 0
+	// totalRate caps the bytes per second sent to all clients together (0 for unlimited)
+	totalRate = 0
+
+	// totalBucket is shared by every client when totalRate is set
+	totalBucket     *tokenBucket
+	totalBucketOnce sync.Once
+
+	throttledMillis = newCounter("outbound_throttled_ms")
+)
+
+// shapeChunk is the largest write made at once, so a large reply is interleaved
+// with other clients' output instead of claiming the shared budget in one go
+const shapeChunk = 4096
+
+// tokenBucket hands out bytes at a fixed rate with bursts of up to one second.
+// Reservations are taken in call order, so waiting writers are served first come, first served.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket refilling at rate bytes per second
+func newTokenBucket(rate int) *tokenBucket {
+	burst := float64(max(rate, 64*1024))
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before sending them
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// shapedConn paces writes to a client according to its own and the shared budget
+type shapedConn struct {
+	net.Conn
+	bucket *tokenBucket
+}
+
+// newShapedConn applies the configured rate limits to conn, or returns it unchanged
+func newShapedConn(conn net.Conn) net.Conn {
+	if clientRate <= 0 && totalRate <= 0 {
+		return conn
+	}
+	if totalRate > 0 {
+		totalBucketOnce.Do(func() { totalBucket = newTokenBucket(totalRate) })
+	}
+	c := &shapedConn{Conn: conn}
+	if clientRate > 0 {
+		c.bucket = newTokenBucket(clientRate)
+	}
+	return c
+}
+
+// Write sends p in chunks, waiting for budget before each one
+func (c *shapedConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(written+shapeChunk, len(p))]
+		now := time.Now()
+		var wait time.Duration
+		if c.bucket != nil {
+			wait = c.bucket.reserve(len(chunk), now)
+		}
+		if totalBucket != nil {
+			wait = max(wait, totalBucket.reserve(len(chunk), now))
+		}
+		if wait > 0 {
+			throttledMillis.Add(wait.Milliseconds())
+			time.Sleep(wait)
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,172 @@
+// Package main contains snapshots of channel membership that survive a server crash
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	// snapshotInterval is how often channel membership is saved (0 disables snapshots)
+	snapshotInterval = 30 * time.Second
+	// snapshotMaxAge is how old a snapshot may be and still be restored at login
+	snapshotMaxAge = time.Hour
+	// serverStarted separates snapshots left by a previous run from this run's own
+	serverStarted = time.Now()
+)
+
+// SessionSnapshot is the channel membership of one account at snapshot time
+type SessionSnapshot struct {
+	Rooms []string
+	Room  string
+}
+
+// collectSnapshots returns the membership of every logged in account. An account
+// with several sessions gets the rooms of all of them.
+func collectSnapshots() map[string]*SessionSnapshot {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	snapshots := make(map[string]*SessionSnapshot)
+	for _, c := range hub.Clients() {
+		account, session := c.Account, sessions[c.Conn]
+		if account == "" || session == nil {
+			continue
+		}
+		snap, ok := snapshots[account]
+		if !ok {
+			snap = &SessionSnapshot{Room: session.room}
+			snapshots[account] = snap
+		}
+		for _, room := range sortedKeys(session.joined) {
+			if !containsString(snap.Rooms, room) {
+				snap.Rooms = append(snap.Rooms, room)
+			}
+		}
+	}
+	return snapshots
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// saveSnapshots replaces the stored snapshots with the current membership
+func saveSnapshots() error {
+	snapshots := collectSnapshots()
+	now := clock.Now().UTC()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM session_snapshots"); err != nil {
+		return err
+	}
+	for account, snap := range snapshots {
+		if _, err := tx.Exec("INSERT INTO session_snapshots (username, rooms, room, saved_at) VALUES (?, ?, ?, ?)",
+			account, strings.Join(snap.Rooms, ","), snap.Room, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// startSnapshots saves channel membership every snapshotInterval
+func startSnapshots() {
+	clock.Every(snapshotInterval, func(time.Time) {
+		if err := saveSnapshots(); err != nil {
+			logger.Error("saving session snapshot", "err", err)
+		}
+	})
+}
+
+// takeSnapshot returns and deletes an account's snapshot from before the server
+// started, if it is recent enough to restore
+func takeSnapshot(account string) (*SessionSnapshot, error) {
+	var rooms, room string
+	var savedAt time.Time
+	err := db.QueryRow("SELECT rooms, room, saved_at FROM session_snapshots WHERE username = ?", account).Scan(&rooms, &room, &savedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// Snapshots taken by this run describe sessions that are still connected
+	if !savedAt.Before(serverStarted) {
+		return nil, nil
+	}
+	if _, err := db.Exec("DELETE FROM session_snapshots WHERE username = ?", account); err != nil {
+		return nil, err
+	}
+	if clock.Now().Sub(savedAt) > snapshotMaxAge || rooms == "" {
+		return nil, nil
+	}
+	return &SessionSnapshot{Rooms: strings.Split(rooms, ","), Room: room}, nil
+}
+
+// restoreSession puts a user who was connected when the server went down back into
+// the channels they had joined, and tells them what was restored. Everyone starts in
+// defaultChannel, so only the other channels are restored.
+func restoreSession(conn net.Conn, account string) {
+	snap, err := takeSnapshot(account)
+	if err != nil {
+		connLogger(conn).Error("loading session snapshot", "err", err)
+		return
+	}
+	if snap == nil {
+		return
+	}
+
+	var restored []string
+	for _, room := range snap.Rooms {
+		if !validRoomName.MatchString(room) || room == defaultChannel {
+			continue
+		}
+		// Channel restrictions may have changed since the snapshot
+		if ok, _ := checkChannelEligibility(account, room); !ok {
+			continue
+		}
+		// So may the room's mode; password rooms have to be rejoined with /join
+		if ok, reason := checkRoomAccess(account, room, ""); !ok {
+			conn.Write([]byte(fmt.Sprintf("\033[1;33mNot rejoining %s: %s.\033[0m\n", room, reason)))
+			continue
+		}
+		mutex.Lock()
+		joined := joinRoomLocked(conn, room)
+		mutex.Unlock()
+		if joined {
+			bus.Emit(UserJoined{User: identityForConn(conn), Channel: room})
+		}
+		restored = append(restored, room)
+	}
+
+	if len(restored) == 0 {
+		return
+	}
+
+	// Talk where the user was talking before, if that channel could be restored
+	mutex.Lock()
+	session := sessions[conn]
+	if session != nil && session.joined[snap.Room] {
+		session.room = snap.Room
+	}
+	room := ""
+	if session != nil {
+		room = session.room
+	}
+	mutex.Unlock()
+
+	conn.Write([]byte(fmt.Sprintf("\033[1;36mThe server restarted. You are back in %s, talking in %s.\033[0m\n",
+		strings.Join(restored, ", "), room)))
+}
@@ -0,0 +1,143 @@
+// Package main contains the soak mode, which drives the server through many client
+// lifetimes and reports whether goroutines or heap memory are leaking
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// soakCycles is how many connect/chat/disconnect cycles the soak mode runs (0 disables it)
+	soakCycles int
+	// soakWorkers is how many soak clients are connected at once
+	soakWorkers = 8
+	// soakGoroutineSlack is how many more goroutines than at the start are tolerated
+	// once every soak client has gone
+	soakGoroutineSlack = 10
+)
+
+// errSoakLeak stops a soak run whose goroutines didn't return to the baseline
+var errSoakLeak = errors.New("soak test found leaked goroutines")
+
+// soakPassword is the password of the accounts soak clients log in to
+const soakPassword = "soakpass"
+
+// soakSample is the goroutine count and live heap at one point of a soak run
+type soakSample struct {
+	goroutines int
+	heap       uint64
+}
+
+// takeSoakSample measures the server once garbage has been collected
+func takeSoakSample() soakSample {
+	runtime.GC()
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return soakSample{goroutines: runtime.NumGoroutine(), heap: m.HeapAlloc}
+}
+
+// soakCycle connects to addr, logs in, chats, and disconnects, waiting for the server
+// to close the connection
+func soakCycle(addr, account string, n int64) error {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	script := fmt.Sprintf("/login %s %s\nsoak%d\n/accept\nhello from cycle %d\n/join #soak\n/private @%s ping\n/exit\n",
+		account, soakPassword, n, n, account)
+	if _, err := io.WriteString(conn, script); err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, conn)
+	return err
+}
+
+// waitForNoClients waits until every soak client has been cleaned up
+func waitForNoClients(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		mutex.Lock()
+		n := hub.Len()
+		mutex.Unlock()
+		if n == 0 {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+// runSoak runs soakCycles client lifetimes against the server at addr, prints the
+// goroutine and heap growth, and stops the server, with errSoakLeak if goroutines
+// leaked
+func runSoak(addr string, stop func(error)) {
+	soakAccounts := make([]string, soakWorkers)
+	for i := range soakAccounts {
+		soakAccounts[i] = fmt.Sprintf("soak%d", i)
+		if exists, _ := userExists(soakAccounts[i]); !exists {
+			if err := saveUser(soakAccounts[i], soakPassword); err != nil {
+				fmt.Println("Soak: error creating account:", err)
+				stop(err)
+				return
+			}
+		}
+	}
+
+	var next, failures atomic.Int64
+	run := func(cycles int64) {
+		var wg sync.WaitGroup
+		for _, account := range soakAccounts {
+			wg.Add(1)
+			go func(account string) {
+				defer wg.Done()
+				for {
+					n := next.Add(1)
+					if n > cycles {
+						return
+					}
+					if err := soakCycle(addr, account, n); err != nil {
+						failures.Add(1)
+					}
+				}
+			}(account)
+		}
+		wg.Wait()
+		waitForNoClients(10 * time.Second)
+	}
+
+	// Warm up first so caches and pools that fill once don't count as growth
+	warmup := int64(soakWorkers * 10)
+	run(warmup)
+	before := takeSoakSample()
+	start := time.Now()
+	run(warmup + int64(soakCycles))
+	// Give background work a moment to finish, e.g. presence summaries
+	time.Sleep(presenceWindow + time.Second)
+	after := takeSoakSample()
+
+	fmt.Printf("Soak: %d cycles in %s, %d failed\n", soakCycles, time.Since(start).Round(time.Millisecond), failures.Load())
+	fmt.Printf("Soak: goroutines %d -> %d (%+d)\n", before.goroutines, after.goroutines, after.goroutines-before.goroutines)
+	fmt.Printf("Soak: heap %.1f MB -> %.1f MB (%+.0f bytes per cycle)\n",
+		float64(before.heap)/(1<<20), float64(after.heap)/(1<<20), (float64(after.heap)-float64(before.heap))/float64(soakCycles))
+
+	if after.goroutines-before.goroutines > soakGoroutineSlack {
+		fmt.Println("Soak: goroutines leaked, remaining goroutines:")
+		pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
+		stop(errSoakLeak)
+		return
+	}
+	stop(nil)
+}
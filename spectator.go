@@ -0,0 +1,99 @@
+// Package main contains the read-only spectator connection mode
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	// spectatorChannels are the public channels spectators may watch
+	spectatorChannels = make(map[string]bool)
+	// spectators maps a spectator connection to the channel it watches
+	spectators = make(map[net.Conn]string)
+	// maxSpectators caps the connections watching without an account, since they
+	// no longer count toward -max-pending once they start watching
+	maxSpectators = 100
+)
+
+// spectateFlag lets -spectate be repeated to designate watchable channels
+type spectateFlag struct{}
+
+func (spectateFlag) String() string {
+	names := make([]string, 0, len(spectatorChannels))
+	for name := range spectatorChannels {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (spectateFlag) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			spectatorChannels[name] = true
+		}
+	}
+	return nil
+}
+
+// parseSpectateCommand validates a /spectate [channel] request and returns the channel to watch
+func parseSpectateCommand(conn net.Conn, message string) (string, bool) {
+	if len(spectatorChannels) == 0 {
+		conn.Write([]byte("\033[1;31mSpectator mode is not enabled on this server.\033[0m\n"))
+		return "", false
+	}
+
+	parts := strings.Fields(message)
+	channel := defaultChannel
+	if len(parts) == 2 {
+		channel = parts[1]
+	} else if len(parts) > 2 {
+		conn.Write([]byte("\033[1;31mUsage: /spectate [channel]\033[0m\n"))
+		return "", false
+	}
+
+	if !spectatorChannels[channel] {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mChannel %s is not open to spectators.\033[0m\n", channel)))
+		return "", false
+	}
+	return channel, true
+}
+
+// addSpectator starts conn watching channel. It returns false, telling the client,
+// if maxSpectators are already watching.
+func addSpectator(conn net.Conn, channel string) bool {
+	mutex.Lock()
+	full := maxSpectators > 0 && len(spectators) >= maxSpectators
+	if !full {
+		spectators[conn] = channel
+	}
+	mutex.Unlock()
+	if full {
+		conn.Write([]byte("\033[1;31mToo many spectators are watching. Please try again later.\033[0m\n"))
+	}
+	return !full
+}
+
+// runSpectator streams a channel to a connection added by addSpectator until it disconnects
+func runSpectator(conn net.Conn, reader *bufio.Reader, channel string) {
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mNow watching %s (read-only). Type /exit to leave.\033[0m\n", channel)))
+
+	for {
+		message, err := readLimitedLine(reader, maxPreAuthLine)
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(strings.TrimSpace(message), "/exit") {
+			conn.Write([]byte("\033[1;32mGoodbye! Thanks for watching.\033[0m\n"))
+			break
+		}
+		conn.Write([]byte("\033[1;31mSpectators cannot post or send private messages.\033[0m\n"))
+	}
+
+	mutex.Lock()
+	delete(spectators, conn)
+	mutex.Unlock()
+	conn.Close()
+}
@@ -0,0 +1,178 @@
+// Package main contains /stats, the server's and each user's activity since the
+// server started
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsTopSenders is how many of the busiest accounts /stats server lists
+const statsTopSenders = 5
+
+var (
+	statsMutex = &sync.Mutex{}
+	// statsMessages counts the chat and private messages sent since the server started
+	statsMessages int
+	// statsMessagesBy counts them by sending account
+	statsMessagesBy = make(map[string]int)
+	// statsPeakUsers is the most users logged in at once since the server started
+	statsPeakUsers int
+)
+
+// countMessage counts a message from sender in the server's stats
+func countMessage(sender string) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	statsMessages++
+	if sender != "" {
+		statsMessagesBy[sender]++
+	}
+}
+
+// countUsers records how many users are logged in, keeping the peak
+func countUsers(count int) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	if count > statsPeakUsers {
+		statsPeakUsers = count
+	}
+}
+
+// topSenders returns the accounts that sent the most messages since the server
+// started, most first, with their counts
+func topSenders(n int) []ChannelActivity {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	list := make([]ChannelActivity, 0, len(statsMessagesBy))
+	for account, count := range statsMessagesBy {
+		list = append(list, ChannelActivity{Channel: account, Messages: count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Messages != list[j].Messages {
+			return list[i].Messages > list[j].Messages
+		}
+		return list[i].Channel < list[j].Channel
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// formatUptime shows how long the server has run, to the minute
+func formatUptime(d time.Duration) string {
+	d = d.Truncate(time.Minute)
+	days := int(d.Hours()) / 24
+	d -= time.Duration(days) * 24 * time.Hour
+	if days > 0 {
+		return fmt.Sprintf("%dd %dh %dm", days, int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// serverStatsText describes the server: uptime, messages, users, channels and
+// connections
+func serverStatsText() string {
+	mutex.Lock()
+	users := hub.Len()
+	var channels []ChannelActivity
+	for channel, members := range rooms {
+		channels = append(channels, ChannelActivity{Channel: channel, Messages: len(members)})
+	}
+	mutex.Unlock()
+	sort.Slice(channels, func(i, j int) bool {
+		if channels[i].Messages != channels[j].Messages {
+			return channels[i].Messages > channels[j].Messages
+		}
+		return channels[i].Channel < channels[j].Channel
+	})
+
+	statsMutex.Lock()
+	messages, peak := statsMessages, statsPeakUsers
+	statsMutex.Unlock()
+
+	var out strings.Builder
+	out.WriteString("\033[1;36mServer stats:\033[0m\n")
+	out.WriteString(fmt.Sprintf("  Up for %s, since %s\n", formatUptime(time.Since(serverStarted)), serverStarted.UTC().Format("2006-01-02 15:04 MST")))
+	out.WriteString(fmt.Sprintf("  Messages sent: %d\n", messages))
+	if top := topSenders(statsTopSenders); len(top) > 0 {
+		var senders []string
+		for _, a := range top {
+			senders = append(senders, fmt.Sprintf("@%s (%d)", a.Channel, a.Messages))
+		}
+		out.WriteString("  Most messages: " + strings.Join(senders, ", ") + "\n")
+	}
+	out.WriteString(fmt.Sprintf("  Users online: %d (peak %d)\n", users, peak))
+	if maxSessions > 0 {
+		out.WriteString(fmt.Sprintf("  Connections: %d of %d\n", activeSessions.Load(), maxSessions))
+	} else {
+		out.WriteString(fmt.Sprintf("  Connections: %d\n", activeSessions.Load()))
+	}
+	if maxSessionQueue > 0 {
+		out.WriteString(fmt.Sprintf("  Waiting for a place: %d of %d\n", sessionQueue.Len(), maxSessionQueue))
+	}
+	var counts []string
+	for _, c := range channels {
+		counts = append(counts, fmt.Sprintf("%s (%d)", c.Channel, c.Messages))
+	}
+	out.WriteString(fmt.Sprintf("  Channels: %d", len(channels)))
+	if len(counts) > 0 {
+		out.WriteString(": " + strings.Join(counts, ", "))
+	}
+	out.WriteString("\n")
+	return out.String()
+}
+
+// personalStatsText describes an account's activity: messages sent since the server
+// started and stored in total, channels, and sessions
+func personalStatsText(conn net.Conn) (string, error) {
+	mutex.Lock()
+	account := hub.Account(conn)
+	var joined []string
+	for channel := range sessionForLocked(conn).joined {
+		joined = append(joined, channel)
+	}
+	sessionCount := len(hub.ConnsForAccount(account))
+	mutex.Unlock()
+	sort.Strings(joined)
+
+	var stored int
+	if err := readQueryRow("SELECT COUNT(*) FROM messages WHERE sender = ?", account).Scan(&stored); err != nil {
+		return "", err
+	}
+	statsMutex.Lock()
+	sent := statsMessagesBy[account]
+	statsMutex.Unlock()
+
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("\033[1;36mStats for @%s:\033[0m\n", account))
+	out.WriteString(fmt.Sprintf("  Messages sent since the server started: %d\n", sent))
+	out.WriteString(fmt.Sprintf("  Messages stored: %d\n", stored))
+	out.WriteString(fmt.Sprintf("  Channels: %s\n", strings.Join(joined, ", ")))
+	out.WriteString(fmt.Sprintf("  Sessions: %d\n", sessionCount))
+	return out.String(), nil
+}
+
+// handleStatsCommand handles the /stats command
+// Format: /stats [server]
+func handleStatsCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	switch {
+	case len(args) == 0:
+		text, err := personalStatsText(conn)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError retrieving your stats. Please try again.\033[0m\n"))
+			return
+		}
+		conn.Write([]byte(text))
+	case len(args) == 1 && args[0] == "server":
+		conn.Write([]byte(serverStatsText()))
+	default:
+		conn.Write([]byte("\033[1;31mUsage: /stats [server]\033[0m\n"))
+	}
+}
@@ -0,0 +1,225 @@
+// Package main contains away messages and statuses that clear themselves
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStatusDuration caps how long a timed status may last
+const maxStatusDuration = 30 * 24 * time.Hour
+
+var (
+	// statusGen counts each account's status changes, so an expiry timer only
+	// clears the status it was started for
+	statusGen = make(map[string]uint64)
+	// awayReplied records, for each away account, who has had its auto-reply since it went away
+	awayReplied = make(map[string]map[string]bool)
+	statusMutex = &sync.Mutex{}
+)
+
+// setStatus stores an account's status. An away status carries an away message
+// (possibly empty) that is sent back to anyone who messages the account privately.
+// A status with a positive ttl clears itself once it has passed. Any vacation ends.
+func setStatus(account, status string, away sql.NullString, ttl time.Duration) error {
+	var expires sql.NullTime
+	if ttl > 0 {
+		expires = sql.NullTime{Time: clock.Now().UTC().Add(ttl), Valid: true}
+	}
+	_, err := db.Exec("UPDATE users SET status = ?, away_message = ?, status_expires_at = ?, vacation_until = NULL WHERE username = ?",
+		status, away, expires, account)
+	invalidateUser(account)
+	if err != nil {
+		return err
+	}
+
+	statusMutex.Lock()
+	statusGen[account]++
+	gen := statusGen[account]
+	delete(awayReplied, account)
+	statusMutex.Unlock()
+	if ttl > 0 {
+		clock.AfterFunc(ttl, func() { expireStatus(account, gen) })
+	}
+	return nil
+}
+
+// expireStatus clears an account's timed status, unless it has changed since the
+// timer for generation gen was started
+func expireStatus(account string, gen uint64) {
+	statusMutex.Lock()
+	current := statusGen[account] == gen
+	statusMutex.Unlock()
+	if !current {
+		return
+	}
+	if err := setStatus(account, "", sql.NullString{}, 0); err != nil {
+		logger.Error("clearing expired status", "user", account, "err", err)
+		return
+	}
+	bus.Emit(StatusChanged{User: identityForAccount(account), Status: ""})
+}
+
+// identityForAccount returns the identity of one of an account's sessions, or just
+// its name when it isn't logged in here
+func identityForAccount(account string) *UserIdentity {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if conns := connsForAccountLocked(account); len(conns) > 0 {
+		return identityForConnLocked(conns[0])
+	}
+	return &UserIdentity{Account: account, Name: account}
+}
+
+// loadStatusExpiries clears the timed statuses that expired while the server was
+// down and restarts the timers of the others
+func loadStatusExpiries() error {
+	now := clock.Now().UTC()
+	if _, err := db.Exec("UPDATE users SET status = '', away_message = NULL, status_expires_at = NULL, vacation_until = NULL WHERE status_expires_at <= ?", now); err != nil {
+		return err
+	}
+	rows, err := db.Query("SELECT username, status_expires_at FROM users WHERE status_expires_at IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	for rows.Next() {
+		var account string
+		var expires time.Time
+		if err := rows.Scan(&account, &expires); err != nil {
+			return err
+		}
+		statusGen[account]++
+		gen := statusGen[account]
+		clock.AfterFunc(expires.Sub(now), func() { expireStatus(account, gen) })
+	}
+	return rows.Err()
+}
+
+// splitStatusDuration takes a trailing duration such as 30m or 2h off a status
+func splitStatusDuration(text string) (string, time.Duration) {
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return strings.TrimSpace(text), 0
+	}
+	d, err := parsePeriod(fields[len(fields)-1])
+	if err != nil {
+		return strings.TrimSpace(text), 0
+	}
+	return strings.Join(fields[:len(fields)-1], " "), d
+}
+
+// handleStatusCommand handles the /status command. A trailing duration makes the
+// status clear itself, e.g. /status busy 30m.
+// Format: /status <status> [duration]
+func handleStatusCommand(conn net.Conn, message string) {
+	parts := strings.SplitN(message, " ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		conn.Write([]byte("\033[1;31mUsage: /status <set status> [duration]\033[0m\n"))
+		return
+	}
+	newStatus, ttl := splitStatusDuration(parts[1])
+	if ttl > maxStatusDuration {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mA status can last at most %s.\033[0m\n", maxStatusDuration)))
+		return
+	}
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	if err := setStatus(username, newStatus, sql.NullString{}, ttl); err != nil {
+		conn.Write([]byte("\033[1;31mError updating status. Please try again.\033[0m\n"))
+		return
+	}
+
+	if ttl > 0 {
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mYour status has been set to: %s (for %s)\033[0m\n", newStatus, ttl)))
+	} else {
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mYour status has been set to: %s\033[0m\n", newStatus)))
+	}
+	bus.Emit(StatusChanged{User: identityForConn(conn), Status: newStatus})
+}
+
+// handleAwayCommand handles the /away command. Private messages get the away message
+// as an auto-reply until the user's next message clears the away status.
+// Format: /away [message]
+func handleAwayCommand(conn net.Conn, message string) {
+	awayMessage := strings.TrimSpace(strings.TrimPrefix(message, "/away"))
+	if !checkMessageLength(conn, awayMessage) {
+		return
+	}
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	status := "away"
+	if awayMessage != "" {
+		status = "away: " + awayMessage
+	}
+	if err := setStatus(username, status, sql.NullString{String: awayMessage, Valid: true}, 0); err != nil {
+		conn.Write([]byte("\033[1;31mError updating status. Please try again.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte("\033[1;32mYou are now away. Private messages get an auto-reply until you send a message.\033[0m\n"))
+	bus.Emit(StatusChanged{User: identityForConn(conn), Status: status})
+}
+
+// clearAway ends the away status of conn's account when it sends a message. A
+// vacation only ends at its time or with /vacation off.
+func clearAway(conn net.Conn) {
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+	if username == "" {
+		return
+	}
+	user, err := lookupUser(username)
+	if err != nil || !user.away || !user.vacationUntil.IsZero() {
+		return
+	}
+	if err := setStatus(username, "", sql.NullString{}, 0); err != nil {
+		connLogger(conn).Error("clearing away status", "err", err)
+		return
+	}
+	conn.Write([]byte("\033[90mWelcome back, you are no longer away.\033[0m\n"))
+	bus.Emit(StatusChanged{User: identityForConn(conn), Status: ""})
+}
+
+// sendAwayReply answers a private message to an away account with its away message,
+// once per sender for each time the account goes away
+func sendAwayReply(senderConn net.Conn, sender, account string) {
+	if senderConn == nil || strings.EqualFold(strings.TrimPrefix(sender, "@"), account) {
+		return
+	}
+	user, err := lookupUser(account)
+	if err != nil || !user.away {
+		return
+	}
+	statusMutex.Lock()
+	if awayReplied[account] == nil {
+		awayReplied[account] = make(map[string]bool)
+	}
+	replied := awayReplied[account][sender]
+	awayReplied[account][sender] = true
+	statusMutex.Unlock()
+	if replied {
+		return
+	}
+
+	text := fmt.Sprintf("@%s is away.", account)
+	if user.awayMessage != "" {
+		text = fmt.Sprintf("@%s is away: %s", account, user.awayMessage)
+	}
+	if !user.vacationUntil.IsZero() {
+		text = fmt.Sprintf("@%s is on vacation until %s: %s", account, formatVacationEnd(user.vacationUntil), user.awayMessage)
+	}
+	ev := WireEvent{Type: "private", From: "@" + account, Body: "[Auto-reply] " + text, TS: clock.Now().UTC()}
+	writeEvent(senderConn, ev, fmt.Sprintf("\033[90m[Auto-reply] %s\033[0m\n", text))
+}
@@ -0,0 +1,111 @@
+// Package main contains automatic slow mode that throttles the chat during message storms
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// stormThreshold is the number of channel messages per stormWindow that turns on slow mode (0 disables)
+	stormThreshold = 0
+	// stormWindow is the sliding window message volume is measured over
+	stormWindow = 10 * time.Second
+	// slowModeInterval is how long each user must wait between messages while slow mode is on
+	slowModeInterval = 5 * time.Second
+	// stormCooldown is how long volume must stay below half the threshold before slow mode turns off
+	stormCooldown = 30 * time.Second
+
+	stormMutex   = &sync.Mutex{}
+	stormTimes   []time.Time
+	slowMode     bool
+	calmSince    time.Time
+	lastSentTime = make(map[string]time.Time)
+)
+
+// trimStormWindow drops message times older than the window. Callers must hold stormMutex.
+func trimStormWindow(now time.Time) {
+	cutoff := now.Add(-stormWindow)
+	i := 0
+	for i < len(stormTimes) && stormTimes[i].Before(cutoff) {
+		i++
+	}
+	stormTimes = stormTimes[i:]
+}
+
+// allowStormMessage records a channel message from username and reports whether it may be
+// sent. While slow mode is on, it returns how long the user still has to wait.
+func allowStormMessage(username string, now time.Time) (bool, time.Duration) {
+	if stormThreshold <= 0 {
+		return true, 0
+	}
+
+	stormMutex.Lock()
+	if slowMode {
+		if wait := lastSentTime[username].Add(slowModeInterval).Sub(now); wait > 0 {
+			stormMutex.Unlock()
+			return false, wait
+		}
+	}
+	lastSentTime[username] = now
+	trimStormWindow(now)
+	stormTimes = append(stormTimes, now)
+	started := !slowMode && len(stormTimes) > stormThreshold
+	if started {
+		slowMode = true
+		calmSince = time.Time{}
+	}
+	stormMutex.Unlock()
+
+	if started {
+		bus.Broadcast(fmt.Sprintf("\033[1;35m[Slow mode] The chat is very busy. Everyone can send one message every %s until it calms down.\033[0m\n", slowModeInterval))
+	}
+	return true, 0
+}
+
+// checkStormCalmed turns slow mode off once volume has stayed low for the cooldown
+func checkStormCalmed(now time.Time) {
+	stormMutex.Lock()
+	if !slowMode {
+		stormMutex.Unlock()
+		return
+	}
+	trimStormWindow(now)
+	if len(stormTimes) > stormThreshold/2 {
+		calmSince = time.Time{}
+		stormMutex.Unlock()
+		return
+	}
+	if calmSince.IsZero() {
+		calmSince = now
+	}
+	if now.Sub(calmSince) < stormCooldown {
+		stormMutex.Unlock()
+		return
+	}
+	slowMode = false
+	lastSentTime = make(map[string]time.Time)
+	stormMutex.Unlock()
+
+	bus.Broadcast("\033[1;35m[Slow mode] The chat has calmed down. Slow mode is off.\033[0m\n")
+}
+
+// startStormMonitor checks every second whether slow mode can be lifted
+func startStormMonitor() {
+	clock.Every(time.Second, checkStormCalmed)
+}
+
+// checkSlowMode reports whether conn may send a channel message now,
+// telling the user how long to wait if not. Admins are never throttled.
+func checkSlowMode(conn net.Conn, username string) bool {
+	if isAdmin(conn) {
+		return true
+	}
+	ok, wait := allowStormMessage(username, clock.Now())
+	if !ok {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mSlow mode is on. You can send another message in %ds.\033[0m\n", int(wait.Seconds())+1)))
+	}
+	return ok
+}
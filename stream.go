@@ -0,0 +1,219 @@
+// Package main contains the token-gated live transcript stream for channels
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamToken must be presented to read a channel stream; empty disables streaming
+var streamToken = ""
+
+// streamRestricted holds restricted channels the stream token may read anyway
+var streamRestricted = make(map[string]bool)
+
+// streamRestrictedFlag lets -stream-restricted be repeated to open restricted
+// channels to the stream
+type streamRestrictedFlag struct{}
+
+func (streamRestrictedFlag) String() string {
+	return strings.Join(sortedKeys(streamRestricted), ",")
+}
+
+func (streamRestrictedFlag) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimPrefix(strings.TrimSpace(name), "#"); name != "" {
+			streamRestricted["#"+name] = true
+		}
+	}
+	return nil
+}
+
+// FeedMessage is a channel message as seen by stream consumers
+type FeedMessage struct {
+	ID      string        `json:"id"`
+	Seq     int64         `json:"seq"`
+	Channel string        `json:"channel"`
+	From    string        `json:"from"`
+	User    *UserIdentity `json:"user,omitempty"`
+	Body    string        `json:"body"`
+	Tag     string        `json:"tag,omitempty"`
+	Time    time.Time     `json:"ts"`
+}
+
+// MemberDelta reports a single change to a channel's member list, so consumers
+// can keep their list current without re-fetching full snapshots
+type MemberDelta struct {
+	Channel string        `json:"channel"`
+	Op      string        `json:"op"` // "join" or "leave"
+	User    *UserIdentity `json:"user"`
+}
+
+// FeedEvent is one server-sent event: its event name and JSON payload
+type FeedEvent struct {
+	channel string
+	name    string
+	data    interface{}
+}
+
+var (
+	// feedSubscribers maps each subscriber to the channel it follows
+	feedSubscribers = make(map[chan FeedEvent]string)
+	feedMutex       = &sync.Mutex{}
+)
+
+// subscribeFeed starts following a channel's events
+func subscribeFeed(channel string) chan FeedEvent {
+	ch := make(chan FeedEvent, 64)
+	feedMutex.Lock()
+	feedSubscribers[ch] = channel
+	feedMutex.Unlock()
+	return ch
+}
+
+// unsubscribeFeed stops following a channel
+func unsubscribeFeed(ch chan FeedEvent) {
+	feedMutex.Lock()
+	delete(feedSubscribers, ch)
+	feedMutex.Unlock()
+}
+
+// publishEvent hands an event to every subscriber of its channel.
+// Slow subscribers miss events rather than holding up the chat.
+func publishEvent(ev FeedEvent) {
+	feedMutex.Lock()
+	defer feedMutex.Unlock()
+
+	for ch, channel := range feedSubscribers {
+		if channel != ev.channel {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// streamConsumer feeds channel subscribers their channel's messages and member changes
+func streamConsumer(ev Event) {
+	switch ev := ev.(type) {
+	case MessagePosted:
+		publishFeed(FeedMessage{
+			ID:      ev.ID,
+			Seq:     ev.Seq,
+			Channel: ev.Channel,
+			From:    ev.User.Name,
+			User:    ev.User,
+			Body:    ev.Body,
+			Tag:     ev.Tag,
+			Time:    ev.Time,
+		})
+	case UserConnected:
+		publishMemberDelta(defaultChannel, "join", ev.User)
+	case UserDisconnected:
+		for _, channel := range ev.Channels {
+			publishMemberDelta(channel, "leave", ev.User)
+		}
+	case UserJoined:
+		publishMemberDelta(ev.Channel, "join", ev.User)
+	case UserLeft:
+		publishMemberDelta(ev.Channel, "leave", ev.User)
+	}
+}
+
+// publishFeed publishes a chat message to its channel's subscribers
+func publishFeed(msg FeedMessage) {
+	publishEvent(FeedEvent{channel: msg.Channel, name: "message", data: msg})
+}
+
+// publishMemberDelta publishes a member joining or leaving a channel
+func publishMemberDelta(channel, op string, user *UserIdentity) {
+	publishEvent(FeedEvent{channel: channel, name: "member", data: MemberDelta{Channel: channel, Op: op, User: user}})
+}
+
+// registerStreamRoutes adds the channel stream routes to mux
+func registerStreamRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /stream/{channel}", serveChannelStream)
+}
+
+// hasStreamToken checks the token from the query string or Authorization header.
+// EventSource cannot set headers, so browsers pass ?token= instead.
+func hasStreamToken(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return streamToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(streamToken)) == 1
+}
+
+// canStreamChannel reports whether the stream token may read a channel. The token
+// belongs to no account, so channels that are invite-only, need a password or only
+// admit eligible accounts are refused unless listed with -stream-restricted.
+func canStreamChannel(channel string) bool {
+	if streamRestricted[channel] {
+		return true
+	}
+	if ok, _ := checkRoomAccess("", channel, ""); !ok {
+		return false
+	}
+	_, restricted, err := getChannelRestriction(channel)
+	return err == nil && !restricted
+}
+
+// serveChannelStream streams a channel's messages as server-sent events.
+// The channel is given without its leading '#', e.g. /stream/general.
+func serveChannelStream(w http.ResponseWriter, r *http.Request) {
+	if !hasStreamToken(r) {
+		http.Error(w, "invalid stream token", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	channel := "#" + strings.TrimPrefix(r.PathValue("channel"), "#")
+	if !canStreamChannel(channel) {
+		http.Error(w, channel+" has restricted access", http.StatusForbidden)
+		return
+	}
+	feed := subscribeFeed(channel)
+	defer unsubscribeFeed(feed)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprintf(w, ": streaming %s\n\n", channel)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			// A channel restricted after the stream started stops streaming
+			if !canStreamChannel(channel) {
+				return
+			}
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case ev := <-feed:
+			data, err := json.Marshal(ev.data)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, data)
+			flusher.Flush()
+		}
+	}
+}
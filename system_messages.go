@@ -0,0 +1,42 @@
+// Package main contains the marking of genuine server messages and the cleaning of
+// user input that could imitate them
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// systemPrefix starts every server notice shown among chat messages. Chat lines start
+// with a display name or a [#channel] prefix, and display names can't contain '*',
+// so users can't produce it.
+const systemPrefix = "*** "
+
+// systemNotice formats a server notice in an ANSI color, e.g. "1;35"
+func systemNotice(color, text string) string {
+	return fmt.Sprintf("\033[%sm%s%s\033[0m\n", color, systemPrefix, text)
+}
+
+// isSpoofingRune reports whether r could be used to disguise a line: control
+// characters such as ESC or carriage return, and bidirectional overrides
+func isSpoofingRune(r rune) bool {
+	if unicode.IsControl(r) {
+		return true
+	}
+	return (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
+}
+
+// sanitizeInput removes the characters of a line typed by a user that could recolor
+// or rewrite what others see. Tabs become spaces.
+func sanitizeInput(line string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if isSpoofingRune(r) {
+			return -1
+		}
+		return r
+	}, line)
+}
@@ -0,0 +1,172 @@
+// Package main contains message tags and per-user tag subscriptions
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// validTag matches tag names: lowercase letters, digits, '-' and '_'
+var validTag = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// TagFilter is a user's tag subscriptions in one channel
+type TagFilter struct {
+	// follow, when not empty, limits the channel to messages with one of these tags
+	follow map[string]bool
+	// mute hides messages with any of these tags
+	mute map[string]bool
+}
+
+// allows reports whether a message with the given tag passes the filter
+func (f *TagFilter) allows(tag string) bool {
+	if f == nil {
+		return true
+	}
+	if tag != "" && f.mute[tag] {
+		return false
+	}
+	return len(f.follow) == 0 || f.follow[tag]
+}
+
+// parseTaggedMessage splits "<tag>: <message>" into the tag and the message body
+func parseTaggedMessage(text string) (tag, body string, ok bool) {
+	tag, body, found := strings.Cut(text, ":")
+	if !found {
+		return "", "", false
+	}
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	body = strings.TrimSpace(body)
+	if !validTag.MatchString(tag) || body == "" {
+		return "", "", false
+	}
+	return tag, body, true
+}
+
+// loadTagFilters reads a user's tag subscriptions, keyed by channel
+func loadTagFilters(username string) (map[string]*TagFilter, error) {
+	rows, err := db.Query("SELECT channel, tag, mode FROM tag_filters WHERE username = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	filters := make(map[string]*TagFilter)
+	for rows.Next() {
+		var channel, tag, mode string
+		if err := rows.Scan(&channel, &tag, &mode); err != nil {
+			return nil, err
+		}
+		f := filters[channel]
+		if f == nil {
+			f = &TagFilter{follow: make(map[string]bool), mute: make(map[string]bool)}
+			filters[channel] = f
+		}
+		if mode == "follow" {
+			f.follow[tag] = true
+		} else {
+			f.mute[tag] = true
+		}
+	}
+	return filters, rows.Err()
+}
+
+// handleTagCommand handles the /tag command
+// Format: /tag <tag>: <message>
+func handleTagCommand(conn net.Conn, message string) {
+	tag, body, ok := parseTaggedMessage(strings.TrimSpace(strings.TrimPrefix(message, "/tag")))
+	if !ok {
+		conn.Write([]byte("\033[1;31mUsage: /tag <tag>: <message> (tags use a-z, 0-9, '-' and '_')\033[0m\n"))
+		return
+	}
+	sendChannelMessage(conn, body, tag, "", nil)
+}
+
+// handleTagsCommand handles the /tags command
+// Format: /tags [follow|mute|clear <tag>]
+func handleTagsCommand(conn net.Conn, message string) {
+	parts := strings.Fields(message)
+	channel := currentRoom(conn)
+
+	mutex.Lock()
+	username := hub.Account(conn)
+	session := sessions[conn]
+	mutex.Unlock()
+	if session == nil {
+		return
+	}
+
+	if len(parts) == 1 {
+		mutex.Lock()
+		f := session.tags[channel]
+		var follow, mute []string
+		if f != nil {
+			for tag := range f.follow {
+				follow = append(follow, tag)
+			}
+			for tag := range f.mute {
+				mute = append(mute, tag)
+			}
+		}
+		mutex.Unlock()
+		sort.Strings(follow)
+		sort.Strings(mute)
+		if len(follow) == 0 && len(mute) == 0 {
+			conn.Write([]byte(fmt.Sprintf("\033[90mNo tag filters in %s.\033[0m\n", channel)))
+			return
+		}
+		if len(follow) > 0 {
+			conn.Write([]byte(fmt.Sprintf("\033[90mFollowing in %s: %s\033[0m\n", channel, strings.Join(follow, ", "))))
+		}
+		if len(mute) > 0 {
+			conn.Write([]byte(fmt.Sprintf("\033[90mMuted in %s: %s\033[0m\n", channel, strings.Join(mute, ", "))))
+		}
+		return
+	}
+
+	if len(parts) != 3 || (parts[1] != "follow" && parts[1] != "mute" && parts[1] != "clear") {
+		conn.Write([]byte("\033[1;31mUsage: /tags [follow|mute|clear <tag>]\033[0m\n"))
+		return
+	}
+	mode, tag := parts[1], strings.ToLower(parts[2])
+	if !validTag.MatchString(tag) {
+		conn.Write([]byte("\033[1;31mInvalid tag.\033[0m\n"))
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM tag_filters WHERE username = ? AND channel = ? AND tag = ?", username, channel, tag)
+	if err == nil && mode != "clear" {
+		_, err = db.Exec("INSERT INTO tag_filters (username, channel, tag, mode) VALUES (?, ?, ?, ?)", username, channel, tag, mode)
+	}
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError saving tag filter.\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	f := session.tags[channel]
+	if f == nil {
+		f = &TagFilter{follow: make(map[string]bool), mute: make(map[string]bool)}
+		session.tags[channel] = f
+	}
+	delete(f.follow, tag)
+	delete(f.mute, tag)
+	switch mode {
+	case "follow":
+		f.follow[tag] = true
+	case "mute":
+		f.mute[tag] = true
+	}
+	mutex.Unlock()
+
+	switch mode {
+	case "follow":
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mFollowing [%s] in %s. Only followed tags are shown there now.\033[0m\n", tag, channel)))
+	case "mute":
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mMuted [%s] in %s.\033[0m\n", tag, channel)))
+	default:
+		conn.Write([]byte(fmt.Sprintf("\033[1;32mCleared filter for [%s] in %s.\033[0m\n", tag, channel)))
+	}
+}
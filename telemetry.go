@@ -0,0 +1,121 @@
+// Package main contains opt-in anonymous usage statistics
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// telemetryEnabled turns on periodic recording of aggregate stats
+	telemetryEnabled = false
+	// telemetryInterval is how often a stats sample is recorded
+	telemetryInterval = time.Hour
+	// telemetryEndpoint, if set, receives each sample as a JSON POST
+	telemetryEndpoint = ""
+
+	// Counters for the current sampling window
+	telemetryMutex    = &sync.Mutex{}
+	telemetryMessages = 0
+	telemetryPeak     = 0
+)
+
+// TelemetrySample is the aggregate data recorded for one interval.
+// It must never contain usernames or message content.
+type TelemetrySample struct {
+	RecordedAt   time.Time `json:"recorded_at"`
+	PeakUsers    int       `json:"peak_users"`
+	CurrentUsers int       `json:"current_users"`
+	Messages     int       `json:"messages"`
+}
+
+// recordMessageSent counts a delivered chat message from sender in the current
+// window and in the server's /stats. Samples only ever get the total.
+func recordMessageSent(sender string) {
+	telemetryMutex.Lock()
+	telemetryMessages++
+	telemetryMutex.Unlock()
+	countMessage(sender)
+}
+
+// recordUserCount updates the peak user count for the current window and /stats
+func recordUserCount(count int) {
+	telemetryMutex.Lock()
+	if count > telemetryPeak {
+		telemetryPeak = count
+	}
+	telemetryMutex.Unlock()
+	countUsers(count)
+}
+
+// takeTelemetrySample returns the stats for the window that just ended and starts a new one
+func takeTelemetrySample() TelemetrySample {
+	mutex.Lock()
+	current := hub.Len()
+	mutex.Unlock()
+
+	telemetryMutex.Lock()
+	defer telemetryMutex.Unlock()
+
+	sample := TelemetrySample{
+		RecordedAt:   time.Now().UTC(),
+		PeakUsers:    telemetryPeak,
+		CurrentUsers: current,
+		Messages:     telemetryMessages,
+	}
+	if current > sample.PeakUsers {
+		sample.PeakUsers = current
+	}
+	telemetryMessages = 0
+	telemetryPeak = current
+	return sample
+}
+
+// saveTelemetrySample stores a sample in the local telemetry table
+func saveTelemetrySample(sample TelemetrySample) error {
+	_, err := db.Exec("INSERT INTO telemetry (recorded_at, peak_users, current_users, messages) VALUES (?, ?, ?, ?)",
+		sample.RecordedAt, sample.PeakUsers, sample.CurrentUsers, sample.Messages)
+	return err
+}
+
+// reportTelemetrySample sends a sample to the configured endpoint
+func reportTelemetrySample(sample TelemetrySample) error {
+	body, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(telemetryEndpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("telemetry endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// runTelemetry records a sample every telemetryInterval until the process exits
+func runTelemetry() {
+	ticker := time.NewTicker(telemetryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sample := takeTelemetrySample()
+		if err := saveTelemetrySample(sample); err != nil {
+			logger.Error("saving telemetry", "err", err)
+		}
+		if telemetryEndpoint != "" {
+			if err := reportTelemetrySample(sample); err != nil {
+				logger.Error("reporting telemetry", "err", err)
+			}
+		}
+	}
+}
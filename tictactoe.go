@@ -0,0 +1,75 @@
+// Package main contains tic-tac-toe, the first game on the game framework
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ticTacToeLines are the rows, columns and diagonals that win, as board indexes
+var ticTacToeLines = [8][3]int{
+	{0, 1, 2}, {3, 4, 5}, {6, 7, 8},
+	{0, 3, 6}, {1, 4, 7}, {2, 5, 8},
+	{0, 4, 8}, {2, 4, 6},
+}
+
+// ticTacToe is a 3x3 board stored as nine characters: X, O, or . for an empty square.
+// The first player is X.
+type ticTacToe struct{}
+
+func (ticTacToe) Title() string { return "Tic-tac-toe" }
+
+func (ticTacToe) Sides() [2]string { return [2]string{"X", "O"} }
+
+func (ticTacToe) Start() string { return "........." }
+
+func (ticTacToe) MoveHelp() string {
+	return "a square from 1 to 9, numbered left to right from the top"
+}
+
+func (ticTacToe) Move(state string, player int, move string) (string, error) {
+	square, err := strconv.Atoi(move)
+	if err != nil || square < 1 || square > 9 {
+		return "", fmt.Errorf("pick a square from 1 to 9")
+	}
+	if state[square-1] != '.' {
+		return "", fmt.Errorf("square %d is taken", square)
+	}
+	board := []byte(state)
+	board[square-1] = "XO"[player]
+	return string(board), nil
+}
+
+func (ticTacToe) Result(state string) (bool, int) {
+	for _, line := range ticTacToeLines {
+		if c := state[line[0]]; c != '.' && c == state[line[1]] && c == state[line[2]] {
+			return true, strings.IndexByte("XO", c)
+		}
+	}
+	if !strings.Contains(state, ".") {
+		return true, -1
+	}
+	return false, 0
+}
+
+// Render draws the board, showing the numbers of the free squares
+func (ticTacToe) Render(state string) string {
+	var out strings.Builder
+	for row := 0; row < 3; row++ {
+		if row > 0 {
+			out.WriteString("  ---+---+---\n")
+		}
+		cells := make([]string, 3)
+		for col := range cells {
+			i := row*3 + col
+			if state[i] == '.' {
+				cells[col] = fmt.Sprintf("\033[90m%d\033[0m", i+1)
+			} else {
+				cells[col] = string(state[i])
+			}
+		}
+		out.WriteString("   " + strings.Join(cells, " | ") + "\n")
+	}
+	return out.String()
+}
@@ -0,0 +1,71 @@
+// Package main contains message timestamps shown in each user's preferred time zone
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	// Time zone data is embedded so /timezone works on hosts without a zoneinfo database
+	_ "time/tzdata"
+)
+
+// timestamp formats the prefix of a delivered message for a recipient's session.
+// A nil session, such as a spectator's, sees UTC.
+func timestamp(s *Session, t time.Time) string {
+	loc := time.UTC
+	if s != nil && s.location != nil {
+		loc = s.location
+	}
+	return fmt.Sprintf("\033[90m[%s]\033[0m ", t.In(loc).Format("15:04"))
+}
+
+// userLocation returns the time zone of the user on conn
+func userLocation(conn net.Conn) *time.Location {
+	return sessionLocation(sessionFor(conn))
+}
+
+// sessionLocation returns the time zone of a session
+func sessionLocation(s *Session) *time.Location {
+	if s.location != nil {
+		return s.location
+	}
+	return time.UTC
+}
+
+// handleTimezoneCommand handles the /timezone command
+// Format: /timezone [IANA zone, e.g. Europe/Berlin]
+func handleTimezoneCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) == 0 {
+		loc := userLocation(conn)
+		conn.Write([]byte(fmt.Sprintf("\033[1;33mYour time zone is %s (now %s).\033[0m\n", loc, time.Now().In(loc).Format("15:04 MST"))))
+		return
+	}
+	if len(args) != 1 {
+		conn.Write([]byte("\033[1;31mUsage: /timezone <zone, e.g. Europe/Berlin>\033[0m\n"))
+		return
+	}
+
+	loc, err := time.LoadLocation(args[0])
+	if err != nil || args[0] == "" || args[0] == "Local" {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mUnknown time zone %s. Use an IANA name such as America/New_York or UTC.\033[0m\n", args[0])))
+		return
+	}
+
+	mutex.Lock()
+	username := hub.Account(conn)
+	if s, ok := sessions[conn]; ok {
+		s.location = loc
+	}
+	mutex.Unlock()
+
+	if username != "" {
+		if _, err := db.Exec("UPDATE users SET timezone = ? WHERE username = ?", loc.String(), username); err != nil {
+			conn.Write([]byte("\033[1;31mError saving time zone.\033[0m\n"))
+			return
+		}
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mTimes are now shown in %s (now %s).\033[0m\n", loc, time.Now().In(loc).Format("15:04 MST"))))
+}
@@ -0,0 +1,93 @@
+// Package main contains typing indicators for channels and private conversations
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// typingInterval is the shortest time between two typing signals from one
+// connection to the same target; signals in between are dropped
+var typingInterval = 3 * time.Second
+
+// typingSent records when each connection last signalled typing, keyed by target
+// (a channel, or a private recipient); guarded by mutex
+var typingSent = make(map[net.Conn]map[string]time.Time)
+
+// allowTypingLocked reports whether conn may signal typing to target now, and
+// records the signal if so. Callers must hold mutex.
+func allowTypingLocked(conn net.Conn, target string, now time.Time) bool {
+	sent := typingSent[conn]
+	if sent == nil {
+		sent = make(map[string]time.Time)
+		typingSent[conn] = sent
+	}
+	if last, ok := sent[target]; ok && now.Sub(last) < typingInterval {
+		return false
+	}
+	sent[target] = now
+	return true
+}
+
+// handleTypingCommand handles the /typing command. Without a name it tells the
+// current channel; with one it tells that user only.
+// Format: /typing [name|@account]
+func handleTypingCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) > 1 {
+		conn.Write([]byte("\033[1;31mUsage: /typing [name|@account]\033[0m\n"))
+		return
+	}
+
+	mutex.Lock()
+	name := hub.Name(conn)
+	session := sessions[conn]
+	if session == nil {
+		mutex.Unlock()
+		return
+	}
+
+	var targets []net.Conn
+	ev := WireEvent{Type: "typing", From: name, TS: clock.Now().UTC()}
+	text := fmt.Sprintf("\033[90m%s is typing...\033[0m\n", name)
+	target := session.room
+	if len(args) == 0 {
+		ev.Room = session.room
+		for member := range rooms[session.room] {
+			if member != conn {
+				targets = append(targets, member)
+			}
+		}
+	} else if strings.HasPrefix(args[0], "@") {
+		target = args[0]
+		ev.To = args[0]
+		targets = connsForAccountLocked(strings.TrimPrefix(args[0], "@"))
+		text = fmt.Sprintf("\033[90m%s is typing a private message...\033[0m\n", name)
+	} else {
+		recipient, _, _ := resolveRecipientLocked(args[0])
+		target = recipient
+		ev.To = recipient
+		if c, ok := hub.ByName(recipient); ok {
+			targets = accountSessionsLocked(c)
+		}
+		text = fmt.Sprintf("\033[90m%s is typing a private message...\033[0m\n", name)
+	}
+
+	if len(args) == 1 && len(targets) == 0 {
+		mutex.Unlock()
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mUser %s is not online.\033[0m\n", args[0])))
+		return
+	}
+	if !allowTypingLocked(conn, target, clock.Now()) {
+		mutex.Unlock()
+		return
+	}
+	mutex.Unlock()
+
+	// Typing signals go straight to their recipients, never through broadcast
+	for _, c := range targets {
+		writeEvent(c, ev, text)
+	}
+}
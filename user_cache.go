@@ -0,0 +1,163 @@
+// Package main contains the in-memory cache that saves database round-trips on user lookups
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+var (
+	// userCacheSize is how many accounts are cached (0 disables the cache)
+	userCacheSize = 1000
+	// userCacheTTL bounds how stale an entry may get when another process, such as
+	// `chat-server users`, changes the database behind the server's back
+	userCacheTTL = 30 * time.Second
+
+	userCache = newLRUCache()
+
+	// allUsers caches the /users listing until any account is added or changed
+	allUsers       map[string]string
+	allUsersLoaded time.Time
+	allUsersMutex  = &sync.Mutex{}
+
+	userCacheHits   = newCounter("user_cache_hits")
+	userCacheMisses = newCounter("user_cache_misses")
+)
+
+// userRecord holds the account fields read on hot paths
+type userRecord struct {
+	exists   bool
+	status   string
+	role     string
+	disabled bool
+	// away is set while the account is away; awayMessage is its auto-reply
+	away        bool
+	awayMessage string
+	// vacationUntil is when the account's vacation ends, zero when it isn't on one
+	vacationUntil time.Time
+}
+
+// cacheEntry is one cached account in the LRU list
+type cacheEntry struct {
+	username string
+	record   userRecord
+	loaded   time.Time
+}
+
+// lruCache keeps the most recently used accounts, evicting the least recently used
+type lruCache struct {
+	mu      sync.Mutex
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+	// gen changes on every removal, so a load that raced with a write isn't cached
+	gen uint64
+}
+
+// newLRUCache returns an empty cache
+func newLRUCache() *lruCache {
+	return &lruCache{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns a fresh cached record for username
+func (c *lruCache) get(username string, now time.Time) (userRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[username]
+	if !ok {
+		return userRecord{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if now.Sub(entry.loaded) > userCacheTTL {
+		c.order.Remove(el)
+		delete(c.entries, username)
+		return userRecord{}, false
+	}
+	c.order.MoveToFront(el)
+	return entry.record, true
+}
+
+// generation returns the current removal generation
+func (c *lruCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put caches record for username, evicting the oldest entry if the cache is full.
+// Records loaded before a removal in generation gen are discarded.
+func (c *lruCache) put(username string, record userRecord, now time.Time, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.entries[username]; ok {
+		el.Value = &cacheEntry{username: username, record: record, loaded: now}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[username] = c.order.PushFront(&cacheEntry{username: username, record: record, loaded: now})
+	for c.order.Len() > userCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).username)
+	}
+}
+
+// remove drops username from the cache
+func (c *lruCache) remove(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if el, ok := c.entries[username]; ok {
+		c.order.Remove(el)
+		delete(c.entries, username)
+	}
+}
+
+// lookupUser returns an account's cached fields, loading them on a miss
+func lookupUser(username string) (userRecord, error) {
+	now := clock.Now()
+	if userCacheSize > 0 {
+		if record, ok := userCache.get(username, now); ok {
+			userCacheHits.Add(1)
+			return record, nil
+		}
+	}
+	userCacheMisses.Add(1)
+
+	gen := userCache.generation()
+	record := userRecord{exists: true}
+	var away sql.NullString
+	var vacationUntil sql.NullTime
+	err := db.QueryRow("SELECT status, role, disabled, away_message, vacation_until FROM users WHERE username = ?", username).
+		Scan(&record.status, &record.role, &record.disabled, &away, &vacationUntil)
+	record.away, record.awayMessage, record.vacationUntil = away.Valid, away.String, vacationUntil.Time
+	if err == sql.ErrNoRows {
+		record = userRecord{}
+	} else if err != nil {
+		return userRecord{}, err
+	}
+	if userCacheSize > 0 {
+		userCache.put(username, record, now, gen)
+	}
+	return record, nil
+}
+
+// resetUserCache empties the cache, e.g. when a different database is opened
+func resetUserCache() {
+	userCache = newLRUCache()
+	allUsersMutex.Lock()
+	allUsers = nil
+	allUsersMutex.Unlock()
+}
+
+// invalidateUser forgets everything cached about an account after it is written
+func invalidateUser(username string) {
+	userCache.remove(username)
+	allUsersMutex.Lock()
+	allUsers = nil
+	allUsersMutex.Unlock()
+}
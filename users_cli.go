@@ -0,0 +1,182 @@
+// Package main contains the `users` subcommand for bulk account import and export
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// usersCSVHeader is the column layout used by import and export
+var usersCSVHeader = []string{"username", "password", "role", "status", "disabled"}
+
+// runUsersCommand implements `chat-server users import <file>` and `chat-server users export [file]`
+func runUsersCommand(args []string) error {
+	fs := newCommandFlags("users")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	args = fs.Args()
+
+	if len(args) < 1 {
+		return errors.New("usage: chat-server users import <file.csv> | export [file.csv]")
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer closeDB()
+
+	switch args[0] {
+	case "import":
+		if len(args) != 2 {
+			return errors.New("usage: chat-server users import <file.csv>")
+		}
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		created, skipped, err := importUsersCSV(f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d users, skipped %d\n", created, skipped)
+		return nil
+	case "export":
+		out := os.Stdout
+		if len(args) == 2 {
+			f, err := os.Create(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		return exportUsersCSV(out)
+	default:
+		return fmt.Errorf("unknown users command %q", args[0])
+	}
+}
+
+// isBcryptHash reports whether a password column already holds a bcrypt hash
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// importUsersCSV creates an account for each CSV row.
+// Columns are username, password, and optionally role, status and disabled, as
+// written by exportUsersCSV; a header row is allowed. Passwords may be plain text
+// (checked like at registration and hashed on import) or existing bcrypt hashes.
+// Rows for usernames that already exist are skipped.
+func importUsersCSV(r io.Reader) (created, skipped int, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	line := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return created, skipped, err
+		}
+		line++
+		if line == 1 && strings.EqualFold(record[0], "username") {
+			continue
+		}
+		if len(record) < 2 {
+			return created, skipped, fmt.Errorf("line %d: expected at least username and password", line)
+		}
+
+		username := strings.TrimSpace(record[0])
+		password := strings.TrimSpace(record[1])
+		role := roleUser
+		if len(record) > 2 && strings.TrimSpace(record[2]) != "" {
+			role = strings.TrimSpace(record[2])
+		}
+		if !isValidRole(role) {
+			return created, skipped, fmt.Errorf("line %d: unknown role %q", line, role)
+		}
+		if err := validateUsername(username); err != nil {
+			return created, skipped, fmt.Errorf("line %d: %v", line, err)
+		}
+		if !isBcryptHash(password) && (password == "" || len(password) > maxPasswordLength) {
+			return created, skipped, fmt.Errorf("line %d: password must be 1 to %d characters", line, maxPasswordLength)
+		}
+		status := ""
+		if len(record) > 3 {
+			status = strings.TrimSpace(record[3])
+		}
+		disabled := false
+		if len(record) > 4 && strings.TrimSpace(record[4]) != "" {
+			if disabled, err = strconv.ParseBool(strings.TrimSpace(record[4])); err != nil {
+				return created, skipped, fmt.Errorf("line %d: disabled must be true or false", line)
+			}
+		}
+
+		exists, err := userExists(username)
+		if err != nil {
+			return created, skipped, err
+		}
+		if exists {
+			skipped++
+			continue
+		}
+
+		if isBcryptHash(password) {
+			err = saveUserWithHash(username, password, role)
+		} else {
+			err = saveUser(username, password)
+			if err == nil && role != roleUser {
+				err = setUserRole(username, role)
+			}
+		}
+		if err == nil && status != "" {
+			err = updateUserStatus(username, status)
+		}
+		if err == nil && disabled {
+			err = setUserDisabled(username, true)
+		}
+		if err != nil {
+			return created, skipped, fmt.Errorf("line %d: %v", line, err)
+		}
+		created++
+	}
+	return created, skipped, nil
+}
+
+// exportUsersCSV writes every account, with its password hash, as CSV
+func exportUsersCSV(w io.Writer) error {
+	rows, err := db.Query("SELECT username, password, role, status, disabled FROM users ORDER BY username")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(usersCSVHeader); err != nil {
+		return err
+	}
+	for rows.Next() {
+		var username, password, role, status string
+		var disabled bool
+		if err := rows.Scan(&username, &password, &role, &status, &disabled); err != nil {
+			return err
+		}
+		if err := writer.Write([]string{username, password, role, status, fmt.Sprint(disabled)}); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,109 @@
+// Package main contains vacation mode, a long away status with an auto-reply that ends
+// at a set time
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// maxVacation caps how long a vacation may last
+const maxVacation = 90 * 24 * time.Hour
+
+// parseVacationEnd reads when a vacation ends: a date, meaning the start of that day
+// in loc, or a period from now such as 10d
+func parseVacationEnd(text string, loc *time.Location, now time.Time) (time.Time, error) {
+	until, err := time.ParseInLocation("2006-01-02", text, loc)
+	if err != nil {
+		d, perr := parsePeriod(text)
+		if perr != nil {
+			return time.Time{}, fmt.Errorf("expected a date like 2006-01-02 or a period like 10d")
+		}
+		until = now.Add(d)
+	}
+	if !until.After(now) {
+		return time.Time{}, fmt.Errorf("the vacation must end in the future")
+	}
+	if until.Sub(now) > maxVacation {
+		return time.Time{}, fmt.Errorf("a vacation can last at most %d days", int(maxVacation.Hours()/24))
+	}
+	return until, nil
+}
+
+// formatVacationEnd shows when a vacation ends, in UTC for people in any time zone
+func formatVacationEnd(until time.Time) string {
+	return until.UTC().Format("2006-01-02 15:04 MST")
+}
+
+// setVacation makes an account away until a time, with message as its auto-reply.
+// The status clears itself at that time.
+func setVacation(account string, until time.Time, message string) (string, error) {
+	status := "on vacation until " + formatVacationEnd(until)
+	if err := setStatus(account, status, sql.NullString{String: message, Valid: true}, until.Sub(clock.Now())); err != nil {
+		return "", err
+	}
+	_, err := db.Exec("UPDATE users SET vacation_until = ? WHERE username = ?", until.UTC(), account)
+	invalidateUser(account)
+	return status, err
+}
+
+// handleVacationCommand handles the /vacation command. Private messages get the
+// message as an auto-reply, and mentions are left out of welcome-back summaries,
+// until the vacation ends.
+// Format: /vacation <date|period> <message> | /vacation off | /vacation
+func handleVacationCommand(conn net.Conn, message string) {
+	parts := strings.SplitN(message, " ", 3)
+	mutex.Lock()
+	username := hub.Account(conn)
+	mutex.Unlock()
+
+	if len(parts) == 1 || parts[1] == "off" {
+		user, err := lookupUser(username)
+		if err != nil {
+			conn.Write([]byte("\033[1;31mError checking your vacation. Please try again.\033[0m\n"))
+			return
+		}
+		if user.vacationUntil.IsZero() {
+			conn.Write([]byte("\033[1;33mYou are not on vacation. Start one with /vacation <date|period> <message>.\033[0m\n"))
+			return
+		}
+		if len(parts) == 1 {
+			conn.Write([]byte(fmt.Sprintf("\033[1;33mYou are on vacation until %s: %s\033[0m\n",
+				user.vacationUntil.In(userLocation(conn)).Format("2006-01-02 15:04 MST"), user.awayMessage)))
+			return
+		}
+		if err := setStatus(username, "", sql.NullString{}, 0); err != nil {
+			conn.Write([]byte("\033[1;31mError updating status. Please try again.\033[0m\n"))
+			return
+		}
+		conn.Write([]byte("\033[1;32mWelcome back, your vacation has ended.\033[0m\n"))
+		bus.Emit(StatusChanged{User: identityForConn(conn), Status: ""})
+		return
+	}
+
+	if len(parts) != 3 || strings.TrimSpace(parts[2]) == "" {
+		conn.Write([]byte("\033[1;31mUsage: /vacation <date|period> <message> | /vacation off\033[0m\n"))
+		return
+	}
+	until, err := parseVacationEnd(parts[1], userLocation(conn), clock.Now())
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mInvalid end of vacation: %v.\033[0m\n", err)))
+		return
+	}
+	reply := strings.TrimSpace(parts[2])
+	if !checkMessageLength(conn, reply) {
+		return
+	}
+
+	status, err := setVacation(username, until, reply)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError updating status. Please try again.\033[0m\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("\033[1;32mYou are on vacation until %s. Private messages get your auto-reply, and mentions are muted, until then or /vacation off.\033[0m\n",
+		until.In(userLocation(conn)).Format("2006-01-02 15:04 MST"))))
+	bus.Emit(StatusChanged{User: identityForConn(conn), Status: status})
+}
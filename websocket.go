@@ -0,0 +1,224 @@
+// Package main contains the WebSocket endpoint that lets browsers speak the chat protocol
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// websocketEnabled exposes /ws on the HTTP server
+var websocketEnabled = false
+
+// websocketGUID is the fixed key suffix from RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketFrame caps the payload of a single incoming frame
+const maxWebSocketFrame = 64 * 1024
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+var errFrameTooLarge = errors.New("websocket frame too large")
+
+// wsConn adapts a WebSocket to net.Conn so handleClient can serve it like a TCP client.
+// Each incoming text frame is one line of input; each Write is sent as one text frame.
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+	// pending holds the unread part of the last frame's payload
+	pending []byte
+	// writeMutex keeps frames from interleaving when several goroutines write
+	writeMutex sync.Mutex
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept value for a client key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether a comma-separated header lists token, ignoring case
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range strings.Split(h.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveWebSocket upgrades the request and runs the chat protocol over it
+func serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	// Like the TCP listener, take no clients while standing by or shutting down
+	if !chatListening.Load() {
+		http.Error(w, "Not accepting clients", http.StatusServiceUnavailable)
+		return
+	}
+	if !acquireSession() {
+		rejectedSessions.Add(1)
+		http.Error(w, "Server full", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseSession()
+	raw, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		raw.Close()
+		return
+	}
+
+	handleClient(wrapClientConn(&wsConn{Conn: newTimeoutConn(raw), reader: rw.Reader}))
+}
+
+// readFrame reads one frame, returning its opcode, FIN bit and unmasked payload
+func (c *wsConn) readFrame() (byte, bool, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return 0, false, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, false, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, false, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketFrame {
+		return 0, false, nil, errFrameTooLarge
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return 0, false, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return 0, false, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, fin, payload, nil
+}
+
+// writeFrame sends one unmasked frame, as servers must
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	_, err := c.Conn.Write(append(header, payload...))
+	return err
+}
+
+// Read returns chat input; every complete text message ends with a newline
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		opcode, fin, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case wsText, wsBinary, wsContinuation:
+			if fin && (len(payload) == 0 || payload[len(payload)-1] != '\n') {
+				payload = append(payload, '\n')
+			}
+			c.pending = payload
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+		case wsClose:
+			c.writeFrame(wsClose, nil)
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends output as a text frame. Telnet commands meant for terminals are
+// dropped, since they aren't valid text.
+func (c *wsConn) Write(p []byte) (int, error) {
+	text := stripTelnetCommands(string(p))
+	if text == "" {
+		return len(p), nil
+	}
+	if err := c.writeFrame(wsText, []byte(text)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Probe checks the connection with a ping frame
+func (c *wsConn) Probe() error {
+	return c.writeFrame(wsPing, nil)
+}
+
+// Close sends a close frame before closing the socket
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, nil)
+	return c.Conn.Close()
+}
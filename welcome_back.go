@@ -0,0 +1,196 @@
+// Package main contains the catch-up summary shown to returning users at login
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// welcomeBackMaxWindow caps how far back the summary looks, however long the user was away
+	welcomeBackMaxWindow = 7 * 24 * time.Hour
+	// welcomeBackTopChannels is how many of the most active channels are listed
+	welcomeBackTopChannels = 3
+	// welcomeBackMentionScan caps the messages searched for mentions
+	welcomeBackMentionScan = 5000
+)
+
+// WelcomeBackSummary is what happened while an account was away
+type WelcomeBackSummary struct {
+	Since     time.Time
+	UnreadPMs int
+	// Mentions counts the messages that mentioned the account, by channel
+	Mentions map[string]int
+	// TopChannels are the busiest channels, most messages first
+	TopChannels []ChannelActivity
+	// Vacation is set while the account is on vacation, which mutes mentions
+	Vacation bool
+}
+
+// ChannelActivity is how many messages a channel had
+type ChannelActivity struct {
+	Channel  string
+	Messages int
+}
+
+// recordLastSeen stores when an account's last session ended
+func recordLastSeen(account string) {
+	if _, err := db.Exec("UPDATE users SET last_seen_at = ? WHERE username = ?", time.Now().UTC(), account); err != nil {
+		logger.Error("recording last seen", "user", account, "err", err)
+	}
+}
+
+// getLastSeen returns when an account's last session ended; ok is false if it never has
+func getLastSeen(account string) (time.Time, bool, error) {
+	var seen sql.NullTime
+	err := db.QueryRow("SELECT last_seen_at FROM users WHERE username = ?", account).Scan(&seen)
+	return seen.Time, seen.Valid, err
+}
+
+// mentions reports whether body mentions any of names as @name. The name must end
+// there, so @al doesn't match a mention of @alice.
+func mentions(body string, names []string) bool {
+	lower := strings.ToLower(body)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		at := "@" + strings.ToLower(name)
+		for rest := lower; ; {
+			i := strings.Index(rest, at)
+			if i < 0 {
+				break
+			}
+			rest = rest[i+len(at):]
+			if next := []rune(rest + " ")[0]; !unicode.IsLetter(next) && !unicode.IsDigit(next) && next != '_' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// buildWelcomeBack summarizes what an account missed since it was last seen. Mentions
+// of the account name or the display name count.
+func buildWelcomeBack(account, name string, since time.Time) (WelcomeBackSummary, error) {
+	s := WelcomeBackSummary{Since: since, Mentions: make(map[string]int)}
+	err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE recipient = ? AND offline = 1 AND delivered_at IS NULL", account).Scan(&s.UnreadPMs)
+	if err != nil {
+		return s, err
+	}
+
+	// Encrypted bodies are only checked for mentions once decrypted
+	mentionFilter := " AND body LIKE '%@%'"
+	if storageCipher != nil {
+		mentionFilter = ""
+	}
+	rows, err := db.Query(`SELECT channel, body FROM messages WHERE seq IS NOT NULL AND created_at >= ? AND sender != ?`+
+		mentionFilter+` ORDER BY id DESC LIMIT ?`, since, account, welcomeBackMentionScan)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel, body string
+		if err := rows.Scan(&channel, &body); err != nil {
+			return s, err
+		}
+		if mentions(openBody(body), []string{account, name}) {
+			s.Mentions[channel]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+
+	top, err := db.Query(`SELECT channel, COUNT(*) AS n FROM messages WHERE seq IS NOT NULL AND created_at >= ?
+		GROUP BY channel ORDER BY n DESC, channel LIMIT ?`, since, welcomeBackTopChannels)
+	if err != nil {
+		return s, err
+	}
+	defer top.Close()
+	for top.Next() {
+		var a ChannelActivity
+		if err := top.Scan(&a.Channel, &a.Messages); err != nil {
+			return s, err
+		}
+		s.TopChannels = append(s.TopChannels, a)
+	}
+	return s, top.Err()
+}
+
+// String renders the summary as a few short lines
+func (s WelcomeBackSummary) String() string {
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("\033[1;36mWelcome back! Since %s:\033[0m\n", s.Since.Format("Jan 2 15:04 MST")))
+	out.WriteString(fmt.Sprintf("  %d unread private message(s)\n", s.UnreadPMs))
+
+	total := 0
+	var where []string
+	for _, a := range sortedMentions(s.Mentions) {
+		total += a.Messages
+		where = append(where, fmt.Sprintf("%s (%d)", a.Channel, a.Messages))
+	}
+	if s.Vacation {
+		out.WriteString("  mentions are muted while you are on vacation\n")
+	} else if total == 0 {
+		out.WriteString("  no mentions\n")
+	} else {
+		out.WriteString(fmt.Sprintf("  %d mention(s) in %s\n", total, strings.Join(where, ", ")))
+	}
+
+	if len(s.TopChannels) > 0 {
+		var busiest []string
+		for _, a := range s.TopChannels {
+			busiest = append(busiest, fmt.Sprintf("%s (%d)", a.Channel, a.Messages))
+		}
+		out.WriteString("  most active: " + strings.Join(busiest, ", ") + "\n")
+	}
+	return out.String()
+}
+
+// sortedMentions lists mention counts by channel, most mentions first
+func sortedMentions(counts map[string]int) []ChannelActivity {
+	list := make([]ChannelActivity, 0, len(counts))
+	for channel, n := range counts {
+		list = append(list, ChannelActivity{Channel: channel, Messages: n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Messages != list[j].Messages {
+			return list[i].Messages > list[j].Messages
+		}
+		return list[i].Channel < list[j].Channel
+	})
+	return list
+}
+
+// sendWelcomeBack shows a returning user what they missed since their last session
+// ended. Accounts that have never logged out, such as new ones, get nothing.
+func sendWelcomeBack(conn net.Conn, account, name string) {
+	seen, ok, err := getLastSeen(account)
+	if err != nil {
+		connLogger(conn).Error("loading last seen", "err", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	if oldest := time.Now().UTC().Add(-welcomeBackMaxWindow); seen.Before(oldest) {
+		seen = oldest
+	}
+	summary, err := buildWelcomeBack(account, name, seen)
+	if err != nil {
+		connLogger(conn).Error("building welcome back summary", "err", err)
+		return
+	}
+	if user, err := lookupUser(account); err == nil && !user.vacationUntil.IsZero() {
+		summary.Vacation = true
+	}
+	summary.Since = summary.Since.In(userLocation(conn))
+	conn.Write([]byte(summary.String()))
+}
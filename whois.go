@@ -0,0 +1,120 @@
+// Package main contains /whois, which shows who is behind a display name or account
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// whoisSession is what /whois shows about one logged in connection
+type whoisSession struct {
+	id        int64
+	name      string
+	addr      string
+	connected time.Time
+	lastSeen  time.Time
+	rooms     []string
+}
+
+// whoisSessionsLocked describes the connections logged in to account, oldest first.
+// Callers must hold mutex.
+func whoisSessionsLocked(account string) []whoisSession {
+	var list []whoisSession
+	for _, c := range hub.ConnsForAccount(account) {
+		list = append(list, whoisSession{
+			id:        connIDs[c],
+			name:      hub.Name(c),
+			addr:      c.RemoteAddr().String(),
+			connected: connectedAt[c],
+			lastSeen:  lastSeen[c],
+			rooms:     sortedKeys(sessionForLocked(c).joined),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// visibleRooms leaves out the invite-only and password protected rooms of rooms,
+// unless the viewer is in them too
+func visibleRooms(rooms []string, viewerJoined map[string]bool) []string {
+	var visible []string
+	for _, room := range rooms {
+		if !viewerJoined[room] {
+			if settings, err := getRoomSettings(room); err != nil || settings.InviteOnly || settings.PasswordHash != "" {
+				continue
+			}
+		}
+		visible = append(visible, room)
+	}
+	return visible
+}
+
+// handleWhoisCommand handles the /whois command. Admins also see where each
+// session connects from, and every channel it is in.
+// Format: /whois <name|@account>
+func handleWhoisCommand(conn net.Conn, message string) {
+	args := strings.Fields(message)[1:]
+	if len(args) != 1 {
+		conn.Write([]byte("\033[1;31mUsage: /whois <name|@account>\033[0m\n"))
+		return
+	}
+	account := privateHistoryAccount(args[0])
+	user, err := lookupUser(account)
+	if err != nil {
+		conn.Write([]byte("\033[1;31mError looking up user. Please try again.\033[0m\n"))
+		return
+	}
+	if !user.exists {
+		conn.Write([]byte(fmt.Sprintf("\033[1;31mNo user %s.\033[0m\n", args[0])))
+		return
+	}
+	admin := isAdmin(conn)
+
+	mutex.Lock()
+	online := whoisSessionsLocked(account)
+	viewerJoined := make(map[string]bool)
+	for room := range sessionForLocked(conn).joined {
+		viewerJoined[room] = true
+	}
+	mutex.Unlock()
+
+	loc := userLocation(conn)
+	now := clock.Now()
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("\033[1;36m@%s\033[0m\n", account))
+	for _, s := range online {
+		rooms := s.rooms
+		if !admin {
+			rooms = visibleRooms(rooms, viewerJoined)
+		}
+		line := fmt.Sprintf("  Online as %s since %s (%s), idle %s", s.name, s.connected.In(loc).Format("2006-01-02 15:04 MST"),
+			formatUptime(now.Sub(s.connected)), now.Sub(s.lastSeen).Round(time.Second))
+		if len(rooms) > 0 {
+			line += ", in " + strings.Join(rooms, ", ")
+		}
+		if admin {
+			line += ", from " + s.addr
+		}
+		out.WriteString(line + "\n")
+	}
+	if len(online) == 0 {
+		if last, ok, err := getLastSeen(account); err == nil && ok {
+			out.WriteString(fmt.Sprintf("  Offline, last seen %s\n", last.In(loc).Format("2006-01-02 15:04 MST")))
+		} else {
+			out.WriteString("  Offline\n")
+		}
+	}
+	if aliases, err := previousNicknames(account); err == nil && len(aliases) > 0 {
+		out.WriteString(fmt.Sprintf("  Previously known as: %s\n", strings.Join(aliases, ", ")))
+	}
+	switch {
+	case !user.vacationUntil.IsZero():
+		out.WriteString(fmt.Sprintf("  On vacation until %s: %s\n", user.vacationUntil.In(loc).Format("2006-01-02 15:04 MST"), user.awayMessage))
+	case user.status != "":
+		out.WriteString(fmt.Sprintf("  Status: %s\n", user.status))
+	}
+	conn.Write([]byte(out.String()))
+}
@@ -0,0 +1,306 @@
+// Package main contains the write-behind queue that stores messages off the delivery path
+package main
+
+import "sync"
+
+var (
+	// persistQueueSize bounds how many messages may wait to be stored
+	persistQueueSize = 10000
+	// persistBatchSize is the most messages stored in one transaction
+	persistBatchSize = 100
+
+	// persistQueue feeds the writer goroutine; nil means messages are stored inline
+	persistQueue chan queuedWrite
+	// persistDone is closed when the writer has stored everything it was given
+	persistDone chan struct{}
+	// persistQueueMutex lets flushPersistQueue close the queue while no one is sending
+	persistQueueMutex = &sync.RWMutex{}
+
+	// inflightKeys maps sender and idempotency key to the ID of a message that is
+	// queued but not yet stored, so retries are still recognised
+	inflightKeys      = make(map[string]string)
+	inflightKeysMutex = &sync.Mutex{}
+
+	persistQueued     = newCounter("persist_queued")
+	persistBatches    = newCounter("persist_batches")
+	persistQueueFull  = newCounter("persist_queue_full")
+	persistRenumbered = newCounter("persist_renumbered")
+	persistRejected   = newCounter("persist_rejected")
+)
+
+// queuedWrite is one insert waiting in the write-behind queue
+type queuedWrite struct {
+	query  string
+	args   []interface{}
+	sender string
+	key    string // idempotency key, if any
+	// charged is what the message cost the sender's storage quota, given back if
+	// the database rejects it
+	charged int64
+	// uncharged is what the message should cost but couldn't be charged because the
+	// database was unavailable; it is charged once the message is stored
+	uncharged int64
+	// renumbered is stored instead when another instance sharing the database
+	// already stored a message under this one's channel sequence number
+	renumbered *queuedWrite
+}
+
+// exec stores the write on its own
+func (w queuedWrite) exec() error {
+	_, err := dbExec(w.query, w.args...)
+	if w.renumbered != nil && isSeqConflict(err) {
+		persistRenumbered.Add(1)
+		err = w.renumbered.exec()
+	}
+	if err == nil {
+		w.chargeStored()
+	}
+	return err
+}
+
+// chargeStored charges a stored message that couldn't be charged when it was sent
+func (w queuedWrite) chargeStored() {
+	if w.uncharged <= 0 {
+		return
+	}
+	if err := chargeStorage(w.sender, storageMessages, w.uncharged); err != nil {
+		logger.Error("charging stored message", "sender", w.sender, "err", err)
+	}
+}
+
+// inflightKey identifies an idempotency key in inflightKeys
+func inflightKey(sender, key string) string {
+	return sender + "\x00" + key
+}
+
+// addInflight remembers the ID of a message with an idempotency key until it is stored
+func addInflight(sender, key, id string) {
+	if key == "" {
+		return
+	}
+	inflightKeysMutex.Lock()
+	inflightKeys[inflightKey(sender, key)] = id
+	inflightKeysMutex.Unlock()
+}
+
+// queuePending keeps the write of w in memory until the database is back, like
+// queueWrite. Its idempotency key stays in inflightKeys until then, so a retry
+// during the outage isn't posted again; if the write is refused for good the key
+// is kept for the rest of the window, as for rejectWrite.
+func queuePending(w queuedWrite, write func() error) {
+	if w.key == "" {
+		queueWrite(write)
+		return
+	}
+	queueWrite(func() error {
+		err := write()
+		if err == nil {
+			forgetInflight([]queuedWrite{w})
+		} else if !isDBUnavailable(err) {
+			clock.AfterFunc(idempotencyWindow, func() { forgetInflight([]queuedWrite{w}) })
+		}
+		return err
+	})
+}
+
+// findInflightMessage returns the ID of a queued message with the same idempotency key
+func findInflightMessage(sender, key string) (string, bool) {
+	inflightKeysMutex.Lock()
+	defer inflightKeysMutex.Unlock()
+	id, ok := inflightKeys[inflightKey(sender, key)]
+	return id, ok
+}
+
+// startPersistWriter starts storing messages in the background
+func startPersistWriter() {
+	persistQueue = make(chan queuedWrite, persistQueueSize)
+	persistDone = make(chan struct{})
+	go runPersistWriter(persistQueue, persistDone)
+}
+
+// persist stores w, in the background when the writer is running. It only returns
+// an error when the write was attempted inline and failed for a reason other than
+// the database being unavailable.
+func persist(w queuedWrite, id string) error {
+	persistQueueMutex.RLock()
+	if persistQueue != nil {
+		addInflight(w.sender, w.key, id)
+		select {
+		case persistQueue <- w:
+		default:
+			// Wait for room rather than lose the message
+			persistQueueFull.Add(1)
+			persistQueue <- w
+		}
+		persistQueued.Add(1)
+		persistQueueMutex.RUnlock()
+		return nil
+	}
+	persistQueueMutex.RUnlock()
+
+	if persistencePending() {
+		addInflight(w.sender, w.key, id)
+		queuePending(w, w.exec)
+		return nil
+	}
+	if err := w.exec(); isDBUnavailable(err) {
+		addInflight(w.sender, w.key, id)
+		queuePending(w, w.exec)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// runPersistWriter stores queued writes, batching whatever has built up since the
+// last transaction
+func runPersistWriter(queue <-chan queuedWrite, done chan<- struct{}) {
+	defer close(done)
+	batch := make([]queuedWrite, 0, persistBatchSize)
+	for w := range queue {
+		batch = append(batch[:0], w)
+	fill:
+		for len(batch) < persistBatchSize {
+			select {
+			case w, ok := <-queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, w)
+			default:
+				break fill
+			}
+		}
+		writeBatch(batch)
+		persistQueued.Add(-int64(len(batch)))
+	}
+}
+
+// writeBatch stores a batch in one transaction. If the database is down the writes
+// are kept in memory for recovery; if one row is rejected the rest are stored alone.
+func writeBatch(batch []queuedWrite) {
+	handled := batch
+	defer func() { forgetInflight(handled) }()
+
+	// Writes kept from an outage go first so messages are stored in order
+	if persistencePending() {
+		handled = nil
+		for _, w := range batch {
+			queuePending(w, w.exec)
+		}
+		return
+	}
+
+	err := execBatch(batch)
+	if err == nil {
+		persistBatches.Add(1)
+		for _, w := range batch {
+			w.chargeStored()
+		}
+		return
+	}
+	if isDBUnavailable(err) {
+		handled = nil
+		for _, w := range batch {
+			queuePending(w, w.exec)
+		}
+		return
+	}
+	handled = nil
+	for _, w := range batch {
+		if err := w.exec(); isDBUnavailable(err) {
+			queuePending(w, w.exec)
+		} else if err != nil {
+			rejectWrite(w, err)
+		} else {
+			handled = append(handled, w)
+		}
+	}
+}
+
+// rejectWrite handles a message the database refused for good. It has been delivered
+// already, so its quota is given back, the sender is told it won't be in the history,
+// and its idempotency key is remembered for the rest of the window so a retry isn't
+// posted again. A retry refused because its original is stored isn't reported.
+func rejectWrite(w queuedWrite, err error) {
+	releaseStorage(w.sender, storageMessages, w.charged)
+	// A retry that reached another instance while the original was still queued there
+	// has been delivered twice, but the original is stored, so only it is kept
+	if w.key != "" && isDuplicateKey(err) {
+		logger.Warn("retry stored by another instance", "sender", w.sender, "key", w.key)
+		forgetInflight([]queuedWrite{w})
+		return
+	}
+	logger.Error("saving message", "sender", w.sender, "err", err)
+	persistRejected.Add(1)
+	if w.key != "" {
+		clock.AfterFunc(idempotencyWindow, func() { forgetInflight([]queuedWrite{w}) })
+	}
+
+	mutex.Lock()
+	conns := connsForAccountLocked(w.sender)
+	mutex.Unlock()
+	for _, conn := range conns {
+		conn.Write([]byte("\033[1;31mA message you sent couldn't be saved, so it won't appear in the history.\033[0m\n"))
+	}
+}
+
+// execBatch runs every write in a single transaction
+func execBatch(batch []queuedWrite) error {
+	if !dbBreaker.allow(clock.Now()) {
+		return errCircuitOpen
+	}
+	err := func() error {
+		if err := dbFault(); err != nil {
+			return err
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, w := range batch {
+			if _, err := tx.Exec(w.query, w.args...); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if isDBUnavailable(err) {
+		dbFailures.Add(1)
+		dbBreaker.record(err, clock.Now())
+	} else {
+		dbBreaker.record(nil, clock.Now())
+	}
+	return err
+}
+
+// forgetInflight drops the idempotency keys of a batch that has been handled
+func forgetInflight(batch []queuedWrite) {
+	inflightKeysMutex.Lock()
+	defer inflightKeysMutex.Unlock()
+	for _, w := range batch {
+		if w.key != "" {
+			delete(inflightKeys, inflightKey(w.sender, w.key))
+		}
+	}
+}
+
+// flushPersistQueue stops the writer once everything queued is stored. Later
+// messages are stored inline. Writes kept from an outage get one last attempt.
+func flushPersistQueue() {
+	persistQueueMutex.Lock()
+	queue, done := persistQueue, persistDone
+	persistQueue = nil
+	persistQueueMutex.Unlock()
+
+	if queue != nil {
+		close(queue)
+		<-done
+	}
+	if persistencePending() && !replayPendingWrites() {
+		pendingWritesMutex.Lock()
+		logger.Error("database unavailable, writes were not stored", "count", len(pendingWrites))
+		pendingWritesMutex.Unlock()
+	}
+}
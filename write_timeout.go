@@ -0,0 +1,75 @@
+// Package main contains write deadlines that drop clients whose sockets stall
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// writeTimeout is how long a single write to a client may block (0 waits forever)
+var writeTimeout = 10 * time.Second
+
+var (
+	writeErrors        = newCounter("write_errors")
+	writeTimeouts      = newCounter("write_timeouts")
+	shortWrites        = newCounter("short_writes")
+	stalledDisconnects = newCounter("stalled_disconnects")
+)
+
+// timeoutConn wraps a client connection so every write has a deadline, short writes
+// are finished, and a connection whose writes fail is closed. Closing makes the
+// client's reader fail, so the usual cleanup runs.
+type timeoutConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+// newTimeoutConn wraps conn with write deadlines
+func newTimeoutConn(conn net.Conn) *timeoutConn {
+	return &timeoutConn{Conn: conn}
+}
+
+// Write writes all of p or disconnects the client
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	if err := writeFault(); err != nil {
+		c.fail(err)
+		return 0, err
+	}
+	written := 0
+	for written < len(p) {
+		if writeTimeout > 0 {
+			c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+		n, err := c.Conn.Write(p[written:])
+		written += n
+		if err != nil {
+			c.fail(err)
+			return written, err
+		}
+		if n == 0 {
+			c.fail(io.ErrShortWrite)
+			return written, io.ErrShortWrite
+		}
+		if written < len(p) {
+			shortWrites.Add(1)
+		}
+	}
+	return written, nil
+}
+
+// fail records a failed write and disconnects the client once
+func (c *timeoutConn) fail(err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		writeTimeouts.Add(1)
+	} else {
+		writeErrors.Add(1)
+	}
+	if c.closed.CompareAndSwap(false, true) {
+		stalledDisconnects.Add(1)
+		c.Conn.Close()
+	}
+}